@@ -18,6 +18,8 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -27,7 +29,9 @@ import (
 	"strings"
 	"time"
 
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
 	"github.com/GoogleCloudPlatform/guest-agent/metadata"
+	"github.com/GoogleCloudPlatform/guest-agent/utils"
 	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
 )
 
@@ -40,14 +44,34 @@ const (
 	configStatusKey = "instance/gce-workload-certificates/config-status"
 	// enableWorkloadCertsKey is set to true as custom metadata to enable automatic provisioning of credentials.
 	enableWorkloadCertsKey = "instance/attributes/enable-workload-certificate"
-	// contentDirPrefix is used as prefx to create certificate directories on refresh as contentDirPrefix-<time>.
+	// contentDirPrefix is used as prefx to create certificate directories on refresh as contentDirPrefix-<time>,
+	// unless overridden by the configuration as all the paths below.
 	contentDirPrefix = "/run/secrets/workload-spiffe-contents"
 	// tempSymlinkPrefix is used as prefix to create temporary symlinks on refresh as tempSymlinkPrefix-<time> to content directories.
 	tempSymlinkPrefix = "/run/secrets/workload-spiffe-symlink"
 	// symlink points to the directory with current GCE workload certificates and is always expected to be present.
 	symlink = "/run/secrets/workload-spiffe-credentials"
+	// hashFile keeps the hash of the workload identities and trust anchors written by the last
+	// successful refresh, it's kept under /run so it's only valid within a boot.
+	hashFile = "/run/gce-workload-cert-refresh.sha256"
+	// logLimiterFile keeps the refresh errors logged by the previous runs, so the errors
+	// repeated by every run during an outage are only logged once per rate limit interval.
+	logLimiterFile = "/run/gce-workload-cert-refresh.errors"
+
+	// layoutGCE only writes the credentials with the GCE file names.
+	layoutGCE = "gce"
+	// layoutSPIFFE additionally links the credentials with the file names SPIFFE
+	// Workload API consumers expect.
+	layoutSPIFFE = "spiffe"
 )
 
+// spiffeLinks maps the SPIFFE file names to the GCE credentials files they link to.
+var spiffeLinks = map[string]string{
+	"svid.pem":     "certificates.pem",
+	"svid_key.pem": "private_key.pem",
+	"bundle.pem":   "ca_certificates.pem",
+}
+
 var (
 	// mdsClient is the client used to query Metadata server.
 	mdsClient   metadata.MDSClientInterface
@@ -142,14 +166,59 @@ type WorkloadTrustedAnchors struct {
 	TrustAnchors map[string]TrustAnchor `json:"trustAnchors"`
 }
 
-// outputOpts is a struct for output directory name and symlink templates.
+// outputOpts is a struct for output directory name and symlink templates, and the path of
+// the last refresh's hash.
 type outputOpts struct {
-	contentDirPrefix, tempSymlinkPrefix, symlink string
+	contentDirPrefix, tempSymlinkPrefix, symlink, hashFile string
+	// layout is the credentials files layout, layoutGCE or layoutSPIFFE.
+	layout string
+}
+
+// configuredOutputOpts returns the output paths, the configured ones taking precedence over the
+// defaults.
+func configuredOutputOpts(config *cfg.WorkloadCertificates) outputOpts {
+	out := outputOpts{contentDirPrefix, tempSymlinkPrefix, symlink, hashFile, layoutGCE}
+	if config == nil {
+		return out
+	}
+
+	if config.ContentDirPrefix != "" {
+		out.contentDirPrefix = config.ContentDirPrefix
+	}
+	if config.TempSymlinkPrefix != "" {
+		out.tempSymlinkPrefix = config.TempSymlinkPrefix
+	}
+	if config.Symlink != "" {
+		out.symlink = config.Symlink
+	}
+	if config.Layout != "" {
+		out.layout = config.Layout
+	}
+	return out
+}
+
+// loadConfig loads the instance configuration and validates the sections used
+// by gce_workload_cert_refresh, invalid options of other sections are ignored.
+func loadConfig() error {
+	if err := cfg.Load(nil); err != nil {
+		return fmt.Errorf("failed to load instance configuration: %w", err)
+	}
+	if err := cfg.Get().ValidateSections("workloadcertificates", "mds"); err != nil {
+		return fmt.Errorf("invalid instance configuration: %w", err)
+	}
+	return nil
 }
 
 func main() {
 	ctx := context.Background()
 
+	// A broken configuration only matters if workload certificates are enabled,
+	// the metadata server is then queried with the default options.
+	configErr := loadConfig()
+	if configErr == nil {
+		metadata.PreferIPv6(cfg.Get().MDS.PreferIPv6)
+	}
+
 	opts := logger.LogOpts{
 		LoggerName:     programName,
 		FormatFunction: logFormat,
@@ -171,15 +240,44 @@ func main() {
 	}()
 
 	if !isEnabled(ctx) {
+		if configErr != nil {
+			logger.Errorf("Ignoring configuration error, workload certificates are not enabled: %v", configErr)
+		}
 		logger.Debugf("GCE Workload Certificate refresh is not enabled, skipping cert generation.")
 		return
 	}
 
-	out := outputOpts{contentDirPrefix, tempSymlinkPrefix, symlink}
-	if err := refreshCreds(ctx, out); err != nil {
-		logger.Fatalf("Error refreshCreds: %v", err.Error())
+	if configErr != nil {
+		logger.Fatalf("Error loading configuration: %v", configErr)
+	}
+
+	out := configuredOutputOpts(cfg.Get().WorkloadCertificates)
+	limiter := utils.NewLogLimiter(logRateLimit())
+	limiter.Load(logLimiterFile)
+	err := refreshCreds(ctx, out)
+	if err != nil {
+		limiter.Logf(logger.Errorf, "Error refreshCreds: %v", err)
+	} else {
+		limiter.Reset(logger.Infof)
+	}
+	if saveErr := limiter.Save(logLimiterFile); saveErr != nil {
+		logger.Warningf("Failed to save %s: %v", logLimiterFile, saveErr)
+	}
+
+	if err != nil {
+		logger.Close()
+		os.Exit(1)
 	}
+}
 
+// logRateLimit returns the configured interval at which identical refresh errors
+// are logged, an invalid interval disables rate limiting.
+func logRateLimit() time.Duration {
+	interval, err := time.ParseDuration(cfg.Get().Core.LogRateLimitInterval)
+	if err != nil {
+		return 0
+	}
+	return interval
 }
 
 // findDomain finds the anchor matching with the domain from spiffeID.
@@ -245,6 +343,44 @@ func writeWorkloadIdentities(destDir string, wisMd []byte) (string, error) {
 	return spiffeID, nil
 }
 
+// writeSPIFFELinks links the SPIFFE file names to the credentials in destDir. The
+// links are relative so they remain valid when destDir is accessed through the
+// credentials symlink.
+func writeSPIFFELinks(destDir string) error {
+	for name, target := range spiffeLinks {
+		if err := os.Symlink(target, filepath.Join(destDir, name)); err != nil {
+			return fmt.Errorf("error linking %s to %s: %w", name, target, err)
+		}
+	}
+	return nil
+}
+
+// credsHash returns the hash of the workload identities and trust anchors payloads and of
+// the layout they're written with, so changing the layout rewrites the credentials.
+func credsHash(wisMd, wtrcsMd []byte, layout string) string {
+	h := sha256.New()
+	h.Write(wisMd)
+	// Separate the payloads so moving bytes from one to the other changes the hash.
+	h.Write([]byte{0})
+	h.Write(wtrcsMd)
+	h.Write([]byte{0})
+	h.Write([]byte(layout))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// credsUnchanged returns true if hash matches the one of the last successful refresh and its
+// credentials are still in place.
+func credsUnchanged(opts outputOpts, hash string) bool {
+	last, err := os.ReadFile(opts.hashFile)
+	if err != nil {
+		return false
+	}
+	if !utils.FileExists(opts.symlink, utils.TypeDir) {
+		return false
+	}
+	return string(last) == hash
+}
+
 func refreshCreds(ctx context.Context, opts outputOpts) error {
 	now := timeNow()
 	contentDir := fmt.Sprintf("%s-%s", opts.contentDirPrefix, now)
@@ -258,6 +394,34 @@ func refreshCreds(ctx context.Context, opts outputOpts) error {
 		return nil
 	}
 
+	// Refuse to replace anything other than a symlink at the configured path, os.Symlink and
+	// os.Rename would otherwise fail on every refresh or clobber a real directory.
+	info, err := os.Lstat(opts.symlink)
+	symlinkExists := err == nil
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error checking symlink %s: %v", opts.symlink, err)
+	}
+	if symlinkExists && info.Mode()&os.ModeSymlink == 0 {
+		return fmt.Errorf("%s exists and is not a symlink, remove it or configure another WorkloadCertificates symlink", opts.symlink)
+	}
+
+	// Fetch the rest of the content upfront, errors are only reported after the config status is
+	// written.
+	wisMd, wisErr := getMetadata(ctx, workloadIdentitiesKey)
+	wtrcsMd, wtrcsErr := getMetadata(ctx, trustAnchorsKey)
+
+	var hash string
+	if wisErr == nil && wtrcsErr == nil {
+		hash = credsHash(wisMd, wtrcsMd, opts.layout)
+		if credsUnchanged(opts, hash) {
+			logger.Infof("Workload certificates unchanged since last refresh, only updating config_status")
+			if err := os.WriteFile(filepath.Join(opts.symlink, "config_status"), certConfigStatus, 0644); err != nil {
+				return fmt.Errorf("error writing config_status: %v", err)
+			}
+			return nil
+		}
+	}
+
 	logger.Infof("Creating timestamp contents dir %s", contentDir)
 
 	if err := os.MkdirAll(contentDir, 0755); err != nil {
@@ -271,18 +435,16 @@ func refreshCreds(ctx context.Context, opts outputOpts) error {
 
 	// Handles the edge case where the config values provided for the first time may be invalid. This ensures
 	// that the symlink directory always exists and contains the config_status to surface config errors to the VM.
-	if _, err := os.Stat(opts.symlink); os.IsNotExist(err) {
-		logger.Infof("Creating new symlink %s", symlink)
+	if !symlinkExists {
+		logger.Infof("Creating new symlink %s", opts.symlink)
 
 		if err := os.Symlink(contentDir, opts.symlink); err != nil {
 			return fmt.Errorf("error creating symlink: %v", err)
 		}
 	}
 
-	// Now get the rest of the content.
-	wisMd, err := getMetadata(ctx, workloadIdentitiesKey)
-	if err != nil {
-		return fmt.Errorf("error getting workload-identities: %v", err)
+	if wisErr != nil {
+		return fmt.Errorf("error getting workload-identities: %v", wisErr)
 	}
 
 	spiffeID, err := writeWorkloadIdentities(contentDir, wisMd)
@@ -290,20 +452,25 @@ func refreshCreds(ctx context.Context, opts outputOpts) error {
 		return fmt.Errorf("failed to write workload identities with error: %w", err)
 	}
 
-	wtrcsMd, err := getMetadata(ctx, trustAnchorsKey)
-	if err != nil {
-		return fmt.Errorf("error getting workload-trust-anchors: %v", err)
+	if wtrcsErr != nil {
+		return fmt.Errorf("error getting workload-trust-anchors: %v", wtrcsErr)
 	}
 
 	if err := writeTrustAnchors(wtrcsMd, contentDir, spiffeID); err != nil {
 		return fmt.Errorf("failed to write trust anchors: %w", err)
 	}
 
+	if opts.layout == layoutSPIFFE {
+		if err := writeSPIFFELinks(contentDir); err != nil {
+			return fmt.Errorf("failed to write SPIFFE layout: %w", err)
+		}
+	}
+
 	if err := os.Symlink(contentDir, tempSymlink); err != nil {
 		return fmt.Errorf("error creating temporary link: %v", err)
 	}
 
-	oldTarget, err := os.Readlink(opts.symlink)
+	oldTarget, err := utils.ReadSymlinkTarget(opts.symlink)
 	if err != nil {
 		logger.Infof("Error reading existing symlink: %v\n", err)
 		oldTarget = ""
@@ -317,7 +484,7 @@ func refreshCreds(ctx context.Context, opts outputOpts) error {
 	}
 
 	// Clean up previous contents dir.
-	newTarget, err := os.Readlink(opts.symlink)
+	newTarget, err := utils.ReadSymlinkTarget(opts.symlink)
 	if err != nil {
 		return fmt.Errorf("error reading new symlink: %v, unable to remove old symlink target", err)
 	}
@@ -328,5 +495,9 @@ func refreshCreds(ctx context.Context, opts outputOpts) error {
 		}
 	}
 
+	if err := os.WriteFile(opts.hashFile, []byte(hash), 0600); err != nil {
+		// Not fatal, the next refresh rewrites the credentials.
+		logger.Warningf("Failed to write %s: %v", opts.hashFile, err)
+	}
 	return nil
 }
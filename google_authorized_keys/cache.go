@@ -0,0 +1,120 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// attributesCache is the on-disk representation of the instance and project
+// attributes read from MDS. Each response is stored along with the etag MDS
+// served it with, an entry is only considered valid if both etags are known.
+type attributesCache struct {
+	// Timestamp is the time the attributes were read from MDS.
+	Timestamp time.Time `json:"timestamp"`
+	// Instance is the cached instance/attributes/ response.
+	Instance cachedResponse `json:"instance"`
+	// Project is the cached project/attributes/ response.
+	Project cachedResponse `json:"project"`
+}
+
+// cachedResponse is a single MDS response and its etag.
+type cachedResponse struct {
+	Etag string `json:"etag"`
+	Data string `json:"data"`
+}
+
+// loadCache reads the cache file at path, it returns an error if the file
+// can't be read or parsed.
+func loadCache(path string) (*attributesCache, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var res attributesCache
+	if err := json.Unmarshal(data, &res); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal cache file %q: %+v", path, err)
+	}
+
+	if res.Instance.Etag == "" || res.Project.Etag == "" {
+		return nil, fmt.Errorf("cache file %q has no etag", path)
+	}
+
+	return &res, nil
+}
+
+// readCache returns the cache entry stored at path if it's not older than ttl.
+func readCache(path string, ttl time.Duration) (*attributesCache, error) {
+	res, err := loadCache(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// A negative age means the clock has been moved backwards, don't trust the entry.
+	age := time.Since(res.Timestamp)
+	if age < 0 || age > ttl {
+		return nil, fmt.Errorf("cache entry expired, age: %v, ttl: %v", age, ttl)
+	}
+
+	return res, nil
+}
+
+// sameEtags returns true if c and other were served with the same instance and
+// project etags. A nil c never matches.
+func (c *attributesCache) sameEtags(other *attributesCache) bool {
+	return c != nil && other != nil && c.Instance.Etag == other.Instance.Etag && c.Project.Etag == other.Project.Etag
+}
+
+// writeCache writes entry to path. The entry is written to a temporary file in the
+// same directory and then renamed over path, concurrent invocations will never
+// observe a partially written file. An existing entry fetched later than entry
+// is kept, a slower invocation must not replace newer attributes with older ones.
+func writeCache(path string, entry *attributesCache) error {
+	if current, err := loadCache(path); err == nil && current.Timestamp.After(entry.Timestamp) {
+		return nil
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to marshal cache entry: %+v", err)
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary cache file: %+v", err)
+	}
+	// Only relevant if we fail before renaming it.
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write temporary cache file: %+v", err)
+	}
+
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to close temporary cache file: %+v", err)
+	}
+
+	if err := os.Rename(f.Name(), path); err != nil {
+		return fmt.Errorf("failed to replace cache file %q: %+v", path, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,217 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+)
+
+func TestReadCache(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache")
+
+	if _, err := readCache(path, time.Minute); err == nil {
+		t.Errorf("readCache(%s, 1m) succeeded for non existing file, want error", path)
+	}
+
+	entry := &attributesCache{
+		Timestamp: time.Now(),
+		Instance:  cachedResponse{Etag: "instance", Data: "instance-data"},
+		Project:   cachedResponse{Etag: "project", Data: "project-data"},
+	}
+	if err := writeCache(path, entry); err != nil {
+		t.Fatalf("writeCache(%s, %+v) failed unexpectedly with error: %v", path, entry, err)
+	}
+
+	got, err := readCache(path, time.Minute)
+	if err != nil {
+		t.Fatalf("readCache(%s, 1m) failed unexpectedly with error: %v", path, err)
+	}
+	if !got.Timestamp.Equal(entry.Timestamp) || got.Instance != entry.Instance || got.Project != entry.Project {
+		t.Errorf("readCache(%s, 1m) = %+v, want: %+v", path, got, entry)
+	}
+
+	if _, err := readCache(path, 0); err == nil {
+		t.Errorf("readCache(%s, 0) succeeded for expired entry, want error", path)
+	}
+}
+
+func TestReadCacheNoEtag(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache")
+
+	entry := &attributesCache{
+		Timestamp: time.Now(),
+		Instance:  cachedResponse{Data: "instance-data"},
+		Project:   cachedResponse{Etag: "project", Data: "project-data"},
+	}
+	if err := writeCache(path, entry); err != nil {
+		t.Fatalf("writeCache(%s, %+v) failed unexpectedly with error: %v", path, entry, err)
+	}
+
+	if _, err := readCache(path, time.Minute); err == nil {
+		t.Errorf("readCache(%s, 1m) succeeded for entry without etag, want error", path)
+	}
+}
+
+func TestWriteCacheKeepsNewer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache")
+	now := time.Now()
+
+	newer := &attributesCache{
+		Timestamp: now,
+		Instance:  cachedResponse{Etag: "instance2", Data: "instance-data2"},
+		Project:   cachedResponse{Etag: "project2", Data: "project-data2"},
+	}
+	older := &attributesCache{
+		Timestamp: now.Add(-time.Second),
+		Instance:  cachedResponse{Etag: "instance1", Data: "instance-data1"},
+		Project:   cachedResponse{Etag: "project1", Data: "project-data1"},
+	}
+
+	for _, entry := range []*attributesCache{newer, older} {
+		if err := writeCache(path, entry); err != nil {
+			t.Fatalf("writeCache(%s, %+v) failed unexpectedly with error: %v", path, entry, err)
+		}
+	}
+
+	got, err := readCache(path, time.Minute)
+	if err != nil {
+		t.Fatalf("readCache(%s, 1m) failed unexpectedly with error: %v", path, err)
+	}
+	if got.Instance != newer.Instance || got.Project != newer.Project {
+		t.Errorf("readCache(%s, 1m) = %+v, want: %+v", path, got, newer)
+	}
+
+	// No temporary files should be left behind.
+	files, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		t.Fatalf("os.ReadDir(%s) failed unexpectedly with error: %v", filepath.Dir(path), err)
+	}
+	if len(files) != 1 {
+		t.Errorf("found %d files in cache dir, want 1", len(files))
+	}
+}
+
+func TestGetAttributesCache(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache")
+	config := fmt.Sprintf("[AuthorizedKeys]\ncache_path = %s\ncache_ttl = 1m\n", path)
+	if err := cfg.Load([]byte(config)); err != nil {
+		t.Fatalf("cfg.Load(%q) failed unexpectedly with error: %v", config, err)
+	}
+
+	mds := &mdsClient{}
+	client = mds
+
+	checkInstance := func(want string) {
+		t.Helper()
+		wantInstance := &attributes{SSHKeys: []string{"name:ssh-rsa [KEY] " + want}}
+		gotInstance, _, err := getAttributes(context.Background())
+		if err != nil {
+			t.Fatalf("getAttributes(ctx) failed unexpectedly with error: %v", err)
+		}
+		if !reflect.DeepEqual(gotInstance, wantInstance) {
+			t.Errorf("getAttributes(ctx) returned instance attributes %+v, want: %+v", gotInstance, wantInstance)
+		}
+	}
+
+	checkInstance("instance1")
+	cached, err := readCache(path, time.Minute)
+	if err != nil {
+		t.Fatalf("readCache(%s, 1m) failed unexpectedly with error: %v", path, err)
+	}
+
+	// Unchanged etags serve the cached entry, which isn't rewritten.
+	checkInstance("instance1")
+	got, err := readCache(path, time.Minute)
+	if err != nil {
+		t.Fatalf("readCache(%s, 1m) failed unexpectedly with error: %v", path, err)
+	}
+	if !got.Timestamp.Equal(cached.Timestamp) {
+		t.Errorf("getAttributes(ctx) rewrote the cache with unchanged etags, timestamp %s, want: %s", got.Timestamp, cached.Timestamp)
+	}
+
+	// A changed etag, e.g. a revoked key, is served fresh from MDS, within the ttl
+	// too, the cached entry must not outlive a metadata change.
+	mds.instanceKey = "instance2"
+	checkInstance("instance2")
+
+	// The cache is served if MDS can't be reached.
+	mds.etagErr = fmt.Errorf("mds unreachable")
+	checkInstance("instance2")
+
+	// Every lookup checks the etags with MDS.
+	if mds.etagRequests != 7 {
+		t.Errorf("getAttributes(ctx) made %d MDS requests, want: 7", mds.etagRequests)
+	}
+}
+
+func TestGetAttributesFallback(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache")
+	config := fmt.Sprintf("[AuthorizedKeys]\ncache_path = %s\nfallback_max_staleness = 1h\n", path)
+	if err := cfg.Load([]byte(config)); err != nil {
+		t.Fatalf("cfg.Load(%q) failed unexpectedly with error: %v", config, err)
+	}
+
+	mds := &mdsClient{etagErr: fmt.Errorf("mds unreachable")}
+	client = mds
+
+	if _, _, err := getAttributes(context.Background()); err == nil {
+		t.Fatalf("getAttributes(ctx) succeeded without MDS or cache, want error")
+	}
+
+	// Without a ttl a reachable MDS is always queried and its response cached.
+	mds.etagErr = nil
+	for i := 0; i < 2; i++ {
+		if _, _, err := getAttributes(context.Background()); err != nil {
+			t.Fatalf("getAttributes(ctx) failed unexpectedly with error: %v", err)
+		}
+	}
+	if mds.etagRequests != 5 {
+		t.Errorf("getAttributes(ctx) made %d MDS requests, want: 5", mds.etagRequests)
+	}
+
+	mds.etagErr = fmt.Errorf("mds unreachable")
+	wantInstance := &attributes{SSHKeys: []string{"name:ssh-rsa [KEY] instance1"}}
+	gotInstance, _, err := getAttributes(context.Background())
+	if err != nil {
+		t.Fatalf("getAttributes(ctx) failed unexpectedly with error: %v", err)
+	}
+	if !reflect.DeepEqual(gotInstance, wantInstance) {
+		t.Errorf("getAttributes(ctx) returned instance attributes %+v, want: %+v", gotInstance, wantInstance)
+	}
+
+	// Entries older than the maximum staleness are not served.
+	entry, err := readCache(path, time.Hour)
+	if err != nil {
+		t.Fatalf("readCache(%s, 1h) failed unexpectedly with error: %v", path, err)
+	}
+	if err := os.Remove(path); err != nil {
+		t.Fatalf("os.Remove(%s) failed unexpectedly with error: %v", path, err)
+	}
+	entry.Timestamp = time.Now().Add(-2 * time.Hour)
+	if err := writeCache(path, entry); err != nil {
+		t.Fatalf("writeCache(%s, %+v) failed unexpectedly with error: %v", path, entry, err)
+	}
+	if _, _, err := getAttributes(context.Background()); err == nil {
+		t.Errorf("getAttributes(ctx) served a cache entry older than fallback_max_staleness, want error")
+	}
+}
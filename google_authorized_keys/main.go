@@ -18,15 +18,20 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"os/user"
 	"path"
 	"runtime"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
 	"github.com/GoogleCloudPlatform/guest-agent/metadata"
 	"github.com/GoogleCloudPlatform/guest-agent/utils"
 	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
@@ -52,11 +57,67 @@ func logFormatWindows(e logger.LogEntry) string {
 	return fmt.Sprintf("%s %s: %s", now, programName, e.Message)
 }
 
-func parseSSHKeys(username string, keys []string) []string {
+// verboseFlag makes google_authorized_keys log to stderr why metadata keys are
+// dropped, stdout is reserved for the keys read by sshd.
+const verboseFlag = "--verbose"
+
+// parseVerboseFlag returns args without verboseFlag and whether it was set.
+func parseVerboseFlag(args []string) ([]string, bool) {
+	var res []string
+	var verbose bool
+	for _, arg := range args {
+		if arg == verboseFlag {
+			verbose = true
+			continue
+		}
+		res = append(res, arg)
+	}
+	return res, verbose
+}
+
+// keyStats counts the metadata keys dropped while parsing, a nil keyStats counts
+// nothing.
+type keyStats struct {
+	// verbose logs the reason of each dropped key.
+	verbose bool
+	// expired is the number of google-ssh keys dropped for being expired.
+	expired int
+	// invalid is the number of keys dropped for having an invalid format.
+	invalid int
+}
+
+// drop accounts the key at index idx of source as dropped because of err.
+func (s *keyStats) drop(source string, idx int, err error) {
+	if s == nil {
+		return
+	}
+
+	reason := "invalid"
+	if errors.Is(err, utils.ErrExpiredKey) {
+		reason = "expired"
+		s.expired++
+	} else {
+		s.invalid++
+	}
+
+	if s.verbose {
+		logger.Infof("Dropped %s key %d of %s metadata: %v", reason, idx, source, err)
+	}
+}
+
+// log logs the dropped keys counters if verbose.
+func (s *keyStats) log() {
+	if s != nil && s.verbose {
+		logger.Infof("Dropped %d expired and %d invalid keys", s.expired, s.invalid)
+	}
+}
+
+func parseSSHKeys(username, source string, keys []string, stats *keyStats) []string {
 	var keyList []string
-	for _, key := range keys {
+	for idx, key := range keys {
 		keySplit := strings.SplitN(key, ":", 2)
 		if len(keySplit) != 2 {
+			stats.drop(source, idx, errors.New("invalid ssh key entry - unrecognized format. Expecting user:ssh-key"))
 			continue
 		}
 
@@ -66,6 +127,7 @@ func parseSSHKeys(username string, keys []string) []string {
 		}
 
 		if err != nil {
+			stats.drop(source, idx, err)
 			continue
 		}
 
@@ -76,22 +138,114 @@ func parseSSHKeys(username string, keys []string) []string {
 	return keyList
 }
 
-func getUserKeys(username string, instanceAttributes *attributes, projectAttributes *attributes) []string {
+// getUserKeys returns the keys of username from instance, project and guest
+// attributes keys, in that order. Project keys are skipped if blocked by
+// block-project-ssh-keys or if username is in blockProjectUsers, guest attributes
+// keys are not affected by either.
+func getUserKeys(username string, instanceAttributes *attributes, projectAttributes *attributes, guestAttributeKeys []string, blockProjectUsers []string, stats *keyStats) []string {
 	var userKeyList []string
 
-	instanceKeyList := parseSSHKeys(username, instanceAttributes.SSHKeys)
+	instanceKeyList := parseSSHKeys(username, "instance", instanceAttributes.SSHKeys, stats)
 	userKeyList = append(userKeyList, instanceKeyList...)
 
-	if !instanceAttributes.BlockProjectSSHKeys {
+	if !instanceAttributes.BlockProjectSSHKeys && !slices.Contains(blockProjectUsers, username) {
 
-		projectKeyList := parseSSHKeys(username, projectAttributes.SSHKeys)
+		projectKeyList := parseSSHKeys(username, "project", projectAttributes.SSHKeys, stats)
 		userKeyList = append(userKeyList, projectKeyList...)
 
 	}
 
+	guestKeyList := parseSSHKeys(username, "guest attributes", guestAttributeKeys, stats)
+	userKeyList = append(userKeyList, guestKeyList...)
+
 	return userKeyList
 }
 
+// blockProjectKeysUsers returns the users configured to only get instance keys.
+func blockProjectKeysUsers() []string {
+	var users []string
+	for _, user := range strings.Split(cfg.Get().AuthorizedKeys.BlockProjectKeysUsers, ",") {
+		if user = strings.TrimSpace(user); user != "" {
+			users = append(users, user)
+		}
+	}
+	return users
+}
+
+// guestAttributesPrefix is the metadata key of the instance guest attributes.
+const guestAttributesPrefix = "instance/guest-attributes/"
+
+// privilegedGroups are the groups granting administrative rights, guest attributes
+// keys are never honored for their members.
+var privilegedGroups = []string{"google-sudoers", "sudo", "wheel", "admin", "Administrators"}
+
+var (
+	// lookupUser, lookupGroup and userGroupIds are replaceable by unit tests.
+	lookupUser   = user.Lookup
+	lookupGroup  = user.LookupGroup
+	userGroupIds = (*user.User).GroupIds
+)
+
+// privilegedUser reports whether username is root or a member of one of the
+// privilegedGroups. Users whose groups can't be looked up are reported
+// privileged, failing closed.
+func privilegedUser(username string) bool {
+	if username == "root" {
+		return true
+	}
+
+	u, err := lookupUser(username)
+	if err != nil {
+		logger.Warningf("Failed to look up user %q: %v", username, err)
+		return true
+	}
+	if u.Uid == "0" {
+		return true
+	}
+
+	gids, err := userGroupIds(u)
+	if err != nil {
+		logger.Warningf("Failed to look up groups of user %q: %v", username, err)
+		return true
+	}
+	for _, name := range privilegedGroups {
+		group, err := lookupGroup(name)
+		if err != nil {
+			continue
+		}
+		if slices.Contains(gids, group.Gid) {
+			return true
+		}
+	}
+	return false
+}
+
+// getGuestAttributeKeys returns the SSH keys set in the guest attributes namespace.
+// Each attribute holds one or more newline separated user:key entries, attributes
+// are ordered by name.
+func getGuestAttributeKeys(ctx context.Context, namespace string) ([]string, error) {
+	var attrs map[string]string
+	if err := metadata.GetKeyRecursiveInto(ctx, client, guestAttributesPrefix+namespace+"/", &attrs); err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(attrs))
+	for name := range attrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var keys []string
+	for _, name := range names {
+		for _, key := range strings.Split(attrs[name], "\n") {
+			if strings.TrimSpace(key) != "" {
+				keys = append(keys, key)
+			}
+		}
+	}
+	return keys, nil
+}
+
 func checkWinSSHEnabled(instanceAttributes *attributes, projectAttributes *attributes) bool {
 	if instanceAttributes.EnableWindowsSSH != nil {
 		return bool(*instanceAttributes.EnableWindowsSSH)
@@ -107,23 +261,32 @@ type attributes struct {
 	SSHKeys             []string
 }
 
+// jsonAttributes is the subset of the metadata attributes google_authorized_keys uses.
+type jsonAttributes struct {
+	EnableWindowsSSH    string `json:"enable-windows-ssh"`
+	BlockProjectSSHKeys string `json:"block-project-ssh-keys"`
+	SSHKeys             string `json:"ssh-keys"`
+}
+
 func getMetadataAttributes(ctx context.Context, metadataKey string) (*attributes, error) {
-	var a attributes
-	type jsonAttributes struct {
-		EnableWindowsSSH    string `json:"enable-windows-ssh"`
-		BlockProjectSSHKeys string `json:"block-project-ssh-keys"`
-		SSHKeys             string `json:"ssh-keys"`
-	}
 	var ja jsonAttributes
-	metadata, err := client.GetKeyRecursive(ctx, metadataKey)
-	if err != nil {
+	if err := metadata.GetKeyRecursiveInto(ctx, client, metadataKey, &ja); err != nil {
 		return nil, err
 	}
+	return ja.attributes(), nil
+}
 
+func parseAttributes(metadata string) (*attributes, error) {
+	var ja jsonAttributes
 	if err := json.Unmarshal([]byte(metadata), &ja); err != nil {
 		return nil, err
 	}
+	return ja.attributes(), nil
+}
 
+// attributes converts the metadata attributes values to their types.
+func (ja jsonAttributes) attributes() *attributes {
+	var a attributes
 	value, err := strconv.ParseBool(ja.BlockProjectSSHKeys)
 	if err == nil {
 		a.BlockProjectSSHKeys = value
@@ -136,12 +299,157 @@ func getMetadataAttributes(ctx context.Context, metadataKey string) (*attributes
 	if ja.SSHKeys != "" {
 		a.SSHKeys = strings.Split(ja.SSHKeys, "\n")
 	}
-	return &a, nil
+	return &a
+}
+
+// metadataTimeout returns the configured timeout of the metadata server reads, zero
+// means no timeout besides the metadata client ones.
+func metadataTimeout() time.Duration {
+	config := cfg.Get().AuthorizedKeys
+	if config == nil || config.MetadataTimeout == "" {
+		return 0
+	}
+
+	timeout, err := time.ParseDuration(config.MetadataTimeout)
+	if err != nil {
+		logger.Warningf("Invalid metadata_timeout %q, ignoring it: %v", config.MetadataTimeout, err)
+		return 0
+	}
+	return timeout
+}
+
+// cacheConfig returns the configured cache file, ttl and fallback maximum staleness.
+// A zero ttl means caching is disabled, a zero staleness that the cache isn't used
+// as a fallback. Both are zero if there's no cache file.
+func cacheConfig() (string, time.Duration, time.Duration) {
+	config := cfg.Get().AuthorizedKeys
+	if config == nil || config.CachePath == "" {
+		return "", 0, 0
+	}
+
+	durations := []struct {
+		key, value string
+	}{
+		{"cache_ttl", config.CacheTTL},
+		{"fallback_max_staleness", config.FallbackMaxStaleness},
+	}
+	var res []time.Duration
+	for _, d := range durations {
+		var value time.Duration
+		if d.value != "" {
+			var err error
+			if value, err = time.ParseDuration(d.value); err != nil {
+				logger.Warningf("Invalid %s %q, ignoring it: %v", d.key, d.value, err)
+				value = 0
+			}
+		}
+		res = append(res, value)
+	}
+
+	return config.CachePath, res[0], res[1]
+}
+
+// fetchAttributes reads the instance and project attributes from MDS along with
+// their etags.
+func fetchAttributes(ctx context.Context) (*attributesCache, error) {
+	// Take the timestamp before querying MDS so a concurrent invocation that
+	// started later is considered newer.
+	entry := &attributesCache{Timestamp: time.Now()}
+
+	var err error
+	entry.Instance.Data, entry.Instance.Etag, err = client.GetKeyRecursiveWithEtag(ctx, "instance/attributes/")
+	if err != nil {
+		return nil, fmt.Errorf("cannot read instance metadata attributes: %v", err)
+	}
+	entry.Project.Data, entry.Project.Etag, err = client.GetKeyRecursiveWithEtag(ctx, "project/attributes/")
+	if err != nil {
+		return nil, fmt.Errorf("cannot read project metadata attributes: %v", err)
+	}
+	return entry, nil
+}
+
+// getAttributes returns the instance and project attributes. If caching is enabled a
+// still valid cache entry is used instead of querying MDS, otherwise the MDS responses
+// are cached for subsequent invocations. If the cache is used as a fallback, MDS
+// responses are always cached and served when MDS can't be reached, as long as
+// they're not older than the fallback maximum staleness.
+func getAttributes(ctx context.Context) (*attributes, *attributes, error) {
+	cachePath, ttl, maxStaleness := cacheConfig()
+	if ttl <= 0 && maxStaleness <= 0 {
+		instanceAttributes, err := getMetadataAttributes(ctx, "instance/attributes/")
+		if err != nil {
+			return nil, nil, fmt.Errorf("cannot read instance metadata attributes: %v", err)
+		}
+		projectAttributes, err := getMetadataAttributes(ctx, "project/attributes/")
+		if err != nil {
+			return nil, nil, fmt.Errorf("cannot read project metadata attributes: %v", err)
+		}
+		return instanceAttributes, projectAttributes, nil
+	}
+
+	var cached *attributesCache
+	if ttl > 0 {
+		var err error
+		if cached, err = readCache(cachePath, ttl); err != nil {
+			logger.Debugf("Not using cached metadata attributes: %v", err)
+		}
+	}
+
+	// The cached attributes are only served if MDS still serves the same etags,
+	// or if it can't be reached.
+	entry, err := fetchAttributes(ctx)
+	switch {
+	case err == nil && cached.sameEtags(entry):
+		logger.Debugf("Metadata attributes unchanged since %s, serving cached ones", cached.Timestamp.Format(time.RFC3339))
+		entry = cached
+	case err == nil:
+		// Failing to cache is not fatal, the next invocation will query MDS again.
+		if err := writeCache(cachePath, entry); err != nil {
+			logger.Warningf("Failed to cache metadata attributes: %v", err)
+		}
+	case cached != nil:
+		logger.Warningf("Serving metadata attributes cached at %s: %v", cached.Timestamp.Format(time.RFC3339), err)
+		entry = cached
+	case maxStaleness > 0:
+		stale, cacheErr := readCache(cachePath, maxStaleness)
+		if cacheErr != nil {
+			return nil, nil, fmt.Errorf("%v, no cached attributes to fall back to: %v", err, cacheErr)
+		}
+		logger.Warningf("Serving metadata attributes cached at %s: %v", stale.Timestamp.Format(time.RFC3339), err)
+		entry = stale
+	default:
+		return nil, nil, err
+	}
+
+	instanceAttributes, err := parseAttributes(entry.Instance.Data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot parse instance metadata attributes: %v", err)
+	}
+	projectAttributes, err := parseAttributes(entry.Project.Data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot parse project metadata attributes: %v", err)
+	}
+	return instanceAttributes, projectAttributes, nil
 }
 
 func main() {
 	ctx := context.Background()
-	username := os.Args[1]
+	args, verbose := parseVerboseFlag(os.Args)
+	username := args[1]
+
+	if err := cfg.Load(nil); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load instance configuration: %+v", err)
+		os.Exit(1)
+	}
+
+	// sshd blocks logins on this command, only the sections used here can stop
+	// it, problems with the other sections are reported but don't matter here.
+	if err := cfg.Get().ValidateSections("authorizedkeys", "mds"); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid instance configuration: %+v", err)
+		os.Exit(1)
+	}
+	metadata.PreferIPv6(cfg.Get().MDS.PreferIPv6)
+	utils.SetExpirationLayouts(utils.SplitExpirationLayouts(cfg.Get().Accounts.KeyExpirationLayouts))
 
 	opts := logger.LogOpts{
 		LoggerName:     programName,
@@ -163,14 +471,22 @@ func main() {
 	// Try flushing logs before exiting, if not flushed logs could go missing.
 	defer logger.Close()
 
-	instanceAttributes, err := getMetadataAttributes(ctx, "instance/attributes/")
-	if err != nil {
-		logger.Errorf("Cannot read instance metadata attributes: %v", err)
-		os.Exit(1)
+	if err := cfg.Get().Validate(); err != nil {
+		logger.Warningf("Ignoring invalid instance configuration unused by %s: %v", programName, err)
 	}
-	projectAttributes, err := getMetadataAttributes(ctx, "project/attributes/")
+
+	// sshd blocks logins on this command, cap the time spent waiting for the
+	// metadata server so it can move on to other authentication methods.
+	mdsCtx := ctx
+	if timeout := metadataTimeout(); timeout > 0 {
+		var cancel context.CancelFunc
+		mdsCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	instanceAttributes, projectAttributes, err := getAttributes(mdsCtx)
 	if err != nil {
-		logger.Errorf("Cannot read project metadata attributes: %v", err)
+		logger.Errorf("Failed to get metadata attributes: %v", err)
 		os.Exit(1)
 	}
 
@@ -179,6 +495,22 @@ func main() {
 		os.Exit(1)
 	}
 
-	userKeyList := getUserKeys(username, instanceAttributes, projectAttributes)
+	// Guest attributes keys are optional, failing to read them must not lock users
+	// out of metadata keys. They are not cached as the VM itself may change them.
+	// As anything on the VM can write them, they are never honored for privileged
+	// users, that would otherwise be a local privilege escalation.
+	var guestAttributeKeys []string
+	if namespace := cfg.Get().AuthorizedKeys.GuestAttributesNamespace; namespace != "" && privilegedUser(username) {
+		logger.Infof("Ignoring guest attributes SSH keys for privileged user %q", username)
+	} else if namespace != "" {
+		guestAttributeKeys, err = getGuestAttributeKeys(mdsCtx, namespace)
+		if err != nil {
+			logger.Warningf("Failed to get SSH keys from guest attributes namespace %q: %v", namespace, err)
+		}
+	}
+
+	stats := &keyStats{verbose: verbose}
+	userKeyList := getUserKeys(username, instanceAttributes, projectAttributes, guestAttributeKeys, blockProjectKeysUsers(), stats)
+	stats.log()
 	fmt.Print(strings.Join(userKeyList, "\n"))
 }
@@ -17,11 +17,14 @@ package main
 import (
 	"context"
 	"fmt"
+	"os/user"
 	"reflect"
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
 	"github.com/GoogleCloudPlatform/guest-agent/metadata"
 	"github.com/GoogleCloudPlatform/guest-agent/utils"
 )
@@ -69,10 +72,49 @@ func TestParseSSHKeys(t *testing.T) {
 
 	user := "usera"
 
-	if got, want := parseSSHKeys(user, keys), expected; !stringSliceEqual(got, want) {
+	if got, want := parseSSHKeys(user, "instance", keys, nil), expected; !stringSliceEqual(got, want) {
 		t.Errorf("ParseSSHKeys(%s,%s) incorrect return: got %v, want %v", user, keys, got, want)
 	}
 
+	// Counting dropped keys doesn't change the keys returned.
+	stats := &keyStats{verbose: true}
+	if got, want := parseSSHKeys(user, "instance", keys, stats), expected; !stringSliceEqual(got, want) {
+		t.Errorf("ParseSSHKeys(%s,%s) with stats incorrect return: got %v, want %v", user, keys, got, want)
+	}
+	if stats.expired != 1 || stats.invalid != 1 {
+		t.Errorf("ParseSSHKeys(%s,%s) counted %d expired and %d invalid keys, want 1 and 1", user, keys, stats.expired, stats.invalid)
+	}
+
+}
+
+func TestParseVerboseFlag(t *testing.T) {
+	tests := []struct {
+		args        []string
+		wantArgs    []string
+		wantVerbose bool
+	}{
+		{
+			args:     []string{"google_authorized_keys", "usera"},
+			wantArgs: []string{"google_authorized_keys", "usera"},
+		},
+		{
+			args:        []string{"google_authorized_keys", "usera", verboseFlag},
+			wantArgs:    []string{"google_authorized_keys", "usera"},
+			wantVerbose: true,
+		},
+		{
+			args:        []string{"google_authorized_keys", verboseFlag, "usera"},
+			wantArgs:    []string{"google_authorized_keys", "usera"},
+			wantVerbose: true,
+		},
+	}
+
+	for _, tt := range tests {
+		gotArgs, gotVerbose := parseVerboseFlag(tt.args)
+		if !stringSliceEqual(gotArgs, tt.wantArgs) || gotVerbose != tt.wantVerbose {
+			t.Errorf("parseVerboseFlag(%v) = %v, %t, want %v, %t", tt.args, gotArgs, gotVerbose, tt.wantArgs, tt.wantVerbose)
+		}
+	}
 }
 
 func TestCheckWinSSHEnabled(t *testing.T) {
@@ -128,6 +170,8 @@ func TestGetUserKeysNew(t *testing.T) {
 		userName         string
 		instanceMetadata attributes
 		projectMetadata  attributes
+		guestKeys        []string
+		blockedUsers     []string
 		expectedKeys     []string
 	}{
 		{
@@ -195,11 +239,55 @@ func TestGetUserKeysNew(t *testing.T) {
 			},
 			expectedKeys: []string{fmt.Sprintf("ssh-rsa %s project1", pubKey)},
 		},
+		{
+			userName: "name",
+			instanceMetadata: attributes{
+				BlockProjectSSHKeys: true,
+				SSHKeys:             []string{fmt.Sprintf("name:ssh-rsa %s instance1", pubKey)},
+			},
+			projectMetadata: attributes{
+				SSHKeys: []string{fmt.Sprintf("name:ssh-rsa %s project1", pubKey)},
+			},
+			guestKeys: []string{
+				fmt.Sprintf("name:ssh-rsa %s guest1", pubKey),
+				fmt.Sprintf("othername:ssh-rsa %s guest2", pubKey),
+				"name:invalid",
+			},
+			expectedKeys: []string{
+				fmt.Sprintf("ssh-rsa %s instance1", pubKey),
+				fmt.Sprintf("ssh-rsa %s guest1", pubKey),
+			},
+		},
+		{
+			userName: "sa-user",
+			instanceMetadata: attributes{
+				SSHKeys: []string{fmt.Sprintf("sa-user:ssh-rsa %s instance1", pubKey)},
+			},
+			projectMetadata: attributes{
+				SSHKeys: []string{fmt.Sprintf("sa-user:ssh-rsa %s project1", pubKey)},
+			},
+			blockedUsers: []string{"other", "sa-user"},
+			expectedKeys: []string{fmt.Sprintf("ssh-rsa %s instance1", pubKey)},
+		},
+		{
+			userName: "name",
+			instanceMetadata: attributes{
+				SSHKeys: []string{fmt.Sprintf("name:ssh-rsa %s instance1", pubKey)},
+			},
+			projectMetadata: attributes{
+				SSHKeys: []string{fmt.Sprintf("name:ssh-rsa %s project1", pubKey)},
+			},
+			blockedUsers: []string{"other", "sa-user"},
+			expectedKeys: []string{
+				fmt.Sprintf("ssh-rsa %s instance1", pubKey),
+				fmt.Sprintf("ssh-rsa %s project1", pubKey),
+			},
+		},
 	}
 
 	for count, tt := range tests {
 		t.Run(fmt.Sprintf("test-%d", count), func(t *testing.T) {
-			if got, want := getUserKeys(tt.userName, &tt.instanceMetadata, &tt.projectMetadata), tt.expectedKeys; !stringSliceEqual(got, want) {
+			if got, want := getUserKeys(tt.userName, &tt.instanceMetadata, &tt.projectMetadata, tt.guestKeys, tt.blockedUsers, nil), tt.expectedKeys; !stringSliceEqual(got, want) {
 				t.Errorf("getUserKeys[%d] incorrect return: got %v, want %v", count, got, want)
 			}
 		})
@@ -250,7 +338,158 @@ func TestGetMetadataAttributes(t *testing.T) {
 	}
 }
 
-type mdsClient struct{}
+func TestBlockProjectKeysUsers(t *testing.T) {
+	config := "[AuthorizedKeys]\nblock_project_keys_users = sa-user, ,other "
+	if err := cfg.Load([]byte(config)); err != nil {
+		t.Fatalf("cfg.Load(%q) failed unexpectedly with error: %v", config, err)
+	}
+
+	if got, want := blockProjectKeysUsers(), []string{"sa-user", "other"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("blockProjectKeysUsers() = %v, want %v", got, want)
+	}
+}
+
+func TestMetadataTimeout(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		want   time.Duration
+	}{
+		{
+			name: "default",
+			want: 5 * time.Second,
+		},
+		{
+			name:   "configured",
+			config: "[AuthorizedKeys]\nmetadata_timeout = 2s",
+			want:   2 * time.Second,
+		},
+		{
+			name:   "disabled",
+			config: "[AuthorizedKeys]\nmetadata_timeout =",
+		},
+		{
+			name:   "invalid",
+			config: "[AuthorizedKeys]\nmetadata_timeout = fast",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := cfg.Load([]byte(tc.config)); err != nil {
+				t.Fatalf("cfg.Load(%q) failed unexpectedly with error: %v", tc.config, err)
+			}
+			if got := metadataTimeout(); got != tc.want {
+				t.Errorf("metadataTimeout() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestGetGuestAttributeKeys(t *testing.T) {
+	client = &mdsClient{guestAttributes: map[string]string{
+		"instance/guest-attributes/ssh-keys/": `{"b":"name:ssh-rsa [KEY] b1\n\nname:ssh-rsa [KEY] b2\n","a":"othername:ssh-rsa [KEY] a1"}`,
+		"instance/guest-attributes/invalid/":  "BADJSON",
+	}}
+
+	tests := []struct {
+		name      string
+		namespace string
+		want      []string
+		wantErr   bool
+	}{
+		{
+			name:      "sorted_by_attribute",
+			namespace: "ssh-keys",
+			want:      []string{"othername:ssh-rsa [KEY] a1", "name:ssh-rsa [KEY] b1", "name:ssh-rsa [KEY] b2"},
+		},
+		{
+			name:      "invalid_json",
+			namespace: "invalid",
+			wantErr:   true,
+		},
+		{
+			name:      "missing_namespace",
+			namespace: "missing",
+			wantErr:   true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := getGuestAttributeKeys(context.Background(), tc.namespace)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("getGuestAttributeKeys(ctx, %q) = error %v, want error: %t", tc.namespace, err, tc.wantErr)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("getGuestAttributeKeys(ctx, %q) = %v, want %v", tc.namespace, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestPrivilegedUser(t *testing.T) {
+	oldLookupUser, oldLookupGroup, oldUserGroupIds := lookupUser, lookupGroup, userGroupIds
+	t.Cleanup(func() { lookupUser, lookupGroup, userGroupIds = oldLookupUser, oldLookupGroup, oldUserGroupIds })
+
+	users := map[string]*user.User{
+		"admin-uid": {Username: "admin-uid", Uid: "0"},
+		"sudoer":    {Username: "sudoer", Uid: "1001"},
+		"regular":   {Username: "regular", Uid: "1002"},
+		"no-groups": {Username: "no-groups", Uid: "1003"},
+	}
+	groups := map[string][]string{
+		"sudoer":  {"1001", "27"},
+		"regular": {"1002", "100"},
+	}
+	lookupUser = func(username string) (*user.User, error) {
+		if u, found := users[username]; found {
+			return u, nil
+		}
+		return nil, user.UnknownUserError(username)
+	}
+	lookupGroup = func(name string) (*user.Group, error) {
+		if name == "sudo" {
+			return &user.Group{Name: name, Gid: "27"}, nil
+		}
+		return nil, user.UnknownGroupError(name)
+	}
+	userGroupIds = func(u *user.User) ([]string, error) {
+		if gids, found := groups[u.Username]; found {
+			return gids, nil
+		}
+		return nil, fmt.Errorf("no groups for %s", u.Username)
+	}
+
+	tests := []struct {
+		username string
+		want     bool
+	}{
+		{username: "root", want: true},
+		{username: "admin-uid", want: true},
+		{username: "sudoer", want: true},
+		{username: "regular", want: false},
+		{username: "no-groups", want: true},
+		{username: "unknown", want: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.username, func(t *testing.T) {
+			if got := privilegedUser(tc.username); got != tc.want {
+				t.Errorf("privilegedUser(%q) = %t, want %t", tc.username, got, tc.want)
+			}
+		})
+	}
+}
+
+type mdsClient struct {
+	etagRequests int
+	etagErr      error
+	// instanceKey replaces the instance1 key served with etags, along with the
+	// instance etag.
+	instanceKey     string
+	guestAttributes map[string]string
+}
 
 func (mds *mdsClient) Get(ctx context.Context) (*metadata.Descriptor, error) {
 	return nil, fmt.Errorf("Get() not yet implemented")
@@ -261,6 +500,14 @@ func (mds *mdsClient) GetKey(ctx context.Context, key string, headers map[string
 }
 
 func (mds *mdsClient) GetKeyRecursive(ctx context.Context, key string) (string, error) {
+	if strings.HasPrefix(key, guestAttributesPrefix) {
+		data, found := mds.guestAttributes[key]
+		if !found {
+			return "", fmt.Errorf("unknown key %q", key)
+		}
+		return data, nil
+	}
+
 	i, err := strconv.Atoi(key[strings.LastIndex(key, "/")+1:])
 	if err != nil {
 		return "", err
@@ -282,6 +529,24 @@ func (mds *mdsClient) GetKeyRecursive(ctx context.Context, key string) (string,
 	}
 }
 
+func (mds *mdsClient) GetKeyRecursiveWithEtag(ctx context.Context, key string) (string, string, error) {
+	mds.etagRequests++
+	if mds.etagErr != nil {
+		return "", "", mds.etagErr
+	}
+	switch key {
+	case "instance/attributes/":
+		if mds.instanceKey != "" {
+			return fmt.Sprintf(`{"ssh-keys":"name:ssh-rsa [KEY] %s"}`, mds.instanceKey), "instance-etag-" + mds.instanceKey, nil
+		}
+		return `{"ssh-keys":"name:ssh-rsa [KEY] instance1"}`, "instance-etag", nil
+	case "project/attributes/":
+		return `{"ssh-keys":"name:ssh-rsa [KEY] project1"}`, "project-etag", nil
+	default:
+		return "", "", fmt.Errorf("unknown key %q", key)
+	}
+}
+
 func (mds *mdsClient) Watch(ctx context.Context) (*metadata.Descriptor, error) {
 	return nil, fmt.Errorf("Watch() not yet implemented")
 }
@@ -289,3 +554,11 @@ func (mds *mdsClient) Watch(ctx context.Context) (*metadata.Descriptor, error) {
 func (mds *mdsClient) WriteGuestAttributes(ctx context.Context, key string, value string) error {
 	return fmt.Errorf("WriteGuestattributes() not yet implemented")
 }
+
+func (mds *mdsClient) WriteGuestAttributesBatch(ctx context.Context, attrs map[string]string) error {
+	return fmt.Errorf("WriteGuestAttributesBatch() not yet implemented")
+}
+
+func (mds *mdsClient) DeleteGuestAttribute(ctx context.Context, key string) error {
+	return fmt.Errorf("DeleteGuestAttribute() not yet implemented")
+}
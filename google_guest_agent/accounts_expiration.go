@@ -0,0 +1,103 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"time"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+)
+
+// keyExpirationJobID is the scheduler ID of the key expiration sweep.
+const keyExpirationJobID = "key-expiration-sweep"
+
+// keyExpirationJob periodically drops expired SSH keys from the authorized keys
+// files written by the accounts manager. Keys are otherwise only re-evaluated on
+// metadata changes, which may not happen for a long time after a key expired.
+type keyExpirationJob struct {
+	// interval is how often the sweep runs, zero disables it.
+	interval time.Duration
+	// provisioner overrides the accounts manager's backend, used by tests.
+	provisioner userProvisioner
+}
+
+// newKeyExpirationJob returns the key expiration sweep configured by
+// [Accounts] key_expiration_sweep_interval.
+func newKeyExpirationJob() *keyExpirationJob {
+	interval, err := time.ParseDuration(cfg.Get().Accounts.KeyExpirationSweepInterval)
+	if err != nil {
+		// An empty or invalid interval disables the sweep, config validation reports
+		// the latter.
+		interval = 0
+	}
+	return &keyExpirationJob{interval: interval}
+}
+
+// ID returns the ID for this job.
+func (j *keyExpirationJob) ID() string {
+	return keyExpirationJobID
+}
+
+// Interval returns the interval at which job is executed, the first sweep only
+// happens after a full interval as the accounts manager handles keys at startup.
+func (j *keyExpirationJob) Interval() (time.Duration, bool) {
+	return j.interval, false
+}
+
+// ShouldEnable returns true if a sweep interval is set and the accounts daemon
+// manages keys on this platform.
+func (j *keyExpirationJob) ShouldEnable(ctx context.Context) bool {
+	return runtime.GOOS != "windows" && j.interval > 0 && cfg.Get().Daemons.AccountsDaemon
+}
+
+// Run rewrites the authorized keys of users with expired keys. It skips the sweep
+// while the accounts manager is disabled, i.e. when OS Login is enabled.
+func (j *keyExpirationJob) Run(ctx context.Context) (bool, error) {
+	if newMetadata == nil {
+		return true, nil
+	}
+	mgr := &accountsMgr{provisioner: j.provisioner}
+	if disabled, _ := mgr.Disabled(ctx); disabled {
+		return true, nil
+	}
+	return true, sweepExpiredKeys(ctx, mgr.backend())
+}
+
+// sweepExpiredKeys removes expired keys from the cached keys of each managed
+// user and rewrites their authorized keys if any were removed.
+func sweepExpiredKeys(ctx context.Context, provisioner userProvisioner) error {
+	sshKeysMu.Lock()
+	defer sshKeysMu.Unlock()
+
+	var errs []error
+	for user, keys := range sshKeys {
+		valid := removeExpiredKeys(keys)
+		if len(valid) == len(keys) {
+			continue
+		}
+		logger.Infof("Removing %d expired key(s) of user %s.", len(keys)-len(valid), user)
+		if err := provisioner.SetAuthorizedKeys(ctx, user, valid); err != nil {
+			errs = append(errs, fmt.Errorf("failed to update SSH keys for %s: %w", user, err))
+			continue
+		}
+		sshKeys[user] = valid
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,105 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/guest-agent/metadata"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestKeyExpirationJobRun(t *testing.T) {
+	reloadConfig(t, nil)
+
+	origKeys, origNew := sshKeys, newMetadata
+	t.Cleanup(func() {
+		sshKeys = origKeys
+		newMetadata = origNew
+	})
+
+	expired := genSSHKey(t, `google-ssh {"userName":"alice@example.com","expireOn":"2018-11-08T19:30:46+0000"}`)
+	valid := genSSHKey(t, `google-ssh {"userName":"alice@example.com","expireOn":"2099-11-08T19:30:46+0000"}`)
+	permanent := genSSHKey(t, "bob")
+
+	sshKeys = map[string][]string{
+		"alice": {expired, valid},
+		"bob":   {permanent},
+		"carol": {expired},
+	}
+	newMetadata = &metadata.Descriptor{}
+
+	fake := &fakeUserProvisioner{keys: make(map[string][]string)}
+	job := &keyExpirationJob{interval: time.Minute, provisioner: fake}
+
+	schedule, err := job.Run(context.Background())
+	if err != nil {
+		t.Fatalf("keyExpirationJob.Run(ctx) failed unexpectedly with error: %v", err)
+	}
+	if !schedule {
+		t.Errorf("keyExpirationJob.Run(ctx) = false, want true")
+	}
+
+	wantSet := map[string][]string{"alice": {valid}, "carol": nil}
+	if diff := cmp.Diff(wantSet, fake.keys); diff != "" {
+		t.Errorf("keyExpirationJob.Run(ctx) set unexpected keys (-want +got):\n%s", diff)
+	}
+
+	wantCache := map[string][]string{"alice": {valid}, "bob": {permanent}, "carol": nil}
+	if diff := cmp.Diff(wantCache, sshKeys); diff != "" {
+		t.Errorf("keyExpirationJob.Run(ctx) left unexpected cached keys (-want +got):\n%s", diff)
+	}
+}
+
+func TestNewKeyExpirationJob(t *testing.T) {
+	tests := []struct {
+		name         string
+		config       string
+		wantInterval time.Duration
+		wantEnabled  bool
+	}{
+		{
+			name:         "default",
+			wantInterval: 10 * time.Minute,
+			wantEnabled:  true,
+		},
+		{
+			name:   "disabled",
+			config: "[Accounts]\nkey_expiration_sweep_interval = 0s",
+		},
+		{
+			name:         "accounts_daemon_disabled",
+			config:       "[Daemons]\naccounts_daemon = false",
+			wantInterval: 10 * time.Minute,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			reloadConfig(t, []byte(tc.config))
+			job := newKeyExpirationJob()
+
+			interval, startNow := job.Interval()
+			if interval != tc.wantInterval || startNow {
+				t.Errorf("newKeyExpirationJob().Interval() = (%v, %t), want (%v, false)", interval, startNow, tc.wantInterval)
+			}
+			if got := job.ShouldEnable(context.Background()); got != tc.wantEnabled {
+				t.Errorf("newKeyExpirationJob().ShouldEnable(ctx) = %t, want %t", got, tc.wantEnabled)
+			}
+		})
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+)
+
+// defaultUserProvisioner is the backend used by the accounts manager to provision
+// users. Images lacking the shadow utilities (i.e. immutable or container optimized
+// images) can compile in a different backend by replacing it in an init() function.
+var defaultUserProvisioner userProvisioner = shellUserProvisioner{}
+
+// userProvisioner defines the user and group operations the accounts manager
+// needs to provision Google managed users.
+type userProvisioner interface {
+	// UserExists returns true if user is known by the system.
+	UserExists(user string) bool
+	// SetupSudoers makes sure the google-sudoers group and its sudoers
+	// configuration exist.
+	SetupSudoers(ctx context.Context, config *cfg.Sections) error
+	// CreateUser creates a Google managed user and adds it to the configured groups.
+	CreateUser(ctx context.Context, config *cfg.Sections, user string) error
+	// RemoveUser removes a Google managed user, or only its keys and sudoer
+	// permissions depending on the configuration.
+	RemoveUser(ctx context.Context, config *cfg.Sections, user string) error
+	// AddUserToGroup adds an existing user to group.
+	AddUserToGroup(ctx context.Context, user, group string) error
+	// SetAuthorizedKeys replaces the Google managed SSH keys of user with keys.
+	SetAuthorizedKeys(ctx context.Context, user string, keys []string) error
+}
+
+// shellUserProvisioner is the default userProvisioner implementation, it shells
+// out to the user and group commands set in the Accounts configuration section.
+type shellUserProvisioner struct{}
+
+// UserExists returns true if user has a passwd entry.
+func (shellUserProvisioner) UserExists(user string) bool {
+	_, err := getPasswd(user)
+	return err == nil
+}
+
+// SetupSudoers creates the google_sudoers file and the google-sudoers group. The
+// group is created even if the file can't be, errors of both are returned.
+func (shellUserProvisioner) SetupSudoers(ctx context.Context, config *cfg.Sections) error {
+	var errs []error
+	if err := createSudoersFile(); err != nil {
+		errs = append(errs, fmt.Errorf("error creating google-sudoers file: %w", err))
+	}
+	if err := createSudoersGroup(ctx, config); err != nil {
+		errs = append(errs, fmt.Errorf("error creating google-sudoers group: %w", err))
+	}
+	return errors.Join(errs...)
+}
+
+// CreateUser creates user with the configured useradd command.
+func (shellUserProvisioner) CreateUser(ctx context.Context, config *cfg.Sections, user string) error {
+	return createGoogleUser(ctx, config, user)
+}
+
+// RemoveUser removes user with the configured userdel or gpasswd commands.
+func (shellUserProvisioner) RemoveUser(ctx context.Context, config *cfg.Sections, user string) error {
+	return removeGoogleUser(ctx, config, user)
+}
+
+// AddUserToGroup adds user to group with the configured gpasswd command.
+func (shellUserProvisioner) AddUserToGroup(ctx context.Context, user, group string) error {
+	return addUserToGroup(ctx, user, group)
+}
+
+// SetAuthorizedKeys writes keys to the user's authorized keys file.
+func (shellUserProvisioner) SetAuthorizedKeys(ctx context.Context, user string, keys []string) error {
+	return updateAuthorizedKeysFile(ctx, user, keys)
+}
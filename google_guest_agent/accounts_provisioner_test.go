@@ -0,0 +1,192 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/run"
+	"github.com/GoogleCloudPlatform/guest-agent/metadata"
+	"github.com/google/go-cmp/cmp"
+	"golang.org/x/crypto/ssh"
+)
+
+// noopRunner is a run.RunnerInterface not running any command.
+type noopRunner struct{}
+
+func (noopRunner) Quiet(ctx context.Context, name string, args ...string) error {
+	return nil
+}
+
+func (noopRunner) WithOutput(ctx context.Context, name string, args ...string) *run.Result {
+	return &run.Result{}
+}
+
+func (noopRunner) WithOutputTimeout(ctx context.Context, timeout time.Duration, name string, args ...string) *run.Result {
+	return &run.Result{}
+}
+
+func (noopRunner) WithCombinedOutput(ctx context.Context, name string, args ...string) *run.Result {
+	return &run.Result{}
+}
+
+func (noopRunner) WithInput(ctx context.Context, stdin io.Reader, name string, args ...string) *run.Result {
+	return &run.Result{}
+}
+
+// fakeUserProvisioner records the operations requested by the accounts manager.
+type fakeUserProvisioner struct {
+	users      map[string]bool
+	created    []string
+	removed    []string
+	groups     map[string][]string
+	keys       map[string][]string
+	sudoersSet bool
+}
+
+func (f *fakeUserProvisioner) UserExists(user string) bool {
+	return f.users[user]
+}
+
+func (f *fakeUserProvisioner) SetupSudoers(ctx context.Context, config *cfg.Sections) error {
+	f.sudoersSet = true
+	return nil
+}
+
+func (f *fakeUserProvisioner) CreateUser(ctx context.Context, config *cfg.Sections, user string) error {
+	f.users[user] = true
+	f.created = append(f.created, user)
+	return nil
+}
+
+func (f *fakeUserProvisioner) RemoveUser(ctx context.Context, config *cfg.Sections, user string) error {
+	f.removed = append(f.removed, user)
+	return nil
+}
+
+func (f *fakeUserProvisioner) AddUserToGroup(ctx context.Context, user, group string) error {
+	f.groups[user] = append(f.groups[user], group)
+	return nil
+}
+
+func (f *fakeUserProvisioner) SetAuthorizedKeys(ctx context.Context, user string, keys []string) error {
+	f.keys[user] = keys
+	return nil
+}
+
+// genSSHKey generates a valid authorized keys entry with the provided comment.
+func genSSHKey(t *testing.T, comment string) string {
+	t.Helper()
+	pub, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("ed25519.GenerateKey(nil) failed unexpectedly with error: %v", err)
+	}
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatalf("ssh.NewPublicKey() failed unexpectedly with error: %v", err)
+	}
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(sshPub))) + " " + comment
+}
+
+func TestAccountsMgrSetWithProvisioner(t *testing.T) {
+	reloadConfig(t, nil)
+
+	origRunner, origUsersFile, origKeys := run.Client, googleUsersFile, sshKeys
+	origNew, origOld := newMetadata, oldMetadata
+	t.Cleanup(func() {
+		run.Client = origRunner
+		googleUsersFile = origUsersFile
+		sshKeys = origKeys
+		newMetadata = origNew
+		oldMetadata = origOld
+	})
+
+	run.Client = noopRunner{}
+	sshKeys = nil
+	googleUsersFile = filepath.Join(t.TempDir(), "google_users")
+	if err := os.WriteFile(googleUsersFile, []byte("carol\n"), 0600); err != nil {
+		t.Fatalf("os.WriteFile(%s) failed unexpectedly with error: %v", googleUsersFile, err)
+	}
+
+	aliceKey, bobKey := genSSHKey(t, "alice"), genSSHKey(t, "bob")
+	newMetadata = &metadata.Descriptor{}
+	newMetadata.Instance.Attributes.SSHKeys = []string{"alice:" + aliceKey, "bob:" + bobKey}
+	oldMetadata = &metadata.Descriptor{}
+
+	fake := &fakeUserProvisioner{
+		users:  map[string]bool{"alice": true},
+		groups: make(map[string][]string),
+		keys:   make(map[string][]string),
+	}
+	mgr := &accountsMgr{provisioner: fake}
+
+	if err := mgr.Set(context.Background()); err != nil {
+		t.Fatalf("accountsMgr.Set(ctx) failed unexpectedly with error: %v", err)
+	}
+
+	if !fake.sudoersSet {
+		t.Errorf("accountsMgr.Set(ctx) didn't set up sudoers")
+	}
+
+	if diff := cmp.Diff([]string{"bob"}, fake.created); diff != "" {
+		t.Errorf("accountsMgr.Set(ctx) created unexpected users (-want +got):\n%s", diff)
+	}
+
+	if diff := cmp.Diff([]string{"carol"}, fake.removed); diff != "" {
+		t.Errorf("accountsMgr.Set(ctx) removed unexpected users (-want +got):\n%s", diff)
+	}
+
+	if diff := cmp.Diff(map[string][]string{"alice": {"google-sudoers"}}, fake.groups); diff != "" {
+		t.Errorf("accountsMgr.Set(ctx) added users to unexpected groups (-want +got):\n%s", diff)
+	}
+
+	wantKeys := map[string][]string{"alice": {aliceKey}, "bob": {bobKey}}
+	if diff := cmp.Diff(wantKeys, fake.keys); diff != "" {
+		t.Errorf("accountsMgr.Set(ctx) set unexpected keys (-want +got):\n%s", diff)
+	}
+
+	gUsers, err := readGoogleUsersFile()
+	if err != nil {
+		t.Fatalf("readGoogleUsersFile() failed unexpectedly with error: %v", err)
+	}
+	var got []string
+	for user := range gUsers {
+		got = append(got, user)
+	}
+	slices.Sort(got)
+	if diff := cmp.Diff([]string{"alice", "bob"}, got); diff != "" {
+		t.Errorf("accountsMgr.Set(ctx) wrote unexpected google users (-want +got):\n%s", diff)
+	}
+}
+
+func TestAccountsMgrBackend(t *testing.T) {
+	if _, ok := (&accountsMgr{}).backend().(shellUserProvisioner); !ok {
+		t.Errorf("accountsMgr.backend() = %T, want shellUserProvisioner", (&accountsMgr{}).backend())
+	}
+
+	fake := &fakeUserProvisioner{}
+	if got := (&accountsMgr{provisioner: fake}).backend(); got != fake {
+		t.Errorf("accountsMgr.backend() = %v, want %v", got, fake)
+	}
+}
@@ -0,0 +1,48 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"sync/atomic"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/command"
+)
+
+// accountsReadyCommand is the command monitor command reporting whether users
+// have been provisioned by the guest agent.
+const accountsReadyCommand = "accounts.ready"
+
+// accountsReady is set once all the managers, including the accounts and OS Login
+// managers, have handled the first metadata update.
+var accountsReady atomic.Bool
+
+// accountsReadyResponse is the response of the accounts.ready command.
+type accountsReadyResponse struct {
+	command.Response
+	// Ready is true if users have been provisioned.
+	Ready bool
+}
+
+// accountsReadyHandler handles the accounts.ready command, it reports a non zero
+// status until users have been provisioned.
+func accountsReadyHandler(_ []byte) ([]byte, error) {
+	resp := accountsReadyResponse{Ready: accountsReady.Load()}
+	if !resp.Ready {
+		resp.Status = 1
+		resp.StatusMessage = "Users are not provisioned yet"
+	}
+	return json.Marshal(resp)
+}
@@ -0,0 +1,50 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestAccountsReadyHandler(t *testing.T) {
+	t.Cleanup(func() { accountsReady.Store(false) })
+
+	for _, ready := range []bool{false, true} {
+		accountsReady.Store(ready)
+
+		b, err := accountsReadyHandler(nil)
+		if err != nil {
+			t.Fatalf("accountsReadyHandler(nil) failed unexpectedly with error: %v", err)
+		}
+
+		var resp accountsReadyResponse
+		if err := json.Unmarshal(b, &resp); err != nil {
+			t.Fatalf("json.Unmarshal(%s) failed unexpectedly with error: %v", b, err)
+		}
+
+		if resp.Ready != ready {
+			t.Errorf("accountsReadyHandler(nil) reported ready = %t, want %t", resp.Ready, ready)
+		}
+
+		wantStatus := 0
+		if !ready {
+			wantStatus = 1
+		}
+		if resp.Status != wantStatus {
+			t.Errorf("accountsReadyHandler(nil) reported status = %d, want %d", resp.Status, wantStatus)
+		}
+	}
+}
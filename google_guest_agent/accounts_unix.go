@@ -25,6 +25,7 @@ import (
 
 	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
 	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/run"
+	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
 )
 
 func getUIDAndGID(path string) (string, string) {
@@ -52,7 +53,26 @@ func createUser(ctx context.Context, username, uid, gid string) error {
 		useradd = fmt.Sprintf("%s -g %s", useradd, gid)
 	}
 	cmd, args := createUserGroupCmd(useradd, username, "")
-	return run.Quiet(ctx, cmd, args...)
+
+	// With SELinux enforcing useradd can't create home directories out of /home
+	// unless their base directory is labeled accordingly.
+	home := selinuxHomeDir(args, username)
+	if home == "" {
+		return run.Quiet(ctx, cmd, args...)
+	}
+
+	labelHomeBase(ctx, home)
+	err := run.Quiet(ctx, cmd, args...)
+	if isExitCode(err, useraddCantCreateHome) {
+		logger.Warningf("useradd failed to create home directory %s, creating it explicitly: %v", home, err)
+		err = createHomeDir(username, home)
+	}
+	if err != nil {
+		return err
+	}
+
+	restoreSELinuxContext(ctx, home, true)
+	return nil
 }
 
 func addUserToGroup(ctx context.Context, user, group string) error {
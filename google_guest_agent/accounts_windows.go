@@ -29,6 +29,8 @@ var (
 	procNetUserGetInfo          = netAPI32.NewProc("NetUserGetInfo")
 	procNetUserSetInfo          = netAPI32.NewProc("NetUserSetInfo")
 	procNetLocalGroupAddMembers = netAPI32.NewProc("NetLocalGroupAddMembers")
+	procNetUserModalsGet        = netAPI32.NewProc("NetUserModalsGet")
+	procNetAPIBufferFree        = netAPI32.NewProc("NetApiBufferFree")
 )
 
 type (
@@ -54,6 +56,14 @@ type (
 	USER_INFO_1003 struct {
 		Usri1003_password LPWSTR
 	}
+
+	USER_MODALS_INFO_0 struct {
+		Usrmod0_min_passwd_len    DWORD
+		Usrmod0_max_passwd_age    DWORD
+		Usrmod0_min_passwd_age    DWORD
+		Usrmod0_force_logoff      DWORD
+		Usrmod0_password_hist_len DWORD
+	}
 )
 
 const (
@@ -189,6 +199,23 @@ func userExists(name string) (bool, error) {
 	return true, nil
 }
 
+// osMinPasswordLength returns the minimum password length enforced by the
+// local security policy.
+func osMinPasswordLength() (int, error) {
+	var info *USER_MODALS_INFO_0
+	ret, _, _ := procNetUserModalsGet.Call(
+		uintptr(0),
+		uintptr(0),
+		uintptr(unsafe.Pointer(&info)),
+	)
+	if ret != 0 {
+		return 0, fmt.Errorf("nonzero return code from NetUserModalsGet: %s", syscall.Errno(ret))
+	}
+	defer procNetAPIBufferFree.Call(uintptr(unsafe.Pointer(info)))
+
+	return int(info.Usrmod0_min_passwd_len), nil
+}
+
 func getUIDAndGID(_ string) (string, string) {
 	return "", ""
 }
@@ -16,9 +16,12 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net"
+	"os"
+	"path/filepath"
 	"reflect"
 	"runtime"
 	"slices"
@@ -27,6 +30,7 @@ import (
 	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
 	network "github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/network/manager"
 	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/run"
+	"github.com/GoogleCloudPlatform/guest-agent/utils"
 	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
 )
 
@@ -34,9 +38,97 @@ var (
 	addressKey       = regKeyBase + `\ForwardedIps`
 	oldWSFCAddresses string
 	oldWSFCEnable    bool
+
+	// ownedIPsFile persists the forwarded IPs owned by the address manager on
+	// Linux so they're still known after the agent restarts, on Windows they're
+	// recorded in the registry.
+	ownedIPsFile = "/var/lib/google/forwarded_ips"
+
+	// networkHasPendingWork reports deferred network setup, overridden in tests.
+	networkHasPendingWork = network.HasPendingWork
 )
 
-type addressMgr struct{}
+type addressMgr struct {
+	// ownedIPs tracks, by interface MAC address, the forwarded IPs added by the
+	// address manager. It's used to only remove owned IPs when configured to not
+	// remove unmanaged IPs.
+	ownedIPs map[string][]string
+	// ownedIPsChanged is true if ownedIPs changed since it was last persisted.
+	ownedIPsChanged bool
+}
+
+// own records ip as added by the address manager on the interface mac.
+func (a *addressMgr) own(mac, ip string) {
+	if a.ownedIPs == nil {
+		a.ownedIPs = make(map[string][]string)
+	}
+	if !slices.Contains(a.ownedIPs[mac], ip) {
+		a.ownedIPs[mac] = append(a.ownedIPs[mac], ip)
+		a.ownedIPsChanged = true
+	}
+}
+
+// disown removes ip from the IPs owned by the address manager on the interface mac.
+func (a *addressMgr) disown(mac, ip string) {
+	if !slices.Contains(a.ownedIPs[mac], ip) {
+		return
+	}
+	a.ownedIPs[mac] = slices.DeleteFunc(a.ownedIPs[mac], func(owned string) bool { return owned == ip })
+	a.ownedIPsChanged = true
+}
+
+// loadOwnedIPs reads the owned IPs persisted by a previous run, if any.
+func (a *addressMgr) loadOwnedIPs() error {
+	data, err := os.ReadFile(ownedIPsFile)
+	if os.IsNotExist(err) {
+		a.ownedIPs = make(map[string][]string)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	owned := make(map[string][]string)
+	if err := json.Unmarshal(data, &owned); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", ownedIPsFile, err)
+	}
+	a.ownedIPs = owned
+	return nil
+}
+
+// saveOwnedIPs persists the owned IPs if they changed since last saved.
+func (a *addressMgr) saveOwnedIPs() error {
+	if !a.ownedIPsChanged {
+		return nil
+	}
+
+	data, err := json.Marshal(a.ownedIPs)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(ownedIPsFile), 0755); err != nil {
+		return err
+	}
+	if err := utils.SaferWriteFile(data, ownedIPsFile, 0600); err != nil {
+		return err
+	}
+	a.ownedIPsChanged = false
+	return nil
+}
+
+// filterOwned returns the IPs in toRm owned by the address manager on the interface
+// mac, unowned IPs are logged and left out.
+func (a *addressMgr) filterOwned(mac string, toRm []string) []string {
+	var res []string
+	for _, ip := range toRm {
+		if slices.Contains(a.ownedIPs[mac], ip) {
+			res = append(res, ip)
+		} else {
+			logger.Debugf("Skipping removal of %s on %s, it was not added by the address manager", ip, mac)
+		}
+	}
+	return res
+}
 
 func (a *addressMgr) parseWSFCAddresses(config *cfg.Sections) string {
 	if config.WSFC != nil && config.WSFC.Addresses != "" {
@@ -149,19 +241,33 @@ func getLocalRoutes(ctx context.Context, config *cfg.Sections, ifname string) ([
 	return res, nil
 }
 
-// TODO: addLocalRoute and addRoute should be merged with the addition of ipForwardType to ipForwardEntry.
-func addLocalRoute(ctx context.Context, config *cfg.Sections, ip, ifname string) error {
-	if runtime.GOOS == "windows" {
-		return errors.New("addLocalRoute unimplemented on Windows")
+// localRouteArgs returns the ip command arguments to add or delete, per action, the local
+// route for ip. IPv6 routes are handled with "ip -6" and, as "scope host" is IPv4 only,
+// without scope.
+func localRouteArgs(action, ip, ifname, protoID string) []string {
+	// Forwarded IPv6 addresses are provided in CIDR notation, IPv4 ones are not.
+	addr := strings.Split(ip, "/")[0]
+	if parsed := net.ParseIP(addr); parsed != nil && isIPv6(parsed) {
+		if !strings.Contains(ip, "/") {
+			ip = ip + "/128"
+		}
+		return strings.Split(fmt.Sprintf("-6 route %s to local %s dev %s proto %s", action, ip, ifname, protoID), " ")
 	}
 
 	// TODO: Subnet size should be parsed from alias IP entries.
 	if !strings.Contains(ip, "/") {
 		ip = ip + "/32"
 	}
-	protoID := config.IPForwarding.EthernetProtoID
-	args := fmt.Sprintf("route add to local %s scope host dev %s proto %s", ip, ifname, protoID)
-	return run.Quiet(ctx, "ip", strings.Split(args, " ")...)
+	return strings.Split(fmt.Sprintf("route %s to local %s scope host dev %s proto %s", action, ip, ifname, protoID), " ")
+}
+
+// TODO: addLocalRoute and addRoute should be merged with the addition of ipForwardType to ipForwardEntry.
+func addLocalRoute(ctx context.Context, config *cfg.Sections, ip, ifname string) error {
+	if runtime.GOOS == "windows" {
+		return errors.New("addLocalRoute unimplemented on Windows")
+	}
+
+	return run.Quiet(ctx, "ip", localRouteArgs("add", ip, ifname, config.IPForwarding.EthernetProtoID)...)
 }
 
 // TODO: removeLocalRoute should be changed to removeIPForwardEntry and match getIPForwardEntries.
@@ -170,13 +276,7 @@ func removeLocalRoute(ctx context.Context, config *cfg.Sections, ip, ifname stri
 		return errors.New("removeLocalRoute unimplemented on Windows")
 	}
 
-	// TODO: Subnet size should be parsed from alias IP entries.
-	if !strings.Contains(ip, "/") {
-		ip = ip + "/32"
-	}
-	protoID := config.IPForwarding.EthernetProtoID
-	args := fmt.Sprintf("route delete to local %s scope host dev %s proto %s", ip, ifname, protoID)
-	return run.Quiet(ctx, "ip", strings.Split(args, " ")...)
+	return run.Quiet(ctx, "ip", localRouteArgs("delete", ip, ifname, config.IPForwarding.EthernetProtoID)...)
 }
 
 // Filter out forwarded ips based on WSFC (Windows Failover Cluster Settings).
@@ -240,15 +340,22 @@ func (a *addressMgr) Diff(ctx context.Context) (bool, error) {
 	wsfcAddresses := a.parseWSFCAddresses(config)
 	wsfcEnable := a.parseWSFCEnable(config)
 
+	// Deferred network setup, i.e. DHCPv6 lease releases, must run even if the
+	// metadata didn't change.
 	diff := !reflect.DeepEqual(newMetadata.Instance.NetworkInterfaces, oldMetadata.Instance.NetworkInterfaces) ||
 		!reflect.DeepEqual(newMetadata.Instance.VlanNetworkInterfaces, oldMetadata.Instance.VlanNetworkInterfaces) ||
-		wsfcEnable != oldWSFCEnable || wsfcAddresses != oldWSFCAddresses
+		wsfcEnable != oldWSFCEnable || wsfcAddresses != oldWSFCAddresses || networkHasPendingWork()
 
 	oldWSFCAddresses = wsfcAddresses
 	oldWSFCEnable = wsfcEnable
 	return diff, nil
 }
 
+// Name returns the manager's name, see addressMgrName.
+func (a *addressMgr) Name() string {
+	return addressMgrName
+}
+
 func (a *addressMgr) Timeout(ctx context.Context) (bool, error) {
 	return false, nil
 }
@@ -293,6 +400,14 @@ func (a *addressMgr) Set(ctx context.Context) error {
 		return nil
 	}
 
+	// On Linux owned IPs are restored from the previous run, on Windows they're
+	// read from the registry below.
+	if runtime.GOOS != "windows" && a.ownedIPs == nil {
+		if err := a.loadOwnedIPs(); err != nil {
+			logger.Errorf("Failed to load forwarded IPs added by previous runs: %v", err)
+		}
+	}
+
 	logger.Debugf("Add routes for aliases, forwarded IP and target-instance IPs")
 	// Add routes for IP aliases, forwarded and target-instance IPs.
 	for _, ni := range newMetadata.Instance.NetworkInterfaces {
@@ -333,6 +448,8 @@ func (a *addressMgr) Set(ctx context.Context) error {
 				// Only add to `forwardedIPs` if it is recorded in the registry.
 				if slices.Contains(regFwdIPs, ip) {
 					forwardedIPs = append(forwardedIPs, ip)
+					// The registry records the IPs added by previous runs.
+					a.own(ni.Mac, ip)
 				}
 			}
 		} else {
@@ -343,11 +460,16 @@ func (a *addressMgr) Set(ctx context.Context) error {
 			}
 		}
 
-		// Trims any '/32' suffix for consistency.
+		// Trims any '/32' suffix for consistency. On Linux single IPv6 address local
+		// routes are listed without prefix length, trim '/128' too.
 		trimSuffix := func(entries []string) []string {
 			var res []string
 			for _, entry := range entries {
-				res = append(res, strings.TrimSuffix(entry, "/32"))
+				entry = strings.TrimSuffix(entry, "/32")
+				if runtime.GOOS != "windows" {
+					entry = strings.TrimSuffix(entry, "/128")
+				}
+				res = append(res, entry)
 			}
 			return res
 		}
@@ -355,6 +477,9 @@ func (a *addressMgr) Set(ctx context.Context) error {
 		wantIPs = trimSuffix(wantIPs)
 
 		toAdd, toRm := compareRoutes(forwardedIPs, wantIPs)
+		if !config.IPForwarding.RemoveUnmanagedIPs {
+			toRm = a.filterOwned(ni.Mac, toRm)
+		}
 
 		if len(toAdd) != 0 || len(toRm) != 0 {
 			var msg string
@@ -396,6 +521,7 @@ func (a *addressMgr) Set(ctx context.Context) error {
 			}
 			if err == nil {
 				registryEntries = append(registryEntries, ip)
+				a.own(ni.Mac, ip)
 			} else {
 				logger.Errorf("error adding route: %v", err)
 			}
@@ -422,6 +548,8 @@ func (a *addressMgr) Set(ctx context.Context) error {
 				logger.Errorf("error removing route: %v", err)
 				// Add IPs we fail to remove to registry to maintain accurate record.
 				registryEntries = append(registryEntries, ip)
+			} else {
+				a.disown(ni.Mac, ip)
 			}
 		}
 
@@ -431,6 +559,11 @@ func (a *addressMgr) Set(ctx context.Context) error {
 			}
 		}
 	}
+	if runtime.GOOS != "windows" {
+		if err := a.saveOwnedIPs(); err != nil {
+			logger.Errorf("Failed to save forwarded IPs added by the address manager: %v", err)
+		}
+	}
 	logger.Infof("Completed adding/removing routes for aliases, forwarded IP and target-instance IPs")
 
 	return nil
@@ -19,7 +19,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"net"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
@@ -65,6 +68,163 @@ func TestCompareRoutes(t *testing.T) {
 	}
 }
 
+func TestFilterOwned(t *testing.T) {
+	mac := "00:00:5e:00:53:01"
+	a := &addressMgr{}
+
+	if got := a.filterOwned(mac, []string{"1.2.3.4"}); got != nil {
+		t.Errorf("filterOwned(%s, [1.2.3.4]) = %q with no owned IPs, want: nil", mac, got)
+	}
+
+	a.own(mac, "1.2.3.4")
+	a.own(mac, "1.2.3.4")
+	a.own(mac, "5.6.7.8")
+	a.own("00:00:5e:00:53:02", "9.10.11.12")
+
+	toRm := []string{"1.2.3.4", "5.6.7.8", "9.10.11.12"}
+	want := []string{"1.2.3.4", "5.6.7.8"}
+	if got := a.filterOwned(mac, toRm); !reflect.DeepEqual(got, want) {
+		t.Errorf("filterOwned(%s, %q) = %q, want: %q", mac, toRm, got, want)
+	}
+
+	a.disown(mac, "1.2.3.4")
+	want = []string{"5.6.7.8"}
+	if got := a.filterOwned(mac, toRm); !reflect.DeepEqual(got, want) {
+		t.Errorf("filterOwned(%s, %q) after disown = %q, want: %q", mac, toRm, got, want)
+	}
+}
+
+func TestLocalRouteArgs(t *testing.T) {
+	tests := []struct {
+		name   string
+		action string
+		ip     string
+		want   string
+	}{
+		{"ipv4_add", "add", "10.0.0.1", "route add to local 10.0.0.1/32 scope host dev eth0 proto 66"},
+		{"ipv4_cidr_delete", "delete", "10.0.0.0/24", "route delete to local 10.0.0.0/24 scope host dev eth0 proto 66"},
+		{"ipv6_cidr_add", "add", "2600:1900::/96", "-6 route add to local 2600:1900::/96 dev eth0 proto 66"},
+		{"ipv6_address_delete", "delete", "2600:1900::1", "-6 route delete to local 2600:1900::1/128 dev eth0 proto 66"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := strings.Join(localRouteArgs(tc.action, tc.ip, "eth0", "66"), " ")
+			if got != tc.want {
+				t.Errorf("localRouteArgs(%s, %s, eth0, 66) = %q, want: %q", tc.action, tc.ip, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestAddressDiffIPv6(t *testing.T) {
+	mkMetadata := func(forwardedIPv6s ...string) *metadata.Descriptor {
+		return &metadata.Descriptor{
+			Instance: metadata.Instance{
+				NetworkInterfaces: []metadata.NetworkInterfaces{
+					{Mac: "00:00:5e:00:53:01", ForwardedIps: []string{"10.0.0.1"}, ForwardedIpv6s: forwardedIPv6s},
+				},
+			},
+		}
+	}
+
+	tests := []struct {
+		name string
+		old  *metadata.Descriptor
+		new  *metadata.Descriptor
+		want bool
+	}{
+		{"unchanged", mkMetadata("2600:1900::/96"), mkMetadata("2600:1900::/96"), false},
+		{"ipv6_added", mkMetadata(), mkMetadata("2600:1900::/96"), true},
+		{"ipv6_changed", mkMetadata("2600:1900::/96"), mkMetadata("2600:1901::/96"), true},
+		{"ipv6_removed", mkMetadata("2600:1900::/96"), mkMetadata(), true},
+	}
+
+	ctx := context.Background()
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			reloadConfig(t, nil)
+
+			oldWSFCEnable = false
+			oldWSFCAddresses = ""
+			oldMetadata = tc.old
+			newMetadata = tc.new
+
+			got, err := (&addressMgr{}).Diff(ctx)
+			if err != nil {
+				t.Fatalf("addressMgr.Diff(ctx) failed unexpectedly with error: %v", err)
+			}
+			if got != tc.want {
+				t.Errorf("addressMgr.Diff(ctx) = %t, want: %t", got, tc.want)
+			}
+		})
+	}
+}
+
+// TestAddressDiffPendingNetworkWork tests the address manager runs with unchanged
+// metadata while the network setup has deferred work, i.e. a DHCPv6 release.
+func TestAddressDiffPendingNetworkWork(t *testing.T) {
+	prevPendingWork := networkHasPendingWork
+	t.Cleanup(func() { networkHasPendingWork = prevPendingWork })
+
+	reloadConfig(t, nil)
+	oldWSFCEnable = false
+	oldWSFCAddresses = ""
+	oldMetadata = &metadata.Descriptor{}
+	newMetadata = &metadata.Descriptor{}
+	ctx := context.Background()
+
+	for _, pending := range []bool{true, false} {
+		networkHasPendingWork = func() bool { return pending }
+		got, err := (&addressMgr{}).Diff(ctx)
+		if err != nil {
+			t.Fatalf("addressMgr.Diff(ctx) failed unexpectedly with error: %v", err)
+		}
+		if got != pending {
+			t.Errorf("addressMgr.Diff(ctx) with pending work %t = %t, want: %t", pending, got, pending)
+		}
+	}
+}
+
+func TestOwnedIPsPersistence(t *testing.T) {
+	prevOwnedIPsFile := ownedIPsFile
+	ownedIPsFile = filepath.Join(t.TempDir(), "google", "forwarded_ips")
+	t.Cleanup(func() { ownedIPsFile = prevOwnedIPsFile })
+
+	mac := "00:00:5e:00:53:01"
+	toRm := []string{"1.2.3.4", "5.6.7.8"}
+
+	a := &addressMgr{}
+	if err := a.loadOwnedIPs(); err != nil {
+		t.Fatalf("loadOwnedIPs() without a file = %v, want nil", err)
+	}
+	a.own(mac, "1.2.3.4")
+	if err := a.saveOwnedIPs(); err != nil {
+		t.Fatalf("saveOwnedIPs() = %v, want nil", err)
+	}
+
+	// A restarted agent must still know the IPs it added.
+	restarted := &addressMgr{}
+	if err := restarted.loadOwnedIPs(); err != nil {
+		t.Fatalf("loadOwnedIPs() = %v, want nil", err)
+	}
+	want := []string{"1.2.3.4"}
+	if got := restarted.filterOwned(mac, toRm); !reflect.DeepEqual(got, want) {
+		t.Errorf("filterOwned(%s, %q) after restart = %q, want: %q", mac, toRm, got, want)
+	}
+
+	// Unchanged owned IPs are not written again.
+	if err := os.Remove(ownedIPsFile); err != nil {
+		t.Fatalf("os.Remove(%s) = %v, want nil", ownedIPsFile, err)
+	}
+	if err := restarted.saveOwnedIPs(); err != nil {
+		t.Fatalf("saveOwnedIPs() = %v, want nil", err)
+	}
+	if _, err := os.Stat(ownedIPsFile); !os.IsNotExist(err) {
+		t.Errorf("saveOwnedIPs() without changes wrote %s, want no write", ownedIPsFile)
+	}
+}
+
 func TestAddressDisabled(t *testing.T) {
 	var tests = []struct {
 		name string
@@ -18,14 +18,17 @@ package cfg
 import (
 	"fmt"
 	"runtime"
+	"strings"
+	"sync/atomic"
 
 	"github.com/go-ini/ini"
 )
 
 var (
 	// instance is the single instance of configuration sections, once loaded this package
-	// should always return it.
-	instance *Sections
+	// should always return it. It's only replaced as a whole when the configuration is
+	// reloaded.
+	instance atomic.Pointer[Sections]
 
 	// configFile is a pointer to a function which takes the current OS name and returns
 	// an appropriate config file name. Replaceable by unit tests.
@@ -43,25 +46,47 @@ const (
 	defaultConfig = `
 [Core]
 cloud_logging_enabled = true
+log_buffer_size = 500
+log_rate_limit_interval = 5m
+resume_triggers = clock,drift-token
 
 [Accounts]
+authorized_keys_file =
 deprovision_remove = false
 gpasswd_add_cmd = gpasswd -a {user} {group}
 gpasswd_remove_cmd = gpasswd -d {user} {group}
 groupadd_cmd = groupadd {group}
 groups = adm,dip,docker,lxd,plugdev,video
+key_expiration_layouts =
+key_expiration_sweep_interval = 10m
 reuse_homedir = false
 useradd_cmd = useradd -m -s /bin/bash -p * {user}
 userdel_cmd = userdel -r {user}
+windows_password_length = 15
+windows_password_character_classes = 3
+
+[AuthorizedKeys]
+block_project_keys_users =
+cache_path = /run/google_authorized_keys.cache
+cache_ttl = 0s
+fallback_max_staleness = 0s
+guest_attributes_namespace =
+metadata_timeout = 5s
 
 [Daemons]
 accounts_daemon = true
 clock_skew_daemon = true
 network_daemon = true
 
+[HealthCheck]
+enabled = false
+port = 8087
+path = /health
+
 [IpForwarding]
 ethernet_proto_id = 66
 ip_aliases = true
+remove_unmanaged_ips = true
 target_instance_ips = true
 
 [Instance]
@@ -78,27 +103,66 @@ set_host_keys = true
 set_multiqueue = true
 
 [MetadataScripts]
-default_shell = /bin/bash
+cross_host_redirects = true
+default_shell =
+download_proxy =
+max_log_line_length = 65536
+max_script_size = 104857600
+run_as_group =
+run_as_user =
 run_dir =
+run_once = false
+script_concurrency = 1
+script_interpreters =
 shutdown = true
 shutdown-windows = true
+shutdown_timeout =
 startup = true
 startup-windows = true
+startup_timeout =
+summary_guest_attribute = false
+summary_path =
 sysprep-specialize = true
+specialize_steps = user-scripts
+wait_for_accounts = false
+wait_for_accounts_timeout = 2m
+
+[MetadataHosts]
+enabled = false
+hostname_entry = false
 
 [NetworkInterfaces]
 dhcp_command =
+dhcpv6_release_delay = 0
 ip_forwarding = true
 setup = true
 manage_primary_nic =
+exclude_interfaces =
+exclude_interface_macs =
+mtu_overrides =
 restore_debian12_netplan_config = true
+ubuntu1804_netplan_dropin = false
 
 [OSLogin]
 cert_authentication = true
+trusted_ca_pipe_path = /etc/ssh/oslogin_trustedca.pub
+trusted_ca_pipe_mode = 0644
+sudoers_dir = /var/google-sudoers.d
+users_dir = /var/google-users.d
+sshd_reload_cmd =
+pam_oslogin_auth =
+pam_group_auth =
+pam_mkhomedir_session =
 
 [MDS]
 disable-https-mds-setup = true
 enable-https-mds-native-cert-store = false
+prefer-ipv6 = false
+
+[ResolvConf]
+enabled = false
+nameservers =
+search =
 
 [Snapshots]
 enabled = false
@@ -106,13 +170,27 @@ snapshot_service_ip = 169.254.169.254
 snapshot_service_port = 8081
 timeout_in_seconds = 60
 
+[Telemetry]
+omit_fields =
+
 [Unstable]
 command_monitor_enabled = false
 command_pipe_mode = 0770
 command_pipe_group =
 command_request_timeout = 10s
+command_shutdown_grace_period = 5s
+command_max_request_size = 1048576
+command_auth_enabled = false
+command_token_path =
+mds_proxy_enabled = false
 vlan_setup_enabled = false
 systemd_config_dir = /usr/lib/systemd/network
+
+[WorkloadCertificates]
+content_dir_prefix = /run/secrets/workload-spiffe-contents
+layout = gce
+temp_symlink_prefix = /run/secrets/workload-spiffe-symlink
+symlink = /run/secrets/workload-spiffe-credentials
 `
 )
 
@@ -122,6 +200,19 @@ type Core struct {
 	// CloudLoggingEnabled config toggle controls Guest Agent cloud logger.
 	// Disabling it will stop Guest Agent for configuring and logging to Cloud Logging.
 	CloudLoggingEnabled bool `ini:"cloud_logging_enabled,omitempty"`
+	// LogBufferSize is the number of recent log entries kept in memory and
+	// returned by the logs.tail command, zero disables the buffer.
+	LogBufferSize int `ini:"log_buffer_size,omitempty"`
+	// LogRateLimitInterval is a duration string defining how often identical error
+	// messages repeated during outages, e.g. failing metadata server watches,
+	// scheduled jobs or workload certificate refreshes, are logged. Rate limiting is
+	// disabled if it's empty or zero.
+	LogRateLimitInterval string `ini:"log_rate_limit_interval,omitempty"`
+	// ResumeTriggers is a comma separated list of the sources detecting the instance
+	// resumed, from suspend or a live migration, which makes the agent reconcile the
+	// clock and network state right away. Supported sources are clock and
+	// drift-token, resume detection is disabled if it's empty.
+	ResumeTriggers string `ini:"resume_triggers,omitempty"`
 }
 
 // Sections encapsulates all the configuration sections.
@@ -143,6 +234,10 @@ type Sections struct {
 	// pointer is nil or not.
 	AddressManager *AddressManager `ini:"addressManager,omitempty"`
 
+	// AuthorizedKeys defines the google_authorized_keys options, i.e. the caching of metadata
+	// server responses.
+	AuthorizedKeys *AuthorizedKeys `ini:"AuthorizedKeys,omitempty"`
+
 	// Daemons defines the availability of clock skew, network and account managers.
 	Daemons *Daemons `ini:"Daemons,omitempty"`
 
@@ -152,6 +247,9 @@ type Sections struct {
 	// pointer is nil or not.
 	Diagnostics *Diagnostics `ini:"diagnostics,omitempty"`
 
+	// HealthCheck defines the local health check HTTP endpoint options.
+	HealthCheck *HealthCheck `ini:"HealthCheck,omitempty"`
+
 	// IPForwarding defines the ip forwarding configuration options.
 	IPForwarding *IPForwarding `ini:"IpForwarding,omitempty"`
 
@@ -165,6 +263,9 @@ type Sections struct {
 	// MetadataScripts contains the configurations of the metadata-scripts service.
 	MetadataScripts *MetadataScripts `ini:"MetadataScripts,omitempty"`
 
+	// MetadataHosts defines if the metadata server's host names are managed in the hosts file.
+	MetadataHosts *MetadataHosts `ini:"MetadataHosts,omitempty"`
+
 	// NetworkInterfaces defines if the network interfaces should be managed/configured by guest-agent
 	// as well as the commands definitions for network configuration.
 	NetworkInterfaces *NetworkInterfaces `ini:"NetworkInterfaces,omitempty"`
@@ -175,13 +276,23 @@ type Sections struct {
 	// MDS defines the MDS configuration options.
 	MDS *MDS `ini:"MDS,omitempty"`
 
+	// ResolvConf defines the resolvers kept in resolv.conf across network setup.
+	ResolvConf *ResolvConf `ini:"ResolvConf,omitempty"`
+
 	// Snpashots defines the snapshot listener configuration and behavior i.e. the server address and port.
 	Snapshots *Snapshots `ini:"Snapshots,omitempty"`
 
+	// Telemetry defines the telemetry job options, i.e. which fields are left out of its payload.
+	Telemetry *Telemetry `ini:"Telemetry,omitempty"`
+
 	// Unstable is a "under development feature flags" section. No stability or long term support is
 	// guaranteed for any keys under this section. No application, script or utility should rely on it.
 	Unstable *Unstable `ini:"Unstable,omitempty"`
 
+	// WorkloadCertificates defines where gce_workload_cert_refresh writes the workload
+	// certificates.
+	WorkloadCertificates *WorkloadCertificates `ini:"WorkloadCertificates,omitempty"`
+
 	// WSFC defines the wsfc configurations. It takes precedence over instance's and project's
 	// metadata configuration. The default configuration doesn't define values to it, if the user
 	// has defined it then we shouldn't even consider metadata values. Users must check if this
@@ -204,6 +315,25 @@ type Accounts struct {
 	ReuseHomedir      bool   `ini:"reuse_homedir,omitempty"`
 	UserAddCmd        string `ini:"useradd_cmd,omitempty"`
 	UserDelCmd        string `ini:"userdel_cmd,omitempty"`
+	// WindowsPasswordLength is the minimum length of generated Windows account passwords,
+	// metadata may request longer passwords. It's raised to the OS minimum if lower.
+	WindowsPasswordLength int `ini:"windows_password_length,omitempty"`
+	// WindowsPasswordCharacterClasses is the number of character classes (lower case, upper
+	// case, digits and special characters) generated Windows account passwords must contain.
+	WindowsPasswordCharacterClasses int `ini:"windows_password_character_classes,omitempty"`
+	// AuthorizedKeysFile is where users' SSH keys are written, it must match sshd's
+	// AuthorizedKeysFile. %h is replaced by the user's home directory and %u by the
+	// user name, relative paths are relative to the home directory. Absolute paths
+	// must contain %h or %u. Empty means %h/.ssh/authorized_keys.
+	AuthorizedKeysFile string `ini:"authorized_keys_file,omitempty"`
+	// KeyExpirationLayouts are "|" separated Go time layouts SSH key expiration
+	// times are parsed with after RFC3339 and the default ones, which are always
+	// kept. Empty only uses the defaults.
+	KeyExpirationLayouts string `ini:"key_expiration_layouts,omitempty"`
+	// KeyExpirationSweepInterval is a duration string defining how often expired
+	// SSH keys are removed from authorized keys files between metadata changes.
+	// The sweep is disabled if it's empty or zero.
+	KeyExpirationSweepInterval string `ini:"key_expiration_sweep_interval,omitempty"`
 }
 
 // AddressManager contains the configuration of addressManager section.
@@ -211,6 +341,34 @@ type AddressManager struct {
 	Disable bool `ini:"disable,omitempty"`
 }
 
+// AuthorizedKeys contains the configurations of AuthorizedKeys section.
+type AuthorizedKeys struct {
+	// BlockProjectKeysUsers is a comma separated list of users for which project
+	// SSH keys are ignored, as if block-project-ssh-keys was set for them only.
+	BlockProjectKeysUsers string `ini:"block_project_keys_users,omitempty"`
+	// CachePath is the file where google_authorized_keys caches the metadata server responses.
+	CachePath string `ini:"cache_path,omitempty"`
+	// CacheTTL is a duration string defining for how long a cached response is valid. The
+	// cached response is only served while the metadata server serves the same etag, or
+	// can't be reached. Caching is disabled if it's empty or zero.
+	CacheTTL string `ini:"cache_ttl,omitempty"`
+	// FallbackMaxStaleness is a duration string, if set google_authorized_keys caches
+	// every metadata server response and serves the cached one when the metadata
+	// server can't be reached, as long as it's not older than FallbackMaxStaleness.
+	// Disabled if it's empty or zero.
+	FallbackMaxStaleness string `ini:"fallback_max_staleness,omitempty"`
+	// GuestAttributesNamespace is a guest attributes namespace google_authorized_keys
+	// reads additional SSH keys from, merged after project keys. Guest attributes are
+	// writable from within the VM, so anything able to write them can grant SSH access,
+	// a local privilege escalation path: they are ignored for root and members of
+	// privileged groups, the other users remain exposed. Disabled if empty.
+	GuestAttributesNamespace string `ini:"guest_attributes_namespace,omitempty"`
+	// MetadataTimeout is a duration string capping the time google_authorized_keys
+	// waits for the metadata server, so a slow metadata server doesn't stall SSH
+	// logins. The metadata client's own timeouts apply if it's empty or zero.
+	MetadataTimeout string `ini:"metadata_timeout,omitempty"`
+}
+
 // Daemons contains the configurations of Daemons section.
 type Daemons struct {
 	AccountsDaemon  bool `ini:"accounts_daemon,omitempty"`
@@ -225,9 +383,25 @@ type Diagnostics struct {
 
 // IPForwarding contains the configurations of IPForwarding section.
 type IPForwarding struct {
-	EthernetProtoID   string `ini:"ethernet_proto_id,omitempty"`
-	IPAliases         bool   `ini:"ip_aliases,omitempty"`
-	TargetInstanceIPs bool   `ini:"target_instance_ips,omitempty"`
+	EthernetProtoID string `ini:"ethernet_proto_id,omitempty"`
+	IPAliases       bool   `ini:"ip_aliases,omitempty"`
+	// RemoveUnmanagedIPs makes the address manager fully reconcile the forwarded IPs, removing any
+	// configured IP not specified in metadata. If false, only IPs added by the address manager
+	// itself are removed and IPs added out of band are left untouched.
+	RemoveUnmanagedIPs bool `ini:"remove_unmanaged_ips,omitempty"`
+	TargetInstanceIPs  bool `ini:"target_instance_ips,omitempty"`
+}
+
+// HealthCheck contains the configurations of HealthCheck section.
+type HealthCheck struct {
+	// Enabled toggles the localhost health check HTTP listener.
+	Enabled bool `ini:"enabled,omitempty"`
+
+	// Port is the localhost TCP port the health check listener binds to.
+	Port int `ini:"port,omitempty"`
+
+	// Path is the HTTP path serving the health report.
+	Path string `ini:"path,omitempty"`
 }
 
 // Instance contains the configurations of Instance section.
@@ -261,11 +435,96 @@ type MetadataScripts struct {
 	Startup           bool   `ini:"startup,omitempty"`
 	StartupWindows    bool   `ini:"startup-windows,omitempty"`
 	SysprepSpecialize bool   `ini:"sysprep_specialize,omitempty"`
+	// ScriptConcurrency is the maximum number of metadata scripts run at the same
+	// time, scripts are run sequentially, in order, when it's 1 or less.
+	ScriptConcurrency int `ini:"script_concurrency,omitempty"`
+	// ScriptInterpreters is a comma separated list of extension=command entries
+	// defining the interpreter scripts with the given extension are run with. On
+	// Windows the windows-startup-script-<extension> keys, and alike, are run for
+	// each configured extension, as are bare keys whose shebang refers to one.
+	ScriptInterpreters string `ini:"script_interpreters,omitempty"`
+	// SpecializeSteps is the comma separated, ordered list of steps run by the
+	// specialize action. user-scripts runs the sysprep-specialize scripts, see
+	// the metadata script runner for the supported built-in steps. Omitting
+	// user-scripts skips the sysprep-specialize scripts, a warning is logged.
+	SpecializeSteps string `ini:"specialize_steps,omitempty"`
+	// WaitForAccounts makes the startup scripts wait for the guest agent to report, over the
+	// command monitor, that users are provisioned before running.
+	WaitForAccounts bool `ini:"wait_for_accounts,omitempty"`
+	// WaitForAccountsTimeout is a duration string defining for how long startup scripts wait
+	// for users to be provisioned, scripts are run anyway once it expires.
+	WaitForAccountsTimeout string `ini:"wait_for_accounts_timeout,omitempty"`
+	// MaxScriptSize is the maximum size, in bytes, of the scripts downloaded from
+	// -url metadata keys, larger scripts fail to download. Zero means no limit.
+	MaxScriptSize int64 `ini:"max_script_size,omitempty"`
+	// MaxLogLineLength is the maximum length, in bytes, of the script output lines
+	// logged, longer lines are truncated.
+	MaxLogLineLength int `ini:"max_log_line_length,omitempty"`
+	// CrossHostRedirects allows script downloads to follow redirects to a host other
+	// than the one of the -url metadata key.
+	CrossHostRedirects bool `ini:"cross_host_redirects,omitempty"`
+	// StartupTimeout is a duration string limiting for how long each startup script
+	// runs, scripts still running are killed. Empty means no limit.
+	StartupTimeout string `ini:"startup_timeout,omitempty"`
+	// ShutdownTimeout is a duration string limiting for how long each shutdown
+	// script runs, including windows-shutdown ones, scripts still running are
+	// killed so the instance can power off. Empty means no limit.
+	ShutdownTimeout string `ini:"shutdown_timeout,omitempty"`
+	// RunAsUser is the user metadata scripts are run as, the script runner's
+	// user if empty. Not supported on Windows.
+	RunAsUser string `ini:"run_as_user,omitempty"`
+	// RunAsGroup is the group metadata scripts are run as, RunAsUser's primary
+	// group if empty. Requires RunAsUser.
+	RunAsGroup string `ini:"run_as_group,omitempty"`
+	// RunOnce makes startup scripts run only once per script content, as if their
+	// <key>-run-once metadata attribute was set to true. Scripts are recorded as
+	// run when they start, failed ones aren't run again.
+	RunOnce bool `ini:"run_once,omitempty"`
+	// SummaryPath is the file a JSON summary of the scripts run, with their exit
+	// code, duration and error, is written to. Not written if empty.
+	SummaryPath string `ini:"summary_path,omitempty"`
+	// SummaryGuestAttribute makes the script runner write the JSON summary to the
+	// metadata-scripts/<action>-summary guest attribute.
+	SummaryGuestAttribute bool `ini:"summary_guest_attribute,omitempty"`
+	// DownloadProxy is the URL of the proxy -url scripts are downloaded through
+	// over HTTP(S), the HTTP_PROXY and HTTPS_PROXY environment variables are
+	// honored if empty.
+	DownloadProxy string `ini:"download_proxy,omitempty"`
+}
+
+// MetadataHosts contains the configurations of MetadataHosts section.
+type MetadataHosts struct {
+	// Enabled makes the guest agent add the metadata server's host names to the
+	// hosts file, the entry is removed if it's disabled.
+	Enabled bool `ini:"enabled,omitempty"`
+	// HostnameEntry makes the guest agent map the instance's fqdn and hostname, as
+	// defined in metadata, to 127.0.1.1 in the hosts file. The entry is updated
+	// when the hostname changes and removed if it's disabled.
+	HostnameEntry bool `ini:"hostname_entry,omitempty"`
 }
 
 // OSLogin contains the configurations of OSLogin section.
 type OSLogin struct {
 	CertAuthentication bool `ini:"cert_authentication,omitempty"`
+	// TrustedCAPipePath is the named pipe sshd reads the trusted user CA keys from,
+	// it's both created by the guest agent and set as sshd's TrustedUserCAKeys.
+	TrustedCAPipePath string `ini:"trusted_ca_pipe_path,omitempty"`
+	// TrustedCAPipeMode is the octal permission mode the trusted CA pipe is created with.
+	TrustedCAPipeMode string `ini:"trusted_ca_pipe_mode,omitempty"`
+	// SudoersDir is the directory OS Login users' sudoers files are kept in, it's
+	// included by the OS Login sudoers file.
+	SudoersDir string `ini:"sudoers_dir,omitempty"`
+	// UsersDir is the directory OS Login users' data is kept in.
+	UsersDir string `ini:"users_dir,omitempty"`
+	// SSHDReloadCmd is the command run to make sshd reload its configuration, if
+	// empty sshd is reloaded with systemctl.
+	SSHDReloadCmd string `ini:"sshd_reload_cmd,omitempty"`
+	// PAMOSLoginAuth, PAMGroupAuth and PAMMkHomeDirSession override the pam_oslogin_login.so,
+	// pam_group.so and pam_mkhomedir.so lines added to pam.d/sshd, the OS specific
+	// defaults are used if empty.
+	PAMOSLoginAuth      string `ini:"pam_oslogin_auth,omitempty"`
+	PAMGroupAuth        string `ini:"pam_group_auth,omitempty"`
+	PAMMkHomeDirSession string `ini:"pam_mkhomedir_session,omitempty"`
 }
 
 // MDS contains the configurations for MDS section. Currently its opt-in only
@@ -279,6 +538,23 @@ type MDS struct {
 	// Root certificate where as its trust store that hosts root certs like
 	// `/etc/pki/ca-trust/extracted/pem/tls-ca-bundle.pem` on Linux.
 	HTTPSMDSEnableNativeStore bool `ini:"enable-https-mds-native-cert-store,omitempty"`
+	// PreferIPv6 makes the metadata server be reached on its IPv6 address and
+	// network readiness probes use IPv6, for IPv6-only instances.
+	PreferIPv6 bool `ini:"prefer-ipv6,omitempty"`
+}
+
+// ResolvConf contains the configurations of ResolvConf section.
+type ResolvConf struct {
+	// Enabled makes the guest agent keep Nameservers and Search in resolv.conf,
+	// re-applying them after network setup. The managed block is removed if it's
+	// disabled. A symlinked resolv.conf, i.e. to systemd-resolved's stub, is left alone.
+	Enabled bool `ini:"enabled,omitempty"`
+	// Nameservers is a comma separated list of name server IP addresses, they take
+	// precedence over the name servers set by the network managers.
+	Nameservers string `ini:"nameservers,omitempty"`
+	// Search is a comma separated list of DNS search domains, it replaces the
+	// search list set by the network managers.
+	Search string `ini:"search,omitempty"`
 }
 
 // NetworkInterfaces contains the configurations of NetworkInterfaces section.
@@ -288,6 +564,23 @@ type NetworkInterfaces struct {
 	Setup                        bool   `ini:"setup,omitempty"`
 	ManagePrimaryNIC             bool   `ini:"manage_primary_nic,omitempty"`
 	RestoreDebian12NetplanConfig bool   `ini:"restore_debian12_netplan_config,omitempty"`
+	ExcludeInterfaces            string `ini:"exclude_interfaces,omitempty"`
+	ExcludeInterfaceMACs         string `ini:"exclude_interface_macs,omitempty"`
+	MTUOverrides                 string `ini:"mtu_overrides,omitempty"`
+	Ubuntu1804NetplanDropin      bool   `ini:"ubuntu1804_netplan_dropin,omitempty"`
+
+	// PrimaryNICUseDomains determines if the domains provided by DHCP are used as
+	// DNS search domains over the primary NIC. If unset the network manager's
+	// previous behavior is kept.
+	PrimaryNICUseDomains *bool `ini:"primary_nic_use_domains,omitempty"`
+	// SecondaryNICUseDomains determines if the domains provided by DHCP are used
+	// as DNS search domains over the secondary NICs. If unset the network
+	// manager's previous behavior is kept.
+	SecondaryNICUseDomains *bool `ini:"secondary_nic_use_domains,omitempty"`
+	// DHCPv6ReleaseDelay is the number of seconds an interface must be seen no
+	// longer IPv6 for before dhclient releases its DHCPv6 lease. The delay starts
+	// over when the agent restarts. Zero releases it right away.
+	DHCPv6ReleaseDelay int `ini:"dhcpv6_release_delay,omitempty"`
 }
 
 // Snapshots contains the configurations of Snapshots section.
@@ -298,6 +591,13 @@ type Snapshots struct {
 	TimeoutInSeconds    int    `ini:"timeout_in_seconds,omitempty"`
 }
 
+// Telemetry contains the configurations of Telemetry section.
+type Telemetry struct {
+	// OmitFields is a comma separated list of telemetry fields not to be reported, i.e.
+	// agent_version,os_version. Telemetry is still reported with the remaining fields.
+	OmitFields string `ini:"omit_fields,omitempty"`
+}
+
 // Unstable contains the configurations of Unstable section. No long term stability or support
 // is guaranteed for configurations defined in the Unstable section. By default all flags defined
 // in this section is disabled and is intended to isolate under development features.
@@ -309,6 +609,38 @@ type Unstable struct {
 	CommandPipeGroup      string `ini:"command_pipe_group,omitempty"`
 	VlanSetupEnabled      bool   `ini:"vlan_setup_enabled,omitempty"`
 	SystemdConfigDir      string `ini:"systemd_config_dir,omitempty"`
+	// MDSProxyEnabled enables the mds.get command, giving the command monitor
+	// callers read access to the metadata server through the guest agent. Service
+	// account tokens, identity tokens and instance credentials are never served.
+	MDSProxyEnabled bool `ini:"mds_proxy_enabled,omitempty"`
+	// CommandShutdownGracePeriod is the time in-flight command requests are given
+	// to complete when the command monitor is stopped.
+	CommandShutdownGracePeriod string `ini:"command_shutdown_grace_period,omitempty"`
+	// CommandMaxRequestSize is the maximum size in bytes of a command request, 0
+	// means no limit.
+	CommandMaxRequestSize int `ini:"command_max_request_size,omitempty"`
+	// CommandAuthEnabled makes the command monitor reject requests without the
+	// token the agent writes to CommandTokenPath at startup.
+	CommandAuthEnabled bool `ini:"command_auth_enabled,omitempty"`
+	// CommandTokenPath is the path of the command authentication token, the
+	// platform's default if empty.
+	CommandTokenPath string `ini:"command_token_path,omitempty"`
+}
+
+// WorkloadCertificates contains the configurations of WorkloadCertificates section.
+type WorkloadCertificates struct {
+	// ContentDirPrefix is the prefix of the directories certificates are written to on
+	// each refresh, as <prefix>-<time>.
+	ContentDirPrefix string `ini:"content_dir_prefix,omitempty"`
+	// TempSymlinkPrefix is the prefix of the temporary symlinks created on each refresh,
+	// before they're renamed to Symlink.
+	TempSymlinkPrefix string `ini:"temp_symlink_prefix,omitempty"`
+	// Symlink points to the directory with the current certificates.
+	Symlink string `ini:"symlink,omitempty"`
+	// Layout is the credentials files layout. "gce" writes certificates.pem,
+	// private_key.pem and ca_certificates.pem, "spiffe" additionally links them
+	// as svid.pem, svid_key.pem and bundle.pem.
+	Layout string `ini:"layout,omitempty"`
 }
 
 // WSFC contains the configurations of WSFC section.
@@ -318,6 +650,18 @@ type WSFC struct {
 	Port      string `ini:"port,omitempty"`
 }
 
+// SplitList splits a comma separated configuration value, ignoring empty entries
+// and surrounding spaces.
+func SplitList(value string) []string {
+	var res []string
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			res = append(res, entry)
+		}
+	}
+	return res
+}
+
 func defaultConfigFile(osName string) string {
 	if osName == "windows" {
 		return winConfigPath
@@ -342,6 +686,19 @@ func defaultDataSources(extraDefaults []byte) []interface{} {
 
 // Load loads default configuration and the configuration from default config files.
 func Load(extraDefaults []byte) error {
+	sections, err := Parse(extraDefaults)
+	if err != nil {
+		return err
+	}
+
+	Set(sections)
+	return nil
+}
+
+// Parse loads default configuration and the configuration from default config files
+// without making it the current configuration, allowing callers to inspect it before
+// calling Set().
+func Parse(extraDefaults []byte) (*Sections, error) {
 	opts := ini.LoadOptions{
 		Loose:       true,
 		Insensitive: true,
@@ -350,23 +707,28 @@ func Load(extraDefaults []byte) error {
 	sources := dataSources(extraDefaults)
 	cfg, err := ini.LoadSources(opts, sources[0], sources[1:]...)
 	if err != nil {
-		return fmt.Errorf("failed to load configuration: %+v", err)
+		return nil, fmt.Errorf("failed to load configuration: %+v", err)
 	}
 
 	sections := new(Sections)
 	if err := cfg.MapTo(sections); err != nil {
-		return fmt.Errorf("failed to map configuration to object: %+v", err)
+		return nil, fmt.Errorf("failed to map configuration to object: %+v", err)
 	}
 
-	instance = sections
-	return nil
+	return sections, nil
+}
+
+// Set makes sections the current configuration returned by Get().
+func Set(sections *Sections) {
+	instance.Store(sections)
 }
 
 // Get returns the configuration's instance previously loaded with Load().
 func Get() *Sections {
-	if instance == nil {
+	sections := instance.Load()
+	if sections == nil {
 		panic("cfg package was not initialized, Load() " +
 			"should be called in the early initialization code path")
 	}
-	return instance
+	return sections
 }
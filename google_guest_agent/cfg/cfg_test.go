@@ -15,6 +15,7 @@
 package cfg
 
 import (
+	"reflect"
 	"testing"
 )
 
@@ -33,6 +34,35 @@ func TestLoad(t *testing.T) {
 	}
 }
 
+func TestParseAndSet(t *testing.T) {
+	if err := Load(nil); err != nil {
+		t.Fatalf("Failed to load configuration: %+v", err)
+	}
+	current := Get()
+
+	sections, err := Parse([]byte("[Accounts]\ndeprovision_remove = true"))
+	if err != nil {
+		t.Fatalf("Parse() failed unexpectedly with error: %+v", err)
+	}
+
+	if Get() != current {
+		t.Errorf("Parse() replaced the current configuration, want it unchanged")
+	}
+
+	if !sections.Accounts.DeprovisionRemove {
+		t.Errorf("Parse() returned Accounts.deprovision_remove: false, want: true")
+	}
+
+	Set(sections)
+	if Get() != sections {
+		t.Errorf("Set() didn't replace the current configuration")
+	}
+
+	if err := Load(nil); err != nil {
+		t.Fatalf("Failed to load configuration: %+v", err)
+	}
+}
+
 func TestInvalidConfig(t *testing.T) {
 	invalidConfig := `
 [Section
@@ -94,3 +124,23 @@ func TestGetTwice(t *testing.T) {
 		t.Errorf("Get() should return always the same pointer, expected: %p, got: %p", firstCfg, secondCfg)
 	}
 }
+
+func TestSplitList(t *testing.T) {
+	tests := []struct {
+		value string
+		want  []string
+	}{
+		{value: "", want: nil},
+		{value: " , ,", want: nil},
+		{value: "eth1", want: []string{"eth1"}},
+		{value: " 10.0.0.2, 10.0.0.3 ,,", want: []string{"10.0.0.2", "10.0.0.3"}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.value, func(t *testing.T) {
+			if got := SplitList(tc.value); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("SplitList(%q) = %q, want %q", tc.value, got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,347 @@
+//  Copyright 2024 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package cfg
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// maxPasswordCharacterClasses is the number of character classes a generated
+	// Windows password can draw from: lower case, upper case, digits and special.
+	maxPasswordCharacterClasses = 4
+	// maxPort is the highest valid TCP port.
+	maxPort = 65535
+)
+
+// Validate checks the configuration for out-of-range values and contradictory
+// options. All the problems found are reported at once, each error names the
+// offending section, lower cased, and key.
+func (s *Sections) Validate() error {
+	return s.validate(func(string) bool { return true })
+}
+
+// ValidateSections is like Validate but only checks the named sections, lower
+// cased as in the errors, i.e. "metadatascripts". Binaries validate the sections
+// they use so an unrelated bad option doesn't stop them.
+func (s *Sections) ValidateSections(names ...string) error {
+	return s.validate(func(name string) bool { return slices.Contains(names, name) })
+}
+
+func (s *Sections) validate(wanted func(name string) bool) error {
+	var errs []error
+
+	if s.Core != nil && wanted("core") {
+		errs = append(errs, s.Core.validate()...)
+	}
+	if s.Accounts != nil && wanted("accounts") {
+		errs = append(errs, s.Accounts.validate()...)
+	}
+	if s.AuthorizedKeys != nil && wanted("authorizedkeys") {
+		errs = append(errs, s.AuthorizedKeys.validate()...)
+	}
+	if s.HealthCheck != nil && wanted("healthcheck") {
+		errs = append(errs, s.HealthCheck.validate()...)
+	}
+	if s.MDS != nil && wanted("mds") {
+		errs = append(errs, s.MDS.validate()...)
+	}
+	if s.OSLogin != nil && wanted("oslogin") {
+		errs = append(errs, s.OSLogin.validate()...)
+	}
+	if s.MetadataScripts != nil && wanted("metadatascripts") {
+		errs = append(errs, s.MetadataScripts.validate(s.Unstable)...)
+	}
+	if s.NetworkInterfaces != nil && wanted("networkinterfaces") {
+		errs = append(errs, s.NetworkInterfaces.validate()...)
+	}
+	if s.ResolvConf != nil && wanted("resolvconf") {
+		errs = append(errs, s.ResolvConf.validate()...)
+	}
+	if s.Snapshots != nil && wanted("snapshots") {
+		errs = append(errs, s.Snapshots.validate()...)
+	}
+	if s.Unstable != nil && wanted("unstable") {
+		errs = append(errs, s.Unstable.validate()...)
+	}
+	if s.WorkloadCertificates != nil && wanted("workloadcertificates") {
+		errs = append(errs, s.WorkloadCertificates.validate()...)
+	}
+
+	return errors.Join(errs...)
+}
+
+func (c *Core) validate() []error {
+	var errs []error
+	if c.LogBufferSize < 0 {
+		errs = append(errs, fmt.Errorf("core: log_buffer_size must not be negative, got %d", c.LogBufferSize))
+	}
+	if _, err := parseDuration(c.LogRateLimitInterval); err != nil {
+		errs = append(errs, fmt.Errorf("core: invalid log_rate_limit_interval: %w", err))
+	}
+	for _, trigger := range strings.Split(c.ResumeTriggers, ",") {
+		trigger = strings.TrimSpace(trigger)
+		if trigger != "" && trigger != "clock" && trigger != "drift-token" {
+			errs = append(errs, fmt.Errorf("core: resume_triggers must only list clock and drift-token, got %q", trigger))
+		}
+	}
+	return errs
+}
+
+func (a *Accounts) validate() []error {
+	var errs []error
+	if a.WindowsPasswordCharacterClasses < 1 || a.WindowsPasswordCharacterClasses > maxPasswordCharacterClasses {
+		errs = append(errs, fmt.Errorf("accounts: windows_password_character_classes must be between 1 and %d, got %d",
+			maxPasswordCharacterClasses, a.WindowsPasswordCharacterClasses))
+	}
+	if a.WindowsPasswordLength < a.WindowsPasswordCharacterClasses {
+		errs = append(errs, fmt.Errorf("accounts: windows_password_length %d is lower than windows_password_character_classes %d",
+			a.WindowsPasswordLength, a.WindowsPasswordCharacterClasses))
+	}
+	var perUser, badToken bool
+	for i := 0; i < len(a.AuthorizedKeysFile); i++ {
+		if a.AuthorizedKeysFile[i] != '%' {
+			continue
+		}
+		if i++; i == len(a.AuthorizedKeysFile) || !strings.ContainsRune("hu%", rune(a.AuthorizedKeysFile[i])) {
+			errs = append(errs, fmt.Errorf("accounts: authorized_keys_file %q only supports the %%h, %%u and %%%% tokens", a.AuthorizedKeysFile))
+			badToken = true
+			break
+		}
+		perUser = perUser || a.AuthorizedKeysFile[i] != '%'
+	}
+	// Relative paths are within each user's home directory, absolute ones must
+	// not be shared by all users, each user's update would overwrite the others'.
+	if !badToken && !perUser && path.IsAbs(a.AuthorizedKeysFile) {
+		errs = append(errs, fmt.Errorf("accounts: authorized_keys_file %q must contain the %%h or %%u token, it would be shared by all users", a.AuthorizedKeysFile))
+	}
+	if _, err := parseDuration(a.KeyExpirationSweepInterval); err != nil {
+		errs = append(errs, fmt.Errorf("accounts: invalid key_expiration_sweep_interval: %w", err))
+	}
+	return errs
+}
+
+func (a *AuthorizedKeys) validate() []error {
+	var errs []error
+	ttl, err := parseDuration(a.CacheTTL)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("authorizedkeys: invalid cache_ttl: %w", err))
+	} else if ttl > 0 && a.CachePath == "" {
+		errs = append(errs, fmt.Errorf("authorizedkeys: cache_ttl is %s but cache_path is empty", ttl))
+	}
+	staleness, err := parseDuration(a.FallbackMaxStaleness)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("authorizedkeys: invalid fallback_max_staleness: %w", err))
+	} else if staleness > 0 && a.CachePath == "" {
+		errs = append(errs, fmt.Errorf("authorizedkeys: fallback_max_staleness is %s but cache_path is empty", staleness))
+	}
+	if _, err := parseDuration(a.MetadataTimeout); err != nil {
+		errs = append(errs, fmt.Errorf("authorizedkeys: invalid metadata_timeout: %w", err))
+	}
+	if strings.ContainsAny(a.GuestAttributesNamespace, "/ ") {
+		errs = append(errs, fmt.Errorf("authorizedkeys: guest_attributes_namespace %q must be a single path component", a.GuestAttributesNamespace))
+	}
+	return errs
+}
+
+func (h *HealthCheck) validate() []error {
+	if !h.Enabled {
+		return nil
+	}
+
+	var errs []error
+	if h.Port < 1 || h.Port > maxPort {
+		errs = append(errs, fmt.Errorf("healthcheck: port must be between 1 and %d, got %d", maxPort, h.Port))
+	}
+	if !strings.HasPrefix(h.Path, "/") {
+		errs = append(errs, fmt.Errorf("healthcheck: path must start with \"/\", got %q", h.Path))
+	}
+	return errs
+}
+
+func (m *MDS) validate() []error {
+	if m.DisableHTTPSMdsSetup && m.HTTPSMDSEnableNativeStore {
+		return []error{fmt.Errorf("mds: enable-https-mds-native-cert-store requires disable-https-mds-setup to be false")}
+	}
+	return nil
+}
+
+func (m *MetadataScripts) validate(unstable *Unstable) []error {
+	var errs []error
+	if m.ScriptConcurrency < 0 {
+		errs = append(errs, fmt.Errorf("metadatascripts: script_concurrency must not be negative, got %d", m.ScriptConcurrency))
+	}
+	if m.MaxScriptSize < 0 {
+		errs = append(errs, fmt.Errorf("metadatascripts: max_script_size must not be negative, got %d", m.MaxScriptSize))
+	}
+	if m.MaxLogLineLength <= 0 {
+		errs = append(errs, fmt.Errorf("metadatascripts: max_log_line_length must be positive, got %d", m.MaxLogLineLength))
+	}
+	if _, err := parseDuration(m.WaitForAccountsTimeout); err != nil {
+		errs = append(errs, fmt.Errorf("metadatascripts: invalid wait_for_accounts_timeout: %w", err))
+	}
+	if _, err := parseDuration(m.StartupTimeout); err != nil {
+		errs = append(errs, fmt.Errorf("metadatascripts: invalid startup_timeout: %w", err))
+	}
+	if _, err := parseDuration(m.ShutdownTimeout); err != nil {
+		errs = append(errs, fmt.Errorf("metadatascripts: invalid shutdown_timeout: %w", err))
+	}
+	if m.DownloadProxy != "" {
+		if u, err := url.Parse(m.DownloadProxy); err != nil || u.Scheme == "" || u.Host == "" {
+			errs = append(errs, fmt.Errorf("metadatascripts: download_proxy must be a URL with scheme and host, got %q", m.DownloadProxy))
+		}
+	}
+	if m.RunAsGroup != "" && m.RunAsUser == "" {
+		errs = append(errs, fmt.Errorf("metadatascripts: run_as_group requires run_as_user"))
+	}
+	if m.WaitForAccounts && (unstable == nil || !unstable.CommandMonitorEnabled) {
+		errs = append(errs, fmt.Errorf("metadatascripts: wait_for_accounts requires Unstable command_monitor_enabled"))
+	}
+	return errs
+}
+
+func (n *NetworkInterfaces) validate() []error {
+	if n.DHCPv6ReleaseDelay < 0 {
+		return []error{fmt.Errorf("networkinterfaces: dhcpv6_release_delay must not be negative, got %d", n.DHCPv6ReleaseDelay)}
+	}
+	return nil
+}
+
+func (o *OSLogin) validate() []error {
+	var errs []error
+	if o.CertAuthentication && o.TrustedCAPipePath == "" {
+		errs = append(errs, fmt.Errorf("oslogin: cert_authentication requires trusted_ca_pipe_path"))
+	}
+	if o.TrustedCAPipePath != "" && !filepath.IsAbs(o.TrustedCAPipePath) {
+		errs = append(errs, fmt.Errorf("oslogin: trusted_ca_pipe_path must be an absolute path, got %q", o.TrustedCAPipePath))
+	}
+	if o.TrustedCAPipeMode != "" && !isOctalMode(o.TrustedCAPipeMode) {
+		errs = append(errs, fmt.Errorf("oslogin: trusted_ca_pipe_mode must be an octal permission mode, got %q", o.TrustedCAPipeMode))
+	}
+	if o.SudoersDir != "" && !filepath.IsAbs(o.SudoersDir) {
+		errs = append(errs, fmt.Errorf("oslogin: sudoers_dir must be an absolute path, got %q", o.SudoersDir))
+	}
+	if o.UsersDir != "" && !filepath.IsAbs(o.UsersDir) {
+		errs = append(errs, fmt.Errorf("oslogin: users_dir must be an absolute path, got %q", o.UsersDir))
+	}
+	return errs
+}
+
+func (r *ResolvConf) validate() []error {
+	var errs []error
+	for _, ns := range strings.Split(r.Nameservers, ",") {
+		ns = strings.TrimSpace(ns)
+		if ns != "" && net.ParseIP(ns) == nil {
+			errs = append(errs, fmt.Errorf("resolvconf: nameservers must be IP addresses, got %q", ns))
+		}
+	}
+	for _, domain := range strings.Split(r.Search, ",") {
+		domain = strings.TrimSpace(domain)
+		if strings.ContainsAny(domain, " \t#;") {
+			errs = append(errs, fmt.Errorf("resolvconf: invalid search domain %q", domain))
+		}
+	}
+	return errs
+}
+
+func (s *Snapshots) validate() []error {
+	if !s.Enabled {
+		return nil
+	}
+
+	var errs []error
+	if net.ParseIP(s.SnapshotServiceIP) == nil {
+		errs = append(errs, fmt.Errorf("snapshots: invalid snapshot_service_ip %q", s.SnapshotServiceIP))
+	}
+	if s.SnapshotServicePort < 1 || s.SnapshotServicePort > maxPort {
+		errs = append(errs, fmt.Errorf("snapshots: snapshot_service_port must be between 1 and %d, got %d", maxPort, s.SnapshotServicePort))
+	}
+	if s.TimeoutInSeconds <= 0 {
+		errs = append(errs, fmt.Errorf("snapshots: timeout_in_seconds must be positive, got %d", s.TimeoutInSeconds))
+	}
+	return errs
+}
+
+func (u *Unstable) validate() []error {
+	var errs []error
+	timeout, err := parseDuration(u.CommandRequestTimeout)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("unstable: invalid command_request_timeout: %w", err))
+	} else if u.CommandMonitorEnabled && timeout == 0 {
+		errs = append(errs, fmt.Errorf("unstable: command_request_timeout must be positive when command_monitor_enabled is set"))
+	}
+
+	if _, err := parseDuration(u.CommandShutdownGracePeriod); err != nil {
+		errs = append(errs, fmt.Errorf("unstable: invalid command_shutdown_grace_period: %w", err))
+	}
+
+	if u.CommandMaxRequestSize < 0 {
+		errs = append(errs, fmt.Errorf("unstable: command_max_request_size must not be negative, got %d", u.CommandMaxRequestSize))
+	}
+
+	if u.CommandPipeMode != "" && !isOctalMode(u.CommandPipeMode) {
+		errs = append(errs, fmt.Errorf("unstable: command_pipe_mode must be an octal permission mode, got %q", u.CommandPipeMode))
+	}
+	return errs
+}
+
+func (w *WorkloadCertificates) validate() []error {
+	var errs []error
+	paths := []struct{ key, path string }{
+		{"content_dir_prefix", w.ContentDirPrefix},
+		{"temp_symlink_prefix", w.TempSymlinkPrefix},
+		{"symlink", w.Symlink},
+	}
+	for _, p := range paths {
+		if p.path != "" && !filepath.IsAbs(p.path) {
+			errs = append(errs, fmt.Errorf("workloadcertificates: %s must be an absolute path, got %q", p.key, p.path))
+		}
+	}
+	if w.Layout != "" && w.Layout != "gce" && w.Layout != "spiffe" {
+		errs = append(errs, fmt.Errorf("workloadcertificates: layout must be gce or spiffe, got %q", w.Layout))
+	}
+	return errs
+}
+
+// isOctalMode returns true if s is an octal file permission mode, i.e. 0644.
+func isOctalMode(s string) bool {
+	mode, err := strconv.ParseUint(s, 8, 32)
+	return err == nil && mode <= 0777
+}
+
+// parseDuration parses an optional, non negative, duration string. Empty
+// strings are parsed as zero.
+func parseDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("duration %q must not be negative", s)
+	}
+	return d, nil
+}
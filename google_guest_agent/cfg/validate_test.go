@@ -0,0 +1,296 @@
+//  Copyright 2024 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package cfg
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		wantErr []string
+	}{
+		{
+			name: "defaults",
+		},
+		{
+			name:    "password_classes_out_of_range",
+			config:  "[Accounts]\nwindows_password_character_classes = 5",
+			wantErr: []string{"windows_password_character_classes"},
+		},
+		{
+			name:    "invalid_log_rate_limit_interval",
+			config:  "[Core]\nlog_rate_limit_interval = often",
+			wantErr: []string{"log_rate_limit_interval"},
+		},
+		{
+			name:    "password_shorter_than_classes",
+			config:  "[Accounts]\nwindows_password_length = 2",
+			wantErr: []string{"windows_password_length"},
+		},
+		{
+			name:    "cache_ttl_without_path",
+			config:  "[AuthorizedKeys]\ncache_path =\ncache_ttl = 5m",
+			wantErr: []string{"cache_path is empty"},
+		},
+		{
+			name:    "negative_cache_ttl",
+			config:  "[AuthorizedKeys]\ncache_ttl = -5m",
+			wantErr: []string{"cache_ttl"},
+		},
+		{
+			name:   "download_proxy",
+			config: "[MetadataScripts]\ndownload_proxy = http://proxy.example.com:3128",
+		},
+		{
+			name:    "invalid_download_proxy",
+			config:  "[MetadataScripts]\ndownload_proxy = proxy.example.com",
+			wantErr: []string{"download_proxy"},
+		},
+		{
+			name:    "run_as_group_without_user",
+			config:  "[MetadataScripts]\nrun_as_group = nogroup",
+			wantErr: []string{"run_as_group"},
+		},
+		{
+			name:    "invalid_resume_trigger",
+			config:  "[Core]\nresume_triggers = clock,suspend",
+			wantErr: []string{"resume_triggers"},
+		},
+		{
+			name:    "negative_dhcpv6_release_delay",
+			config:  "[NetworkInterfaces]\ndhcpv6_release_delay = -1",
+			wantErr: []string{"dhcpv6_release_delay"},
+		},
+		{
+			name:    "negative_log_buffer_size",
+			config:  "[Core]\nlog_buffer_size = -1",
+			wantErr: []string{"log_buffer_size"},
+		},
+		{
+			name:    "zero_max_log_line_length",
+			config:  "[MetadataScripts]\nmax_log_line_length = 0",
+			wantErr: []string{"max_log_line_length"},
+		},
+		{
+			name:    "fallback_without_cache_path",
+			config:  "[AuthorizedKeys]\ncache_path =\nfallback_max_staleness = 1h",
+			wantErr: []string{"fallback_max_staleness"},
+		},
+		{
+			name:    "invalid_authorized_keys_metadata_timeout",
+			config:  "[AuthorizedKeys]\nmetadata_timeout = fast",
+			wantErr: []string{"metadata_timeout"},
+		},
+		{
+			name:    "invalid_guest_attributes_namespace",
+			config:  "[AuthorizedKeys]\nguest_attributes_namespace = ssh/keys",
+			wantErr: []string{"guest_attributes_namespace"},
+		},
+		{
+			name:    "health_check_invalid",
+			config:  "[HealthCheck]\nenabled = true\nport = 70000\npath = health",
+			wantErr: []string{"healthcheck: port", "healthcheck: path"},
+		},
+		{
+			name:   "health_check_disabled",
+			config: "[HealthCheck]\nenabled = false\nport = 70000",
+		},
+		{
+			name:    "native_store_without_mtls",
+			config:  "[MDS]\nenable-https-mds-native-cert-store = true",
+			wantErr: []string{"enable-https-mds-native-cert-store"},
+		},
+		{
+			name:   "native_store_with_mtls",
+			config: "[MDS]\ndisable-https-mds-setup = false\nenable-https-mds-native-cert-store = true",
+		},
+		{
+			name:    "relative_trusted_ca_pipe_path",
+			config:  "[OSLogin]\ntrusted_ca_pipe_path = oslogin_trustedca.pub",
+			wantErr: []string{"trusted_ca_pipe_path"},
+		},
+		{
+			name:    "invalid_trusted_ca_pipe_mode",
+			config:  "[OSLogin]\ntrusted_ca_pipe_mode = rw-r--r--",
+			wantErr: []string{"trusted_ca_pipe_mode"},
+		},
+		{
+			name:    "cert_authentication_without_trusted_ca_pipe",
+			config:  "[OSLogin]\ntrusted_ca_pipe_path =",
+			wantErr: []string{"cert_authentication requires trusted_ca_pipe_path"},
+		},
+		{
+			name:   "no_trusted_ca_pipe_without_cert_authentication",
+			config: "[OSLogin]\ncert_authentication = false\ntrusted_ca_pipe_path =",
+		},
+		{
+			name:    "relative_oslogin_dirs",
+			config:  "[OSLogin]\nsudoers_dir = google-sudoers.d\nusers_dir = google-users.d",
+			wantErr: []string{"sudoers_dir", "users_dir"},
+		},
+		{
+			name:    "negative_script_concurrency",
+			config:  "[MetadataScripts]\nscript_concurrency = -1",
+			wantErr: []string{"script_concurrency"},
+		},
+		{
+			name:    "relative_workload_certificates_paths",
+			config:  "[WorkloadCertificates]\nsymlink = credentials\ncontent_dir_prefix = contents",
+			wantErr: []string{"symlink", "content_dir_prefix"},
+		},
+		{
+			name:    "unknown_workload_certificates_layout",
+			config:  "[WorkloadCertificates]\nlayout = x509",
+			wantErr: []string{"layout"},
+		},
+		{
+			name:    "authorized_keys_file_unsupported_token",
+			config:  "[Accounts]\nauthorized_keys_file = /etc/ssh/keys/%i",
+			wantErr: []string{"authorized_keys_file"},
+		},
+		{
+			name:    "authorized_keys_file_shared",
+			config:  "[Accounts]\nauthorized_keys_file = /etc/ssh/authorized_keys",
+			wantErr: []string{"authorized_keys_file"},
+		},
+		{
+			name:    "authorized_keys_file_shared_literal_percent",
+			config:  "[Accounts]\nauthorized_keys_file = /etc/ssh/%%keys",
+			wantErr: []string{"authorized_keys_file"},
+		},
+		{
+			name:    "authorized_keys_file_incomplete_token",
+			config:  "[Accounts]\nauthorized_keys_file = /etc/ssh/keys/%",
+			wantErr: []string{"authorized_keys_file"},
+		},
+		{
+			name:    "invalid_key_expiration_sweep_interval",
+			config:  "[Accounts]\nkey_expiration_sweep_interval = daily",
+			wantErr: []string{"key_expiration_sweep_interval"},
+		},
+		{
+			name:    "negative_key_expiration_sweep_interval",
+			config:  "[Accounts]\nkey_expiration_sweep_interval = -1m",
+			wantErr: []string{"key_expiration_sweep_interval"},
+		},
+		{
+			name:    "invalid_resolv_conf",
+			config:  "[ResolvConf]\nnameservers = 8.8.8.8, dns.example.com\nsearch = example.com, bad domain",
+			wantErr: []string{"nameservers", "search domain"},
+		},
+		{
+			name:    "negative_max_script_size",
+			config:  "[MetadataScripts]\nmax_script_size = -1",
+			wantErr: []string{"max_script_size"},
+		},
+		{
+			name:    "invalid_script_timeouts",
+			config:  "[MetadataScripts]\nstartup_timeout = forever\nshutdown_timeout = -1s",
+			wantErr: []string{"startup_timeout", "shutdown_timeout"},
+		},
+		{
+			name:    "wait_for_accounts_without_command_monitor",
+			config:  "[MetadataScripts]\nwait_for_accounts = true",
+			wantErr: []string{"wait_for_accounts requires"},
+		},
+		{
+			name:   "wait_for_accounts_with_command_monitor",
+			config: "[MetadataScripts]\nwait_for_accounts = true\n[Unstable]\ncommand_monitor_enabled = true",
+		},
+		{
+			name:    "snapshots_invalid",
+			config:  "[Snapshots]\nenabled = true\nsnapshot_service_ip = metadata\nsnapshot_service_port = 0\ntimeout_in_seconds = 0",
+			wantErr: []string{"snapshot_service_ip", "snapshot_service_port", "timeout_in_seconds"},
+		},
+		{
+			name:    "invalid_command_request_timeout",
+			config:  "[Unstable]\ncommand_request_timeout = abc",
+			wantErr: []string{"command_request_timeout"},
+		},
+		{
+			name:    "zero_command_request_timeout",
+			config:  "[Unstable]\ncommand_monitor_enabled = true\ncommand_request_timeout = 0s",
+			wantErr: []string{"command_request_timeout must be positive"},
+		},
+		{
+			name:    "invalid_command_pipe_mode",
+			config:  "[Unstable]\ncommand_pipe_mode = 0999",
+			wantErr: []string{"command_pipe_mode"},
+		},
+		{
+			name:    "command_pipe_mode_out_of_range",
+			config:  "[Unstable]\ncommand_pipe_mode = 01777",
+			wantErr: []string{"command_pipe_mode"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			dataSources = func(extraDefaults []byte) []interface{} {
+				return []interface{}{[]byte(defaultConfig), []byte(tc.config)}
+			}
+			t.Cleanup(func() { dataSources = defaultDataSources })
+
+			sections, err := Parse(nil)
+			if err != nil {
+				t.Fatalf("Parse(nil) failed unexpectedly with error: %v", err)
+			}
+
+			err = sections.Validate()
+			if len(tc.wantErr) == 0 {
+				if err != nil {
+					t.Fatalf("Validate() = %v, want nil", err)
+				}
+				return
+			}
+
+			if err == nil {
+				t.Fatalf("Validate() = nil, want errors containing %v", tc.wantErr)
+			}
+			for _, want := range tc.wantErr {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("Validate() = %v, want error containing %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateMissingSections(t *testing.T) {
+	if err := new(Sections).Validate(); err != nil {
+		t.Errorf("Validate() on empty sections = %v, want nil", err)
+	}
+}
+
+func TestValidateSections(t *testing.T) {
+	sections := &Sections{
+		HealthCheck:     &HealthCheck{Enabled: true, Port: 0, Path: "/"},
+		MetadataScripts: &MetadataScripts{MaxLogLineLength: 1024},
+	}
+
+	if err := sections.ValidateSections("metadatascripts", "mds"); err != nil {
+		t.Errorf("ValidateSections(metadatascripts, mds) = %v, want nil", err)
+	}
+	if err := sections.ValidateSections("healthcheck"); err == nil || !strings.Contains(err.Error(), "healthcheck: port") {
+		t.Errorf("ValidateSections(healthcheck) = %v, want error containing %q", err, "healthcheck: port")
+	}
+	if err := sections.Validate(); err == nil {
+		t.Errorf("Validate() = nil, want healthcheck error")
+	}
+}
@@ -16,17 +16,61 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 	"runtime"
+	"sync"
 
 	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/command"
 	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/run"
 	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
 )
 
-type clockskewMgr struct{}
+// clockSyncCommand is the command monitor command used to force a clock sync.
+const clockSyncCommand = "clocksync"
 
+type clockskewMgr struct {
+	// mu protects lastSyncedToken, the manager and the clocksync command may
+	// run concurrently.
+	mu sync.Mutex
+	// lastSyncedToken is the drift token seen the last time the clock was
+	// successfully synced.
+	lastSyncedToken int
+}
+
+// clockSyncResponse is the response of the clocksync command.
+type clockSyncResponse struct {
+	command.Response
+	// DriftToken is the drift token currently seen in metadata.
+	DriftToken int
+	// LastSyncedDriftToken is the drift token seen the last time the clock was
+	// successfully synced.
+	LastSyncedDriftToken int
+}
+
+// currentDriftToken returns the drift token of the latest seen metadata, it's
+// safe to call from any goroutine.
+func currentDriftToken() int {
+	mds := latestMetadata.Load()
+	if mds == nil {
+		return 0
+	}
+	return mds.Instance.VirtualClock.DriftToken
+}
+
+// Diff reports a drift if the metadata's drift token doesn't match the one seen
+// on the last successful sync. Unlike comparing with the previous metadata a
+// failed sync is retried on the next run.
 func (a *clockskewMgr) Diff(ctx context.Context) (bool, error) {
-	return oldMetadata.Instance.VirtualClock.DriftToken != newMetadata.Instance.VirtualClock.DriftToken, nil
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.lastSyncedToken != currentDriftToken(), nil
+}
+
+// Name returns the manager's name, see clockskewMgrName.
+func (a *clockskewMgr) Name() string {
+	return clockskewMgrName
 }
 
 func (a *clockskewMgr) Timeout(ctx context.Context) (bool, error) {
@@ -38,7 +82,54 @@ func (a *clockskewMgr) Disabled(ctx context.Context) (bool, error) {
 	return runtime.GOOS == "windows" || !enabled, nil
 }
 
+// Set syncs the system clock and records the drift token it was synced for.
 func (a *clockskewMgr) Set(ctx context.Context) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	token := currentDriftToken()
+	if err := syncClock(ctx); err != nil {
+		return err
+	}
+
+	if a.lastSyncedToken != token {
+		logger.Infof("Clock synced, drift token changed from %d to %d.", a.lastSyncedToken, token)
+	}
+	a.lastSyncedToken = token
+	return nil
+}
+
+// syncCommand returns the handler of the clocksync command, it runs Set()
+// immediately regardless of the drift token and reports the drift tokens.
+func (a *clockskewMgr) syncCommand(ctx context.Context) command.Handler {
+	return func(b []byte) ([]byte, error) {
+		var resp clockSyncResponse
+
+		disabled, err := a.Disabled(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		if disabled {
+			resp.Status = 1
+			resp.StatusMessage = "clock skew daemon is disabled"
+		} else if err := a.Set(ctx); err != nil {
+			resp.Status = 1
+			resp.StatusMessage = fmt.Sprintf("failed to sync clock: %v", err)
+		} else {
+			resp.StatusMessage = "OK"
+		}
+
+		a.mu.Lock()
+		resp.LastSyncedDriftToken = a.lastSyncedToken
+		a.mu.Unlock()
+		resp.DriftToken = currentDriftToken()
+
+		return json.Marshal(resp)
+	}
+}
+
+func syncClock(ctx context.Context) error {
 	if runtime.GOOS == "freebsd" {
 		err := run.Quiet(ctx, "service", "ntpd", "status")
 		if err == nil {
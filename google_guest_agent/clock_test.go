@@ -0,0 +1,83 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/guest-agent/metadata"
+)
+
+func driftMetadata(token int) *metadata.Descriptor {
+	md := &metadata.Descriptor{}
+	md.Instance.VirtualClock.DriftToken = token
+	return md
+}
+
+func TestClockskewDiff(t *testing.T) {
+	tests := []struct {
+		name       string
+		lastSynced int
+		md         *metadata.Descriptor
+		want       bool
+	}{
+		{"no metadata", 0, nil, false},
+		{"no drift token", 0, driftMetadata(0), false},
+		{"new drift token", 0, driftMetadata(1), true},
+		{"already synced", 1, driftMetadata(1), false},
+		{"drift token changed", 1, driftMetadata(2), true},
+	}
+
+	ctx := context.Background()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			latestMetadata.Store(tt.md)
+			mgr := &clockskewMgr{lastSyncedToken: tt.lastSynced}
+
+			got, err := mgr.Diff(ctx)
+			if err != nil {
+				t.Fatalf("clockskewMgr.Diff(ctx) failed unexpectedly with error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("clockskewMgr.Diff(ctx) = %t, want: %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClockSyncCommandDisabled(t *testing.T) {
+	reloadConfig(t, []byte("[Daemons]\nclock_skew_daemon = false"))
+	latestMetadata.Store(driftMetadata(2))
+
+	mgr := &clockskewMgr{lastSyncedToken: 1}
+	b, err := mgr.syncCommand(context.Background())([]byte(`{"Command":"clocksync"}`))
+	if err != nil {
+		t.Fatalf("clocksync handler failed unexpectedly with error: %v", err)
+	}
+
+	var resp clockSyncResponse
+	if err := json.Unmarshal(b, &resp); err != nil {
+		t.Fatalf("json.Unmarshal(%s) failed unexpectedly with error: %v", b, err)
+	}
+
+	if resp.Status == 0 {
+		t.Errorf("clocksync handler returned status 0 with clock skew daemon disabled, want non-zero")
+	}
+	if resp.DriftToken != 2 || resp.LastSyncedDriftToken != 1 {
+		t.Errorf("clocksync handler returned drift tokens (%d, %d), want: (2, 1)", resp.DriftToken, resp.LastSyncedDriftToken)
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package command
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+)
+
+// tokenSize is the number of random bytes of an authentication token.
+const tokenSize = 32
+
+// tokenPath returns the configured authentication token path.
+func tokenPath() string {
+	if path := cfg.Get().Unstable.CommandTokenPath; path != "" {
+		return path
+	}
+	return DefaultTokenPath
+}
+
+// newToken returns a new random authentication token.
+func newToken() (string, error) {
+	b := make([]byte, tokenSize)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// writeToken writes token to path, readable by its owner only. The token is
+// written to a temporary file restricted before the token is written to it, see
+// restrictToOwner, and then renamed over path.
+func writeToken(path, token string) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create directory of %s: %w", path, err)
+	}
+
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+"*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file under %s: %w", dir, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close temporary file %s: %w", tmp.Name(), err)
+	}
+	// Only relevant if we fail before renaming it.
+	defer os.Remove(tmp.Name())
+
+	if err := restrictToOwner(tmp.Name()); err != nil {
+		return fmt.Errorf("failed to restrict access to %s: %w", tmp.Name(), err)
+	}
+	if err := os.WriteFile(tmp.Name(), []byte(token), 0600); err != nil {
+		return fmt.Errorf("failed to write %s: %w", tmp.Name(), err)
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// readToken reads the authentication token written to path.
+func readToken(path string) (string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// validToken compares the request token with the server's in constant time.
+func validToken(got, want string) bool {
+	return subtle.ConstantTimeCompare([]byte(got), []byte(want)) == 1
+}
+
+// addToken returns req with its Token field set to token, the other fields are
+// kept as is.
+func addToken(req []byte, token string) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(req, &fields); err != nil {
+		return nil, err
+	}
+
+	t, err := json.Marshal(token)
+	if err != nil {
+		return nil, err
+	}
+	fields["Token"] = t
+	return json.Marshal(fields)
+}
@@ -0,0 +1,122 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package command
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+)
+
+func TestAddToken(t *testing.T) {
+	got, err := addToken([]byte(`{"Command":"cmd","Data":{"a":1}}`), "token")
+	if err != nil {
+		t.Fatalf("addToken() failed unexpectedly with error: %v", err)
+	}
+
+	var req struct {
+		Request
+		Data map[string]int
+	}
+	if err := json.Unmarshal(got, &req); err != nil {
+		t.Fatalf("json.Unmarshal(%s) failed unexpectedly with error: %v", got, err)
+	}
+	if req.Command != "cmd" || req.Token != "token" || req.Data["a"] != 1 {
+		t.Errorf("addToken() = %s, want the original request with Token \"token\"", got)
+	}
+
+	if _, err := addToken([]byte(`not json`), "token"); err == nil {
+		t.Errorf("addToken(not json) succeeded, want error")
+	}
+}
+
+func TestWriteReadToken(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "run", "commands.token")
+	token, err := newToken()
+	if err != nil {
+		t.Fatalf("newToken() failed unexpectedly with error: %v", err)
+	}
+	if err := writeToken(path, token); err != nil {
+		t.Fatalf("writeToken(%q) failed unexpectedly with error: %v", path, err)
+	}
+
+	got, err := readToken(path)
+	if err != nil {
+		t.Fatalf("readToken(%q) failed unexpectedly with error: %v", path, err)
+	}
+	if got != token {
+		t.Errorf("readToken(%q) = %q, want %q", path, got, token)
+	}
+}
+
+func TestAuthenticatedServer(t *testing.T) {
+	if err := cfg.Load(nil); err != nil {
+		t.Fatalf("cfg.Load() failed unexpectedly with error: %v", err)
+	}
+	h := func(b []byte) ([]byte, error) {
+		return []byte(`{"Status":0,"StatusMessage":"OK"}`), nil
+	}
+
+	cs := cmdServerForTest(t, 0770, "-1", time.Second)
+	cs.token = "secret"
+	if err := cs.monitor.RegisterHandler("TestAuth", h); err != nil {
+		t.Fatalf("could not register handler: %v", err)
+	}
+	cfg.Get().Unstable.CommandPipePath = cs.pipe
+	cfg.Get().Unstable.CommandTokenPath = filepath.Join(t.TempDir(), "commands.token")
+
+	testcases := []struct {
+		name  string
+		token string
+		want  Response
+	}{
+		{
+			name: "no_token",
+			want: UnauthorizedError,
+		},
+		{
+			name:  "wrong_token",
+			token: "wrong",
+			want:  UnauthorizedError,
+		},
+		{
+			name:  "valid_token",
+			token: "secret",
+			want:  Response{Status: 0, StatusMessage: "OK"},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.token != "" {
+				if err := writeToken(tokenPath(), tc.token); err != nil {
+					t.Fatalf("writeToken() failed unexpectedly with error: %v", err)
+				}
+			}
+
+			d := SendCommand(testctx(t), []byte(`{"Command":"TestAuth"}`))
+			var r Response
+			if err := json.Unmarshal(d, &r); err != nil {
+				t.Fatalf("could not parse response %q: %v", d, err)
+			}
+			if r != tc.want {
+				t.Errorf("unexpected response with %s, got %+v want %+v", tc.name, r, tc.want)
+			}
+		})
+	}
+}
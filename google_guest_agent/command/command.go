@@ -40,6 +40,9 @@ type Handler func([]byte) ([]byte, error)
 // request is routed to. Callers may set additional arbitrary fields.
 type Request struct {
 	Command string
+	// Token authenticates the request when the command monitor requires it, see
+	// SendCommand.
+	Token string `json:",omitempty"`
 }
 
 // Response is the basic response structure. Handlers may set additional
@@ -82,6 +85,21 @@ var (
 	// InternalErrorCode is the error code for internal command server errors. Returned when failing to marshal a response.
 	InternalErrorCode = 106
 	internalError     = []byte(`{"Status":106,"StatusMessage":"The command server encountered an internal error trying to respond to your request"}`)
+	// RequestTooLargeError is returned when the request exceeds the maximum request size.
+	RequestTooLargeError = Response{
+		Status:        107,
+		StatusMessage: "Request exceeds the maximum request size",
+	}
+	// RequestTooDeepError is returned when the request JSON is nested deeper than maxRequestDepth.
+	RequestTooDeepError = Response{
+		Status:        108,
+		StatusMessage: "Request exceeds the maximum JSON nesting depth",
+	}
+	// UnauthorizedError is returned when authentication is enabled and the request has no valid token.
+	UnauthorizedError = Response{
+		Status:        109,
+		StatusMessage: "Request is missing a valid authentication token",
+	}
 )
 
 // RegisterHandler registers f as the handler for cmd. If a command.Server has
@@ -109,12 +127,19 @@ func (m *Monitor) UnregisterHandler(cmd string) error {
 	return nil
 }
 
-// SendCommand sends a command request over the configured pipe.
+// SendCommand sends a command request over the configured pipe. If the agent
+// wrote an authentication token the caller can read, it's added to the request.
 func SendCommand(ctx context.Context, req []byte) []byte {
 	pipe := cfg.Get().Unstable.CommandPipePath
 	if pipe == "" {
 		pipe = DefaultPipePath
 	}
+
+	if token, err := readToken(tokenPath()); err == nil {
+		if authReq, err := addToken(req, token); err == nil {
+			req = authReq
+		}
+	}
 	return SendCmdPipe(ctx, pipe, req)
 }
 
@@ -31,6 +31,14 @@ import (
 // DefaultPipePath is the default unix socket path for linux.
 const DefaultPipePath = "/run/google-guest-agent/commands.sock"
 
+// DefaultTokenPath is the default path of the command authentication token for linux.
+const DefaultTokenPath = "/run/google-guest-agent/commands.token"
+
+// restrictToOwner makes path readable and writable by its owner only.
+func restrictToOwner(path string) error {
+	return os.Chmod(path, 0600)
+}
+
 func mkdirpWithPerms(dir string, p os.FileMode, uid, gid int) error {
 	parent := path.Dir(dir)
 	stat, err := os.Stat(dir)
@@ -35,6 +35,13 @@ import (
 	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
 )
 
+// defaultGracePeriod is the time in-flight requests are given to complete when
+// the server is closed, if not configured.
+const defaultGracePeriod = 5 * time.Second
+
+// maxRequestDepth is the maximum nesting depth of objects and arrays in a request.
+const maxRequestDepth = 32
+
 var cmdMonitor *Monitor = &Monitor{
 	handlersMu: new(sync.RWMutex),
 	handlers:   make(map[string]Handler),
@@ -61,12 +68,33 @@ func Init(ctx context.Context) {
 		logger.Errorf("could not parse command_pipe_mode as octal integer: %v falling back to mode 0770", err)
 		pipemode = 0770
 	}
+	grace, err := time.ParseDuration(cfg.Get().Unstable.CommandShutdownGracePeriod)
+	if err != nil {
+		logger.Errorf("command shutdown grace period configuration is not a valid duration string, falling back to %s", defaultGracePeriod)
+		grace = defaultGracePeriod
+	}
 	cmdMonitor.srv = &Server{
-		pipe:      pipe,
-		pipeMode:  int(pipemode),
-		pipeGroup: cfg.Get().Unstable.CommandPipeGroup,
-		timeout:   to,
-		monitor:   cmdMonitor,
+		pipe:           pipe,
+		pipeMode:       int(pipemode),
+		pipeGroup:      cfg.Get().Unstable.CommandPipeGroup,
+		timeout:        to,
+		gracePeriod:    grace,
+		maxRequestSize: cfg.Get().Unstable.CommandMaxRequestSize,
+		monitor:        cmdMonitor,
+	}
+	if cfg.Get().Unstable.CommandAuthEnabled {
+		token, err := newToken()
+		if err != nil {
+			logger.Errorf("failed to generate command authentication token, not starting command server: %v", err)
+			cmdMonitor.srv = nil
+			return
+		}
+		cmdMonitor.srv.token = token
+		// Without the token file callers can't authenticate, the server still starts
+		// rejecting all the requests rather than accepting unauthenticated ones.
+		if err := writeToken(tokenPath(), token); err != nil {
+			logger.Errorf("failed to write command authentication token: %v", err)
+		}
 	}
 	err = cmdMonitor.srv.start(ctx)
 	if err != nil {
@@ -75,9 +103,12 @@ func Init(ctx context.Context) {
 }
 
 // Close will close the internally managed command server, if it was initialized.
+// The registered handlers are kept, a following Init() starts serving them again.
 func Close() error {
 	if cmdMonitor.srv != nil {
-		return cmdMonitor.srv.Close()
+		srv := cmdMonitor.srv
+		cmdMonitor.srv = nil
+		return srv.Close()
 	}
 	return nil
 }
@@ -104,15 +135,53 @@ type Server struct {
 	timeout   time.Duration
 	srv       net.Listener
 	monitor   *Monitor
+	// gracePeriod is the time in-flight requests are given to complete on Close.
+	gracePeriod time.Duration
+	// maxRequestSize is the maximum size of a request in bytes, 0 means no limit.
+	maxRequestSize int
+	// token is the token requests must have when authentication is enabled, empty
+	// if disabled.
+	token string
+	// inflight tracks the connections being handled.
+	inflight sync.WaitGroup
+	// stopped is closed once the server stopped accepting connections.
+	stopped chan struct{}
 }
 
 // Close signals the server to stop listening for commands and stop waiting to
-// listen.
+// listen. Requests already accepted are given the grace period to complete
+// before Close returns.
 func (c *Server) Close() error {
-	if c.srv != nil {
-		return c.srv.Close()
+	if c.srv == nil {
+		return nil
+	}
+
+	err := c.srv.Close()
+	if errors.Is(err, net.ErrClosed) {
+		// Already closed, i.e. by the context being cancelled.
+		err = nil
+	}
+	c.drain()
+	return err
+}
+
+// drain waits for the in-flight requests to complete, giving up after the grace
+// period.
+func (c *Server) drain() {
+	// No new connection is tracked once the accept loop is done.
+	<-c.stopped
+
+	done := make(chan struct{})
+	go func() {
+		c.inflight.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(c.gracePeriod):
+		logger.Warningf("command server closed with requests still in flight after %s grace period", c.gracePeriod)
 	}
-	return nil
 }
 
 func (c *Server) start(ctx context.Context) error {
@@ -123,7 +192,24 @@ func (c *Server) start(ctx context.Context) error {
 	if err != nil {
 		return err
 	}
+	c.srv = srv
+	c.stopped = make(chan struct{})
+	stopped := c.stopped
+
+	// Stop accepting connections when ctx is cancelled, draining the in-flight
+	// requests as with an explicit Close.
+	go func() {
+		select {
+		case <-ctx.Done():
+			if err := c.Close(); err != nil {
+				logger.Errorf("error closing command server: %v", err)
+			}
+		case <-stopped:
+		}
+	}()
+
 	go func() {
+		defer close(stopped)
 		defer srv.Close()
 		for {
 			if ctx.Err() != nil {
@@ -131,19 +217,26 @@ func (c *Server) start(ctx context.Context) error {
 			}
 			conn, err := srv.Accept()
 			if err != nil {
-				if err == net.ErrClosed {
+				if errors.Is(err, net.ErrClosed) {
 					break
 				}
 				logger.Infof("error on connection to pipe %s: %v", c.pipe, err)
 				continue
 			}
+			c.inflight.Add(1)
 			go func(conn net.Conn) {
+				defer c.inflight.Done()
 				defer conn.Close()
 				// Go has lots of helpers to do this for us but none of them return the byte
 				// slice afterwards, and we need it for the handler
 				var b []byte
 				r := bufio.NewReader(conn)
-				var depth int
+				// depth tracks the objects nesting, a request is complete when its top
+				// level object is closed. nesting also accounts for arrays. Brackets
+				// within strings are ignored, inString and escaped track whether the
+				// current rune is part of a string and follows a backslash.
+				var depth, nesting int
+				var inString, escaped bool
 				deadline := time.Now().Add(c.timeout)
 				e := conn.SetReadDeadline(deadline)
 				if e != nil {
@@ -178,11 +271,40 @@ func (c *Server) start(ctx context.Context) error {
 						return
 					}
 					b = append(b, byte(rune))
-					switch rune {
-					case '{':
+					if c.maxRequestSize > 0 && len(b) > c.maxRequestSize {
+						if b, err := json.Marshal(RequestTooLargeError); err != nil {
+							conn.Write(internalError)
+						} else {
+							conn.Write(b)
+						}
+						return
+					}
+					switch {
+					case escaped:
+						escaped = false
+					case inString && rune == '\\':
+						escaped = true
+					case rune == '"':
+						inString = !inString
+					case inString:
+					case rune == '{':
 						depth++
-					case '}':
+						nesting++
+					case rune == '}':
 						depth--
+						nesting--
+					case rune == '[':
+						nesting++
+					case rune == ']':
+						nesting--
+					}
+					if nesting > maxRequestDepth {
+						if b, err := json.Marshal(RequestTooDeepError); err != nil {
+							conn.Write(internalError)
+						} else {
+							conn.Write(b)
+						}
+						return
 					}
 					// Must check here because the first pass always depth = 0
 					if depth == 0 {
@@ -199,6 +321,14 @@ func (c *Server) start(ctx context.Context) error {
 					}
 					return
 				}
+				if c.token != "" && !validToken(req.Token, c.token) {
+					if b, err := json.Marshal(UnauthorizedError); err != nil {
+						conn.Write(internalError)
+					} else {
+						conn.Write(b)
+					}
+					return
+				}
 				c.monitor.handlersMu.RLock()
 				defer c.monitor.handlersMu.RUnlock()
 				handler, ok := c.monitor.handlers[req.Command]
@@ -223,6 +353,5 @@ func (c *Server) start(ctx context.Context) error {
 			}(conn)
 		}
 	}()
-	c.srv = srv
 	return nil
 }
@@ -23,6 +23,7 @@ import (
 	"os/user"
 	"path"
 	"runtime"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -207,3 +208,139 @@ func TestListenTimeout(t *testing.T) {
 		t.Errorf("unexpected response from timed out connection, got %s but want %s", data, expect)
 	}
 }
+
+func TestCloseDrainsInFlightRequests(t *testing.T) {
+	testcases := []struct {
+		name     string
+		shutdown func(cs *Server, cancel context.CancelFunc)
+	}{
+		{
+			name:     "close",
+			shutdown: func(cs *Server, cancel context.CancelFunc) { cs.Close() },
+		},
+		{
+			name:     "context_cancelled",
+			shutdown: func(cs *Server, cancel context.CancelFunc) { cancel() },
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(testctx(t))
+			defer cancel()
+
+			cs := &Server{
+				pipe:        getTestPipePath(t),
+				pipeMode:    0770,
+				pipeGroup:   "-1",
+				timeout:     time.Second,
+				gracePeriod: 5 * time.Second,
+				monitor: &Monitor{
+					handlersMu: new(sync.RWMutex),
+					handlers:   make(map[string]Handler),
+				},
+			}
+			cs.monitor.srv = cs
+			if err := cs.start(ctx); err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { cs.Close() })
+
+			started := make(chan struct{})
+			h := func(b []byte) ([]byte, error) {
+				close(started)
+				time.Sleep(100 * time.Millisecond)
+				return []byte(`{"Status":0,"StatusMessage":"OK"}`), nil
+			}
+			if err := cs.monitor.RegisterHandler("TestDrain", h); err != nil {
+				t.Fatalf("could not register handler: %v", err)
+			}
+
+			respc := make(chan []byte)
+			go func() {
+				respc <- SendCmdPipe(testctx(t), cs.pipe, []byte(`{"Command":"TestDrain"}`))
+			}()
+
+			<-started
+			tc.shutdown(cs, cancel)
+
+			var r Response
+			d := <-respc
+			if err := json.Unmarshal(d, &r); err != nil {
+				t.Fatalf("incomplete response %q from request in flight on shutdown: %v", d, err)
+			}
+			if r.Status != 0 || r.StatusMessage != "OK" {
+				t.Errorf("unexpected status from request in flight on shutdown, want 0, \"OK\" but got %d, %q", r.Status, r.StatusMessage)
+			}
+		})
+	}
+}
+
+func TestRequestLimits(t *testing.T) {
+	h := func(b []byte) ([]byte, error) {
+		return []byte(`{"Status":0,"StatusMessage":"OK"}`), nil
+	}
+
+	testcases := []struct {
+		name    string
+		req     string
+		want    Response
+		maxSize int
+	}{
+		{
+			name: "within_limits",
+			req:  `{"Command":"TestRequestLimits","Data":[{"a":[1]}]}`,
+			want: Response{Status: 0, StatusMessage: "OK"},
+		},
+		{
+			name:    "too_large",
+			req:     `{"Command":"TestRequestLimits","Data":"` + strings.Repeat("a", 128) + `"}`,
+			want:    RequestTooLargeError,
+			maxSize: 64,
+		},
+		{
+			name: "too_deep",
+			req:  `{"Command":"TestRequestLimits","Data":` + strings.Repeat("[", maxRequestDepth) + strings.Repeat("]", maxRequestDepth) + `}`,
+			want: RequestTooDeepError,
+		},
+		{
+			name: "brackets_in_string",
+			req:  `{"Command":"TestRequestLimits","Data":"` + strings.Repeat("[{", maxRequestDepth) + `"}`,
+			want: Response{Status: 0, StatusMessage: "OK"},
+		},
+		{
+			name: "closing_brackets_in_string",
+			req:  `{"Command":"TestRequestLimits","Data":"}]}"}`,
+			want: Response{Status: 0, StatusMessage: "OK"},
+		},
+		{
+			name: "escaped_quote_in_string",
+			req:  `{"Command":"TestRequestLimits","Data":"\\\"}` + strings.Repeat("[", maxRequestDepth) + `"}`,
+			want: Response{Status: 0, StatusMessage: "OK"},
+		},
+		{
+			name: "too_deep_after_string",
+			req:  `{"Command":"TestRequestLimits","Data":["]\\",` + strings.Repeat("[", maxRequestDepth) + strings.Repeat("]", maxRequestDepth+1) + `}`,
+			want: RequestTooDeepError,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			cs := cmdServerForTest(t, 0770, "-1", time.Second)
+			cs.maxRequestSize = tc.maxSize
+			if err := cs.monitor.RegisterHandler("TestRequestLimits", h); err != nil {
+				t.Fatalf("could not register handler: %v", err)
+			}
+
+			d := SendCmdPipe(testctx(t), cs.pipe, []byte(tc.req))
+			var r Response
+			if err := json.Unmarshal(d, &r); err != nil {
+				t.Fatalf("could not parse response %q: %v", d, err)
+			}
+			if r != tc.want {
+				t.Errorf("unexpected response to %s request, got %+v want %+v", tc.name, r, tc.want)
+			}
+		})
+	}
+}
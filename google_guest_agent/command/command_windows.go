@@ -22,6 +22,7 @@ import (
 
 	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
 	"github.com/Microsoft/go-winio"
+	"golang.org/x/sys/windows"
 )
 
 const (
@@ -33,6 +34,28 @@ const (
 	creatorGroupSID = "S-1-3-1"
 )
 
+// DefaultTokenPath is the default path of the command authentication token for windows.
+const DefaultTokenPath = `C:\ProgramData\Google\Compute Engine\commands.token`
+
+// ownerOnlyDACL grants full access to SYSTEM and the Administrators group only,
+// protected from inheriting the parent's ACEs. File modes have no effect on
+// Windows, files under ProgramData would otherwise be readable by Users.
+const ownerOnlyDACL = "D:P(A;;FA;;;SY)(A;;FA;;;BA)"
+
+// restrictToOwner replaces the DACL of path with ownerOnlyDACL.
+func restrictToOwner(path string) error {
+	sd, err := windows.SecurityDescriptorFromString(ownerOnlyDACL)
+	if err != nil {
+		return fmt.Errorf("failed to parse security descriptor %q: %w", ownerOnlyDACL, err)
+	}
+	dacl, _, err := sd.DACL()
+	if err != nil {
+		return fmt.Errorf("failed to get DACL of %q: %w", ownerOnlyDACL, err)
+	}
+	info := windows.SECURITY_INFORMATION(windows.DACL_SECURITY_INFORMATION | windows.PROTECTED_DACL_SECURITY_INFORMATION)
+	return windows.SetNamedSecurityInfo(path, windows.SE_FILE_OBJECT, info, nil, nil, dacl, nil)
+}
+
 func genSecurityDescriptor(filemode int, grp string) string {
 	// This function translates the intention of a unix file mode and owner group into an appropriate SDDL security descriptor for a windows named pipe.
 	owner := creatorOwnerSID
@@ -0,0 +1,101 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/command"
+)
+
+// configDumpCommand is the command monitor command reporting the effective
+// configuration, after merging the defaults and configuration files.
+const configDumpCommand = "agent.config.dump"
+
+// redactedValue replaces the value of sensitive options in the configuration dump.
+const redactedValue = "<redacted>"
+
+// sensitiveOptions are the configuration options holding secrets, keyed by
+// section, their values are never reported by agent.config.dump. None of the
+// current options does, options holding secrets must be added here.
+var sensitiveOptions = map[string][]string{}
+
+// urlOptions are the configuration options holding URLs, keyed by section. The
+// user information, i.e. user:password@, is stripped from their values.
+var urlOptions = map[string][]string{
+	"MetadataScripts": {"DownloadProxy"},
+}
+
+// configDumpResponse is the response of the agent.config.dump command.
+type configDumpResponse struct {
+	command.Response
+	// Config is the effective configuration keyed by section and option name,
+	// sections not defined in the configuration are null.
+	Config map[string]map[string]any
+}
+
+// configDumpHandler handles the agent.config.dump command.
+func configDumpHandler(_ []byte) ([]byte, error) {
+	config, err := redactedConfig(cfg.Get())
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(configDumpResponse{Config: config})
+}
+
+// redactedConfig converts sections to a section/option map with the values of
+// sensitive options redacted.
+func redactedConfig(sections *cfg.Sections) (map[string]map[string]any, error) {
+	data, err := json.Marshal(sections)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal configuration: %w", err)
+	}
+
+	var res map[string]map[string]any
+	if err := json.Unmarshal(data, &res); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal configuration: %w", err)
+	}
+
+	for section, names := range sensitiveOptions {
+		for _, name := range names {
+			if _, ok := res[section][name]; ok {
+				res[section][name] = redactedValue
+			}
+		}
+	}
+	for section, names := range urlOptions {
+		for _, name := range names {
+			if value, ok := res[section][name].(string); ok {
+				res[section][name] = stripUserinfo(value)
+			}
+		}
+	}
+
+	return res, nil
+}
+
+// stripUserinfo returns value without the user information if it's a URL, an
+// unparsable value is redacted as it could be a URL with credentials.
+func stripUserinfo(value string) string {
+	u, err := url.Parse(value)
+	if err != nil {
+		return redactedValue
+	}
+	u.User = nil
+	return u.String()
+}
@@ -0,0 +1,145 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"runtime"
+	"syscall"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/command"
+	"github.com/GoogleCloudPlatform/guest-agent/utils"
+	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+)
+
+var (
+	// parseConfig points to the function loading the configuration without
+	// applying it.
+	parseConfig = cfg.Parse
+
+	// reloadLogger points to the function re-initializing the logger.
+	reloadLogger = logger.Init
+
+	// commandMonitorStart and commandMonitorStop point to the functions starting
+	// and stopping the command monitor.
+	commandMonitorStart = startCommandMonitor
+	commandMonitorStop  = command.Close
+)
+
+// handleConfigReload reloads the configuration on SIGHUP until ctx is done. opts
+// are the logger options the logger is re-initialized with.
+func handleConfigReload(ctx context.Context, opts *logger.LogOpts) {
+	if runtime.GOOS == "windows" {
+		return
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+
+	go func() {
+		defer signal.Stop(sigs)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-sigs:
+				logger.Infof("Received SIGHUP, reloading configuration.")
+				if err := reloadAgentConfig(ctx, opts); err != nil {
+					logger.Errorf("Failed to reload configuration, keeping the current one: %v", err)
+					continue
+				}
+				logger.Infof("Configuration reloaded.")
+			}
+		}
+	}()
+}
+
+// reloadAgentConfig loads the configuration files again and, if the resulting
+// configuration is valid, makes it the current one and re-applies the state
+// depending on it. The current configuration is kept if the new one is invalid.
+func reloadAgentConfig(ctx context.Context, opts *logger.LogOpts) error {
+	newConfig, err := parseConfig(nil)
+	if err != nil {
+		return err
+	}
+
+	if err := validateReloadedConfig(newConfig); err != nil {
+		return err
+	}
+
+	oldConfig := cfg.Get()
+	cfg.Set(newConfig)
+
+	// Logger.
+	if oldConfig.Core.CloudLoggingEnabled != newConfig.Core.CloudLoggingEnabled {
+		opts.DisableCloudLogging = !newConfig.Core.CloudLoggingEnabled
+		if err := reloadLogger(ctx, *opts); err != nil {
+			logger.Errorf("Failed to re-initialize logger: %v", err)
+		}
+	}
+
+	applyLogRateLimit(newConfig)
+	logBuffer.SetSize(newConfig.Core.LogBufferSize)
+	if newConfig.Accounts != nil {
+		utils.SetExpirationLayouts(utils.SplitExpirationLayouts(newConfig.Accounts.KeyExpirationLayouts))
+	}
+
+	// Command monitor, restarted if its server options changed.
+	oldMonitor, newMonitor := oldConfig.Unstable, newConfig.Unstable
+	monitorChanged := oldMonitor.CommandPipePath != newMonitor.CommandPipePath ||
+		oldMonitor.CommandPipeMode != newMonitor.CommandPipeMode ||
+		oldMonitor.CommandPipeGroup != newMonitor.CommandPipeGroup ||
+		oldMonitor.CommandRequestTimeout != newMonitor.CommandRequestTimeout ||
+		oldMonitor.CommandAuthEnabled != newMonitor.CommandAuthEnabled ||
+		oldMonitor.CommandTokenPath != newMonitor.CommandTokenPath ||
+		oldMonitor.CommandShutdownGracePeriod != newMonitor.CommandShutdownGracePeriod ||
+		oldMonitor.CommandMaxRequestSize != newMonitor.CommandMaxRequestSize
+
+	if oldMonitor.CommandMonitorEnabled && (!newMonitor.CommandMonitorEnabled || monitorChanged) {
+		logger.Infof("Stopping command monitor.")
+		if err := commandMonitorStop(); err != nil {
+			logger.Errorf("Failed to stop command monitor: %v", err)
+		}
+	}
+
+	if newMonitor.CommandMonitorEnabled && (!oldMonitor.CommandMonitorEnabled || monitorChanged) {
+		logger.Infof("Starting command monitor.")
+		commandMonitorStart(ctx)
+	}
+
+	// Event watchers.
+	updateMu.Lock()
+	defer updateMu.Unlock()
+	if err := enableDisableOSLoginCertAuth(ctx); err != nil {
+		logger.Errorf("Failed to enable/disable sshtrustedca watcher: %+v", err)
+	}
+
+	return nil
+}
+
+// validateReloadedConfig checks the reloaded configuration options applied at
+// runtime are valid, so an invalid configuration file doesn't leave the agent
+// partially reconfigured.
+func validateReloadedConfig(config *cfg.Sections) error {
+	if config.Core == nil || config.Unstable == nil {
+		return fmt.Errorf("configuration is missing required sections")
+	}
+
+	return config.Validate()
+}
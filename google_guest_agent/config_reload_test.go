@@ -0,0 +1,136 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+)
+
+func TestReloadAgentConfig(t *testing.T) {
+	origParse, origLogger, origStart, origStop, origMetadata := parseConfig, reloadLogger, commandMonitorStart, commandMonitorStop, newMetadata
+	t.Cleanup(func() {
+		parseConfig, reloadLogger, commandMonitorStart, commandMonitorStop, newMetadata = origParse, origLogger, origStart, origStop, origMetadata
+		reloadConfig(t, nil)
+	})
+	newMetadata = nil
+
+	tests := []struct {
+		name          string
+		current       string
+		reloaded      string
+		wantErr       bool
+		wantLogger    bool
+		wantStarted   bool
+		wantStopped   bool
+		wantUnchanged bool
+	}{
+		{
+			name:     "no_changes",
+			reloaded: "",
+		},
+		{
+			name:        "enable_command_monitor",
+			reloaded:    "[Unstable]\ncommand_monitor_enabled = true",
+			wantStarted: true,
+		},
+		{
+			name:        "disable_command_monitor",
+			current:     "[Unstable]\ncommand_monitor_enabled = true",
+			reloaded:    "",
+			wantStopped: true,
+		},
+		{
+			name:        "restart_command_monitor",
+			current:     "[Unstable]\ncommand_monitor_enabled = true",
+			reloaded:    "[Unstable]\ncommand_monitor_enabled = true\ncommand_request_timeout = 20s",
+			wantStarted: true,
+			wantStopped: true,
+		},
+		{
+			name:        "restart_command_monitor_grace_period",
+			current:     "[Unstable]\ncommand_monitor_enabled = true",
+			reloaded:    "[Unstable]\ncommand_monitor_enabled = true\ncommand_shutdown_grace_period = 30s",
+			wantStarted: true,
+			wantStopped: true,
+		},
+		{
+			name:        "restart_command_monitor_max_request_size",
+			current:     "[Unstable]\ncommand_monitor_enabled = true",
+			reloaded:    "[Unstable]\ncommand_monitor_enabled = true\ncommand_max_request_size = 4096",
+			wantStarted: true,
+			wantStopped: true,
+		},
+		{
+			name:       "disable_cloud_logging",
+			reloaded:   "[Core]\ncloud_logging_enabled = false",
+			wantLogger: true,
+		},
+		{
+			name:          "invalid_timeout",
+			reloaded:      "[Unstable]\ncommand_monitor_enabled = true\ncommand_request_timeout = abc",
+			wantErr:       true,
+			wantUnchanged: true,
+		},
+		{
+			name:          "invalid_pipe_mode",
+			reloaded:      "[Unstable]\ncommand_pipe_mode = 999",
+			wantErr:       true,
+			wantUnchanged: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			reloadConfig(t, []byte(tc.current))
+			current := cfg.Get()
+
+			var loggerReloaded, started, stopped bool
+			parseConfig = func(extraDefaults []byte) (*cfg.Sections, error) {
+				return cfg.Parse([]byte(tc.reloaded))
+			}
+			reloadLogger = func(context.Context, logger.LogOpts) error {
+				loggerReloaded = true
+				return nil
+			}
+			commandMonitorStart = func(context.Context) { started = true }
+			commandMonitorStop = func() error {
+				stopped = true
+				return nil
+			}
+
+			err := reloadAgentConfig(context.Background(), &logger.LogOpts{})
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("reloadAgentConfig() = %v, want error: %t", err, tc.wantErr)
+			}
+
+			if got := cfg.Get() == current; got != tc.wantUnchanged {
+				t.Errorf("reloadAgentConfig() kept the current configuration: %t, want %t", got, tc.wantUnchanged)
+			}
+			if loggerReloaded != tc.wantLogger {
+				t.Errorf("reloadAgentConfig() re-initialized logger: %t, want %t", loggerReloaded, tc.wantLogger)
+			}
+			if started != tc.wantStarted {
+				t.Errorf("reloadAgentConfig() started command monitor: %t, want %t", started, tc.wantStarted)
+			}
+			if stopped != tc.wantStopped {
+				t.Errorf("reloadAgentConfig() stopped command monitor: %t, want %t", stopped, tc.wantStopped)
+			}
+		})
+	}
+}
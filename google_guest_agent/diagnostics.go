@@ -17,6 +17,7 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"reflect"
 	"runtime"
 	"slices"
@@ -30,6 +31,10 @@ import (
 
 const diagnosticsCmd = `C:\Program Files\Google\Compute Engine\diagnostics\diagnostics.exe`
 
+// diagnosticsStatusKey is the guest attribute reporting the outcome of the last
+// diagnostics collection.
+const diagnosticsStatusKey = "diagnostics/status"
+
 var (
 	diagnosticsRegKey   = "Diagnostics"
 	diagnosticsDisabled = false
@@ -54,6 +59,11 @@ func (d *diagnosticsMgr) Diff(ctx context.Context) (bool, error) {
 	return !reflect.DeepEqual(newMetadata.Instance.Attributes.Diagnostics, oldMetadata.Instance.Attributes.Diagnostics), nil
 }
 
+// Name returns the manager's name, see diagnosticsMgrName.
+func (d *diagnosticsMgr) Name() string {
+	return diagnosticsMgrName
+}
+
 func (d *diagnosticsMgr) Timeout(ctx context.Context) (bool, error) {
 	return false, nil
 }
@@ -124,15 +134,28 @@ func (d *diagnosticsMgr) Set(ctx context.Context) error {
 	}
 
 	go func() {
-		logger.Infof("Diagnostics: collecting logs from the system.")
-		res := run.WithCombinedOutput(ctx, diagnosticsCmd, args...)
-		logger.Infof(res.Combined)
-		if res.ExitCode != 0 {
-			logger.Warningf("Error collecting logs: %v", res.Error())
-		}
+		collectDiagnostics(ctx, args)
 		// Job is done, unblock the following requests
 		atomic.SwapInt32(&isDiagnosticsRunning, 0)
 	}()
 
 	return writeRegMultiString(regKeyBase, diagnosticsRegKey, diagnosticsEntries)
 }
+
+// collectDiagnostics runs the diagnostics tool, collecting and uploading the logs,
+// and reports its outcome with the diagnostics/status guest attribute.
+func collectDiagnostics(ctx context.Context, args []string) {
+	logger.Infof("Diagnostics: collecting logs from the system.")
+	res := run.WithCombinedOutput(ctx, diagnosticsCmd, args...)
+	logger.Infof(res.Combined)
+
+	status := "success"
+	if res.ExitCode != 0 {
+		logger.Warningf("Error collecting logs: %v", res.Error())
+		status = fmt.Sprintf("failure: exit code %d", res.ExitCode)
+	}
+
+	if err := writeGuestAttribute(ctx, diagnosticsStatusKey, status); err != nil {
+		logger.Warningf("Diagnostics: failed to report status with guest attribute %q: %v", diagnosticsStatusKey, err)
+	}
+}
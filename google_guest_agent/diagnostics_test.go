@@ -19,6 +19,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/run"
 	"github.com/GoogleCloudPlatform/guest-agent/metadata"
 	"github.com/GoogleCloudPlatform/guest-agent/utils"
 )
@@ -82,3 +83,48 @@ func TestDiagnosticsDisabled(t *testing.T) {
 		})
 	}
 }
+
+// exitCodeRunner is a run.RunnerInterface whose commands exit with exitCode.
+type exitCodeRunner struct {
+	noopRunner
+	exitCode int
+}
+
+func (r exitCodeRunner) WithCombinedOutput(ctx context.Context, name string, args ...string) *run.Result {
+	return &run.Result{ExitCode: r.exitCode}
+}
+
+func TestCollectDiagnosticsStatus(t *testing.T) {
+	origClient, origWrite := run.Client, writeGuestAttribute
+	t.Cleanup(func() {
+		run.Client = origClient
+		writeGuestAttribute = origWrite
+	})
+
+	tests := []struct {
+		name     string
+		exitCode int
+		want     string
+	}{
+		{name: "success", exitCode: 0, want: "success"},
+		{name: "failure", exitCode: 2, want: "failure: exit code 2"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			run.Client = exitCodeRunner{exitCode: tc.exitCode}
+
+			attrs := make(map[string]string)
+			writeGuestAttribute = func(ctx context.Context, key, value string) error {
+				attrs[key] = value
+				return nil
+			}
+
+			collectDiagnostics(context.Background(), []string{"-signedUrl", "url"})
+
+			if got := attrs[diagnosticsStatusKey]; got != tc.want {
+				t.Errorf("collectDiagnostics(ctx) reported %s = %q, want %q", diagnosticsStatusKey, got, tc.want)
+			}
+		})
+	}
+}
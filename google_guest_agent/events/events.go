@@ -64,7 +64,10 @@ type Manager struct {
 	// running is a flag indicating if the Run() was previously called.
 	running bool
 
-	// runningMutex protects the running flag.
+	// finished is a flag indicating if a previously called Run() has returned.
+	finished bool
+
+	// runningMutex protects the running and finished flags.
 	runningMutex sync.RWMutex
 
 	// subscribers maps the subscribed callbacks.
@@ -363,6 +366,14 @@ func (mngr *Manager) runWatcher(ctx context.Context, watcher Watcher, evType str
 	mngr.queue.watcherDone <- evType
 }
 
+// IsRunning returns true if the event manager's Run() was called and has not
+// returned yet.
+func (mngr *Manager) IsRunning() bool {
+	mngr.runningMutex.RLock()
+	defer mngr.runningMutex.RUnlock()
+	return mngr.running && !mngr.finished
+}
+
 // Run runs the event manager, it will block until all watchers have given up/failed.
 // The event manager is meant to be started right after the early initialization code
 // and live until the application ends, the event manager can not be restarted - the Run()
@@ -378,6 +389,12 @@ func (mngr *Manager) Run(ctx context.Context) error {
 	mngr.running = true
 	mngr.runningMutex.Unlock()
 
+	defer func() {
+		mngr.runningMutex.Lock()
+		mngr.finished = true
+		mngr.runningMutex.Unlock()
+	}()
+
 	queue := mngr.queue
 
 	// Manages the context's done signal, pass it down to the other go routines to
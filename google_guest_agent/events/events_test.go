@@ -88,10 +88,18 @@ func TestRun(t *testing.T) {
 		return true
 	})
 
+	if eventManager.IsRunning() {
+		t.Errorf("IsRunning() = true before Run(), want false")
+	}
+
 	if err := eventManager.Run(ctx); err != nil {
 		t.Errorf("Failed to run event managed, expected success, got error: %+v", err)
 	}
 
+	if eventManager.IsRunning() {
+		t.Errorf("IsRunning() = true after Run() returned, want false")
+	}
+
 	if counter != maxCount {
 		t.Errorf("Failed to increment callback counter, expected: %d, got: %d", maxCount, counter)
 	}
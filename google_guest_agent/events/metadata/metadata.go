@@ -19,8 +19,10 @@ import (
 	"context"
 	"net"
 	"net/url"
+	"time"
 
 	"github.com/GoogleCloudPlatform/guest-agent/metadata"
+	"github.com/GoogleCloudPlatform/guest-agent/utils"
 	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
 )
 
@@ -31,6 +33,16 @@ const (
 	LongpollEvent = "metadata-watcher,longpoll"
 )
 
+// logLimiter rate limits the watch errors, the watcher retries forever during
+// metadata server outages.
+var logLimiter = utils.NewLogLimiter(0)
+
+// SetLogRateLimit sets the interval at which identical watch errors are logged, a
+// zero interval logs every error.
+func SetLogRateLimit(interval time.Duration) {
+	logLimiter.SetInterval(interval)
+}
+
 // Watcher is the metadata event watcher implementation.
 type Watcher struct {
 	client         metadata.MDSClientInterface
@@ -58,17 +70,17 @@ func (mp *Watcher) Events() []string {
 func (mp *Watcher) Run(ctx context.Context, evType string) (bool, interface{}, error) {
 	descriptor, err := mp.client.Watch(ctx)
 	if err != nil {
-		// Only log error once to avoid transient errors and not to spam the log on network failures.
-		if !mp.failedPrevious {
-			if urlErr, ok := err.(*url.Error); ok {
-				if _, ok := urlErr.Err.(*net.OpError); ok {
-					logger.Errorf("Network error when requesting metadata, make sure your instance has an active network and can reach the metadata server.")
-				}
+		// Errors repeat until the metadata server is reachable again, only log them
+		// once per rate limit interval not to spam the log on network failures.
+		if urlErr, ok := err.(*url.Error); ok {
+			if _, ok := urlErr.Err.(*net.OpError); ok {
+				logLimiter.Logf(logger.Errorf, "Network error when requesting metadata, make sure your instance has an active network and can reach the metadata server.")
 			}
-			logger.Errorf("Error watching metadata: %s", err)
-			mp.failedPrevious = true
 		}
-	} else {
+		logLimiter.Logf(logger.Errorf, "Error watching metadata: %s", err)
+		mp.failedPrevious = true
+	} else if mp.failedPrevious {
+		logLimiter.Reset(logger.Infof)
 		mp.failedPrevious = false
 	}
 
@@ -43,6 +43,10 @@ func (mds *mdsClient) GetKeyRecursive(ctx context.Context, key string) (string,
 	return "", fmt.Errorf("GetKeyRecursive() not yet implemented")
 }
 
+func (mds *mdsClient) GetKeyRecursiveWithEtag(ctx context.Context, key string) (string, string, error) {
+	return "", "", fmt.Errorf("GetKeyRecursiveWithEtag() not yet implemented")
+}
+
 func (mds *mdsClient) Watch(ctx context.Context) (*metadata.Descriptor, error) {
 	if !mds.disableUnknownFailure {
 		return nil, errUnknown
@@ -54,6 +58,14 @@ func (mds *mdsClient) WriteGuestAttributes(ctx context.Context, key string, valu
 	return fmt.Errorf("WriteGuestattributes() not yet implemented")
 }
 
+func (mds *mdsClient) WriteGuestAttributesBatch(ctx context.Context, attrs map[string]string) error {
+	return fmt.Errorf("WriteGuestAttributesBatch() not yet implemented")
+}
+
+func (mds *mdsClient) DeleteGuestAttribute(ctx context.Context, key string) error {
+	return fmt.Errorf("DeleteGuestAttribute() not yet implemented")
+}
+
 func TestWatcherAPI(t *testing.T) {
 	watcher := New()
 	expectedEvents := []string{LongpollEvent}
@@ -0,0 +1,149 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package resume implements the watcher of instance resume events, i.e. resume
+// from suspend or live migration, after which the clock and network state may
+// need to be reconciled.
+package resume
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+const (
+	// WatcherID is the resume watcher's ID.
+	WatcherID = "resume-watcher"
+	// ResumeEvent is the resume watcher's resume event type ID.
+	ResumeEvent = "resume-watcher,resume"
+
+	// SourceClock detects resumes from the wall clock moving ahead of the
+	// monotonic clock, which doesn't advance while the instance is suspended.
+	SourceClock = "clock"
+	// SourceDriftToken detects resumes from the metadata virtual clock drift
+	// token changing, i.e. after a live migration.
+	SourceDriftToken = "drift-token"
+
+	// defaultInterval is how often resume sources are checked.
+	defaultInterval = 5 * time.Second
+	// defaultClockJump is how far the wall clock must move ahead of the monotonic
+	// clock between checks to be considered a resume.
+	defaultClockJump = 10 * time.Second
+)
+
+// Data describes a resume event.
+type Data struct {
+	// Source is the source the resume was detected from.
+	Source string
+	// Detail describes what was detected, i.e. the clock jump.
+	Detail string
+}
+
+// Watcher is the resume event watcher implementation.
+type Watcher struct {
+	// sources are the enabled resume sources.
+	sources map[string]bool
+	// driftToken returns the current drift token, zero if it's unknown.
+	driftToken func() int
+	// interval is how often sources are checked.
+	interval time.Duration
+	// clockJump is the minimum wall clock jump detected as a resume.
+	clockJump time.Duration
+
+	// wall and mono return the current wall clock time and monotonic clock
+	// reading, overridden in tests.
+	wall func() time.Time
+	mono func() time.Duration
+
+	// lastWall, lastMono and lastToken are the values seen on the last check.
+	lastWall  time.Time
+	lastMono  time.Duration
+	lastToken int
+}
+
+// New allocates and initializes a new Watcher checking sources, driftToken is
+// used by the SourceDriftToken source.
+func New(sources []string, driftToken func() int) *Watcher {
+	start := time.Now()
+	w := &Watcher{
+		sources:    make(map[string]bool),
+		driftToken: driftToken,
+		interval:   defaultInterval,
+		clockJump:  defaultClockJump,
+		wall:       func() time.Time { return time.Now().Round(0) },
+		mono:       func() time.Duration { return time.Since(start) },
+	}
+	for _, source := range sources {
+		w.sources[source] = true
+	}
+	w.lastWall, w.lastMono = w.wall(), w.mono()
+	if w.driftToken != nil {
+		w.lastToken = w.driftToken()
+	}
+	return w
+}
+
+// ID returns the resume event watcher id.
+func (w *Watcher) ID() string {
+	return WatcherID
+}
+
+// Events returns an slice with all implemented events.
+func (w *Watcher) Events() []string {
+	return []string{ResumeEvent}
+}
+
+// Run checks the enabled sources every interval until a resume is detected, it
+// stops renewing once ctx is done.
+func (w *Watcher) Run(ctx context.Context, evType string) (bool, interface{}, error) {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return false, nil, nil
+		case <-ticker.C:
+			if data := w.check(); data != nil {
+				return true, data, nil
+			}
+		}
+	}
+}
+
+// check returns the resume detected since the last check, nil if none.
+func (w *Watcher) check() *Data {
+	wall, mono := w.wall(), w.mono()
+	jump := wall.Sub(w.lastWall) - (mono - w.lastMono)
+	w.lastWall, w.lastMono = wall, mono
+
+	token := 0
+	if w.driftToken != nil {
+		token = w.driftToken()
+	}
+	// A zero token means no metadata was seen yet, not a migration.
+	lastToken := w.lastToken
+	if token != 0 {
+		w.lastToken = token
+	}
+
+	if w.sources[SourceClock] && jump >= w.clockJump {
+		return &Data{Source: SourceClock, Detail: fmt.Sprintf("wall clock jumped %s ahead of the monotonic clock", jump.Round(time.Second))}
+	}
+	if w.sources[SourceDriftToken] && token != 0 && lastToken != 0 && token != lastToken {
+		return &Data{Source: SourceDriftToken, Detail: fmt.Sprintf("drift token changed from %d to %d", lastToken, token)}
+	}
+	return nil
+}
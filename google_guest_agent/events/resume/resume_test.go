@@ -0,0 +1,138 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package resume
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// fakeClock drives the wall and monotonic clocks of a Watcher.
+type fakeClock struct {
+	wall time.Time
+	mono time.Duration
+}
+
+// advance moves both clocks by d, the wall clock by an additional jump.
+func (c *fakeClock) advance(d, jump time.Duration) {
+	c.wall = c.wall.Add(d + jump)
+	c.mono += d
+}
+
+func newTestWatcher(sources []string, token *int) (*Watcher, *fakeClock) {
+	clock := &fakeClock{wall: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	w := New(sources, func() int { return *token })
+	w.wall = func() time.Time { return clock.wall }
+	w.mono = func() time.Duration { return clock.mono }
+	w.lastWall, w.lastMono = clock.wall, clock.mono
+	return w, clock
+}
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		name       string
+		sources    []string
+		jump       time.Duration
+		startToken int
+		token      int
+		wantSource string
+	}{
+		{
+			name:    "no_resume",
+			sources: []string{SourceClock, SourceDriftToken},
+			token:   1,
+		},
+		{
+			name:       "clock_jump",
+			sources:    []string{SourceClock, SourceDriftToken},
+			jump:       time.Hour,
+			wantSource: SourceClock,
+		},
+		{
+			name:    "small_clock_jump",
+			sources: []string{SourceClock},
+			jump:    time.Second,
+		},
+		{
+			name:    "clock_disabled",
+			sources: []string{SourceDriftToken},
+			jump:    time.Hour,
+		},
+		{
+			name:       "drift_token_changed",
+			sources:    []string{SourceClock, SourceDriftToken},
+			startToken: 1,
+			token:      2,
+			wantSource: SourceDriftToken,
+		},
+		{
+			name:    "first_drift_token",
+			sources: []string{SourceDriftToken},
+			token:   2,
+		},
+		{
+			name:       "drift_token_disabled",
+			sources:    []string{SourceClock},
+			startToken: 1,
+			token:      2,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			token := tc.startToken
+			w, clock := newTestWatcher(tc.sources, &token)
+
+			token = tc.token
+			clock.advance(defaultInterval, tc.jump)
+			got := w.check()
+
+			if tc.wantSource == "" && got != nil {
+				t.Errorf("check() = %+v, want no resume", got)
+			}
+			if tc.wantSource != "" && (got == nil || got.Source != tc.wantSource) {
+				t.Errorf("check() = %+v, want resume from %s", got, tc.wantSource)
+			}
+
+			// A resume is only reported once.
+			clock.advance(defaultInterval, 0)
+			if got := w.check(); got != nil {
+				t.Errorf("second check() = %+v, want no resume", got)
+			}
+		})
+	}
+}
+
+func TestRun(t *testing.T) {
+	token := 1
+	w := New([]string{SourceDriftToken}, func() int { return token })
+	w.interval = time.Millisecond
+	token = 2
+
+	renew, data, err := w.Run(context.Background(), ResumeEvent)
+	if err != nil || !renew {
+		t.Fatalf("Run() = %t, %v, %v, want renewed without error", renew, data, err)
+	}
+	if got, ok := data.(*Data); !ok || got.Source != SourceDriftToken {
+		t.Errorf("Run() returned data %+v, want resume from %s", data, SourceDriftToken)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if renew, _, _ := w.Run(ctx, ResumeEvent); renew {
+		t.Errorf("Run() with canceled context renewed, want not renewed")
+	}
+}
@@ -27,6 +27,8 @@ const (
 	ReadEvent = "ssh-trusted-ca-pipe-watcher,read"
 	// DefaultPipePath defines the default ssh trusted ca pipe path.
 	DefaultPipePath = "/etc/ssh/oslogin_trustedca.pub"
+	// DefaultPipeMode defines the default ssh trusted ca pipe permissions.
+	DefaultPipeMode os.FileMode = 0644
 )
 
 // Watcher is the sshtrustedca event watcher implementation.
@@ -34,6 +36,9 @@ type Watcher struct {
 	// pipePath points to the named pipe it's writing to.
 	pipePath string
 
+	// pipeMode is the permission mode the named pipe is created with.
+	pipeMode os.FileMode
+
 	// waitingWrite is a flag to inform the Watcher that the Handler has or
 	// hasn't finished writing.
 	waitingWrite bool
@@ -54,9 +59,10 @@ type PipeData struct {
 }
 
 // New allocates and initializes a new Watcher.
-func New(pipePath string) *Watcher {
+func New(pipePath string, pipeMode os.FileMode) *Watcher {
 	return &Watcher{
 		pipePath: pipePath,
+		pipeMode: pipeMode,
 	}
 }
 
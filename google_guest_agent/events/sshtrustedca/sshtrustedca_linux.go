@@ -29,7 +29,7 @@ import (
 )
 
 // Create a named pipe if it doesn't exist.
-func createNamedPipe(ctx context.Context, pipePath string) error {
+func createNamedPipe(ctx context.Context, pipePath string, pipeMode os.FileMode) error {
 	pipeDir := filepath.Dir(pipePath)
 	_, err := os.Stat(pipeDir)
 
@@ -42,9 +42,14 @@ func createNamedPipe(ctx context.Context, pipePath string) error {
 
 	if _, err := os.Stat(pipePath); err != nil {
 		if os.IsNotExist(err) {
-			if err := syscall.Mkfifo(pipePath, 0644); err != nil {
+			if err := syscall.Mkfifo(pipePath, uint32(pipeMode.Perm())); err != nil {
 				return fmt.Errorf("failed to create named pipe: %+v", err)
 			}
+			// Mkfifo's mode is subject to the process umask, make sure the pipe ends up
+			// with the exact permissions configured.
+			if err := os.Chmod(pipePath, pipeMode.Perm()); err != nil {
+				return fmt.Errorf("failed to set named pipe permissions: %+v", err)
+			}
 		} else {
 			return fmt.Errorf("failed to stat file: " + pipePath)
 		}
@@ -115,7 +120,7 @@ func (mp *Watcher) Run(ctx context.Context, evType string) (bool, interface{}, e
 
 	// If the configured named pipe doesn't exists we create it before emitting events
 	// from it.
-	if err := createNamedPipe(ctx, mp.pipePath); err != nil {
+	if err := createNamedPipe(ctx, mp.pipePath, mp.pipeMode); err != nil {
 		return true, nil, err
 	}
 
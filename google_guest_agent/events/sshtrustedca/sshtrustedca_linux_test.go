@@ -28,7 +28,7 @@ func TestPipe(t *testing.T) {
 	// Putting a directory name between temp dir and the file name guarantees we test
 	// the directory creation.
 	pipePath := path.Join(t.TempDir(), "ssh", "oslogin_trustedca.pub")
-	watcher := New(pipePath)
+	watcher := New(pipePath, DefaultPipeMode)
 	testData := "test data transmited through the pipe."
 
 	if watcher.ID() != WatcherID {
@@ -95,7 +95,7 @@ func TestPipe(t *testing.T) {
 
 func TestCancel(t *testing.T) {
 	pipePath := path.Join(t.TempDir(), "ssh", "oslogin_trustedca.pub")
-	watcher := New(pipePath)
+	watcher := New(pipePath, DefaultPipeMode)
 
 	sync := make(chan bool)
 	defer close(sync)
@@ -121,3 +121,23 @@ func TestCancel(t *testing.T) {
 
 	watcher.Run(ctx, ReadEvent)
 }
+
+func TestCreateNamedPipeMode(t *testing.T) {
+	pipePath := path.Join(t.TempDir(), "ssh", "oslogin_trustedca.pub")
+	var mode os.FileMode = 0600
+
+	if err := createNamedPipe(context.Background(), pipePath, mode); err != nil {
+		t.Fatalf("createNamedPipe(ctx, %q, %#o) failed unexpectedly with error: %v", pipePath, mode, err)
+	}
+
+	info, err := os.Stat(pipePath)
+	if err != nil {
+		t.Fatalf("os.Stat(%q) failed unexpectedly with error: %v", pipePath, err)
+	}
+	if info.Mode()&os.ModeNamedPipe == 0 {
+		t.Errorf("createNamedPipe(ctx, %q, %#o) created %v, want a named pipe", pipePath, mode, info.Mode())
+	}
+	if got := info.Mode().Perm(); got != mode {
+		t.Errorf("createNamedPipe(ctx, %q, %#o) created pipe with mode %#o, want %#o", pipePath, mode, got, mode)
+	}
+}
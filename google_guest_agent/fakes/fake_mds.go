@@ -42,6 +42,11 @@ func (s MDSClient) GetKeyRecursive(ctx context.Context, key string) (string, err
 	return "", fmt.Errorf("GetKeyRecursive() not yet implemented")
 }
 
+// GetKeyRecursiveWithEtag implements fake GetKeyRecursiveWithEtag MDS method.
+func (s MDSClient) GetKeyRecursiveWithEtag(ctx context.Context, key string) (string, string, error) {
+	return "", "", fmt.Errorf("GetKeyRecursiveWithEtag() not yet implemented")
+}
+
 // GetKey implements fake GetKey MDS method.
 func (s MDSClient) GetKey(ctx context.Context, key string, headers map[string]string) (string, error) {
 	valid := `
@@ -92,3 +97,13 @@ func (s MDSClient) Watch(context.Context) (*metadata.Descriptor, error) {
 func (s MDSClient) WriteGuestAttributes(context.Context, string, string) error {
 	return fmt.Errorf("not yet implemented")
 }
+
+// WriteGuestAttributesBatch method implements fake batch writer on MDS.
+func (s MDSClient) WriteGuestAttributesBatch(context.Context, map[string]string) error {
+	return fmt.Errorf("not yet implemented")
+}
+
+// DeleteGuestAttribute method implements fake guest attribute removal on MDS.
+func (s MDSClient) DeleteGuestAttribute(context.Context, string) error {
+	return fmt.Errorf("not yet implemented")
+}
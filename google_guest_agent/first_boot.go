@@ -0,0 +1,144 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/guest-agent/utils"
+	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+)
+
+var (
+	// firstBootMarker records the ID of the instance first-boot managers last ran
+	// on, they run again if the image is booted as a different instance.
+	firstBootMarker = "/var/lib/google/first_boot_managers"
+
+	// firstBootManagerTimeout is the timeout of the context each first-boot
+	// manager runs with.
+	firstBootManagerTimeout = 30 * time.Second
+
+	// firstBootTimeout is how long the agent waits for the first-boot managers
+	// before moving on. It's below systemd's default TimeoutStartSec, readiness is
+	// only reported afterwards.
+	firstBootTimeout = 60 * time.Second
+)
+
+// firstBootManager is implemented by managers that must run synchronously on the
+// instance's first boot, before the agent handles metadata events and reports
+// itself ready. It makes sure their setup is done before startup scripts run.
+type firstBootManager interface {
+	// runOnFirstBoot returns true if the manager must run on first boot.
+	runOnFirstBoot() bool
+}
+
+// runOnFirstBoot makes users and sudoers exist before startup scripts run.
+func (a *accountsMgr) runOnFirstBoot() bool {
+	return true
+}
+
+// runOnFirstBoot configures OS Login, the accounts manager depends on, before
+// startup scripts run.
+func (o *osloginMgr) runOnFirstBoot() bool {
+	return true
+}
+
+// isFirstBoot returns true if first-boot managers haven't run on instanceID yet.
+func isFirstBoot(instanceID string) (bool, error) {
+	data, err := os.ReadFile(firstBootMarker)
+	if os.IsNotExist(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return strings.TrimSpace(string(data)) != instanceID, nil
+}
+
+// runFirstBootManagers runs the first-boot managers of mgrs, in dependency order,
+// if this is the first boot of the instance and records they did. Failures are
+// logged, the managers run again on the first metadata event anyway. Each manager
+// runs with a firstBootManagerTimeout context, if they're still running after
+// firstBootTimeout an error is returned so the agent can report itself ready, the
+// marker is written once they're done either way. Metadata events wait for them to be
+// done as updateMu is held while they run.
+func runFirstBootManagers(ctx context.Context, mgrs []manager) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	if newMetadata == nil {
+		return fmt.Errorf("no metadata available")
+	}
+
+	instanceID := newMetadata.Instance.ID.String()
+	firstBoot, err := isFirstBoot(instanceID)
+	if err != nil {
+		return fmt.Errorf("failed to read first boot marker: %w", err)
+	}
+	if !firstBoot {
+		logger.Debugf("Not the first boot of instance %s, skipping first-boot managers", instanceID)
+		return nil
+	}
+
+	var firstBootMgrs []manager
+	for _, mgr := range mgrs {
+		if fb, ok := mgr.(firstBootManager); ok && fb.runOnFirstBoot() {
+			firstBootMgrs = append(firstBootMgrs, mgr)
+		}
+	}
+
+	logger.Infof("First boot of instance %s, running %d first-boot managers", instanceID, len(firstBootMgrs))
+	done := make(chan struct{})
+	updateMu.Lock()
+	go func() {
+		defer updateMu.Unlock()
+		defer close(done)
+
+		runManagersOrdered(firstBootMgrs, func(mgr manager) {
+			mgrCtx, cancel := context.WithTimeout(ctx, firstBootManagerTimeout)
+			defer cancel()
+			if err := runManager(mgrCtx, mgr); err != nil {
+				logger.Errorf("Failed to run first-boot manager %s: %v", mgr.Name(), err)
+			}
+		})
+		if err := writeFirstBootMarker(instanceID); err != nil {
+			logger.Errorf("Failed to record first-boot managers ran: %v", err)
+		}
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-time.After(firstBootTimeout):
+		return fmt.Errorf("first-boot managers still running after %s, not waiting for them", firstBootTimeout)
+	}
+}
+
+// writeFirstBootMarker records first-boot managers ran on instanceID.
+func writeFirstBootMarker(instanceID string) error {
+	if err := os.MkdirAll(filepath.Dir(firstBootMarker), 0755); err != nil {
+		return fmt.Errorf("failed to create first boot marker directory: %w", err)
+	}
+	if err := utils.SaferWriteFile([]byte(instanceID+"\n"), firstBootMarker, 0644); err != nil {
+		return fmt.Errorf("failed to write first boot marker: %w", err)
+	}
+	return nil
+}
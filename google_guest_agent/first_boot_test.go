@@ -0,0 +1,160 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/guest-agent/metadata"
+)
+
+// firstBootTestMgr is a manager counting its Set() calls.
+type firstBootTestMgr struct {
+	statsTestMgr
+	firstBoot bool
+	sets      int
+}
+
+func (m *firstBootTestMgr) Set(ctx context.Context) error { m.sets++; return nil }
+func (m *firstBootTestMgr) runOnFirstBoot() bool          { return m.firstBoot }
+
+func TestRunFirstBootManagers(t *testing.T) {
+	origMarker, origNew, origOld, origStats := firstBootMarker, newMetadata, oldMetadata, stats
+	t.Cleanup(func() {
+		firstBootMarker = origMarker
+		newMetadata = origNew
+		oldMetadata = origOld
+		stats = origStats
+	})
+	stats = &managerStats{}
+	firstBootMarker = filepath.Join(t.TempDir(), "google", "first_boot_managers")
+	oldMetadata = &metadata.Descriptor{}
+
+	boot := func(t *testing.T, instanceID string) (*firstBootTestMgr, *firstBootTestMgr) {
+		t.Helper()
+		newMetadata = &metadata.Descriptor{}
+		newMetadata.Instance.ID = json.Number(instanceID)
+
+		fb := &firstBootTestMgr{statsTestMgr: statsTestMgr{name: "onFirstBootMgr", diff: true}, firstBoot: true}
+		other := &firstBootTestMgr{statsTestMgr: statsTestMgr{name: "notOnFirstBootMgr", diff: true}}
+		if err := runFirstBootManagers(context.Background(), []manager{fb, other}); err != nil {
+			t.Fatalf("runFirstBootManagers(ctx, mgrs) failed unexpectedly with error: %v", err)
+		}
+		return fb, other
+	}
+
+	tests := []struct {
+		name       string
+		instanceID string
+		wantSets   int
+	}{
+		{
+			name:       "first_boot",
+			instanceID: "123",
+			wantSets:   1,
+		},
+		{
+			name:       "reboot",
+			instanceID: "123",
+		},
+		{
+			name:       "new_instance",
+			instanceID: "456",
+			wantSets:   1,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			fb, other := boot(t, tc.instanceID)
+			if fb.sets != tc.wantSets {
+				t.Errorf("runFirstBootManagers(ctx, mgrs) ran first-boot manager %d times, want %d", fb.sets, tc.wantSets)
+			}
+			if other.sets != 0 {
+				t.Errorf("runFirstBootManagers(ctx, mgrs) ran a manager not declaring first boot %d times, want 0", other.sets)
+			}
+
+			data, err := os.ReadFile(firstBootMarker)
+			if err != nil {
+				t.Fatalf("os.ReadFile(%s) failed unexpectedly with error: %v", firstBootMarker, err)
+			}
+			if got, want := string(data), tc.instanceID+"\n"; got != want {
+				t.Errorf("first boot marker = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestRunFirstBootManagersNoMetadata(t *testing.T) {
+	origNew := newMetadata
+	t.Cleanup(func() { newMetadata = origNew })
+	newMetadata = nil
+
+	if err := runFirstBootManagers(context.Background(), nil); err == nil {
+		t.Errorf("runFirstBootManagers(ctx, nil) succeeded without metadata, want error")
+	}
+}
+
+// hangingFirstBootMgr is a first-boot manager whose Set() blocks until release
+// is closed.
+type hangingFirstBootMgr struct {
+	statsTestMgr
+	release chan struct{}
+}
+
+func (m *hangingFirstBootMgr) Set(ctx context.Context) error { <-m.release; return nil }
+func (m *hangingFirstBootMgr) runOnFirstBoot() bool          { return true }
+
+func TestRunFirstBootManagersTimeout(t *testing.T) {
+	origMarker, origNew, origOld, origStats, origTimeout := firstBootMarker, newMetadata, oldMetadata, stats, firstBootTimeout
+	t.Cleanup(func() {
+		firstBootMarker = origMarker
+		newMetadata = origNew
+		oldMetadata = origOld
+		stats = origStats
+		firstBootTimeout = origTimeout
+	})
+	stats = &managerStats{}
+	firstBootMarker = filepath.Join(t.TempDir(), "google", "first_boot_managers")
+	firstBootTimeout = 10 * time.Millisecond
+	oldMetadata = &metadata.Descriptor{}
+	newMetadata = &metadata.Descriptor{}
+	newMetadata.Instance.ID = json.Number("123")
+
+	mgr := &hangingFirstBootMgr{statsTestMgr: statsTestMgr{diff: true}, release: make(chan struct{})}
+	if err := runFirstBootManagers(context.Background(), []manager{mgr}); err == nil {
+		t.Errorf("runFirstBootManagers(ctx, mgrs) succeeded with a hanging manager, want error")
+	}
+	if _, err := os.Stat(firstBootMarker); !os.IsNotExist(err) {
+		t.Errorf("os.Stat(%s) = %v, want the marker not written while the manager runs", firstBootMarker, err)
+	}
+
+	// The marker is written once the manager is done, updateMu is held until then.
+	close(mgr.release)
+	updateMu.Lock()
+	updateMu.Unlock()
+	data, err := os.ReadFile(firstBootMarker)
+	if err != nil {
+		t.Fatalf("os.ReadFile(%s) failed unexpectedly with error: %v", firstBootMarker, err)
+	}
+	if got, want := string(data), "123\n"; got != want {
+		t.Errorf("first boot marker = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/command"
+)
+
+// setGuestAttributeCommand is the command monitor command writing a single guest
+// attribute through the agent's metadata client, and its retry policy.
+const setGuestAttributeCommand = "agent.guestattributes.set"
+
+// writeGuestAttribute writes a guest attribute, overridden in tests.
+var writeGuestAttribute = func(ctx context.Context, key, value string) error {
+	return mdsClient.WriteGuestAttributes(ctx, key, value)
+}
+
+// setGuestAttributeRequest is the request of the agent.guestattributes.set command.
+type setGuestAttributeRequest struct {
+	command.Request
+	// Key is the guest attribute key, in the "namespace/key" form.
+	Key string
+	// Value is the guest attribute value.
+	Value string
+}
+
+// setGuestAttributeHandler returns the handler of the agent.guestattributes.set
+// command.
+func setGuestAttributeHandler(ctx context.Context) command.Handler {
+	return func(b []byte) ([]byte, error) {
+		var req setGuestAttributeRequest
+		var resp command.Response
+
+		if err := json.Unmarshal(b, &req); err != nil {
+			resp.Status = 1
+			resp.StatusMessage = fmt.Sprintf("invalid request: %v", err)
+			return json.Marshal(resp)
+		}
+
+		if err := validGuestAttributeKey(req.Key); err != nil {
+			resp.Status = 1
+			resp.StatusMessage = err.Error()
+			return json.Marshal(resp)
+		}
+
+		if err := writeGuestAttribute(ctx, req.Key, req.Value); err != nil {
+			resp.Status = 1
+			resp.StatusMessage = fmt.Sprintf("failed to write guest attribute %q: %v", req.Key, err)
+			return json.Marshal(resp)
+		}
+
+		resp.StatusMessage = "OK"
+		return json.Marshal(resp)
+	}
+}
+
+// validGuestAttributeKey returns an error if key is not in the "namespace/key"
+// form expected by the metadata server.
+func validGuestAttributeKey(key string) error {
+	namespace, name, found := strings.Cut(key, "/")
+	if !found || namespace == "" || name == "" || strings.Contains(name, "/") {
+		return fmt.Errorf("invalid guest attribute key %q, want namespace/key", key)
+	}
+	return nil
+}
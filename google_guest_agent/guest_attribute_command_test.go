@@ -0,0 +1,95 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/command"
+)
+
+func TestSetGuestAttributeHandler(t *testing.T) {
+	origWrite := writeGuestAttribute
+	t.Cleanup(func() { writeGuestAttribute = origWrite })
+
+	tests := []struct {
+		name       string
+		request    string
+		writeErr   error
+		wantStatus int
+		wantWrite  bool
+	}{
+		{
+			name:      "success",
+			request:   `{"Command":"agent.guestattributes.set","Key":"ns/key","Value":"value"}`,
+			wantWrite: true,
+		},
+		{
+			name:       "write_failure",
+			request:    `{"Command":"agent.guestattributes.set","Key":"ns/key","Value":"value"}`,
+			writeErr:   fmt.Errorf("write error"),
+			wantStatus: 1,
+			wantWrite:  true,
+		},
+		{
+			name:       "missing_namespace",
+			request:    `{"Command":"agent.guestattributes.set","Key":"key","Value":"value"}`,
+			wantStatus: 1,
+		},
+		{
+			name:       "nested_key",
+			request:    `{"Command":"agent.guestattributes.set","Key":"ns/a/b","Value":"value"}`,
+			wantStatus: 1,
+		},
+		{
+			name:       "invalid_json",
+			request:    `{"Command":`,
+			wantStatus: 1,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			written := false
+			writeGuestAttribute = func(ctx context.Context, key, value string) error {
+				written = true
+				if key != "ns/key" || value != "value" {
+					t.Errorf("writeGuestAttribute(ctx, %q, %q) called, want (ctx, %q, %q)", key, value, "ns/key", "value")
+				}
+				return tc.writeErr
+			}
+
+			b, err := setGuestAttributeHandler(context.Background())([]byte(tc.request))
+			if err != nil {
+				t.Fatalf("setGuestAttributeHandler(ctx)(%s) failed unexpectedly with error: %v", tc.request, err)
+			}
+
+			var resp command.Response
+			if err := json.Unmarshal(b, &resp); err != nil {
+				t.Fatalf("json.Unmarshal(%s) failed unexpectedly with error: %v", b, err)
+			}
+
+			if resp.Status != tc.wantStatus {
+				t.Errorf("setGuestAttributeHandler(ctx)(%s) returned status %d, want %d", tc.request, resp.Status, tc.wantStatus)
+			}
+			if written != tc.wantWrite {
+				t.Errorf("setGuestAttributeHandler(ctx)(%s) wrote attribute = %t, want %t", tc.request, written, tc.wantWrite)
+			}
+		})
+	}
+}
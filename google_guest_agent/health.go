@@ -0,0 +1,199 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/events"
+	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+)
+
+// agentHealth tracks the agent state reported by the health check endpoint.
+type agentHealth struct {
+	// mu protects the fields below.
+	mu sync.Mutex
+	// lastMetadataFetch is the time of the last successfully handled metadata
+	// longpoll event.
+	lastMetadataFetch time.Time
+	// lastUpdate is the time the last runUpdate() call has finished.
+	lastUpdate time.Time
+	// lastUpdateErrors are the manager errors of the last runUpdate() call.
+	lastUpdateErrors []string
+	// lastProgress is the time the metadata event loop last made progress, see
+	// responsive().
+	lastProgress time.Time
+}
+
+// healthReport is the JSON health report served by the health check endpoint.
+type healthReport struct {
+	// EventManagerRunning is true if the event manager is running.
+	EventManagerRunning bool `json:"eventManagerRunning"`
+	// LastMetadataFetch is the time of the last successful metadata fetch.
+	LastMetadataFetch *time.Time `json:"lastMetadataFetch,omitempty"`
+	// LastUpdate is the time the managers were last run.
+	LastUpdate *time.Time `json:"lastUpdate,omitempty"`
+	// LastUpdateStatus is "ok" if all managers succeeded on their last run,
+	// "failed" otherwise. It's empty if the managers have not run yet.
+	LastUpdateStatus string `json:"lastUpdateStatus,omitempty"`
+	// LastUpdateErrors are the errors reported by the managers on their last run.
+	LastUpdateErrors []string `json:"lastUpdateErrors,omitempty"`
+}
+
+var (
+	// health is the agent's health state.
+	health = &agentHealth{}
+
+	// eventManagerRunning reports whether the event manager is running.
+	eventManagerRunning = func() bool { return events.Get().IsRunning() }
+)
+
+// maxProgressAge is how long the metadata event loop may go without progress
+// before the agent is considered wedged. Longpoll events are handled at least
+// every minute, failed ones included, the rest covers retries and slow managers.
+const maxProgressAge = 10 * time.Minute
+
+// progressed records the metadata event loop made progress.
+func (h *agentHealth) progressed() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastProgress = time.Now()
+}
+
+// responsive returns true if the event manager is running and the metadata event
+// loop made progress within maxProgressAge, a hung manager or event loop stops it
+// from progressing.
+func (h *agentHealth) responsive() bool {
+	if !eventManagerRunning() {
+		return false
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return !h.lastProgress.IsZero() && time.Since(h.lastProgress) <= maxProgressAge
+}
+
+// metadataFetched records a successful metadata fetch.
+func (h *agentHealth) metadataFetched() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastMetadataFetch = time.Now()
+}
+
+// updateFinished records the outcome of a runUpdate() call.
+func (h *agentHealth) updateFinished(errs []error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.lastUpdate = time.Now()
+	h.lastUpdateErrors = nil
+	for _, err := range errs {
+		h.lastUpdateErrors = append(h.lastUpdateErrors, err.Error())
+	}
+}
+
+// report builds the current health report.
+func (h *agentHealth) report() healthReport {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	res := healthReport{
+		EventManagerRunning: eventManagerRunning(),
+		LastUpdateErrors:    h.lastUpdateErrors,
+	}
+
+	if !h.lastMetadataFetch.IsZero() {
+		fetched := h.lastMetadataFetch
+		res.LastMetadataFetch = &fetched
+	}
+
+	if !h.lastUpdate.IsZero() {
+		updated := h.lastUpdate
+		res.LastUpdate = &updated
+		res.LastUpdateStatus = "ok"
+		if len(h.lastUpdateErrors) > 0 {
+			res.LastUpdateStatus = "failed"
+		}
+	}
+
+	return res
+}
+
+// ServeHTTP serves the JSON health report. The response status is 503 if the
+// event manager is not running, 200 otherwise.
+func (h *agentHealth) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	report := h.report()
+	data, err := json.Marshal(report)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to marshal health report: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !report.EventManagerRunning {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if _, err := w.Write(data); err != nil {
+		logger.Debugf("Failed to write health report: %v", err)
+	}
+}
+
+// startHealthCheck starts the localhost health check HTTP listener if enabled
+// by configuration. The listener is closed when ctx is done.
+func startHealthCheck(ctx context.Context) {
+	config := cfg.Get().HealthCheck
+	if config == nil || !config.Enabled {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(config.Path, health)
+
+	addr := net.JoinHostPort("localhost", fmt.Sprintf("%d", config.Port))
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		logger.Errorf("Failed to start health check listener on %s: %v", addr, err)
+		return
+	}
+
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	go func() {
+		<-ctx.Done()
+		if err := srv.Close(); err != nil {
+			logger.Debugf("Failed to close health check listener: %v", err)
+		}
+	}()
+
+	go func() {
+		logger.Infof("Serving health check on http://%s%s", addr, config.Path)
+		if err := srv.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Errorf("Health check listener failed: %v", err)
+		}
+	}()
+}
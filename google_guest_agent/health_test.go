@@ -0,0 +1,139 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHealthHandler(t *testing.T) {
+	orig := eventManagerRunning
+	t.Cleanup(func() { eventManagerRunning = orig })
+
+	tests := []struct {
+		name       string
+		running    bool
+		fetched    bool
+		errs       []error
+		wantCode   int
+		wantStatus string
+	}{
+		{
+			name:     "not_running",
+			wantCode: http.StatusServiceUnavailable,
+		},
+		{
+			name:     "running_no_update",
+			running:  true,
+			fetched:  true,
+			wantCode: http.StatusOK,
+		},
+		{
+			name:       "running_update_ok",
+			running:    true,
+			fetched:    true,
+			errs:       []error{},
+			wantCode:   http.StatusOK,
+			wantStatus: "ok",
+		},
+		{
+			name:       "running_update_failed",
+			running:    true,
+			fetched:    true,
+			errs:       []error{fmt.Errorf("manager failed")},
+			wantCode:   http.StatusOK,
+			wantStatus: "failed",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			eventManagerRunning = func() bool { return tc.running }
+			h := &agentHealth{}
+			if tc.fetched {
+				h.metadataFetched()
+			}
+			if tc.errs != nil {
+				h.updateFinished(tc.errs)
+			}
+
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/health", nil))
+
+			if rec.Code != tc.wantCode {
+				t.Errorf("ServeHTTP() returned status %d, want %d", rec.Code, tc.wantCode)
+			}
+
+			var got healthReport
+			if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+				t.Fatalf("json.Unmarshal(%s) failed unexpectedly with error: %v", rec.Body.String(), err)
+			}
+
+			if got.EventManagerRunning != tc.running {
+				t.Errorf("ServeHTTP() reported eventManagerRunning = %t, want %t", got.EventManagerRunning, tc.running)
+			}
+			if (got.LastMetadataFetch != nil) != tc.fetched {
+				t.Errorf("ServeHTTP() reported lastMetadataFetch = %v, want set: %t", got.LastMetadataFetch, tc.fetched)
+			}
+			if got.LastUpdateStatus != tc.wantStatus {
+				t.Errorf("ServeHTTP() reported lastUpdateStatus = %q, want %q", got.LastUpdateStatus, tc.wantStatus)
+			}
+			if len(got.LastUpdateErrors) != len(tc.errs) {
+				t.Errorf("ServeHTTP() reported lastUpdateErrors = %v, want %d errors", got.LastUpdateErrors, len(tc.errs))
+			}
+		})
+	}
+}
+
+func TestHealthHandlerMethod(t *testing.T) {
+	rec := httptest.NewRecorder()
+	(&agentHealth{}).ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/health", nil))
+
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("ServeHTTP(POST) returned status %d, want %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestHealthResponsive(t *testing.T) {
+	orig := eventManagerRunning
+	t.Cleanup(func() { eventManagerRunning = orig })
+
+	tests := []struct {
+		name         string
+		running      bool
+		lastProgress time.Time
+		want         bool
+	}{
+		{name: "recent_progress", running: true, lastProgress: time.Now(), want: true},
+		{name: "no_progress", running: true, want: false},
+		{name: "stale_progress", running: true, lastProgress: time.Now().Add(-2 * maxProgressAge), want: false},
+		{name: "event_manager_stopped", running: false, lastProgress: time.Now(), want: false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			eventManagerRunning = func() bool { return tc.running }
+			h := &agentHealth{lastProgress: tc.lastProgress}
+			if got := h.responsive(); got != tc.want {
+				t.Errorf("responsive() = %t, want %t", got, tc.want)
+			}
+		})
+	}
+}
@@ -23,6 +23,7 @@ import (
 	"runtime"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/agentcrypto"
@@ -78,7 +79,49 @@ func addMetadataRoute() error {
 	return addIPForwardEntry(forwardEntry)
 }
 
-func agentInit(ctx context.Context) {
+// agentInitResult summarizes the actions taken by agentInit.
+type agentInitResult struct {
+	// configured lists the actions agentInit performed.
+	configured []string
+	// skipped lists the actions agentInit skipped along with the reason.
+	skipped []string
+	// failed lists the actions agentInit failed to perform along with the error.
+	failed []string
+	// metadataReachable is true if agentInit got the metadata descriptor from MDS,
+	// if false callers must fetch it again themselves.
+	metadataReachable bool
+}
+
+func (r *agentInitResult) configure(action string) {
+	r.configured = append(r.configured, action)
+}
+
+func (r *agentInitResult) skip(action, reason string) {
+	r.skipped = append(r.skipped, fmt.Sprintf("%s (%s)", action, reason))
+}
+
+func (r *agentInitResult) fail(action string, err error) {
+	r.failed = append(r.failed, fmt.Sprintf("%s (%v)", action, err))
+}
+
+// String returns a single line summary of the result.
+func (r *agentInitResult) String() string {
+	return fmt.Sprintf("configured: %q, skipped: %q, failed: %q, metadata reachable: %t", r.configured, r.skipped, r.failed, r.metadataReachable)
+}
+
+var (
+	// snapshotListenerOnce guarantees the snapshot listener is started only once
+	// no matter how many times agentInit is called.
+	snapshotListenerOnce sync.Once
+	// agentcryptoInitOnce guarantees the MDS credentials handler is subscribed only once.
+	agentcryptoInitOnce sync.Once
+)
+
+// agentInit runs the actions to take on agent startup and returns a summary of
+// them. It's safe to call it more than once, i.e. to retry after MDS was not
+// reachable: routes already in place are not duplicated, one time actions are
+// not repeated.
+func agentInit(ctx context.Context) *agentInitResult {
 	// Actions to take on agent startup.
 	//
 	// All platforms:
@@ -95,6 +138,8 @@ func agentInit(ctx context.Context) {
 	//  - Run `google_set_multiqueue` script.
 	// TODO incorporate these scripts into the agent. liamh@12-11-19
 	config := cfg.Get()
+	res := &agentInitResult{}
+	defer func() { logger.Infof("Agent initialization summary, %s", res) }()
 
 	if runtime.GOOS == "windows" {
 		// Try maximum for 1 min.
@@ -103,17 +148,21 @@ func agentInit(ctx context.Context) {
 		if err != nil {
 			panic(fmt.Sprintf("Failed to set metadata route: %+v", err))
 		}
+		res.configure("metadata route")
 	} else {
-		// Linux instance setup.
-		defer run.Quiet(ctx, "systemd-notify", "--ready")
-		defer logger.Debugf("notify systemd")
-
+		// Linux instance setup. Systemd is notified the agent is ready by runAgent,
+		// once first-boot managers ran.
 		if config.Snapshots.Enabled {
-			logger.Infof("Snapshot listener enabled")
-			snapshotServiceIP := config.Snapshots.SnapshotServiceIP
-			snapshotServicePort := config.Snapshots.SnapshotServicePort
-			timeoutInSeconds := config.Snapshots.TimeoutInSeconds
-			startSnapshotListener(ctx, snapshotServiceIP, snapshotServicePort, timeoutInSeconds)
+			snapshotListenerOnce.Do(func() {
+				logger.Infof("Snapshot listener enabled")
+				snapshotServiceIP := config.Snapshots.SnapshotServiceIP
+				snapshotServicePort := config.Snapshots.SnapshotServicePort
+				timeoutInSeconds := config.Snapshots.TimeoutInSeconds
+				startSnapshotListener(ctx, snapshotServiceIP, snapshotServicePort, timeoutInSeconds)
+			})
+			res.configure("snapshot listener")
+		} else {
+			res.skip("snapshot listener", "disabled")
 		}
 
 		scripts := []struct {
@@ -127,11 +176,15 @@ func agentInit(ctx context.Context) {
 		// These scripts are run regardless of metadata/network access and config options.
 		for _, curr := range scripts {
 			if !curr.enabled {
+				res.skip(curr.script, "disabled")
 				continue
 			}
 
 			if err := run.Quiet(ctx, "google_"+curr.script); err != nil {
 				logger.Warningf("Failed to run %q script: %v", "google_"+curr.script, err)
+				res.fail(curr.script, err)
+			} else {
+				res.configure(curr.script)
 			}
 		}
 
@@ -143,12 +196,16 @@ func agentInit(ctx context.Context) {
 		logger.Debugf("set IO scheduler config")
 		if err := setIOScheduler(); err != nil {
 			logger.Warningf("Failed to set IO scheduler: %v", err)
+			res.fail("io scheduler", err)
+		} else {
+			res.configure("io scheduler")
 		}
 
 		// Allow users to opt out of below instance setup actions.
 		if !config.InstanceSetup.NetworkEnabled {
 			logger.Infof("InstanceSetup.network_enabled is false, skipping setup actions that require metadata")
-			return
+			res.skip("metadata dependent setup", "network_enabled is false")
+			return res
 		}
 
 		if newMetadata == nil {
@@ -168,17 +225,28 @@ func agentInit(ctx context.Context) {
 					logger.Errorf("Failed to reach MDS after attempt to recover network configuration(all retries exhausted): %+v", err)
 					os.Exit(1)
 				}
+				res.configure("fallback network configuration")
 			}
 		}
+		res.metadataReachable = true
 
 		// Early setup the network configurations before we notify systemd we are done.
-		runManager(ctx, addressManager)
+		// The address manager only applies differences, running it again doesn't
+		// duplicate routes.
+		if err := runManager(ctx, addressManager); err != nil {
+			res.fail("network interfaces and routes", err)
+		} else {
+			res.configure("network interfaces and routes")
+		}
 
 		// Disable overcommit accounting; e2 instances only.
 		parts := strings.Split(newMetadata.Instance.MachineType, "/")
 		if strings.HasPrefix(parts[len(parts)-1], "e2-") {
 			if err := run.Quiet(ctx, "sysctl", "vm.overcommit_memory=1"); err != nil {
 				logger.Warningf("Failed to run 'sysctl vm.overcommit_memory=1': %v", err)
+				res.fail("overcommit accounting", err)
+			} else {
+				res.configure("overcommit accounting")
 			}
 		}
 
@@ -189,6 +257,7 @@ func agentInit(ctx context.Context) {
 		instanceID, err := os.ReadFile(instanceIDFile)
 		if err != nil && !os.IsNotExist(err) {
 			logger.Warningf("Not running first-boot actions, error reading instance ID: %v", err)
+			res.fail("first-boot actions", err)
 		} else {
 			if string(instanceID) == "" {
 				// If the file didn't exist or was empty, try legacy key from instance configs.
@@ -205,11 +274,17 @@ func agentInit(ctx context.Context) {
 				if config.InstanceSetup.SetHostKeys {
 					if err := generateSSHKeys(ctx); err != nil {
 						logger.Warningf("Failed to generate SSH keys: %v", err)
+						res.fail("ssh host keys", err)
+					} else {
+						res.configure("ssh host keys")
 					}
 				}
 				if config.InstanceSetup.SetBotoConfig {
 					if err := generateBotoConfig(); err != nil {
 						logger.Warningf("Failed to create boto.cfg: %v", err)
+						res.fail("boto config", err)
+					} else {
+						res.configure("boto config")
 					}
 				}
 
@@ -218,6 +293,8 @@ func agentInit(ctx context.Context) {
 				if err := os.WriteFile(instanceIDFile, []byte(towrite), 0644); err != nil {
 					logger.Warningf("Failed to write instance ID file: %v", err)
 				}
+			} else {
+				res.skip("first-boot actions", "instance ID unchanged")
 			}
 		}
 	}
@@ -226,7 +303,10 @@ func agentInit(ctx context.Context) {
 	// use them. Processes may depend on the Guest Agent at startup to ensure that the credentials are
 	// available for use. By generating the credentials before notifying the systemd, we ensure that
 	// they are generated for any process that depends on the Guest Agent.
-	agentcrypto.Init(ctx)
+	agentcryptoInitOnce.Do(func() { agentcrypto.Init(ctx) })
+	res.configure("mds credentials")
+
+	return res
 }
 
 func generateSSHKeys(ctx context.Context) error {
@@ -0,0 +1,101 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/guest-agent/metadata"
+)
+
+func TestAgentInitResultString(t *testing.T) {
+	res := &agentInitResult{}
+	res.configure("io scheduler")
+	res.skip("snapshot listener", "disabled")
+	res.fail("boto config", fmt.Errorf("fake error"))
+	res.metadataReachable = true
+
+	want := `configured: ["io scheduler"], skipped: ["snapshot listener (disabled)"], failed: ["boto config (fake error)"], metadata reachable: true`
+	if got := res.String(); got != want {
+		t.Errorf("agentInitResult.String() = %q, want: %q", got, want)
+	}
+}
+
+func TestMetadataAfterInit(t *testing.T) {
+	initMetadata := &metadata.Descriptor{}
+	fetchedMetadata := &metadata.Descriptor{}
+
+	tests := []struct {
+		name      string
+		reachable bool
+		mds       *metadata.Descriptor
+		fetchErr  error
+		want      *metadata.Descriptor
+		wantFetch bool
+		wantErr   bool
+	}{
+		{
+			name:      "reachable",
+			reachable: true,
+			mds:       initMetadata,
+			want:      initMetadata,
+		},
+		{
+			name:      "unreachable",
+			mds:       initMetadata,
+			want:      fetchedMetadata,
+			wantFetch: true,
+		},
+		{
+			name:      "reachable-without-metadata",
+			reachable: true,
+			want:      fetchedMetadata,
+			wantFetch: true,
+		},
+		{
+			name:      "fetch-error",
+			fetchErr:  fmt.Errorf("fake error"),
+			wantFetch: true,
+			wantErr:   true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			fetched := false
+			fetch := func(context.Context) (*metadata.Descriptor, error) {
+				fetched = true
+				if tc.fetchErr != nil {
+					return nil, tc.fetchErr
+				}
+				return fetchedMetadata, nil
+			}
+
+			res := &agentInitResult{metadataReachable: tc.reachable}
+			got, err := metadataAfterInit(context.Background(), res, tc.mds, fetch)
+			if (err != nil) != tc.wantErr {
+				t.Errorf("metadataAfterInit(ctx, %s, %v, fetch) = error %v, want error: %t", res, tc.mds, err, tc.wantErr)
+			}
+			if got != tc.want {
+				t.Errorf("metadataAfterInit(ctx, %s, %v, fetch) = %p, want: %p", res, tc.mds, got, tc.want)
+			}
+			if fetched != tc.wantFetch {
+				t.Errorf("metadataAfterInit(ctx, %s, %v, fetch) fetched metadata: %t, want: %t", res, tc.mds, fetched, tc.wantFetch)
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/command"
+	"github.com/GoogleCloudPlatform/guest-agent/utils"
+)
+
+// logsTailCommand is the command monitor command returning the agent's most
+// recent log entries, without waiting for them to be exported.
+const logsTailCommand = "logs.tail"
+
+// sendLogsCommand sends the logs action's request to the running agent,
+// replaceable by unit tests.
+var sendLogsCommand = command.SendCommand
+
+// logBuffer keeps the agent's most recent log entries, it's sized by Core
+// log_buffer_size.
+var logBuffer = utils.NewLogBuffer(0)
+
+// logsTailRequest is the request of the logs.tail command.
+type logsTailRequest struct {
+	command.Request
+	// Lines is the number of most recent entries requested, all the buffered
+	// entries are returned if it's zero.
+	Lines int
+}
+
+// logsTailResponse is the response of the logs.tail command.
+type logsTailResponse struct {
+	command.Response
+	// Entries are the requested log entries, oldest first.
+	Entries []utils.LogBufferEntry
+}
+
+// logsTailHandler handles the logs.tail command.
+func logsTailHandler(b []byte) ([]byte, error) {
+	var resp logsTailResponse
+
+	var req logsTailRequest
+	if err := json.Unmarshal(b, &req); err != nil {
+		resp.Status = 1
+		resp.StatusMessage = fmt.Sprintf("invalid request: %v", err)
+		return json.Marshal(resp)
+	}
+
+	if req.Lines < 0 {
+		resp.Status = 1
+		resp.StatusMessage = fmt.Sprintf("invalid number of lines: %d", req.Lines)
+		return json.Marshal(resp)
+	}
+
+	resp.Entries = logBuffer.Tail(req.Lines)
+	resp.StatusMessage = "OK"
+	return json.Marshal(resp)
+}
+
+// runLogsAction implements the logs action, printing the running agent's most
+// recent log entries to w, the last args[0] lines if given, all the buffered ones
+// otherwise. It returns the process exit code.
+func runLogsAction(ctx context.Context, w io.Writer, args []string) int {
+	var lines int
+	if len(args) > 0 {
+		var err error
+		if lines, err = strconv.Atoi(args[0]); err != nil || lines < 0 {
+			fmt.Fprintf(w, "Invalid number of lines %q.\n", args[0])
+			return 1
+		}
+	}
+
+	req, err := json.Marshal(logsTailRequest{Request: command.Request{Command: logsTailCommand}, Lines: lines})
+	if err != nil {
+		fmt.Fprintf(w, "Failed to marshal %s request: %v\n", logsTailCommand, err)
+		return 1
+	}
+
+	var resp logsTailResponse
+	if err := json.Unmarshal(sendLogsCommand(ctx, req), &resp); err != nil {
+		fmt.Fprintf(w, "Invalid %s response: %v\n", logsTailCommand, err)
+		return 1
+	}
+	if resp.Status != 0 {
+		fmt.Fprintf(w, "%s failed with status %d: %s\n", logsTailCommand, resp.Status, resp.StatusMessage)
+		return 1
+	}
+
+	for _, entry := range resp.Entries {
+		fmt.Fprintf(w, "%s %s\n", entry.Time.Format(time.RFC3339), entry.Message)
+	}
+	return 0
+}
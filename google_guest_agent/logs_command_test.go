@@ -0,0 +1,154 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/guest-agent/utils"
+)
+
+func TestLogsTailHandler(t *testing.T) {
+	oldBuffer := logBuffer
+	t.Cleanup(func() { logBuffer = oldBuffer })
+	logBuffer = utils.NewLogBuffer(10)
+	for i := 1; i <= 3; i++ {
+		fmt.Fprintf(logBuffer, "line %d\n", i)
+	}
+
+	tests := []struct {
+		name       string
+		req        string
+		wantStatus int
+		want       []string
+	}{
+		{
+			name: "all",
+			req:  `{"Name":"logs.tail"}`,
+			want: []string{"line 1", "line 2", "line 3"},
+		},
+		{
+			name: "last_line",
+			req:  `{"Name":"logs.tail","Lines":1}`,
+			want: []string{"line 3"},
+		},
+		{
+			name:       "negative_lines",
+			req:        `{"Name":"logs.tail","Lines":-1}`,
+			wantStatus: 1,
+		},
+		{
+			name:       "invalid_request",
+			req:        `{`,
+			wantStatus: 1,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			b, err := logsTailHandler([]byte(tc.req))
+			if err != nil {
+				t.Fatalf("logsTailHandler(%s) failed unexpectedly with error: %v", tc.req, err)
+			}
+
+			var resp logsTailResponse
+			if err := json.Unmarshal(b, &resp); err != nil {
+				t.Fatalf("json.Unmarshal(%s) failed unexpectedly with error: %v", b, err)
+			}
+
+			if resp.Status != tc.wantStatus {
+				t.Errorf("logsTailHandler(%s) returned status %d, want %d", tc.req, resp.Status, tc.wantStatus)
+			}
+
+			var got []string
+			for _, e := range resp.Entries {
+				got = append(got, e.Message)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tc.want) {
+				t.Errorf("logsTailHandler(%s) returned entries %q, want %q", tc.req, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRunLogsAction(t *testing.T) {
+	oldBuffer, oldSend := logBuffer, sendLogsCommand
+	t.Cleanup(func() { logBuffer, sendLogsCommand = oldBuffer, oldSend })
+	logBuffer = utils.NewLogBuffer(10)
+	for i := 1; i <= 3; i++ {
+		fmt.Fprintf(logBuffer, "line %d\n", i)
+	}
+	sendLogsCommand = func(ctx context.Context, req []byte) []byte {
+		resp, err := logsTailHandler(req)
+		if err != nil {
+			t.Fatalf("logsTailHandler(%s) failed unexpectedly with error: %v", req, err)
+		}
+		return resp
+	}
+
+	tests := []struct {
+		name     string
+		args     []string
+		wantCode int
+		want     []string
+	}{
+		{
+			name: "all",
+			want: []string{"line 1", "line 2", "line 3"},
+		},
+		{
+			name: "last_lines",
+			args: []string{"2"},
+			want: []string{"line 2", "line 3"},
+		},
+		{
+			name:     "invalid_lines",
+			args:     []string{"many"},
+			wantCode: 1,
+		},
+		{
+			name:     "negative_lines",
+			args:     []string{"-1"},
+			wantCode: 1,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if code := runLogsAction(context.Background(), &buf, tc.args); code != tc.wantCode {
+				t.Fatalf("runLogsAction(ctx, %v) = %d, want %d, output: %s", tc.args, code, tc.wantCode, buf.String())
+			}
+			if tc.wantCode != 0 {
+				return
+			}
+
+			lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+			if len(lines) != len(tc.want) {
+				t.Fatalf("runLogsAction(ctx, %v) printed %q, want %d lines", tc.args, buf.String(), len(tc.want))
+			}
+			for i, line := range lines {
+				if !strings.HasSuffix(line, " "+tc.want[i]) {
+					t.Errorf("runLogsAction(ctx, %v) line %d = %q, want suffix %q", tc.args, i, line, tc.want[i])
+				}
+			}
+		})
+	}
+}
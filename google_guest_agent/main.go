@@ -23,6 +23,7 @@ import (
 	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
@@ -54,13 +55,44 @@ var (
 	osInfo                   osinfo.OSInfo
 	mdsClient                *metadata.Client
 	addressManager           = &addressMgr{}
+	clockskewManager         = &clockskewMgr{}
 )
 
 const (
 	regKeyBase = `SOFTWARE\Google\ComputeEngine`
 )
 
+// Manager names, as returned by the managers' Name(). They are matched against
+// the disabled-managers metadata attribute and reported by the agent.stats
+// command, so they are part of the user facing interface and must not change.
+const (
+	addressMgrName       = "addressMgr"
+	clockskewMgrName     = "clockskewMgr"
+	diagnosticsMgrName   = "diagnosticsMgr"
+	metadataHostsMgrName = "metadataHostsMgr"
+	accountsMgrName      = "accountsMgr"
+	osloginMgrName       = "osloginMgr"
+	resolvConfMgrName    = "resolvConfMgr"
+	winAccountsMgrName   = "winAccountsMgr"
+	wsfcManagerName      = "wsfcManager"
+)
+
+// knownManagerNames are the names of the managers of every platform.
+var knownManagerNames = []string{
+	addressMgrName,
+	clockskewMgrName,
+	diagnosticsMgrName,
+	metadataHostsMgrName,
+	accountsMgrName,
+	osloginMgrName,
+	resolvConfMgrName,
+	winAccountsMgrName,
+	wsfcManagerName,
+}
+
 type manager interface {
+	// Name returns the manager's stable name, one of knownManagerNames.
+	Name() string
 	Diff(ctx context.Context) (bool, error)
 	Disabled(ctx context.Context) (bool, error)
 	Set(ctx context.Context) error
@@ -99,57 +131,190 @@ func availableManagers() []manager {
 	}
 
 	return append(managers,
-		&clockskewMgr{},
+		clockskewManager,
 		&osloginMgr{},
 		&accountsMgr{},
+		&metadataHostsMgr{},
+		&resolvConfMgr{},
 	)
 }
 
-func runManager(ctx context.Context, mgr manager) {
+// runManager runs mgr if it's enabled and has changes to apply, the returned
+// error reports any failure to evaluate or apply its configuration.
+func runManager(ctx context.Context, mgr manager) error {
+	outcome, err := runManagerCalls(ctx, mgr)
+	stats.record(mgr, outcome)
+	return err
+}
+
+// disabledByMetadata returns true if mgr is listed, by name as returned by
+// Name(), in the disabled-managers attribute. The instance attribute takes
+// precedence over the project one.
+func disabledByMetadata(mgr manager) bool {
+	if newMetadata == nil {
+		return false
+	}
+
+	attr := newMetadata.Instance.Attributes.DisabledManagers
+	if attr == nil {
+		attr = newMetadata.Project.Attributes.DisabledManagers
+	}
+	if attr == nil {
+		return false
+	}
+
+	name := mgr.Name()
+	for _, disabled := range strings.Split(*attr, ",") {
+		if strings.EqualFold(strings.TrimSpace(disabled), name) {
+			return true
+		}
+	}
+	return false
+}
+
+// runManagerCalls runs the manager's calls and reports the outcome.
+func runManagerCalls(ctx context.Context, mgr manager) (managerOutcome, error) {
+	if disabledByMetadata(mgr) {
+		logger.Debugf("manager %s disabled by the disabled-managers attribute, skipping", mgr.Name())
+		return outcomeDisabled, nil
+	}
+
 	disabled, err := mgr.Disabled(ctx)
 	if err != nil {
 		logger.Errorf("Failed to run manager's Disabled() call: %+v", err)
-		return
+		return outcomeFailure, fmt.Errorf("failed to run manager's Disabled() call: %+v", err)
 	}
 
 	if disabled {
 		logger.Debugf("manager %#v disabled, skipping", mgr)
-		return
+		return outcomeDisabled, nil
 	}
 
 	timeout, err := mgr.Timeout(ctx)
 	if err != nil {
 		logger.Errorf("[%#v] Failed to run manager Timeout() call: %+v", mgr, err)
-		return
+		return outcomeFailure, fmt.Errorf("[%T] failed to run manager Timeout() call: %+v", mgr, err)
 	}
 
 	diff, err := mgr.Diff(ctx)
 	if err != nil {
 		logger.Errorf("[%#v] Failed to run manager Diff() call: %+v", mgr, err)
-		return
+		return outcomeFailure, fmt.Errorf("[%T] failed to run manager Diff() call: %+v", mgr, err)
 	}
 
 	if !timeout && !diff {
 		logger.Debugf("[%#v] Manager reports no diff", mgr)
-		return
+		return outcomeNoDiff, nil
 	}
 
 	logger.Debugf("running %#v manager", mgr)
 	if err := mgr.Set(ctx); err != nil {
 		logger.Errorf("[%#v] Failed to run manager Set() call: %s", mgr, err)
+		return outcomeSetFailure, fmt.Errorf("[%T] failed to run manager Set() call: %s", mgr, err)
 	}
+	return outcomeSetSuccess, nil
 }
 
-func runUpdate(ctx context.Context) {
-	var wg sync.WaitGroup
-	for _, mgr := range availableManagers() {
-		wg.Add(1)
-		go func(mgr manager) {
-			defer wg.Done()
-			runManager(ctx, mgr)
-		}(mgr)
+// updateMu serializes the managers runs of metadata events and resume events,
+// oldMetadata and newMetadata are only written with it held once the event
+// handlers are running.
+var updateMu sync.Mutex
+
+// latestMetadata is the latest metadata seen, published for the goroutines not
+// holding updateMu, e.g. watchers and command handlers.
+var latestMetadata atomic.Pointer[metadata.Descriptor]
+
+// applyMetadata makes mds the latest metadata and runs mgrs against it.
+func applyMetadata(ctx context.Context, mds *metadata.Descriptor, mgrs []manager) {
+	updateMu.Lock()
+	defer updateMu.Unlock()
+
+	newMetadata = mds
+	latestMetadata.Store(mds)
+	health.metadataFetched()
+
+	if err := enableDisableOSLoginCertAuth(ctx); err != nil {
+		logger.Errorf("Failed to enable/disable sshtrustedca watcher: %+v", err)
 	}
-	wg.Wait()
+
+	runUpdate(ctx, mgrs)
+	oldMetadata = newMetadata
+}
+
+// runUpdate runs mgrs, updateMu must be held.
+func runUpdate(ctx context.Context, mgrs []manager) {
+	var mu sync.Mutex
+	var errs []error
+
+	runManagersOrdered(mgrs, func(mgr manager) {
+		if err := runManager(ctx, mgr); err != nil {
+			mu.Lock()
+			errs = append(errs, err)
+			mu.Unlock()
+		}
+	})
+
+	health.updateFinished(errs)
+}
+
+// registerCommandHandlersOnce guards the command handlers registration, handlers
+// are kept registered across command monitor restarts.
+var registerCommandHandlersOnce sync.Once
+
+// startCommandMonitor starts the command monitor, registering the agent's command
+// handlers the first time it's started.
+func startCommandMonitor(ctx context.Context) {
+	command.Init(ctx)
+
+	registerCommandHandlersOnce.Do(func() {
+		if err := command.Get().RegisterHandler(accountsReadyCommand, accountsReadyHandler); err != nil {
+			logger.Errorf("Failed to register %s command handler: %v", accountsReadyCommand, err)
+		}
+
+		if err := command.Get().RegisterHandler(versionCommand, versionHandler); err != nil {
+			logger.Errorf("Failed to register %s command handler: %v", versionCommand, err)
+		}
+
+		if err := command.Get().RegisterHandler(configDumpCommand, configDumpHandler); err != nil {
+			logger.Errorf("Failed to register %s command handler: %v", configDumpCommand, err)
+		}
+
+		if err := command.Get().RegisterHandler(statsCommand, statsHandler); err != nil {
+			logger.Errorf("Failed to register %s command handler: %v", statsCommand, err)
+		}
+
+		if err := command.Get().RegisterHandler(setGuestAttributeCommand, setGuestAttributeHandler(ctx)); err != nil {
+			logger.Errorf("Failed to register %s command handler: %v", setGuestAttributeCommand, err)
+		}
+
+		if err := command.Get().RegisterHandler(mdsGetCommand, mdsGetHandler(ctx)); err != nil {
+			logger.Errorf("Failed to register %s command handler: %v", mdsGetCommand, err)
+		}
+
+		if err := command.Get().RegisterHandler(logsTailCommand, logsTailHandler); err != nil {
+			logger.Errorf("Failed to register %s command handler: %v", logsTailCommand, err)
+		}
+
+		if runtime.GOOS != "windows" {
+			if err := command.Get().RegisterHandler(clockSyncCommand, clockskewManager.syncCommand(ctx)); err != nil {
+				logger.Errorf("Failed to register %s command handler: %v", clockSyncCommand, err)
+			}
+
+			if err := command.Get().RegisterHandler(networkRollbackCommand, networkRollbackHandler(ctx)); err != nil {
+				logger.Errorf("Failed to register %s command handler: %v", networkRollbackCommand, err)
+			}
+		}
+	})
+}
+
+// metadataAfterInit returns the metadata descriptor to use once agentInit ran. The
+// descriptor agentInit got is reused if it reached MDS, otherwise it's fetched
+// again with fetch now that the routes to MDS are in place.
+func metadataAfterInit(ctx context.Context, res *agentInitResult, mds *metadata.Descriptor, fetch func(context.Context) (*metadata.Descriptor, error)) (*metadata.Descriptor, error) {
+	if res.metadataReachable && mds != nil {
+		return mds, nil
+	}
+	return fetch(ctx)
 }
 
 func runAgent(ctx context.Context) {
@@ -161,10 +326,10 @@ func runAgent(ctx context.Context) {
 
 	if runtime.GOOS == "windows" {
 		opts.FormatFunction = logFormatWindows
-		opts.Writers = []io.Writer{&utils.SerialPort{Port: "COM1"}}
+		opts.Writers = []io.Writer{&utils.SerialPort{Port: "COM1"}, logBuffer}
 	} else {
 		opts.FormatFunction = logFormat
-		opts.Writers = []io.Writer{os.Stdout}
+		opts.Writers = []io.Writer{os.Stdout, logBuffer}
 		// Local logging is syslog; we will just use stdout in Linux.
 		opts.DisableLocalLogging = true
 	}
@@ -183,37 +348,49 @@ func runAgent(ctx context.Context) {
 
 	logger.Infof("GCE Agent Started (version %s)", version)
 
+	// The agent runs every manager, any invalid option must stop it.
+	if err := cfg.Get().Validate(); err != nil {
+		logger.Fatalf("Invalid instance configuration: %v", err)
+	}
+
 	osInfo = osinfo.Get()
-	mdsClient = metadata.New()
+	mdsClient = metadata.New(metadata.WithUserAgent(fmt.Sprintf("%s/%s", programName, version)))
 
-	agentInit(ctx)
+	initResult := agentInit(ctx)
 
 	if cfg.Get().Unstable.CommandMonitorEnabled {
-		command.Init(ctx)
-		defer command.Close()
+		startCommandMonitor(ctx)
 	}
+	defer command.Close()
 
 	// Previous request to metadata *may* not have worked becasue routes don't get added until agentInit.
+	// Fetch it again unless agentInit reached MDS.
 	var err error
-	if newMetadata == nil {
+	newMetadata, err = metadataAfterInit(ctx, initResult, newMetadata, mdsClient.Get)
+	if err != nil {
 		// Error here doesn't matter, if we cant get metadata, we cant record telemetry.
-		newMetadata, err = mdsClient.Get(ctx)
-		if err != nil {
-			logger.Debugf("Error getting metdata: %v", err)
-		}
+		logger.Debugf("Error getting metdata: %v", err)
 	}
 
 	// Try to re-initialize logger now, we know after agentInit() is more likely to have metadata available.
 	// TODO: move all this metadata dependent code to its own metadata event handler.
 	if newMetadata != nil {
+		latestMetadata.Store(newMetadata)
 		opts.ProjectName = newMetadata.Project.ProjectID
 		if err := logger.Init(ctx, opts); err != nil {
 			logger.Errorf("Error initializing logger: %v", err)
 		}
 	}
 
+	// Run first-boot managers before handling metadata events and reporting ready,
+	// startup scripts must not race with their setup.
+	oldMetadata = &metadata.Descriptor{}
+	if err := runFirstBootManagers(ctx, availableManagers()); err != nil {
+		logger.Errorf("Failed to run first-boot managers: %v", err)
+	}
+
 	// knownJobs is list of default jobs that run on a pre-defined schedule.
-	knownJobs := []scheduler.Job{telemetry.New(mdsClient, programName, version)}
+	knownJobs := []scheduler.Job{telemetry.New(mdsClient, programName, version), newKeyExpirationJob(), newNetworkPendingJob()}
 	scheduler.ScheduleJobs(ctx, knownJobs, false)
 
 	eventManager := events.Get()
@@ -227,34 +404,44 @@ func runAgent(ctx context.Context) {
 		return
 	}
 
+	if err := startResumeWatcher(ctx, eventManager); err != nil {
+		logger.Errorf("Failed to start resume watcher: %v", err)
+	}
+
+	// The first metadata event runs all managers, first-boot ones included.
 	oldMetadata = &metadata.Descriptor{}
+	mdsEventHandler := newMetadataEventHandler(mdsClient.Get)
 	eventManager.Subscribe(mdsEvent.LongpollEvent, nil, func(ctx context.Context, evType string, data interface{}, evData *events.EventData) bool {
 		logger.Debugf("Handling metadata %q event.", evType)
+		health.progressed()
 
-		// If metadata watcher failed there isn't much we can do, just ignore the event and
-		// allow the watcher to get it corrected.
-		if evData.Error != nil {
-			logger.Infof("Metadata event watcher failed, ignoring: %+v", evData.Error)
+		// If metadata watcher failed, ignore the event and allow the watcher to get it
+		// corrected. Persistent failures fall back to fetching the metadata directly.
+		mds := mdsEventHandler.descriptor(ctx, evData)
+		if mds == nil {
 			return true
 		}
 
-		if evData.Data == nil {
-			logger.Infof("Metadata event watcher didn't pass in the metadata, ignoring.")
-			return true
-		}
+		applyMetadata(ctx, mds, availableManagers())
+		health.progressed()
 
-		newMetadata = evData.Data.(*metadata.Descriptor)
-
-		if err := enableDisableOSLoginCertAuth(ctx); err != nil {
-			logger.Errorf("Failed to enable/disable sshtrustedca watcher: %+v", err)
+		// All managers handled metadata at least once, users are provisioned.
+		if !accountsReady.Swap(true) {
+			logger.Infof("Users provisioned, reporting accounts ready")
 		}
 
-		runUpdate(ctx)
-		oldMetadata = newMetadata
-
 		return true
 	})
 
+	startHealthCheck(ctx)
+
+	handleConfigReload(ctx, &opts)
+
+	// Watchers and subscribers are registered, report readiness and keep systemd's
+	// watchdog alive while the metadata event loop makes progress.
+	health.progressed()
+	notifySystemdReady(ctx, health.responsive)
+
 	if err := eventManager.Run(ctx); err != nil {
 		logger.Fatalf("Failed to run event manager: %+v", err)
 	}
@@ -294,6 +481,18 @@ func main() {
 		os.Exit(1)
 	}
 
+	// Every action needs the metadata server, the other sections are checked once
+	// logging is set up when running the agent, see runAgent, so client actions
+	// like selftest still work with an invalid configuration.
+	if err := cfg.Get().ValidateSections("mds"); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid instance configuration: %+v", err)
+		os.Exit(1)
+	}
+	metadata.PreferIPv6(cfg.Get().MDS.PreferIPv6)
+	utils.SetExpirationLayouts(utils.SplitExpirationLayouts(cfg.Get().Accounts.KeyExpirationLayouts))
+	applyLogRateLimit(cfg.Get())
+	logBuffer.SetSize(cfg.Get().Core.LogBufferSize)
+
 	var action string
 	if len(os.Args) < 2 {
 		action = "run"
@@ -306,6 +505,14 @@ func main() {
 		os.Exit(0)
 	}
 
+	if action == "selftest" {
+		os.Exit(runSelfTest(ctx, os.Stdout, selfTestChecks()))
+	}
+
+	if action == "logs" {
+		os.Exit(runLogsAction(ctx, os.Stdout, os.Args[2:]))
+	}
+
 	if err := register(ctx, "GCEAgent", "GCEAgent", "", runAgent, action); err != nil {
 		logger.Fatalf("error registering service: %s", err)
 	}
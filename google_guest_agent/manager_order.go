@@ -0,0 +1,136 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+)
+
+// dependentManager is implemented by managers that must only run after other
+// managers have finished running.
+type dependentManager interface {
+	// dependencies returns the names, as returned by Name(), of the managers that
+	// must run first. Managers not available on the platform are ignored.
+	dependencies() []string
+}
+
+// managerDependencies returns the available dependencies of each manager, keyed
+// by manager name. It returns an error if managers share a name or depend on a
+// manager that isn't one of knownManagerNames nor in mgrs.
+func managerDependencies(mgrs []manager) (map[string][]string, error) {
+	available := make(map[string]bool)
+	for _, mgr := range mgrs {
+		if available[mgr.Name()] {
+			return nil, fmt.Errorf("duplicate manager name %s", mgr.Name())
+		}
+		available[mgr.Name()] = true
+	}
+
+	res := make(map[string][]string)
+	for _, mgr := range mgrs {
+		dependent, ok := mgr.(dependentManager)
+		if !ok {
+			continue
+		}
+		for _, dep := range dependent.dependencies() {
+			switch {
+			case available[dep]:
+				res[mgr.Name()] = append(res[mgr.Name()], dep)
+			case !slices.Contains(knownManagerNames, dep):
+				return nil, fmt.Errorf("manager %s depends on unknown manager %s", mgr.Name(), dep)
+			}
+		}
+	}
+	return res, nil
+}
+
+// checkDependencyCycles returns an error if deps has a dependency cycle.
+func checkDependencyCycles(deps map[string][]string) error {
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := make(map[string]int)
+
+	var visit func(name string) error
+	visit = func(name string) error {
+		switch state[name] {
+		case visiting:
+			return fmt.Errorf("manager %s depends on itself", name)
+		case visited:
+			return nil
+		}
+
+		state[name] = visiting
+		for _, dep := range deps[name] {
+			if err := visit(dep); err != nil {
+				return err
+			}
+		}
+		state[name] = visited
+		return nil
+	}
+
+	for name := range deps {
+		if err := visit(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runManagersOrdered calls run for all managers concurrently, except managers
+// declaring dependencies which wait for their dependencies to finish first. If
+// dependencies are invalid, i.e. have a cycle, they are ignored and all managers
+// run concurrently.
+func runManagersOrdered(mgrs []manager, run func(manager)) {
+	deps, err := managerDependencies(mgrs)
+	if err == nil {
+		err = checkDependencyCycles(deps)
+	}
+	if err != nil {
+		logger.Errorf("Ignoring managers dependencies: %v", err)
+		deps = nil
+	}
+
+	// Managers sharing a name, only possible with invalid dependencies, each
+	// account for their name's completion.
+	done := make(map[string]*sync.WaitGroup)
+	for _, mgr := range mgrs {
+		if done[mgr.Name()] == nil {
+			done[mgr.Name()] = &sync.WaitGroup{}
+		}
+		done[mgr.Name()].Add(1)
+	}
+
+	var wg sync.WaitGroup
+	for _, mgr := range mgrs {
+		wg.Add(1)
+		go func(mgr manager) {
+			defer wg.Done()
+			defer done[mgr.Name()].Done()
+
+			for _, dep := range deps[mgr.Name()] {
+				done[dep].Wait()
+			}
+			run(mgr)
+		}(mgr)
+	}
+	wg.Wait()
+}
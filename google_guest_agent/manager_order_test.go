@@ -0,0 +1,151 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// orderTestMgr is a manager with configurable dependencies.
+type orderTestMgr struct {
+	statsTestMgr
+	deps []string
+}
+
+func (m *orderTestMgr) dependencies() []string { return m.deps }
+
+func TestRunManagersOrdered(t *testing.T) {
+	first := &statsTestMgr{name: "firstMgr"}
+	// The Windows only manager isn't available, the dependency is ignored.
+	second := &orderTestMgr{statsTestMgr{name: "secondMgr"}, []string{"firstMgr", wsfcManagerName}}
+	third := &orderTestMgr{statsTestMgr{name: "thirdMgr"}, []string{"secondMgr"}}
+
+	var mu sync.Mutex
+	var order []string
+	runManagersOrdered([]manager{third, second, first}, func(mgr manager) {
+		// Give dependent managers a chance to run first if not waiting.
+		if mgr == manager(first) {
+			time.Sleep(20 * time.Millisecond)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		order = append(order, mgr.Name())
+	})
+
+	want := []string{"firstMgr", "secondMgr", "thirdMgr"}
+	if len(order) != len(want) {
+		t.Fatalf("runManagersOrdered() ran %v, want %v", order, want)
+	}
+	for i := range want {
+		if order[i] != want[i] {
+			t.Errorf("runManagersOrdered() ran %v, want %v", order, want)
+			break
+		}
+	}
+}
+
+func TestRunManagersOrderedInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		mgrs []manager
+	}{
+		{
+			name: "cycle",
+			mgrs: []manager{
+				&orderTestMgr{statsTestMgr{name: "cycleAMgr"}, []string{"cycleBMgr"}},
+				&orderTestMgr{statsTestMgr{name: "cycleBMgr"}, []string{"cycleAMgr"}},
+			},
+		},
+		{
+			name: "duplicate_names",
+			mgrs: []manager{
+				&statsTestMgr{name: "dupMgr"},
+				&statsTestMgr{name: "dupMgr"},
+				&orderTestMgr{statsTestMgr{name: "dependentMgr"}, []string{"dupMgr"}},
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ran := make(chan string, len(tc.mgrs))
+			finished := make(chan bool)
+			go func() {
+				runManagersOrdered(tc.mgrs, func(mgr manager) { ran <- mgr.Name() })
+				close(finished)
+			}()
+
+			select {
+			case <-finished:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("runManagersOrdered() with invalid dependencies did not finish")
+			}
+			if len(ran) != len(tc.mgrs) {
+				t.Errorf("runManagersOrdered() with invalid dependencies ran %d managers, want %d", len(ran), len(tc.mgrs))
+			}
+		})
+	}
+}
+
+func TestManagerDependenciesErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		mgrs []manager
+	}{
+		{
+			name: "unknown_dependency",
+			mgrs: []manager{&orderTestMgr{statsTestMgr{name: "typoMgr"}, []string{"osloginMgrr"}}},
+		},
+		{
+			name: "duplicate_names",
+			mgrs: []manager{&osloginMgr{}, &osloginMgr{}},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if deps, err := managerDependencies(tc.mgrs); err == nil {
+				t.Errorf("managerDependencies() = %v, want error", deps)
+			}
+		})
+	}
+}
+
+func TestAccountsManagerDependsOnOSLogin(t *testing.T) {
+	deps, err := managerDependencies([]manager{&accountsMgr{}, &osloginMgr{}})
+	if err != nil {
+		t.Fatalf("managerDependencies() failed unexpectedly with error: %v", err)
+	}
+	if got := deps[accountsMgrName]; len(got) != 1 || got[0] != osloginMgrName {
+		t.Errorf("managerDependencies() returned %v for accountsMgr, want [osloginMgr]", got)
+	}
+
+	// Without the OS Login manager, i.e. on Windows, the dependency is ignored.
+	deps, err = managerDependencies([]manager{&accountsMgr{}})
+	if err != nil {
+		t.Fatalf("managerDependencies() failed unexpectedly with error: %v", err)
+	}
+	if got := deps[accountsMgrName]; len(got) != 0 {
+		t.Errorf("managerDependencies() returned %v for accountsMgr, want none", got)
+	}
+}
+
+func TestAvailableManagersDependencies(t *testing.T) {
+	if _, err := managerDependencies(availableManagers()); err != nil {
+		t.Errorf("managerDependencies(availableManagers()) failed unexpectedly with error: %v", err)
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/command"
+)
+
+// statsCommand is the command monitor command reporting the managers' counters.
+const statsCommand = "agent.stats"
+
+// managerOutcome is the outcome of a single runManager() call.
+type managerOutcome int
+
+const (
+	// outcomeDisabled means the manager was disabled.
+	outcomeDisabled managerOutcome = iota
+	// outcomeNoDiff means the manager reported no diff, Set() was not called.
+	outcomeNoDiff
+	// outcomeSetSuccess means Set() was called and succeeded.
+	outcomeSetSuccess
+	// outcomeSetFailure means Set() was called and failed.
+	outcomeSetFailure
+	// outcomeFailure means Disabled(), Timeout() or Diff() failed.
+	outcomeFailure
+)
+
+// managerCounters are the counters of a single manager.
+type managerCounters struct {
+	// Runs is the number of times the manager was run.
+	Runs uint64
+	// Disabled is the number of runs the manager was disabled.
+	Disabled uint64
+	// DiffDetected is the number of runs the manager reported a diff or timeout,
+	// i.e. Set() was called.
+	DiffDetected uint64
+	// Success is the number of successful Set() calls.
+	Success uint64
+	// Failure is the number of failed runs, either Set() or the calls before it.
+	Failure uint64
+}
+
+// managerStats holds the counters of all managers, keyed by manager name.
+type managerStats struct {
+	mu       sync.Mutex
+	counters map[string]*managerCounters
+}
+
+// statsResponse is the response of the agent.stats command.
+type statsResponse struct {
+	command.Response
+	// Managers are the counters keyed by manager name.
+	Managers map[string]managerCounters
+}
+
+// stats is the managers' counters.
+var stats = &managerStats{}
+
+// record accounts a runManager() outcome for mgr.
+func (s *managerStats) record(mgr manager, outcome managerOutcome) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.counters == nil {
+		s.counters = make(map[string]*managerCounters)
+	}
+
+	name := mgr.Name()
+	counters, found := s.counters[name]
+	if !found {
+		counters = &managerCounters{}
+		s.counters[name] = counters
+	}
+
+	counters.Runs++
+	switch outcome {
+	case outcomeDisabled:
+		counters.Disabled++
+	case outcomeSetSuccess:
+		counters.DiffDetected++
+		counters.Success++
+	case outcomeSetFailure:
+		counters.DiffDetected++
+		counters.Failure++
+	case outcomeFailure:
+		counters.Failure++
+	}
+}
+
+// snapshot returns a copy of the current counters.
+func (s *managerStats) snapshot() map[string]managerCounters {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	res := make(map[string]managerCounters, len(s.counters))
+	for name, counters := range s.counters {
+		res[name] = *counters
+	}
+	return res
+}
+
+// statsHandler handles the agent.stats command.
+func statsHandler(_ []byte) ([]byte, error) {
+	return json.Marshal(statsResponse{Managers: stats.snapshot()})
+}
@@ -0,0 +1,163 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/guest-agent/metadata"
+	"github.com/google/go-cmp/cmp"
+)
+
+// statsTestMgr is a manager with configurable results, named "statsTestMgr"
+// unless name is set.
+type statsTestMgr struct {
+	name     string
+	disabled bool
+	diff     bool
+	diffErr  error
+	setErr   error
+}
+
+func (m *statsTestMgr) Name() string {
+	if m.name != "" {
+		return m.name
+	}
+	return "statsTestMgr"
+}
+
+func (m *statsTestMgr) Diff(ctx context.Context) (bool, error)     { return m.diff, m.diffErr }
+func (m *statsTestMgr) Disabled(ctx context.Context) (bool, error) { return m.disabled, nil }
+func (m *statsTestMgr) Set(ctx context.Context) error              { return m.setErr }
+func (m *statsTestMgr) Timeout(ctx context.Context) (bool, error)  { return false, nil }
+
+func TestManagerStats(t *testing.T) {
+	oldStats := stats
+	stats = &managerStats{}
+	t.Cleanup(func() { stats = oldStats })
+
+	ctx := context.Background()
+	runs := []*statsTestMgr{
+		{disabled: true},
+		{},
+		{diff: true},
+		{diff: true},
+		{diff: true, setErr: fmt.Errorf("set error")},
+		{diffErr: fmt.Errorf("diff error")},
+	}
+	for _, mgr := range runs {
+		runManager(ctx, mgr)
+	}
+
+	b, err := statsHandler(nil)
+	if err != nil {
+		t.Fatalf("statsHandler(nil) failed unexpectedly with error: %v", err)
+	}
+
+	var resp statsResponse
+	if err := json.Unmarshal(b, &resp); err != nil {
+		t.Fatalf("json.Unmarshal(%s) failed unexpectedly with error: %v", b, err)
+	}
+
+	want := map[string]managerCounters{
+		"statsTestMgr": {Runs: 6, Disabled: 1, DiffDetected: 3, Success: 2, Failure: 2},
+	}
+	if diff := cmp.Diff(want, resp.Managers); diff != "" {
+		t.Errorf("statsHandler(nil) returned unexpected counters (-want +got):\n%s", diff)
+	}
+}
+
+func TestManagerNames(t *testing.T) {
+	mgrs := []manager{
+		&addressMgr{},
+		&clockskewMgr{},
+		&diagnosticsMgr{},
+		&metadataHostsMgr{},
+		&accountsMgr{},
+		&osloginMgr{},
+		&resolvConfMgr{},
+		&winAccountsMgr{},
+		&wsfcManager{},
+	}
+
+	var got []string
+	for _, mgr := range mgrs {
+		got = append(got, mgr.Name())
+	}
+	if diff := cmp.Diff(knownManagerNames, got); diff != "" {
+		t.Errorf("Name() of the managers returned unexpected names (-want +got):\n%s", diff)
+	}
+}
+
+func TestDisabledByMetadata(t *testing.T) {
+	oldMetadata := newMetadata
+	t.Cleanup(func() { newMetadata = oldMetadata })
+
+	list := func(s string) *string { return &s }
+
+	tests := []struct {
+		name     string
+		instance *string
+		project  *string
+		want     bool
+	}{
+		{
+			name: "not_set",
+		},
+		{
+			name:     "instance",
+			instance: list("accountsMgr, statsTestMgr"),
+			want:     true,
+		},
+		{
+			name:    "project",
+			project: list("STATSTESTMGR"),
+			want:    true,
+		},
+		{
+			name:     "instance_overrides_project",
+			instance: list(""),
+			project:  list("statsTestMgr"),
+		},
+		{
+			name:     "other_managers",
+			instance: list("accountsMgr,osloginMgr"),
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			newMetadata = &metadata.Descriptor{}
+			newMetadata.Instance.Attributes.DisabledManagers = tc.instance
+			newMetadata.Project.Attributes.DisabledManagers = tc.project
+
+			mgr := &statsTestMgr{diff: true}
+			if got := disabledByMetadata(mgr); got != tc.want {
+				t.Errorf("disabledByMetadata(%s) = %t, want %t", mgr.Name(), got, tc.want)
+			}
+
+			outcome, err := runManagerCalls(context.Background(), mgr)
+			if err != nil {
+				t.Fatalf("runManagerCalls(ctx, %s) failed unexpectedly with error: %v", mgr.Name(), err)
+			}
+			if (outcome == outcomeDisabled) != tc.want {
+				t.Errorf("runManagerCalls(ctx, %s) = %v, want disabled: %t", mgr.Name(), outcome, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/command"
+)
+
+// mdsGetCommand is the command monitor command reading a metadata key through the
+// agent's metadata client, for callers that can't reach the metadata server.
+const mdsGetCommand = "mds.get"
+
+// mdsGetDeniedKeys are the metadata keys, as path.Match patterns, that mds.get
+// never proxies as they hand out credentials of the instance.
+var mdsGetDeniedKeys = []string{
+	"instance/service-accounts/*/token",
+	"instance/service-accounts/*/identity",
+	"instance/credentials",
+	"instance/credentials/*",
+}
+
+// mdsGetDenied reports whether key, ignoring any query parameters, is one of
+// mdsGetDeniedKeys. The metadata client decodes percent-escapes and resolves "."
+// and ".." segments when building the request URL, so keys are matched once
+// decoded, and keys that aren't in canonical form or still hold escapes once
+// decoded are denied: they could otherwise reach a denied key.
+func mdsGetDenied(key string) bool {
+	key, _, _ = strings.Cut(key, "?")
+	key, _, _ = strings.Cut(key, "#")
+	key, err := url.PathUnescape(key)
+	if err != nil || strings.Contains(key, "%") {
+		return true
+	}
+	// Escaped query and fragment delimiters, i.e. %3F, are decoded by now.
+	key, _, _ = strings.Cut(key, "?")
+	key, _, _ = strings.Cut(key, "#")
+
+	trimmed := strings.Trim(key, "/")
+	if path.Clean("/"+trimmed) != "/"+trimmed {
+		return true
+	}
+	for _, segment := range strings.Split(trimmed, "/") {
+		if segment == "." || segment == ".." {
+			return true
+		}
+	}
+	for _, pattern := range mdsGetDeniedKeys {
+		if matched, _ := path.Match(pattern, trimmed); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// mdsGetKey reads a metadata key, overridden in tests.
+var mdsGetKey = func(ctx context.Context, key string, recursive bool) (string, error) {
+	if recursive {
+		return mdsClient.GetKeyRecursive(ctx, key)
+	}
+	return mdsClient.GetKey(ctx, key, nil)
+}
+
+// mdsGetRequest is the request of the mds.get command.
+type mdsGetRequest struct {
+	command.Request
+	// Key is the metadata key relative to the metadata root, i.e.
+	// "instance/hostname".
+	Key string
+	// Recursive requests the key's whole subtree as JSON.
+	Recursive bool
+}
+
+// mdsGetResponse is the response of the mds.get command.
+type mdsGetResponse struct {
+	command.Response
+	// Value is the metadata value of the requested key.
+	Value string
+}
+
+// mdsGetHandler returns the handler of the mds.get command. The command is
+// refused unless enabled with Unstable mds_proxy_enabled, as it proxies metadata
+// server access to every caller allowed on the command monitor. Credential keys
+// in mdsGetDeniedKeys are refused regardless.
+func mdsGetHandler(ctx context.Context) command.Handler {
+	return func(b []byte) ([]byte, error) {
+		var resp mdsGetResponse
+
+		if config := cfg.Get().Unstable; config == nil || !config.MDSProxyEnabled {
+			resp.Status = 1
+			resp.StatusMessage = fmt.Sprintf("%s is disabled, enable it with Unstable mds_proxy_enabled", mdsGetCommand)
+			return json.Marshal(resp)
+		}
+
+		var req mdsGetRequest
+		if err := json.Unmarshal(b, &req); err != nil {
+			resp.Status = 1
+			resp.StatusMessage = fmt.Sprintf("invalid request: %v", err)
+			return json.Marshal(resp)
+		}
+
+		if req.Key == "" {
+			resp.Status = 1
+			resp.StatusMessage = "missing metadata key"
+			return json.Marshal(resp)
+		}
+
+		if mdsGetDenied(req.Key) {
+			resp.Status = 1
+			resp.StatusMessage = fmt.Sprintf("metadata key %q is not allowed", req.Key)
+			return json.Marshal(resp)
+		}
+
+		value, err := mdsGetKey(ctx, req.Key, req.Recursive)
+		if err != nil {
+			resp.Status = 1
+			resp.StatusMessage = fmt.Sprintf("failed to get metadata key %q: %v", req.Key, err)
+			return json.Marshal(resp)
+		}
+
+		resp.Value = value
+		resp.StatusMessage = "OK"
+		return json.Marshal(resp)
+	}
+}
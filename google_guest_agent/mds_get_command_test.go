@@ -0,0 +1,149 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+)
+
+func TestMDSGetHandler(t *testing.T) {
+	origGetKey := mdsGetKey
+	t.Cleanup(func() { mdsGetKey = origGetKey })
+
+	tests := []struct {
+		name          string
+		enabled       bool
+		request       string
+		getErr        error
+		wantStatus    int
+		wantValue     string
+		wantRecursive bool
+	}{
+		{
+			name:       "disabled",
+			request:    `{"Command":"mds.get","Key":"instance/hostname"}`,
+			wantStatus: 1,
+		},
+		{
+			name:      "key",
+			enabled:   true,
+			request:   `{"Command":"mds.get","Key":"instance/hostname"}`,
+			wantValue: "value",
+		},
+		{
+			name:          "recursive",
+			enabled:       true,
+			request:       `{"Command":"mds.get","Key":"instance/hostname","Recursive":true}`,
+			wantValue:     "value",
+			wantRecursive: true,
+		},
+		{
+			name:       "get_failure",
+			enabled:    true,
+			request:    `{"Command":"mds.get","Key":"instance/hostname"}`,
+			getErr:     fmt.Errorf("get error"),
+			wantStatus: 1,
+		},
+		{
+			name:       "denied_key",
+			enabled:    true,
+			request:    `{"Command":"mds.get","Key":"instance/service-accounts/default/token"}`,
+			wantStatus: 1,
+		},
+		{
+			name:       "missing_key",
+			enabled:    true,
+			request:    `{"Command":"mds.get"}`,
+			wantStatus: 1,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := cfg.Load([]byte(fmt.Sprintf("[Unstable]\nmds_proxy_enabled = %t", tc.enabled))); err != nil {
+				t.Fatalf("cfg.Load() failed unexpectedly with error: %v", err)
+			}
+
+			mdsGetKey = func(ctx context.Context, key string, recursive bool) (string, error) {
+				if key != "instance/hostname" || recursive != tc.wantRecursive {
+					t.Errorf("mdsGetKey(ctx, %q, %t) called, want (ctx, %q, %t)", key, recursive, "instance/hostname", tc.wantRecursive)
+				}
+				return "value", tc.getErr
+			}
+
+			b, err := mdsGetHandler(context.Background())([]byte(tc.request))
+			if err != nil {
+				t.Fatalf("mdsGetHandler(ctx)(%s) failed unexpectedly with error: %v", tc.request, err)
+			}
+
+			var resp mdsGetResponse
+			if err := json.Unmarshal(b, &resp); err != nil {
+				t.Fatalf("json.Unmarshal(%s) failed unexpectedly with error: %v", b, err)
+			}
+
+			if resp.Status != tc.wantStatus {
+				t.Errorf("mdsGetHandler(ctx)(%s) returned status %d, want %d", tc.request, resp.Status, tc.wantStatus)
+			}
+			if resp.Value != tc.wantValue {
+				t.Errorf("mdsGetHandler(ctx)(%s) returned value %q, want %q", tc.request, resp.Value, tc.wantValue)
+			}
+		})
+	}
+}
+
+func TestMDSGetDenied(t *testing.T) {
+	tests := []struct {
+		key  string
+		want bool
+	}{
+		{key: "instance/hostname", want: false},
+		{key: "instance/service-accounts/default/email", want: false},
+		{key: "instance/service-accounts", want: false},
+		{key: "instance/service-accounts/default/token", want: true},
+		{key: "instance/service-accounts/sa@project.iam.gserviceaccount.com/token", want: true},
+		{key: "/instance/service-accounts/default/token/", want: true},
+		{key: "instance//service-accounts/default/./token", want: true},
+		{key: "instance/service-accounts/default/token?scopes=x", want: true},
+		{key: "instance/service-accounts/default/identity?audience=x", want: true},
+		{key: "instance/attributes/../service-accounts/default/identity", want: true},
+		{key: "../v1/instance/service-accounts/default/token", want: true},
+		{key: "instance/../../computeMetadata/v1/instance/hostname", want: true},
+		{key: "instance/./hostname", want: true},
+		{key: "instance/credentials", want: true},
+		{key: "instance/credentials/mds-client-certificate", want: true},
+		{key: "instance/service-accounts/default/%74oken", want: true},
+		{key: "instance/service-accounts/default%2Ftoken", want: true},
+		{key: "instance/service-accounts/default/token%3Fx", want: true},
+		{key: "instance/service-accounts/default/token%23x", want: true},
+		{key: "instance/service-accounts/default/%2574oken", want: true},
+		{key: "instance/attributes/%2E%2E/service-accounts/default/token", want: true},
+		{key: "instance/service-accounts/default/token#x", want: true},
+		{key: "instance/hostname%zz", want: true},
+		{key: "instance/%68ostname", want: false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.key, func(t *testing.T) {
+			if got := mdsGetDenied(tc.key); got != tc.want {
+				t.Errorf("mdsGetDenied(%q) = %t, want %t", tc.key, got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/events"
+	mdsEvent "github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/events/metadata"
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/scheduler"
+	"github.com/GoogleCloudPlatform/guest-agent/metadata"
+	"github.com/GoogleCloudPlatform/guest-agent/utils"
+	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+)
+
+const (
+	// metadataEventWarnThreshold is the number of consecutive failed metadata
+	// events after which failures are logged as warnings.
+	metadataEventWarnThreshold = 3
+	// metadataEventFallbackThreshold is the number of consecutive failed metadata
+	// events after which failures are logged as errors and the metadata is fetched
+	// directly instead of waiting for the next longpoll event.
+	metadataEventFallbackThreshold = 5
+)
+
+// logLimiter rate limits the agent's errors repeated during outages, see
+// applyLogRateLimit.
+var logLimiter = utils.NewLogLimiter(0)
+
+// applyLogRateLimit applies the configured log rate limit interval, an invalid
+// interval disables rate limiting.
+func applyLogRateLimit(config *cfg.Sections) {
+	interval, err := time.ParseDuration(config.Core.LogRateLimitInterval)
+	if err != nil {
+		interval = 0
+	}
+	logLimiter.SetInterval(interval)
+	scheduler.SetLogRateLimit(interval)
+	mdsEvent.SetLogRateLimit(interval)
+}
+
+// metadataEventHandler extracts the metadata descriptor from longpoll events,
+// keeping track of consecutive failures so a persistent watcher failure doesn't
+// silently stall the managers.
+type metadataEventHandler struct {
+	// failures is the number of consecutive failed metadata events.
+	failures int
+	// get fetches the metadata descriptor without longpolling.
+	get func(context.Context) (*metadata.Descriptor, error)
+}
+
+// newMetadataEventHandler returns a metadataEventHandler falling back to get
+// when longpoll events keep failing.
+func newMetadataEventHandler(get func(context.Context) (*metadata.Descriptor, error)) *metadataEventHandler {
+	return &metadataEventHandler{get: get}
+}
+
+// descriptor returns the metadata descriptor carried by evData, or nil if it's
+// not available. After metadataEventFallbackThreshold consecutive failures the
+// descriptor is fetched directly, the failure count is reset on success.
+func (h *metadataEventHandler) descriptor(ctx context.Context, evData *events.EventData) *metadata.Descriptor {
+	var err error
+	var mds *metadata.Descriptor
+
+	if evData.Error != nil {
+		err = fmt.Errorf("metadata event watcher failed: %+v", evData.Error)
+	} else if mds, _ = evData.Data.(*metadata.Descriptor); mds == nil {
+		err = fmt.Errorf("metadata event watcher didn't pass in the metadata")
+	}
+
+	if err == nil {
+		h.failures = 0
+		return mds
+	}
+
+	h.failures++
+
+	switch {
+	case h.failures < metadataEventWarnThreshold:
+		// Transient failures are expected, allow the watcher to get it corrected.
+		logger.Infof("%v (%d consecutive failures), ignoring.", err, h.failures)
+		return nil
+	case h.failures < metadataEventFallbackThreshold:
+		logger.Warningf("%v (%d consecutive failures), ignoring.", err, h.failures)
+		return nil
+	}
+
+	// Failures keep happening on every event during an outage, only log them
+	// once per rate limit interval.
+	logLimiter.Logf(logger.Errorf, "%v (%d or more consecutive failures), fetching metadata directly.", err, metadataEventFallbackThreshold)
+	mds, err = h.get(ctx)
+	if err != nil {
+		logLimiter.Logf(logger.Errorf, "Failed to fetch metadata directly: %+v", err)
+		return nil
+	}
+
+	logger.Infof("Successfully fetched metadata directly, recovered from metadata event failures after %d consecutive failures.", h.failures)
+	logLimiter.Reset(logger.Infof)
+	h.failures = 0
+	return mds
+}
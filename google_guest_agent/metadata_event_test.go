@@ -0,0 +1,84 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/events"
+	"github.com/GoogleCloudPlatform/guest-agent/metadata"
+)
+
+func TestMetadataEventHandler(t *testing.T) {
+	ctx := context.Background()
+	fetched := &metadata.Descriptor{}
+	fetched.Instance.ID = "1"
+
+	var getCalls int
+	var getErr error
+	h := newMetadataEventHandler(func(context.Context) (*metadata.Descriptor, error) {
+		getCalls++
+		if getErr != nil {
+			return nil, getErr
+		}
+		return fetched, nil
+	})
+
+	failed := &events.EventData{Error: fmt.Errorf("unmarshal error")}
+	empty := &events.EventData{}
+
+	// Failures before the threshold are ignored without fetching.
+	for i := 1; i < metadataEventFallbackThreshold; i++ {
+		evData := failed
+		if i%2 == 0 {
+			evData = empty
+		}
+		if got := h.descriptor(ctx, evData); got != nil {
+			t.Fatalf("descriptor(%+v) = %+v on failure %d, want nil", evData, got, i)
+		}
+	}
+	if getCalls != 0 {
+		t.Fatalf("descriptor() fetched metadata %d times before reaching the threshold, want 0", getCalls)
+	}
+
+	// Reaching the threshold falls back to a direct fetch, if it fails keep trying.
+	getErr = fmt.Errorf("fetch error")
+	if got := h.descriptor(ctx, failed); got != nil {
+		t.Errorf("descriptor() = %+v with failing fallback, want nil", got)
+	}
+	if getCalls != 1 {
+		t.Errorf("descriptor() fetched metadata %d times, want 1", getCalls)
+	}
+
+	getErr = nil
+	if got := h.descriptor(ctx, failed); got != fetched {
+		t.Errorf("descriptor() = %+v, want fetched descriptor %+v", got, fetched)
+	}
+	if h.failures != 0 {
+		t.Errorf("descriptor() left %d failures after recovering, want 0", h.failures)
+	}
+
+	// A successful event resets the failures count.
+	h.failures = metadataEventFallbackThreshold - 1
+	want := &metadata.Descriptor{}
+	if got := h.descriptor(ctx, &events.EventData{Data: want}); got != want {
+		t.Errorf("descriptor() = %+v, want %+v", got, want)
+	}
+	if h.failures != 0 {
+		t.Errorf("descriptor() left %d failures after a successful event, want 0", h.failures)
+	}
+}
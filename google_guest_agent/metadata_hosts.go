@@ -0,0 +1,207 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-agent/utils"
+	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+)
+
+const (
+	// metadataIP is the metadata server's IP address.
+	metadataIP = "169.254.169.254"
+	// hostnameIP is the address the instance's own host names are mapped to, as
+	// commonly done by distributions for hosts without a static IP address.
+	hostnameIP = "127.0.1.1"
+	// metadataHostsMarker marks the hosts file entries managed by the guest agent,
+	// it differs from the hostname setup scripts' marker so their entries are never
+	// rolled back.
+	metadataHostsMarker = "# Added by Google Compute Engine guest agent."
+)
+
+var (
+	// hostsFile is the hosts file path, replaceable by unit tests.
+	hostsFile = "/etc/hosts"
+
+	// metadataHostnames are the metadata server's host names resolved with the
+	// hosts file entry.
+	metadataHostnames = []string{"metadata.google.internal", "metadata.internal.google"}
+)
+
+// metadataHostsMgr keeps the hosts file entries derived from metadata: the metadata
+// server's host names, so metadata requests don't depend on DNS, and optionally
+// the instance's own host names, so reverse lookups of the hostname don't hang.
+type metadataHostsMgr struct{}
+
+// hostsEntry is a hosts file entry.
+type hostsEntry struct {
+	// ip is the entry's IP address.
+	ip string
+	// names are the host names mapped to ip.
+	names []string
+}
+
+// String returns the hosts file line of the entry, marked as managed by the agent.
+func (e hostsEntry) String() string {
+	return fmt.Sprintf("%s %s  %s", e.ip, strings.Join(e.names, " "), metadataHostsMarker)
+}
+
+// metadataHostsEntry returns the hosts file entry of the metadata server.
+func metadataHostsEntry() hostsEntry {
+	return hostsEntry{ip: metadataIP, names: metadataHostnames}
+}
+
+// hostnameHostsEntry returns the hosts file entry of the instance's fqdn and short
+// hostname, fqdn is not valid if it's empty.
+func hostnameHostsEntry(fqdn string) (hostsEntry, bool) {
+	if fqdn == "" {
+		return hostsEntry{}, false
+	}
+	names := []string{fqdn}
+	if short, _, found := strings.Cut(fqdn, "."); found && short != "" {
+		names = append(names, short)
+	}
+	return hostsEntry{ip: hostnameIP, names: names}, true
+}
+
+// isManagedHostsEntry returns true if line is an entry added by the guest agent.
+func isManagedHostsEntry(line string) bool {
+	return strings.HasSuffix(strings.TrimSpace(line), metadataHostsMarker)
+}
+
+// hasHostsEntry returns true if lines already map all the entry's host names to
+// its IP address.
+func hasHostsEntry(lines []string, entry hostsEntry) bool {
+	found := make(map[string]bool)
+	for _, line := range lines {
+		content, _, _ := strings.Cut(line, "#")
+		fields := strings.Fields(content)
+		if len(fields) < 2 || fields[0] != entry.ip {
+			continue
+		}
+		for _, name := range fields[1:] {
+			found[name] = true
+		}
+	}
+
+	for _, name := range entry.names {
+		if !found[name] {
+			return false
+		}
+	}
+	return true
+}
+
+// updateHostsFile returns hosts with the entries previously added by the guest
+// agent replaced with entries. Entries already defined by the user are not added.
+func updateHostsFile(hosts string, entries []hostsEntry) string {
+	var lines []string
+	for _, line := range strings.Split(hosts, "\n") {
+		if !isManagedHostsEntry(line) {
+			lines = append(lines, line)
+		}
+	}
+
+	var added []string
+	for _, entry := range entries {
+		if !hasHostsEntry(lines, entry) {
+			added = append(added, entry.String())
+		}
+	}
+
+	// Keep the entries before the trailing new line, if any.
+	if len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = append(append(lines[:len(lines)-1], added...), "")
+	} else {
+		lines = append(lines, added...)
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// wantedHostsEntries returns the entries the hosts file should have according to
+// the configuration and metadata.
+func wantedHostsEntries() []hostsEntry {
+	config := cfg.Get().MetadataHosts
+
+	var res []hostsEntry
+	if config.Enabled {
+		res = append(res, metadataHostsEntry())
+	}
+
+	if config.HostnameEntry && newMetadata != nil {
+		if entry, ok := hostnameHostsEntry(newMetadata.Instance.Hostname); ok {
+			res = append(res, entry)
+		}
+	}
+	return res
+}
+
+// readHostsFile returns the contents of the hosts file and its permissions.
+func readHostsFile() (string, os.FileMode, error) {
+	info, err := os.Stat(hostsFile)
+	if err != nil {
+		return "", 0, err
+	}
+	contents, err := os.ReadFile(hostsFile)
+	if err != nil {
+		return "", 0, err
+	}
+	return string(contents), info.Mode().Perm(), nil
+}
+
+// Diff reports a diff if the hosts file doesn't match the configured state.
+func (m *metadataHostsMgr) Diff(ctx context.Context) (bool, error) {
+	hosts, _, err := readHostsFile()
+	if err != nil {
+		return false, err
+	}
+	return updateHostsFile(hosts, wantedHostsEntries()) != hosts, nil
+}
+
+// Name returns the manager's name, see metadataHostsMgrName.
+func (m *metadataHostsMgr) Name() string {
+	return metadataHostsMgrName
+}
+
+func (m *metadataHostsMgr) Timeout(ctx context.Context) (bool, error) {
+	return false, nil
+}
+
+// Disabled reports the manager disabled on Windows or if the section is not
+// configured. Disabling the option itself is handled by Set, removing the entry.
+func (m *metadataHostsMgr) Disabled(ctx context.Context) (bool, error) {
+	return runtime.GOOS == "windows" || cfg.Get().MetadataHosts == nil, nil
+}
+
+// Set updates the hosts file entries, entries no longer wanted, i.e. disabled or
+// for a previous hostname, are rolled back.
+func (m *metadataHostsMgr) Set(ctx context.Context) error {
+	hosts, perm, err := readHostsFile()
+	if err != nil {
+		return err
+	}
+
+	entries := wantedHostsEntries()
+	logger.Infof("Updating %s with %d guest agent managed entries", hostsFile, len(entries))
+	return utils.SaferWriteFile([]byte(updateHostsFile(hosts, entries)), hostsFile, perm)
+}
@@ -0,0 +1,231 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-agent/metadata"
+)
+
+func TestUpdateHostsFile(t *testing.T) {
+	mds := metadataHostsEntry()
+	entry := mds.String()
+	host, _ := hostnameHostsEntry("vm.c.project.internal")
+	oldHost, _ := hostnameHostsEntry("old.c.project.internal")
+	localhost := "127.0.0.1 localhost\n"
+	scriptEntry := "169.254.169.254 metadata.google.internal  # Added by Google\n"
+
+	tests := []struct {
+		name    string
+		hosts   string
+		entries []hostsEntry
+		want    string
+	}{
+		{
+			name:    "add_entry",
+			hosts:   localhost,
+			entries: []hostsEntry{mds},
+			want:    localhost + entry + "\n",
+		},
+		{
+			name:    "add_entry_no_trailing_newline",
+			hosts:   "127.0.0.1 localhost",
+			entries: []hostsEntry{mds},
+			want:    "127.0.0.1 localhost\n" + entry,
+		},
+		{
+			name:    "entry_exists",
+			hosts:   localhost + entry + "\n",
+			entries: []hostsEntry{mds},
+			want:    localhost + entry + "\n",
+		},
+		{
+			name:    "user_entry_exists",
+			hosts:   localhost + "169.254.169.254 metadata.google.internal metadata.internal.google\n",
+			entries: []hostsEntry{mds},
+			want:    localhost + "169.254.169.254 metadata.google.internal metadata.internal.google\n",
+		},
+		{
+			name:    "partial_script_entry",
+			hosts:   localhost + scriptEntry,
+			entries: []hostsEntry{mds},
+			want:    localhost + scriptEntry + entry + "\n",
+		},
+		{
+			name:    "rollback",
+			hosts:   localhost + entry + "\n" + scriptEntry,
+			entries: nil,
+			want:    localhost + scriptEntry,
+		},
+		{
+			name:    "disabled_no_entry",
+			hosts:   localhost + scriptEntry,
+			entries: nil,
+			want:    localhost + scriptEntry,
+		},
+		{
+			name:    "add_hostname_entry",
+			hosts:   localhost,
+			entries: []hostsEntry{mds, host},
+			want:    localhost + entry + "\n" + host.String() + "\n",
+		},
+		{
+			name:    "hostname_changed",
+			hosts:   localhost + oldHost.String() + "\n",
+			entries: []hostsEntry{host},
+			want:    localhost + host.String() + "\n",
+		},
+		{
+			name:    "user_hostname_entry_exists",
+			hosts:   localhost + "127.0.1.1 vm.c.project.internal vm\n",
+			entries: []hostsEntry{host},
+			want:    localhost + "127.0.1.1 vm.c.project.internal vm\n",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := updateHostsFile(tc.hosts, tc.entries); got != tc.want {
+				t.Errorf("updateHostsFile(%q, %v) = %q, want %q", tc.hosts, tc.entries, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestMetadataHostsMgr(t *testing.T) {
+	ctx := context.Background()
+	mgr := &metadataHostsMgr{}
+
+	oldHostsFile := hostsFile
+	hostsFile = filepath.Join(t.TempDir(), "hosts")
+	t.Cleanup(func() { hostsFile = oldHostsFile })
+
+	localhost := "127.0.0.1 localhost\n"
+	if err := os.WriteFile(hostsFile, []byte(localhost), 0644); err != nil {
+		t.Fatalf("os.WriteFile(%q) failed unexpectedly with error: %v", hostsFile, err)
+	}
+
+	for _, enable := range []bool{true, false} {
+		config := "[MetadataHosts]\nenabled = false"
+		want := localhost
+		if enable {
+			config = "[MetadataHosts]\nenabled = true"
+			want = localhost + metadataHostsEntry().String() + "\n"
+		}
+		if err := cfg.Load([]byte(config)); err != nil {
+			t.Fatalf("cfg.Load() failed unexpectedly with error: %v", err)
+		}
+
+		diff, err := mgr.Diff(ctx)
+		if err != nil {
+			t.Fatalf("metadataHostsMgr.Diff(ctx) failed unexpectedly with error: %v", err)
+		}
+		if !diff {
+			t.Errorf("metadataHostsMgr.Diff(ctx) = false with enabled = %t, want true", enable)
+		}
+
+		if err := mgr.Set(ctx); err != nil {
+			t.Fatalf("metadataHostsMgr.Set(ctx) failed unexpectedly with error: %v", err)
+		}
+
+		got, err := os.ReadFile(hostsFile)
+		if err != nil {
+			t.Fatalf("os.ReadFile(%q) failed unexpectedly with error: %v", hostsFile, err)
+		}
+		if string(got) != want {
+			t.Errorf("metadataHostsMgr.Set(ctx) with enabled = %t wrote %q, want %q", enable, got, want)
+		}
+
+		if diff, _ := mgr.Diff(ctx); diff {
+			t.Errorf("metadataHostsMgr.Diff(ctx) = true after Set() with enabled = %t, want false", enable)
+		}
+	}
+}
+
+func TestHostnameHostsEntry(t *testing.T) {
+	tests := []struct {
+		fqdn  string
+		want  []string
+		valid bool
+	}{
+		{fqdn: "vm.c.project.internal", want: []string{"vm.c.project.internal", "vm"}, valid: true},
+		{fqdn: "vm", want: []string{"vm"}, valid: true},
+		{fqdn: "", valid: false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.fqdn, func(t *testing.T) {
+			got, valid := hostnameHostsEntry(tc.fqdn)
+			if valid != tc.valid {
+				t.Fatalf("hostnameHostsEntry(%q) returned valid = %t, want %t", tc.fqdn, valid, tc.valid)
+			}
+			if !valid {
+				return
+			}
+			if got.ip != hostnameIP || !reflect.DeepEqual(got.names, tc.want) {
+				t.Errorf("hostnameHostsEntry(%q) = %+v, want names %v mapped to %s", tc.fqdn, got, tc.want, hostnameIP)
+			}
+		})
+	}
+}
+
+func TestMetadataHostsMgrHostname(t *testing.T) {
+	ctx := context.Background()
+	mgr := &metadataHostsMgr{}
+
+	oldHostsFile := hostsFile
+	hostsFile = filepath.Join(t.TempDir(), "hosts")
+	oldMetadata := newMetadata
+	t.Cleanup(func() {
+		hostsFile = oldHostsFile
+		newMetadata = oldMetadata
+	})
+
+	localhost := "127.0.0.1 localhost\n"
+	if err := os.WriteFile(hostsFile, []byte(localhost), 0644); err != nil {
+		t.Fatalf("os.WriteFile(%q) failed unexpectedly with error: %v", hostsFile, err)
+	}
+	if err := cfg.Load([]byte("[MetadataHosts]\nhostname_entry = true")); err != nil {
+		t.Fatalf("cfg.Load() failed unexpectedly with error: %v", err)
+	}
+
+	for _, fqdn := range []string{"old.c.project.internal", "vm.c.project.internal"} {
+		newMetadata = &metadata.Descriptor{}
+		newMetadata.Instance.Hostname = fqdn
+
+		if diff, err := mgr.Diff(ctx); err != nil || !diff {
+			t.Fatalf("metadataHostsMgr.Diff(ctx) = (%t, %v) with hostname %q, want (true, nil)", diff, err, fqdn)
+		}
+		if err := mgr.Set(ctx); err != nil {
+			t.Fatalf("metadataHostsMgr.Set(ctx) failed unexpectedly with error: %v", err)
+		}
+
+		entry, _ := hostnameHostsEntry(fqdn)
+		want := localhost + entry.String() + "\n"
+		got, err := os.ReadFile(hostsFile)
+		if err != nil {
+			t.Fatalf("os.ReadFile(%q) failed unexpectedly with error: %v", hostsFile, err)
+		}
+		if string(got) != want {
+			t.Errorf("metadataHostsMgr.Set(ctx) with hostname %q wrote %q, want %q", fqdn, got, want)
+		}
+	}
+}
@@ -25,8 +25,8 @@ import (
 	"os/exec"
 	"regexp"
 	"strconv"
+	"strings"
 
-	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/osinfo"
 	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/run"
 	"github.com/GoogleCloudPlatform/guest-agent/metadata"
 	"github.com/GoogleCloudPlatform/guest-agent/utils"
@@ -41,6 +41,12 @@ var (
 
 	// execLookPath points to the function to check if a path exists.
 	execLookPath = exec.LookPath
+
+	// netInterfaces points to the function listing the system's network interfaces.
+	netInterfaces = net.Interfaces
+
+	// interfaceByName points to the function looking up a network interface by its name.
+	interfaceByName = net.InterfaceByName
 )
 
 func cliExists(name string) (bool, error) {
@@ -55,6 +61,22 @@ func cliExists(name string) (bool, error) {
 	return false, fmt.Errorf("error looking up path for %q: %v", name, err)
 }
 
+// setSysctl sets the kernel parameter key to value using sysctl. The current
+// value is read first and the write is skipped if it's already set, avoiding
+// repeated writes on every network setup.
+func setSysctl(ctx context.Context, key, value string) error {
+	res := run.WithOutput(ctx, "sysctl", "-n", key)
+	if res.ExitCode == 0 && strings.Join(strings.Fields(res.StdOut), " ") == value {
+		logger.Debugf("sysctl %s is already set to %q, skipping", key, value)
+		return nil
+	}
+
+	if err := run.Quiet(ctx, "sysctl", fmt.Sprintf("%s=%s", key, value)); err != nil {
+		return fmt.Errorf("failed to set sysctl %s to %q: %w", key, value, err)
+	}
+	return nil
+}
+
 // logInterfaceState logs all network interface state present on the machine.
 func logInterfaceState(ctx context.Context) {
 	logger.Infof("Getting current interface state and routes")
@@ -79,18 +101,43 @@ func logInterfaceState(ctx context.Context) {
 	logger.Infof("Currently present IP routes:\n %s", res.StdOut)
 }
 
-// interfaceNames extracts the names of the network interfaces from the provided list
-// of network interfaces.
-func interfaceNames(nics []metadata.NetworkInterfaces) ([]string, error) {
-	var ifaces []string
-	for _, ni := range nics {
-		iface, err := GetInterfaceByMAC(ni.Mac)
-		if err != nil {
-			return nil, err
+// interfaceDecisions returns a one line summary per ethernet interface of how
+// managerName configures it: whether it's managed, obtains DHCPv4 and DHCPv6
+// leases and its MTU. interfaces are the nics' names, the first being the primary.
+func interfaceDecisions(managerName string, nics []metadata.NetworkInterfaces, interfaces []string) []string {
+	var res []string
+	for i, nic := range nics {
+		if i >= len(interfaces) {
+			break
+		}
+		iface := interfaces[i]
+		isPrimary := i == 0
+
+		managed := shouldManageInterface(iface, isPrimary)
+		reason := ""
+		switch {
+		case isExcludedInterface(iface):
+			reason = " (excluded by configuration)"
+		case !managed:
+			reason = " (primary NIC left to the OS, manage_primary_nic is disabled)"
 		}
-		ifaces = append(ifaces, iface.Name)
+
+		mtu := "default"
+		if nic.MTU > 0 {
+			mtu = strconv.Itoa(nic.MTU)
+		}
+
+		res = append(res, fmt.Sprintf("Interface %s (mac: %s, primary: %t): manager: %s, managed: %t%s, dhcp4: %t, dhcp6: %t, mtu: %s",
+			iface, nic.Mac, isPrimary, managerName, managed, reason, managed, managed && nic.DHCPv6Refresh != "", mtu))
+	}
+	return res
+}
+
+// logInterfaceDecisions logs the interfaceDecisions summary at INFO level.
+func logInterfaceDecisions(managerName string, nics []metadata.NetworkInterfaces, interfaces []string) {
+	for _, decision := range interfaceDecisions(managerName, nics, interfaces) {
+		logger.Infof(decision)
 	}
-	return ifaces, nil
 }
 
 // vlanInterfaceParentMap gets a map of VLAN IDs and its parent NIC.
@@ -163,6 +210,20 @@ func interfacesMTUMap(nics []metadata.NetworkInterfaces) (map[string]int, error)
 	return res, nil
 }
 
+// localInterfaceNames returns the set of the system's network interface names.
+func localInterfaceNames() (map[string]bool, error) {
+	interfaces, err := netInterfaces()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get interfaces: %v", err)
+	}
+
+	names := make(map[string]bool)
+	for _, iface := range interfaces {
+		names[iface.Name] = true
+	}
+	return names, nil
+}
+
 // GetInterfaceByMAC gets the interface given the mac string.
 func GetInterfaceByMAC(mac string) (net.Interface, error) {
 	hwaddr, err := net.ParseMAC(mac)
@@ -264,22 +325,8 @@ func readYamlFile(filepath string, ptr any) error {
 	return yaml.Unmarshal(bytes, ptr)
 }
 
-// fileExists returns true only if file exists and it can successfully run stat
-// on the path.
-func fileExists(filepath string) bool {
-	s, err := os.Stat(filepath)
-	if err != nil && !errors.Is(os.ErrNotExist, err) {
-		return false
-	}
-	return !s.IsDir()
-}
-
 // isUbuntu1804 checks if agent is running on Ubuntu 18.04. This is a helper
 // method to support some exceptions we have for 18.04.
 func isUbuntu1804() bool {
-	info := osinfo.Get()
-	if info.OS == "ubuntu" && info.VersionID == "18.04" {
-		return true
-	}
-	return false
+	return osinfoGet().Is("ubuntu", 18, 4)
 }
@@ -15,12 +15,16 @@
 package manager
 
 import (
+	"context"
 	"fmt"
-	"os"
-	"path/filepath"
+	"io"
 	"sort"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/run"
 	"github.com/GoogleCloudPlatform/guest-agent/metadata"
 	"github.com/google/go-cmp/cmp"
 )
@@ -139,40 +143,136 @@ func TestVlanInterfaceParentMap(t *testing.T) {
 	}
 }
 
-func TestFileExists(t *testing.T) {
-	dir := t.TempDir()
-	f, err := os.CreateTemp(dir, "file")
-	if err != nil {
-		t.Fatalf("os.CreateTemp(%s, file) failed unexpectedly with error: %v", dir, err)
+// sysctlMockRunner mocks sysctl reads and records sysctl writes.
+type sysctlMockRunner struct {
+	// current is the result returned when reading a value.
+	current *run.Result
+	// setErr is returned when writing a value.
+	setErr error
+	// written are the sysctl write requests.
+	written []string
+}
+
+func (s *sysctlMockRunner) Quiet(ctx context.Context, name string, args ...string) error {
+	s.written = append(s.written, name+" "+strings.Join(args, " "))
+	return s.setErr
+}
+
+func (s *sysctlMockRunner) WithOutput(ctx context.Context, name string, args ...string) *run.Result {
+	return s.current
+}
+
+func (s *sysctlMockRunner) WithOutputTimeout(ctx context.Context, timeout time.Duration, name string, args ...string) *run.Result {
+	return s.current
+}
+
+func (s *sysctlMockRunner) WithCombinedOutput(ctx context.Context, name string, args ...string) *run.Result {
+	return s.current
+}
+
+func (s *sysctlMockRunner) WithInput(ctx context.Context, stdin io.Reader, name string, args ...string) *run.Result {
+	return s.current
+}
+
+func TestSetSysctl(t *testing.T) {
+	orig := run.Client
+	t.Cleanup(func() { run.Client = orig })
+
+	key := "net.ipv6.conf.eth0.accept_ra_rt_info_max_plen"
+
+	tests := []struct {
+		name        string
+		current     *run.Result
+		setErr      error
+		wantWritten []string
+		wantErr     bool
+	}{
+		{
+			name:    "already_set",
+			current: &run.Result{StdOut: "128\n"},
+		},
+		{
+			name:        "different_value",
+			current:     &run.Result{StdOut: "0\n"},
+			wantWritten: []string{"sysctl " + key + "=128"},
+		},
+		{
+			name:        "read_failure",
+			current:     &run.Result{ExitCode: 255, StdErr: "unknown key"},
+			wantWritten: []string{"sysctl " + key + "=128"},
+		},
+		{
+			name:        "write_failure",
+			current:     &run.Result{StdOut: "0\n"},
+			setErr:      fmt.Errorf("permission denied"),
+			wantWritten: []string{"sysctl " + key + "=128"},
+			wantErr:     true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			runner := &sysctlMockRunner{current: tc.current, setErr: tc.setErr}
+			run.Client = runner
+
+			err := setSysctl(context.Background(), key, "128")
+			if (err != nil) != tc.wantErr {
+				t.Errorf("setSysctl(ctx, %s, 128) = %v, want error: %t", key, err, tc.wantErr)
+			}
+
+			if diff := cmp.Diff(tc.wantWritten, runner.written); diff != "" {
+				t.Errorf("setSysctl(ctx, %s, 128) wrote unexpected values (-want +got):\n%s", key, diff)
+			}
+		})
 	}
-	defer f.Close()
+}
 
+func TestInterfaceDecisions(t *testing.T) {
 	tests := []struct {
-		name string
-		want bool
-		path string
+		name   string
+		config string
+		want   []string
 	}{
 		{
-			name: "existing_file",
-			want: true,
-			path: f.Name(),
+			name:   "primary_managed",
+			config: "[NetworkInterfaces]\nmanage_primary_nic = true",
+			want: []string{
+				"Interface eth0 (mac: mac0, primary: true): manager: netplan, managed: true, dhcp4: true, dhcp6: false, mtu: 1460",
+				"Interface eth1 (mac: mac1, primary: false): manager: netplan, managed: true, dhcp4: true, dhcp6: true, mtu: default",
+			},
 		},
 		{
-			name: "existing_dir",
-			want: false,
-			path: dir,
+			name:   "primary_unmanaged",
+			config: "[NetworkInterfaces]\nmanage_primary_nic = false",
+			want: []string{
+				"Interface eth0 (mac: mac0, primary: true): manager: netplan, managed: false (primary NIC left to the OS, manage_primary_nic is disabled), dhcp4: false, dhcp6: false, mtu: 1460",
+				"Interface eth1 (mac: mac1, primary: false): manager: netplan, managed: true, dhcp4: true, dhcp6: true, mtu: default",
+			},
 		},
 		{
-			name: "non_existing_file",
-			want: false,
-			path: filepath.Join(t.TempDir(), "random"),
+			name:   "excluded",
+			config: "[NetworkInterfaces]\nexclude_interfaces = eth1",
+			want: []string{
+				"Interface eth0 (mac: mac0, primary: true): manager: netplan, managed: false (primary NIC left to the OS, manage_primary_nic is disabled), dhcp4: false, dhcp6: false, mtu: 1460",
+				"Interface eth1 (mac: mac1, primary: false): manager: netplan, managed: false (excluded by configuration), dhcp4: false, dhcp6: false, mtu: default",
+			},
 		},
 	}
 
-	for _, test := range tests {
-		t.Run(test.name, func(t *testing.T) {
-			if got := fileExists(test.path); got != test.want {
-				t.Errorf("fileExists(%s) = %t, want = %t", test.path, got, test.want)
+	nics := []metadata.NetworkInterfaces{
+		{Mac: "mac0", MTU: 1460},
+		{Mac: "mac1", DHCPv6Refresh: "123"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := cfg.Load([]byte(tc.config)); err != nil {
+				t.Fatalf("cfg.Load(%q) failed unexpectedly with error: %v", tc.config, err)
+			}
+
+			got := interfaceDecisions("netplan", nics, []string{"eth0", "eth1"})
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("interfaceDecisions() returned unexpected diff (-want +got):\n%s", diff)
 			}
 		})
 	}
@@ -152,7 +152,18 @@ type ipVersion struct {
 }
 
 // dhclient implements the manager.Service interface for dhclient use cases.
-type dhclient struct{}
+type dhclient struct {
+	// pendingIPv6Release maps the interfaces no longer IPv6 whose DHCPv6 lease
+	// release is deferred to the time they were first seen no longer IPv6.
+	pendingIPv6Release map[string]time.Time
+}
+
+// hasPendingWork returns true if the release of a DHCPv6 lease is deferred, the
+// setup must run again even if the metadata didn't change so it happens once the
+// delay expires.
+func (n *dhclient) hasPendingWork() bool {
+	return len(n.pendingIPv6Release) > 0
+}
 
 // Name returns the name of the network manager service.
 func (n *dhclient) Name() string {
@@ -172,7 +183,11 @@ func (n *dhclient) isDhclientInstalled() (bool, error) {
 
 // IsManaging checks if the dhclient CLI is available.
 func (n *dhclient) IsManaging(ctx context.Context, iface string) (bool, error) {
-	return n.isDhclientInstalled()
+	installed, err := n.isDhclientInstalled()
+	if !installed {
+		notManaging(ctx, n, "dhclient not found")
+	}
+	return installed, err
 }
 
 // SetupEthernetInterface sets up the non-primary interfaces with dhclient, having different setup procedures
@@ -190,6 +205,7 @@ func (n *dhclient) SetupEthernetInterface(ctx context.Context, config *cfg.Secti
 	if err != nil {
 		return fmt.Errorf("error partitioning interfaces: %v", err)
 	}
+	releaseIpv6Interfaces = n.deferIPv6Release(releaseIpv6Interfaces, time.Duration(config.NetworkInterfaces.DHCPv6ReleaseDelay)*time.Second, time.Now())
 
 	// Release IPv6 leases.
 	for _, iface := range releaseIpv6Interfaces {
@@ -221,10 +237,11 @@ func (n *dhclient) SetupEthernetInterface(ctx context.Context, config *cfg.Secti
 
 	// Setup IPv6.
 	for _, iface := range obtainIpv6Interfaces {
-		// Set appropriate system values.
-		val := fmt.Sprintf("net.ipv6.conf.%s.accept_ra_rt_info_max_plen=128", iface)
-		if err := run.Quiet(ctx, "sysctl", val); err != nil {
-			return err
+		// Set appropriate system values, failing to do so is not fatal for the
+		// interface setup.
+		key := fmt.Sprintf("net.ipv6.conf.%s.accept_ra_rt_info_max_plen", iface)
+		if err := setSysctl(ctx, key, "128"); err != nil {
+			logger.Warningf("%v", err)
 		}
 
 		if err := runDhclient(ctx, ipv6, iface, false); err != nil {
@@ -275,7 +292,7 @@ func (n *dhclient) SetupVlanInterface(ctx context.Context, config *cfg.Sections,
 			}
 		}
 
-		if err := vlanIfaceCommonSet.RunQuiet(ctx, ifaceDesc); err != nil {
+		if _, err := vlanIfaceCommonSet.RunWithOutput(ctx, ifaceDesc); err != nil {
 			return err
 		}
 
@@ -308,7 +325,7 @@ func (n *dhclient) SetupVlanInterface(ctx context.Context, config *cfg.Sections,
 
 		for data, batch := range batches {
 			for _, curr := range batch {
-				if err := curr.RunQuiet(ctx, data); err != nil {
+				if _, err := curr.RunWithOutput(ctx, data); err != nil {
 					return err
 				}
 			}
@@ -410,13 +427,14 @@ func partitionInterfaces(ctx context.Context, interfaces, ipv6Interfaces []strin
 	var releaseIpv6Interfaces []string
 
 	for i, iface := range interfaces {
-		if !shouldManageInterface(i == 0) {
+		if !shouldManageInterface(iface, i == 0) {
 			// Do not setup anything for this interface to avoid duplicate processes.
-			logger.Debugf("ManagePrimaryNIC is disabled, skipping dhclient launch for %s", iface)
+			logger.Debugf("Interface %s is not managed by the guest agent, skipping dhclient launch", iface)
 			continue
 		}
-		// On 18.04 we fallback to dhclient as networkctl is very old and has not reload support for example.
-		// Default netplan config will take care of it, do not launch dhclient for primary NIC on 18.04.
+		// On 18.04 we fallback to dhclient if ubuntu1804_netplan_dropin is disabled, networkctl is very old
+		// and has no reload support for example. Default netplan config will take care of it, do not launch
+		// dhclient for primary NIC on 18.04.
 		if (i == 0) && isUbuntu1804() {
 			logger.Debugf("ManagePrimaryNIC is enabled, but skipping primary nic as its managed by default OS config")
 			continue
@@ -450,6 +468,31 @@ func partitionInterfaces(ctx context.Context, interfaces, ipv6Interfaces []strin
 	return obtainIpv4Interfaces, obtainIpv6Interfaces, releaseIpv6Interfaces, nil
 }
 
+// deferIPv6Release returns the interfaces of candidates whose DHCPv6 lease must be
+// released, those seen no longer IPv6 for at least delay as of now. The others are
+// tracked until the next call, interfaces that are no longer candidates, i.e. IPv6
+// again, are forgotten so flapping metadata doesn't release leases.
+func (n *dhclient) deferIPv6Release(candidates []string, delay time.Duration, now time.Time) []string {
+	pending := make(map[string]time.Time)
+	var release []string
+
+	for _, iface := range candidates {
+		since, found := n.pendingIPv6Release[iface]
+		if !found {
+			since = now
+		}
+		if now.Sub(since) >= delay {
+			release = append(release, iface)
+			continue
+		}
+		logger.Infof("Interface %s is no longer IPv6 since %s, deferring the release of its DHCPv6 lease by %s.", iface, since.Format(time.RFC3339), delay)
+		pending[iface] = since
+	}
+
+	n.pendingIPv6Release = pending
+	return release
+}
+
 // dhclientProcessExists checks if a dhclient process for the provided
 // interface and IP version exists.
 func dhclientProcessExists(_ context.Context, iface string, ipVersion ipVersion) (bool, error) {
@@ -19,6 +19,7 @@ package manager
 import (
 	"context"
 	"fmt"
+	"io"
 	"os/exec"
 	"slices"
 	"strings"
@@ -66,6 +67,10 @@ func (d dhclientMockRunner) WithCombinedOutput(ctx context.Context, name string,
 	return &run.Result{}
 }
 
+func (d dhclientMockRunner) WithInput(ctx context.Context, stdin io.Reader, name string, args ...string) *run.Result {
+	return &run.Result{}
+}
+
 // The mock Ps client to use for this test.
 type dhclientMockPs struct {
 	// ifaces is the list of mock interfaces.
@@ -352,6 +357,84 @@ func TestPartitionInterfaces(t *testing.T) {
 	}
 }
 
+// TestDeferIPv6Release tests that deferIPv6Release only releases leases of
+// interfaces no longer IPv6 for at least the configured delay.
+func TestDeferIPv6Release(t *testing.T) {
+	tests := []struct {
+		// name is the name of the test.
+		name string
+		// delay is the time releases are deferred by.
+		delay time.Duration
+		// elapsed is the time elapsed since the first setup on each setup.
+		elapsed []time.Duration
+		// candidates are the release candidates of each setup.
+		candidates [][]string
+		// want are the interfaces released on each setup.
+		want [][]string
+	}{
+		{
+			name:       "no-delay",
+			elapsed:    []time.Duration{0, 0},
+			candidates: [][]string{{"eth1"}, {"eth1", "eth2"}},
+			want:       [][]string{{"eth1"}, {"eth1", "eth2"}},
+		},
+		{
+			name:       "delayed",
+			delay:      time.Minute,
+			elapsed:    []time.Duration{0, 30 * time.Second, time.Minute, 2 * time.Minute},
+			candidates: [][]string{{"eth1"}, {"eth1", "eth2"}, {"eth1", "eth2"}, {"eth2"}},
+			want:       [][]string{nil, nil, {"eth1"}, {"eth2"}},
+		},
+		{
+			name:       "unchanged-setups",
+			delay:      time.Minute,
+			elapsed:    []time.Duration{0, time.Second, 2 * time.Second, 3 * time.Second},
+			candidates: [][]string{{"eth1"}, {"eth1"}, {"eth1"}, {"eth1"}},
+			want:       [][]string{nil, nil, nil, nil},
+		},
+		{
+			name:       "flapping",
+			delay:      time.Minute,
+			elapsed:    []time.Duration{0, time.Minute, 2 * time.Minute, 3 * time.Minute},
+			candidates: [][]string{{"eth1"}, nil, {"eth1"}, nil},
+			want:       [][]string{nil, nil, nil, nil},
+		},
+	}
+
+	start := time.Now()
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			n := &dhclient{}
+			for i, candidates := range test.candidates {
+				now := start.Add(test.elapsed[i])
+				if got := n.deferIPv6Release(candidates, test.delay, now); !slices.Equal(got, test.want[i]) {
+					t.Errorf("deferIPv6Release(%v, %s, now) on setup %d = %v, want %v", candidates, test.delay, i, got, test.want[i])
+				}
+			}
+		})
+	}
+}
+
+// TestDhclientHasPendingWork tests that dhclient reports pending work while a
+// DHCPv6 lease release is deferred, so unchanged metadata doesn't skip the setup.
+func TestDhclientHasPendingWork(t *testing.T) {
+	n := &dhclient{}
+	prevKnownNetworkManagers := knownNetworkManagers
+	knownNetworkManagers = []Service{n}
+	t.Cleanup(func() { knownNetworkManagers = prevKnownNetworkManagers })
+
+	now := time.Now()
+	n.deferIPv6Release([]string{"eth1"}, time.Minute, now)
+	if !HasPendingWork() {
+		t.Errorf("HasPendingWork() = false with a deferred release, want true")
+	}
+
+	n.deferIPv6Release([]string{"eth1"}, time.Minute, now.Add(time.Minute))
+	if HasPendingWork() {
+		t.Errorf("HasPendingWork() = true after the release, want false")
+	}
+}
+
 // TestRunDhclient tests whether runDhclient calls dhclient with the correct args.
 func TestRunDhclient(t *testing.T) {
 	tests := []struct {
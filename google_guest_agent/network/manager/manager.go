@@ -18,10 +18,14 @@ package manager
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
 	"os"
 	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
@@ -94,6 +98,16 @@ type guestAgentSection struct {
 }
 
 const (
+	// minVlanID and maxVlanID are the boundaries of valid 802.1Q vlan IDs, 0 and
+	// 4095 are reserved.
+	minVlanID = 1
+	maxVlanID = 4094
+
+	// minMTU and maxMTU are the boundaries of MTU values accepted as overrides,
+	// 8896 is the largest MTU supported by Compute Engine networks.
+	minMTU = 576
+	maxMTU = 8896
+
 	googleComment         = "# Added by Google Compute Engine Guest Agent."
 	debian12NetplanFile   = "/etc/netplan/90-default.yaml"
 	debian12NetplanConfig = `network:
@@ -121,6 +135,9 @@ const (
 )
 
 var (
+	// errNoNetworkManager is returned when no known network manager is managing an interface.
+	errNoNetworkManager = errors.New("no network manager impl found")
+
 	// knownNetworkManagers contains the list of known network managers. This is
 	// used to determine the network manager service that is managing the primary
 	// network interface.
@@ -130,55 +147,268 @@ var (
 	// Primarily used for testing.
 	osinfoGet = osinfo.Get
 
+	// seenMetadataMu protects seenMetadata.
+	seenMetadataMu sync.Mutex
 	// seenMetadata keeps a copy of MDS descriptor that was already seen and applied
 	// in terms of VLAN/Ethernet NIC configuration by the manager.
 	seenMetadata *metadata.Descriptor
+
+	// activeManagerMu protects activeManagerName and lastDetection.
+	activeManagerMu sync.Mutex
+	// activeManagerName is the name of the last detected network manager.
+	activeManagerName string
+	// lastDetection is the outcome of the last network manager detection, it's
+	// logged at info level only when it changes.
+	lastDetection string
 )
 
+// detectionKey is the context key of the detectionReport of a network manager
+// detection.
+type detectionKey struct{}
+
+// detectionReport collects why the known network managers are not managing the
+// interface being detected, keyed by their name.
+type detectionReport map[string]string
+
+// notManaging records why svc is not managing the interface in the detection
+// report of ctx, if any. IsManaging() implementations call it before returning
+// false so the detection outcome can be logged.
+func notManaging(ctx context.Context, svc Service, format string, args ...any) {
+	if report, ok := ctx.Value(detectionKey{}).(detectionReport); ok {
+		report[svc.Name()] = fmt.Sprintf(format, args...)
+	}
+}
+
+// logDetection logs the outcome of each network manager checked for iface, at
+// info level the first time and whenever it changes.
+func logDetection(iface string, outcomes []string) {
+	summary := strings.Join(outcomes, "; ")
+
+	activeManagerMu.Lock()
+	defer activeManagerMu.Unlock()
+	if summary == lastDetection {
+		logger.Debugf("Network manager detection for %s: %s", iface, summary)
+		return
+	}
+	lastDetection = summary
+	logger.Infof("Network manager detection for %s: %s", iface, summary)
+}
+
+// ActiveManager returns the name of the network manager detected as managing the
+// primary network interface, or an empty string if none was detected yet.
+func ActiveManager() string {
+	activeManagerMu.Lock()
+	defer activeManagerMu.Unlock()
+	return activeManagerName
+}
+
+// DetectNetworkManager returns the name of the network manager managing the
+// primary network interface described by mds, without configuring anything.
+func DetectNetworkManager(ctx context.Context, mds *metadata.Descriptor) (string, error) {
+	_, interfaces, err := NewInterfaces(mds, false)
+	if err != nil {
+		return "", fmt.Errorf("error getting interface names: %w", err)
+	}
+
+	svc, err := detectNetworkManager(ctx, interfaces[0])
+	if err != nil {
+		return "", err
+	}
+	return svc.manager.Name(), nil
+}
+
+// setActiveManager records the name of the detected network manager.
+func setActiveManager(name string) {
+	activeManagerMu.Lock()
+	defer activeManagerMu.Unlock()
+	activeManagerName = name
+}
+
 // detectNetworkManager detects the network manager managing the primary network interface.
 // This network manager will be used to set up primary and secondary network interfaces.
 func detectNetworkManager(ctx context.Context, iface string) (*serviceStatus, error) {
 	logger.Infof("Detecting network manager...")
 
-	for _, curr := range knownNetworkManagers {
+	report := make(detectionReport)
+	ctx = context.WithValue(ctx, detectionKey{}, report)
+
+	var outcomes []string
+	for i, curr := range knownNetworkManagers {
 		active, err := curr.IsManaging(ctx, iface)
 		if err != nil {
+			logDetection(iface, append(outcomes, fmt.Sprintf("%s: error: %v", curr.Name(), err)))
 			return nil, err
 		}
 
 		if active {
+			outcomes = append(outcomes, fmt.Sprintf("%s: active", curr.Name()))
+			for _, skipped := range knownNetworkManagers[i+1:] {
+				outcomes = append(outcomes, fmt.Sprintf("%s: not checked, lower priority", skipped.Name()))
+			}
+			logDetection(iface, outcomes)
 			return &serviceStatus{manager: curr, active: active}, nil
 		}
+
+		reason, found := report[curr.Name()]
+		if !found {
+			reason = "not managing the interface"
+		}
+		outcomes = append(outcomes, fmt.Sprintf("%s: rejected, %s", curr.Name(), reason))
+	}
+
+	logDetection(iface, outcomes)
+	return nil, fmt.Errorf("%w for %s", errNoNetworkManager, iface)
+}
+
+// NewInterfaces builds the [Interfaces] described by mds. Every ethernet NIC's MAC
+// must belong to a locally present interface, the returned slice holds their names
+// in metadata order, i.e. the first one is the primary interface. VLAN NICs are
+// only included if withVlans is true, invalid ones are skipped but a VLAN whose
+// parent can't be resolved fails the whole build.
+func NewInterfaces(mds *metadata.Descriptor, withVlans bool) (*Interfaces, []string, error) {
+	if mds == nil || len(mds.Instance.NetworkInterfaces) == 0 {
+		return nil, nil, fmt.Errorf("no network interfaces known from metadata")
+	}
+
+	nics := &Interfaces{
+		EthernetInterfaces: mds.Instance.NetworkInterfaces,
+		VlanInterfaces:     map[int]VlanInterface{},
+	}
+
+	names, err := nics.ethernetNames()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// VLANs must not prevent the ethernet interfaces setup, or their rollback.
+	if withVlans {
+		if err := reformatVlanNics(mds, nics, names); err != nil {
+			logger.Errorf("Unable to read VLAN interfaces, skipping them: %v", err)
+		}
+	}
+
+	return nics, names, nil
+}
+
+// ethernetNames returns the names of the local interfaces matching the MACs of
+// nics.EthernetInterfaces, in the same order. It fails if any of them is not
+// locally present.
+func (nics *Interfaces) ethernetNames() ([]string, error) {
+	localInterfaces, err := netInterfaces()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get interfaces: %v", err)
+	}
+
+	byMAC := make(map[string]string)
+	for _, iface := range localInterfaces {
+		if iface.HardwareAddr != nil {
+			byMAC[iface.HardwareAddr.String()] = iface.Name
+		}
 	}
 
-	return nil, fmt.Errorf("no network manager impl found for %s", iface)
+	var names []string
+	for i, ni := range nics.EthernetInterfaces {
+		hwaddr, err := net.ParseMAC(ni.Mac)
+		if err != nil {
+			return nil, fmt.Errorf("invalid MAC %q of network interface %d: %v", ni.Mac, i, err)
+		}
+		name, found := byMAC[hwaddr.String()]
+		if !found {
+			return nil, fmt.Errorf("no local interface found with MAC %s of network interface %d", ni.Mac, i)
+		}
+		names = append(names, name)
+	}
+	return names, nil
 }
 
 // reformatVlanNics reads VLAN NIC information from metadata descriptor and formats
 // it into [Interfaces.VlanInterfaces] that every network manager understands.
+// Invalid VLANs are logged and skipped, the valid ones are still set up.
 func reformatVlanNics(mds *metadata.Descriptor, nics *Interfaces, ethernetInterfaces []string) error {
+	localInterfaces, err := localInterfaceNames()
+	if err != nil {
+		return err
+	}
+
 	for parentID, vlans := range mds.Instance.VlanNetworkInterfaces {
 		if parentID >= len(ethernetInterfaces) {
-			return fmt.Errorf("invalid parent index(%d), known interfaces count: %d", parentID, len(ethernetInterfaces))
+			logger.Errorf("Skipping VLAN interfaces of invalid parent index(%d), known interfaces count: %d", parentID, len(ethernetInterfaces))
+			continue
 		}
 
 		for vlanID, vlan := range vlans {
-			nics.VlanInterfaces[vlanID] = VlanInterface{VlanInterface: vlan, ParentInterfaceID: ethernetInterfaces[parentID]}
+			vlanNic := VlanInterface{VlanInterface: vlan, ParentInterfaceID: ethernetInterfaces[parentID]}
+
+			// The parent reference, when present, must agree with the index the vlan
+			// is listed under.
+			if vlan.ParentInterface != "" {
+				parent, err := vlanParentInterface(ethernetInterfaces, vlan)
+				if err != nil {
+					logger.Errorf("Skipping VLAN interface %d, unable to resolve its parent: %v", vlanID, err)
+					continue
+				}
+				if parent != vlanNic.ParentInterfaceID {
+					logger.Errorf("Skipping VLAN interface %d, it references parent %q but is listed under %q", vlanID, parent, vlanNic.ParentInterfaceID)
+					continue
+				}
+			}
+
+			if err := validateVlanInterface(vlanNic, localInterfaces); err != nil {
+				logger.Errorf("Skipping invalid VLAN interface %d: %v", vlanID, err)
+				continue
+			}
+			nics.VlanInterfaces[vlanID] = vlanNic
 		}
 	}
 	return nil
 }
 
+// validateVlanInterface checks the vlan ID is in the valid 802.1Q range and its
+// parent interface exists in the system.
+func validateVlanInterface(vlan VlanInterface, localInterfaces map[string]bool) error {
+	if vlan.Vlan < minVlanID || vlan.Vlan > maxVlanID {
+		return fmt.Errorf("invalid vlan id %d, must be in range %d-%d", vlan.Vlan, minVlanID, maxVlanID)
+	}
+
+	if !localInterfaces[vlan.ParentInterfaceID] {
+		return fmt.Errorf("parent interface %q of vlan id %d not found", vlan.ParentInterfaceID, vlan.Vlan)
+	}
+
+	return nil
+}
+
+// pendingWorker is implemented by the services that may defer part of the setup,
+// e.g. dhclient deferring the release of DHCPv6 leases.
+type pendingWorker interface {
+	// hasPendingWork returns true if the service has deferred work left.
+	hasPendingWork() bool
+}
+
+// HasPendingWork returns true if any known network manager has deferred work
+// left, in which case the setup runs even if the metadata didn't change.
+func HasPendingWork() bool {
+	for _, svc := range knownNetworkManagers {
+		if p, ok := svc.(pendingWorker); ok && p.hasPendingWork() {
+			return true
+		}
+	}
+	return false
+}
+
 // SetupInterfaces sets up all secondary network interfaces on the system, and primary network
 // interface if enabled in the configuration using the native network manager service detected
 // to be managing the primary network interface.
 func SetupInterfaces(ctx context.Context, config *cfg.Sections, mds *metadata.Descriptor) error {
-	if seenMetadata != nil {
-		diff := reflect.DeepEqual(mds.Instance.NetworkInterfaces, seenMetadata.Instance.NetworkInterfaces) &&
-			reflect.DeepEqual(mds.Instance.VlanNetworkInterfaces, seenMetadata.Instance.VlanNetworkInterfaces)
+	seenMetadataMu.Lock()
+	seen := seenMetadata
+	seenMetadataMu.Unlock()
+
+	if seen != nil {
+		diff := reflect.DeepEqual(mds.Instance.NetworkInterfaces, seen.Instance.NetworkInterfaces) &&
+			reflect.DeepEqual(mds.Instance.VlanNetworkInterfaces, seen.Instance.VlanNetworkInterfaces)
 
-		if diff {
-			logger.Debugf("MDS returned Ethernet NICs [%+v] and VLAN NICs [%+v] are already seen and applied, skipping", seenMetadata.Instance.NetworkInterfaces, seenMetadata.Instance.VlanNetworkInterfaces)
+		if diff && !HasPendingWork() {
+			logger.Debugf("MDS returned Ethernet NICs [%+v] and VLAN NICs [%+v] are already seen and applied, skipping", seen.Instance.NetworkInterfaces, seen.Instance.VlanNetworkInterfaces)
 			return nil
 		}
 	}
@@ -189,22 +419,21 @@ func SetupInterfaces(ctx context.Context, config *cfg.Sections, mds *metadata.De
 		return nil
 	}
 
-	nics := &Interfaces{
-		EthernetInterfaces: mds.Instance.NetworkInterfaces,
-		VlanInterfaces:     map[int]VlanInterface{},
-	}
-
-	interfaces, err := interfaceNames(nics.EthernetInterfaces)
+	nics, interfaces, err := NewInterfaces(mds, config.Unstable.VlanSetupEnabled)
 	if err != nil {
 		return fmt.Errorf("error getting interface names: %v", err)
 	}
 	primaryInterface := interfaces[0]
 
+	mtuOverrides := parseMTUOverrides(config.NetworkInterfaces.MTUOverrides)
+	overrideEthernetMTU(mtuOverrides, nics, interfaces)
+
 	// Get the network manager.
 	activeService, err := detectNetworkManager(ctx, primaryInterface)
 	if err != nil {
 		return fmt.Errorf("error detecting network manager service: %v", err)
 	}
+	setActiveManager(activeService.manager.Name())
 
 	if err := rollbackLeftoverConfigs(ctx, config, mds); err != nil {
 		logger.Errorf("Failed to rollback left over configs: %v", err)
@@ -230,12 +459,12 @@ func SetupInterfaces(ctx context.Context, config *cfg.Sections, mds *metadata.De
 	if err = activeService.manager.SetupEthernetInterface(ctx, config, nics); err != nil {
 		return fmt.Errorf("manager(%s): error setting up ethernet interfaces: %v", activeService.manager.Name(), err)
 	}
+	// Logged once per applied metadata change, unchanged metadata is skipped above.
+	logInterfaceDecisions(activeService.manager.Name(), nics.EthernetInterfaces, interfaces)
 
 	if config.Unstable.VlanSetupEnabled {
 		logger.Infof("VLAN setup is enabled via config file, setting up interfaces")
-		if err := reformatVlanNics(mds, nics, interfaces); err != nil {
-			return fmt.Errorf("unable to read vlans, invalid format: %w", err)
-		}
+		overrideVlanMTU(mtuOverrides, nics)
 		if err = activeService.manager.SetupVlanInterface(ctx, config, nics); err != nil {
 			return fmt.Errorf("manager(%s): error setting up vlan interfaces: %v", activeService.manager.Name(), err)
 		}
@@ -250,7 +479,9 @@ func SetupInterfaces(ctx context.Context, config *cfg.Sections, mds *metadata.De
 		logInterfaceState(ctx)
 	}()
 
+	seenMetadataMu.Lock()
 	seenMetadata = mds
+	seenMetadataMu.Unlock()
 	return nil
 }
 
@@ -291,8 +522,7 @@ func restoreDebian12NetplanConfig(config *cfg.Sections) error {
 		return nil
 	}
 
-	osDesc := osinfo.Get()
-	if osDesc.OS != "debian" || osDesc.Version.Major != 12 {
+	if !osinfoGet().IsMajor("debian", 12) {
 		logger.Debugf("Not running a debian-12 system, skipping netplan configuration restore")
 		return nil
 	}
@@ -312,6 +542,44 @@ func restoreDebian12NetplanConfig(config *cfg.Sections) error {
 	return nil
 }
 
+// RollbackAll rolls back all the ethernet and vlan configuration written by the
+// guest agent for the network manager service managing the primary network interface,
+// i.e. for a clean teardown before reimaging. It returns the name of the network
+// manager rolled back, if no network manager is detected it's a no-op returning an
+// empty name.
+func RollbackAll(ctx context.Context, mds *metadata.Descriptor) (string, error) {
+	nics, interfaces, err := NewInterfaces(mds, true)
+	if err != nil {
+		return "", err
+	}
+
+	return rollbackAll(ctx, nics, interfaces[0])
+}
+
+// rollbackAll rolls back nics for the network manager service managing primaryInterface.
+func rollbackAll(ctx context.Context, nics *Interfaces, primaryInterface string) (string, error) {
+	activeService, err := detectNetworkManager(ctx, primaryInterface)
+	if errors.Is(err, errNoNetworkManager) {
+		logger.Infof("No network manager detected managing %s, nothing to roll back", primaryInterface)
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("error detecting network manager service: %v", err)
+	}
+
+	name := activeService.manager.Name()
+	logger.Infof("Rolling back all network configuration of %s", name)
+	if err := activeService.manager.Rollback(ctx, nics); err != nil {
+		return name, fmt.Errorf("manager(%s): error rolling back network configuration: %v", name, err)
+	}
+
+	// Make sure the next SetupInterfaces() call re-applies the configuration.
+	seenMetadataMu.Lock()
+	seenMetadata = nil
+	seenMetadataMu.Unlock()
+	return name, nil
+}
+
 // FallbackToDefault will attempt to rescue broken networking by rolling back
 // all guest-agent modifications to the network configuration.
 func FallbackToDefault(ctx context.Context) error {
@@ -356,11 +624,132 @@ func buildInterfacesFromAllPhysicalNICs() (*Interfaces, error) {
 	return nics, nil
 }
 
-// shouldManageInterface returns whether the guest agent should manage an interface
+// shouldManageInterface returns whether the guest agent should manage iface
 // provided whether the interface of interest is the primary interface or not.
-func shouldManageInterface(isPrimary bool) bool {
+// Interfaces excluded by configuration are never managed, even if iface is the
+// primary interface and ManagePrimaryNIC is enabled.
+func shouldManageInterface(iface string, isPrimary bool) bool {
+	if isExcludedInterface(iface) {
+		return false
+	}
 	if isPrimary {
 		return cfg.Get().NetworkInterfaces.ManagePrimaryNIC
 	}
 	return true
 }
+
+// useDHCPDomains returns whether the domains provided by DHCP are used as DNS
+// search domains over the primary or a secondary interface, as configured by
+// primary_nic_use_domains and secondary_nic_use_domains. It returns nil if the
+// respective option is unset.
+func useDHCPDomains(isPrimary bool) *bool {
+	if isPrimary {
+		return cfg.Get().NetworkInterfaces.PrimaryNICUseDomains
+	}
+	return cfg.Get().NetworkInterfaces.SecondaryNICUseDomains
+}
+
+// isExcludedInterface returns true if iface's name or MAC address is listed in
+// the exclude_interfaces or exclude_interface_macs configuration.
+func isExcludedInterface(iface string) bool {
+	config := cfg.Get().NetworkInterfaces
+
+	for _, name := range cfg.SplitList(config.ExcludeInterfaces) {
+		if name == iface {
+			logger.Debugf("Interface %s is excluded by name from management", iface)
+			return true
+		}
+	}
+
+	macs := cfg.SplitList(config.ExcludeInterfaceMACs)
+	if len(macs) == 0 {
+		return false
+	}
+
+	nic, err := interfaceByName(iface)
+	if err != nil {
+		logger.Debugf("Failed to lookup interface %s, skipping MAC exclusion check: %v", iface, err)
+		return false
+	}
+
+	for _, mac := range macs {
+		hwaddr, err := net.ParseMAC(mac)
+		if err != nil {
+			logger.Warningf("Ignoring invalid MAC address %q in exclude_interface_macs: %v", mac, err)
+			continue
+		}
+		if nic.HardwareAddr.String() == hwaddr.String() {
+			logger.Debugf("Interface %s is excluded by MAC(%s) from management", iface, mac)
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseMTUOverrides parses the mtu_overrides configuration, a comma separated
+// list of interface=mtu entries, into a map indexed by interface name. Invalid
+// or out of range entries are logged and ignored.
+func parseMTUOverrides(value string) map[string]int {
+	res := make(map[string]int)
+
+	for _, entry := range cfg.SplitList(value) {
+		iface, mtuStr, found := strings.Cut(entry, "=")
+		iface = strings.TrimSpace(iface)
+		if !found || iface == "" {
+			logger.Warningf("Ignoring invalid mtu_overrides entry %q, expected format is interface=mtu", entry)
+			continue
+		}
+
+		mtu, err := strconv.Atoi(strings.TrimSpace(mtuStr))
+		if err != nil {
+			logger.Warningf("Ignoring invalid MTU for interface %s in mtu_overrides: %v", iface, err)
+			continue
+		}
+
+		if mtu < minMTU || mtu > maxMTU {
+			logger.Warningf("Ignoring MTU %d for interface %s in mtu_overrides, must be in range %d-%d", mtu, iface, minMTU, maxMTU)
+			continue
+		}
+
+		res[iface] = mtu
+	}
+
+	return res
+}
+
+// overrideEthernetMTU replaces the MDS provided MTU of the ethernet interfaces
+// with the configured overrides. ethernetInterfaces are the interface names
+// matching nics.EthernetInterfaces by index.
+func overrideEthernetMTU(overrides map[string]int, nics *Interfaces, ethernetInterfaces []string) {
+	if len(overrides) == 0 {
+		return
+	}
+
+	// Copy the interfaces so the MDS descriptor itself is left untouched.
+	ethernet := make([]metadata.NetworkInterfaces, len(nics.EthernetInterfaces))
+	copy(ethernet, nics.EthernetInterfaces)
+
+	for i, iface := range ethernetInterfaces {
+		if mtu, found := overrides[iface]; found && i < len(ethernet) {
+			logger.Debugf("Overriding MTU of %s from %d to %d", iface, ethernet[i].MTU, mtu)
+			ethernet[i].MTU = mtu
+		}
+	}
+
+	nics.EthernetInterfaces = ethernet
+}
+
+// overrideVlanMTU replaces the MDS provided MTU of the vlan interfaces with the
+// configured overrides. Vlan interfaces are referred by their gcp.<parent>.<vlan id>
+// interface name.
+func overrideVlanMTU(overrides map[string]int, nics *Interfaces) {
+	for id, vlan := range nics.VlanInterfaces {
+		iface := fmt.Sprintf("gcp.%s.%d", vlan.ParentInterfaceID, vlan.Vlan)
+		if mtu, found := overrides[iface]; found {
+			logger.Debugf("Overriding MTU of %s from %d to %d", iface, vlan.MTU, mtu)
+			vlan.MTU = mtu
+			nics.VlanInterfaces[id] = vlan
+		}
+	}
+}
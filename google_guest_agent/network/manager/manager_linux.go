@@ -18,9 +18,10 @@ func init() {
 	// knownNetworkManagers is a list of supported/available network managers.
 	knownNetworkManagers = []Service{
 		&netplan{
-			netplanConfigDir:  "/run/netplan/",
-			networkdDropinDir: "/run/systemd/network/",
-			priority:          20,
+			netplanConfigDir:   "/run/netplan/",
+			networkdDropinDir:  "/run/systemd/network/",
+			priority:           20,
+			rendererConfigDirs: []string{"/lib/netplan", "/etc/netplan", "/run/netplan"},
 		},
 		&wicked{
 			configDir: defaultWickedConfigDir,
@@ -19,6 +19,9 @@ package manager
 import (
 	"context"
 	"fmt"
+	"net"
+	"sort"
+	"sync"
 	"testing"
 
 	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
@@ -43,6 +46,10 @@ type mockService struct {
 	// managingError indicates whether isManaging() should return an error.
 	managingError bool
 
+	// rejectReason is recorded as the reason the service is not managing the
+	// interface, if set.
+	rejectReason string
+
 	// rollbackError indicates whether Rollback() should return an error.
 	rollbackError bool
 
@@ -64,10 +71,13 @@ func (n *mockService) Configure(context.Context, *cfg.Sections) {
 }
 
 // IsManaging implements the Service interface.
-func (n *mockService) IsManaging(context.Context, string) (bool, error) {
+func (n *mockService) IsManaging(ctx context.Context, _ string) (bool, error) {
 	if n.managingError {
 		return false, fmt.Errorf("mock error")
 	}
+	if !n.isManaging && n.rejectReason != "" {
+		notManaging(ctx, n, "%s", n.rejectReason)
+	}
 	return n.isManaging, nil
 }
 
@@ -118,6 +128,39 @@ func managerTestSetup() {
 	}
 }
 
+// TestDetectionLog tests that the network manager detection outcome lists each
+// service with why it was rejected.
+func TestDetectionLog(t *testing.T) {
+	prevKnownNetworkManager := knownNetworkManagers
+	t.Cleanup(func() {
+		knownNetworkManagers = prevKnownNetworkManager
+		lastDetection = ""
+	})
+	managerTestSetup()
+
+	knownNetworkManagers = []Service{
+		&mockService{rejectReason: "systemd-networkd version 250 < 252"},
+		&mockService{isFallback: true, isManaging: true},
+		&mockService{isFallback: true},
+	}
+	if _, err := detectNetworkManager(context.Background(), "iface"); err != nil {
+		t.Fatalf("detectNetworkManager(ctx, iface) failed unexpectedly with error: %v", err)
+	}
+
+	want := "service: rejected, systemd-networkd version 250 < 252; fallback: active; fallback: not checked, lower priority"
+	if lastDetection != want {
+		t.Errorf("detectNetworkManager(ctx, iface) logged %q, want: %q", lastDetection, want)
+	}
+
+	knownNetworkManagers = []Service{&mockService{}}
+	if _, err := detectNetworkManager(context.Background(), "iface"); err == nil {
+		t.Fatalf("detectNetworkManager(ctx, iface) succeeded without an active service, want error")
+	}
+	if want := "service: rejected, not managing the interface"; lastDetection != want {
+		t.Errorf("detectNetworkManager(ctx, iface) logged %q, want: %q", lastDetection, want)
+	}
+}
+
 // TestDetectNetworkManager tests whether DetectNetworkManager()
 // returns expected values given certain mock environment setups.
 func TestDetectNetworkManager(t *testing.T) {
@@ -306,24 +349,91 @@ func TestShouldManageInterface(t *testing.T) {
 	if err := cfg.Load(nil); err != nil {
 		t.Fatalf("cfg.Load(nil) = %v, want nil", err)
 	}
-	if shouldManageInterface(true) {
+	if shouldManageInterface("eth0", true) {
 		t.Error("with default config, shouldManageInterface(isPrimary = true) = true, want false")
 	}
-	if !shouldManageInterface(false) {
+	if !shouldManageInterface("eth1", false) {
 		t.Error("with default config, shouldManageInterface(isPrimary = false) = false, want true")
 	}
 	if err := cfg.Load([]byte("[NetworkInterfaces]\nmanage_primary_nic=true")); err != nil {
 		t.Fatalf("cfg.Load(%q) = %v, want nil", "[NetworkInterfaces]\nmanage_primary_nic=true", err)
 	}
-	if !shouldManageInterface(true) {
+	if !shouldManageInterface("eth0", true) {
 		t.Error("with manage_primary_nic=false, shouldManageInterface(isPrimary = true) = false, want true")
 	}
-	if !shouldManageInterface(false) {
+	if !shouldManageInterface("eth1", false) {
 		t.Error("with manage_primary_nic=false, shouldManageInterface(isPrimary = false) = false, want true")
 	}
 }
 
+func TestShouldManageInterfaceExcluded(t *testing.T) {
+	orig := interfaceByName
+	t.Cleanup(func() { interfaceByName = orig })
+
+	interfaceByName = func(name string) (*net.Interface, error) {
+		macs := map[string]string{"eth0": "00:00:5e:00:53:00", "eth1": "00:00:5e:00:53:01", "eth2": "00:00:5e:00:53:02"}
+		mac, found := macs[name]
+		if !found {
+			return nil, fmt.Errorf("interface %s not found", name)
+		}
+		hwaddr, err := net.ParseMAC(mac)
+		if err != nil {
+			return nil, err
+		}
+		return &net.Interface{Name: name, HardwareAddr: hwaddr}, nil
+	}
+
+	config := "[NetworkInterfaces]\nmanage_primary_nic = true\nexclude_interfaces = eth0, eth3\nexclude_interface_macs = 00:00:5E:00:53:02,invalid"
+	if err := cfg.Load([]byte(config)); err != nil {
+		t.Fatalf("cfg.Load(%q) = %v, want nil", config, err)
+	}
+	t.Cleanup(func() {
+		if err := cfg.Load(nil); err != nil {
+			t.Fatalf("cfg.Load(nil) = %v, want nil", err)
+		}
+	})
+
+	tests := []struct {
+		iface     string
+		isPrimary bool
+		want      bool
+	}{
+		{iface: "eth0", isPrimary: true, want: false},
+		{iface: "eth1", isPrimary: false, want: true},
+		{iface: "eth2", isPrimary: false, want: false},
+		{iface: "eth3", isPrimary: false, want: false},
+		{iface: "eth4", isPrimary: false, want: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.iface, func(t *testing.T) {
+			if got := shouldManageInterface(tc.iface, tc.isPrimary); got != tc.want {
+				t.Errorf("shouldManageInterface(%q, %t) = %t, want %t", tc.iface, tc.isPrimary, got, tc.want)
+			}
+		})
+	}
+}
+
+// mockNetInterfaces overrides the system's interface listing with names for
+// the duration of the test.
+func mockNetInterfaces(t *testing.T, names ...string) {
+	t.Helper()
+
+	orig := netInterfaces
+	t.Cleanup(func() { netInterfaces = orig })
+
+	netInterfaces = func() ([]net.Interface, error) {
+		var ifaces []net.Interface
+		for _, name := range names {
+			ifaces = append(ifaces, net.Interface{Name: name})
+		}
+		return ifaces, nil
+	}
+}
+
 func TestReformatVlanNics(t *testing.T) {
+	mockNetInterfaces(t, "eth0", "eth1")
+
 	mds := &metadata.Descriptor{Instance: metadata.Instance{
 		VlanNetworkInterfaces: map[int]map[int]metadata.VlanInterface{
 			0: {
@@ -353,7 +463,87 @@ func TestReformatVlanNics(t *testing.T) {
 	}
 }
 
-func TestReformatVlanNicsError(t *testing.T) {
+// TestReformatVlanNicsSkipsInvalid tests that vlans with out of range IDs or
+// missing parent interfaces are skipped.
+func TestReformatVlanNicsSkipsInvalid(t *testing.T) {
+	mockNetInterfaces(t, "eth0")
+
+	mds := &metadata.Descriptor{Instance: metadata.Instance{
+		VlanNetworkInterfaces: map[int]map[int]metadata.VlanInterface{
+			0: {
+				0:    {Mac: "a", Vlan: 0},
+				5:    {Mac: "b", Vlan: 5},
+				4094: {Mac: "c", Vlan: 4094},
+				4095: {Mac: "d", Vlan: 4095},
+			},
+			1: {
+				7: {Mac: "e", Vlan: 7},
+			},
+		},
+	}}
+	nics := &Interfaces{VlanInterfaces: map[int]VlanInterface{}}
+	want := map[int]VlanInterface{
+		5:    {VlanInterface: metadata.VlanInterface{Mac: "b", Vlan: 5}, ParentInterfaceID: "eth0"},
+		4094: {VlanInterface: metadata.VlanInterface{Mac: "c", Vlan: 4094}, ParentInterfaceID: "eth0"},
+	}
+
+	ethernetInterfaces := []string{"eth0", "eth1"}
+
+	if err := reformatVlanNics(mds, nics, ethernetInterfaces); err != nil {
+		t.Fatalf("reformatVlanNics(%+v, %+v, %+v) failed unexpectedly with error: %v", mds, nics, ethernetInterfaces, err)
+	}
+
+	if diff := cmp.Diff(want, nics.VlanInterfaces); diff != "" {
+		t.Errorf("reformatVlanNics(%+v, %+v, %+v) returned unexpected diff (-want,+got):\n %s", mds, nics, ethernetInterfaces, diff)
+	}
+}
+
+func TestValidateVlanInterface(t *testing.T) {
+	local := map[string]bool{"eth0": true}
+
+	tests := []struct {
+		name    string
+		vlan    VlanInterface
+		wantErr bool
+	}{
+		{
+			name: "valid",
+			vlan: VlanInterface{VlanInterface: metadata.VlanInterface{Vlan: 10}, ParentInterfaceID: "eth0"},
+		},
+		{
+			name:    "zero_id",
+			vlan:    VlanInterface{VlanInterface: metadata.VlanInterface{Vlan: 0}, ParentInterfaceID: "eth0"},
+			wantErr: true,
+		},
+		{
+			name:    "reserved_id",
+			vlan:    VlanInterface{VlanInterface: metadata.VlanInterface{Vlan: 4095}, ParentInterfaceID: "eth0"},
+			wantErr: true,
+		},
+		{
+			name:    "missing_parent",
+			vlan:    VlanInterface{VlanInterface: metadata.VlanInterface{Vlan: 10}, ParentInterfaceID: "eth1"},
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := validateVlanInterface(test.vlan, local)
+			if (err != nil) != test.wantErr {
+				t.Errorf("validateVlanInterface(%+v, %v) = %v, want error: %t", test.vlan, local, err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestReformatVlanNicsInvalidParent(t *testing.T) {
+	orig := netInterfaces
+	t.Cleanup(func() { netInterfaces = orig })
+	netInterfaces = func() ([]net.Interface, error) {
+		return []net.Interface{{Name: "eth0"}}, nil
+	}
+
 	mds := &metadata.Descriptor{Instance: metadata.Instance{
 		VlanNetworkInterfaces: map[int]map[int]metadata.VlanInterface{
 			0: {
@@ -365,29 +555,323 @@ func TestReformatVlanNicsError(t *testing.T) {
 			},
 		},
 	}}
-	nics := &Interfaces{VlanInterfaces: map[int]VlanInterface{}}
 
 	tests := []struct {
 		name               string
-		mds                *metadata.Descriptor
 		ethernetInterfaces []string
+		wantVlans          []int
 	}{
 		{
 			name:               "invalid_parentId",
-			mds:                mds,
 			ethernetInterfaces: []string{"eth0"},
+			wantVlans:          []int{5, 6},
 		},
 		{
 			name: "all_invalid_parentIds",
-			mds:  mds,
 		},
 	}
 
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
-			if err := reformatVlanNics(mds, nics, test.ethernetInterfaces); err == nil {
-				t.Fatalf("reformatVlanNics(%+v, %+v, %+v) succeeded, want error", mds, nics, test.ethernetInterfaces)
+			nics := &Interfaces{VlanInterfaces: map[int]VlanInterface{}}
+			if err := reformatVlanNics(mds, nics, test.ethernetInterfaces); err != nil {
+				t.Fatalf("reformatVlanNics(%+v, %+v, %+v) failed unexpectedly with error: %v", mds, nics, test.ethernetInterfaces, err)
+			}
+
+			var got []int
+			for id := range nics.VlanInterfaces {
+				got = append(got, id)
+			}
+			sort.Ints(got)
+			if diff := cmp.Diff(test.wantVlans, got); diff != "" {
+				t.Errorf("reformatVlanNics(%+v, %+v, %+v) returned unexpected vlan ids diff (-want,+got):\n %s", mds, nics, test.ethernetInterfaces, diff)
+			}
+		})
+	}
+}
+
+func TestNewInterfaces(t *testing.T) {
+	orig := netInterfaces
+	t.Cleanup(func() { netInterfaces = orig })
+
+	netInterfaces = func() ([]net.Interface, error) {
+		var ifaces []net.Interface
+		for name, mac := range map[string]string{"eth0": "00:00:5e:00:53:00", "eth1": "00:00:5e:00:53:01", "lo": ""} {
+			hwaddr, _ := net.ParseMAC(mac)
+			ifaces = append(ifaces, net.Interface{Name: name, HardwareAddr: hwaddr})
+		}
+		return ifaces, nil
+	}
+
+	ethernet := []metadata.NetworkInterfaces{{Mac: "00:00:5e:00:53:01"}, {Mac: "00:00:5E:00:53:00"}}
+	vlan := metadata.VlanInterface{Mac: "a", ParentInterface: "/computeMetadata/v1/instance/network-interfaces/1/", Vlan: 5}
+
+	tests := []struct {
+		name      string
+		mds       *metadata.Descriptor
+		withVlans bool
+		wantNames []string
+		wantVlans map[int]VlanInterface
+		wantErr   bool
+	}{
+		{
+			name:      "ethernet_only",
+			mds:       &metadata.Descriptor{Instance: metadata.Instance{NetworkInterfaces: ethernet}},
+			wantNames: []string{"eth1", "eth0"},
+			wantVlans: map[int]VlanInterface{},
+		},
+		{
+			name: "vlans_not_wanted",
+			mds: &metadata.Descriptor{Instance: metadata.Instance{
+				NetworkInterfaces:     ethernet,
+				VlanNetworkInterfaces: map[int]map[int]metadata.VlanInterface{1: {5: vlan}},
+			}},
+			wantNames: []string{"eth1", "eth0"},
+			wantVlans: map[int]VlanInterface{},
+		},
+		{
+			name: "vlans",
+			mds: &metadata.Descriptor{Instance: metadata.Instance{
+				NetworkInterfaces:     ethernet,
+				VlanNetworkInterfaces: map[int]map[int]metadata.VlanInterface{1: {5: vlan}},
+			}},
+			withVlans: true,
+			wantNames: []string{"eth1", "eth0"},
+			wantVlans: map[int]VlanInterface{5: {VlanInterface: vlan, ParentInterfaceID: "eth0"}},
+		},
+		{
+			name: "vlan_parent_mismatch_skipped",
+			mds: &metadata.Descriptor{Instance: metadata.Instance{
+				NetworkInterfaces:     ethernet,
+				VlanNetworkInterfaces: map[int]map[int]metadata.VlanInterface{0: {5: vlan}},
+			}},
+			withVlans: true,
+			wantNames: []string{"eth1", "eth0"},
+			wantVlans: map[int]VlanInterface{},
+		},
+		{
+			name: "vlan_parent_out_of_range_skipped",
+			mds: &metadata.Descriptor{Instance: metadata.Instance{
+				NetworkInterfaces:     ethernet,
+				VlanNetworkInterfaces: map[int]map[int]metadata.VlanInterface{2: {5: {Mac: "a", Vlan: 5}}, 1: {5: vlan}},
+			}},
+			withVlans: true,
+			wantNames: []string{"eth1", "eth0"},
+			wantVlans: map[int]VlanInterface{5: {VlanInterface: vlan, ParentInterfaceID: "eth0"}},
+		},
+		{
+			name:    "mac_not_present",
+			mds:     &metadata.Descriptor{Instance: metadata.Instance{NetworkInterfaces: []metadata.NetworkInterfaces{{Mac: "00:00:5e:00:53:02"}}}},
+			wantErr: true,
+		},
+		{
+			name:    "invalid_mac",
+			mds:     &metadata.Descriptor{Instance: metadata.Instance{NetworkInterfaces: []metadata.NetworkInterfaces{{Mac: "invalid"}}}},
+			wantErr: true,
+		},
+		{
+			name:    "no_interfaces",
+			mds:     &metadata.Descriptor{},
+			wantErr: true,
+		},
+		{
+			name:    "nil_descriptor",
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			nics, names, err := NewInterfaces(test.mds, test.withVlans)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("NewInterfaces(%+v, %t) = %v, want error: %t", test.mds, test.withVlans, err, test.wantErr)
+			}
+			if test.wantErr {
+				return
+			}
+
+			if diff := cmp.Diff(test.wantNames, names); diff != "" {
+				t.Errorf("NewInterfaces(%+v, %t) returned unexpected names diff (-want,+got):\n %s", test.mds, test.withVlans, diff)
+			}
+			if diff := cmp.Diff(test.mds.Instance.NetworkInterfaces, nics.EthernetInterfaces); diff != "" {
+				t.Errorf("NewInterfaces(%+v, %t) returned unexpected ethernet diff (-want,+got):\n %s", test.mds, test.withVlans, diff)
+			}
+			if diff := cmp.Diff(test.wantVlans, nics.VlanInterfaces); diff != "" {
+				t.Errorf("NewInterfaces(%+v, %t) returned unexpected vlan diff (-want,+got):\n %s", test.mds, test.withVlans, diff)
+			}
+		})
+	}
+}
+
+// TestRollbackAll tests rolling back all configuration of the managing service.
+func TestRollbackAll(t *testing.T) {
+	tests := []struct {
+		name         string
+		services     []*mockService
+		wantName     string
+		wantRollback []bool
+		wantErr      bool
+	}{
+		{
+			name:         "managing-service",
+			services:     []*mockService{{isManaging: false}, {isManaging: true}},
+			wantName:     "service",
+			wantRollback: []bool{false, true},
+		},
+		{
+			name:         "no-manager",
+			services:     []*mockService{{isManaging: false}, {isManaging: false}},
+			wantRollback: []bool{false, false},
+		},
+		{
+			name:         "detection-error",
+			services:     []*mockService{{managingError: true}, {isManaging: true}},
+			wantRollback: []bool{false, false},
+			wantErr:      true,
+		},
+		{
+			name:         "rollback-error",
+			services:     []*mockService{{isManaging: true, rollbackError: true}},
+			wantName:     "service",
+			wantRollback: []bool{true},
+			wantErr:      true,
+		},
+	}
+
+	prevKnownNetworkManager, prevSeenMetadata := knownNetworkManagers, seenMetadata
+	t.Cleanup(func() {
+		knownNetworkManagers = prevKnownNetworkManager
+		seenMetadata = prevSeenMetadata
+	})
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			managerTestSetup()
+
+			knownNetworkManagers = nil
+			for _, service := range test.services {
+				knownNetworkManagers = append(knownNetworkManagers, service)
+			}
+
+			name, err := rollbackAll(context.Background(), &Interfaces{}, "iface")
+			if (err != nil) != test.wantErr {
+				t.Errorf("rollbackAll(ctx, nics, iface) = %v, want error: %t", err, test.wantErr)
+			}
+
+			if name != test.wantName {
+				t.Errorf("rollbackAll(ctx, nics, iface) = %q, want %q", name, test.wantName)
+			}
+
+			for i, service := range test.services {
+				if service.rolledBack != test.wantRollback[i] {
+					t.Errorf("rollbackAll(ctx, nics, iface) rolled back service %d: %t, want %t", i, service.rolledBack, test.wantRollback[i])
+				}
+			}
+		})
+	}
+}
+
+// TestRollbackAllSetupRace tests that rolling back concurrently with a network
+// setup doesn't race on the seen metadata, meant to be run with -race.
+func TestRollbackAllSetupRace(t *testing.T) {
+	prevKnownNetworkManager, prevSeenMetadata := knownNetworkManagers, seenMetadata
+	t.Cleanup(func() {
+		knownNetworkManagers = prevKnownNetworkManager
+		seenMetadata = prevSeenMetadata
+	})
+
+	managerTestSetup()
+	knownNetworkManagers = []Service{&mockService{isManaging: true}}
+	seenMetadata = &metadata.Descriptor{}
+	config := &cfg.Sections{NetworkInterfaces: &cfg.NetworkInterfaces{}}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 10; i++ {
+			if _, err := rollbackAll(context.Background(), &Interfaces{}, "iface"); err != nil {
+				t.Errorf("rollbackAll(ctx, nics, iface) = %v, want nil", err)
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 10; i++ {
+			if err := SetupInterfaces(context.Background(), config, &metadata.Descriptor{}); err != nil {
+				t.Errorf("SetupInterfaces(ctx, config, mds) = %v, want nil", err)
+			}
+		}
+	}()
+	wg.Wait()
+}
+
+func TestRollbackAllNoMetadata(t *testing.T) {
+	if _, err := RollbackAll(context.Background(), nil); err == nil {
+		t.Errorf("RollbackAll(ctx, nil) succeeded, want error")
+	}
+}
+
+func TestParseMTUOverrides(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  map[string]int
+	}{
+		{
+			name:  "empty",
+			value: "",
+			want:  map[string]int{},
+		},
+		{
+			name:  "valid",
+			value: "eth1=8896, gcp.eth0.5 = 1460",
+			want:  map[string]int{"eth1": 8896, "gcp.eth0.5": 1460},
+		},
+		{
+			name:  "invalid_entries",
+			value: "eth1,=1500,eth2=abc,eth3=100,eth4=9001,eth5=1500",
+			want:  map[string]int{"eth5": 1500},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if diff := cmp.Diff(tc.want, parseMTUOverrides(tc.value)); diff != "" {
+				t.Errorf("parseMTUOverrides(%q) returned unexpected diff (-want,+got):\n %s", tc.value, diff)
 			}
 		})
 	}
 }
+
+func TestOverrideMTU(t *testing.T) {
+	mdsNics := []metadata.NetworkInterfaces{{Mac: "a", MTU: 1460}, {Mac: "b", MTU: 1460}}
+	nics := &Interfaces{
+		EthernetInterfaces: mdsNics,
+		VlanInterfaces: map[int]VlanInterface{
+			5: {VlanInterface: metadata.VlanInterface{Vlan: 5, MTU: 1460}, ParentInterfaceID: "eth0"},
+			6: {VlanInterface: metadata.VlanInterface{Vlan: 6, MTU: 1460}, ParentInterfaceID: "eth0"},
+		},
+	}
+	overrides := map[string]int{"eth1": 8896, "gcp.eth0.6": 1500}
+
+	overrideEthernetMTU(overrides, nics, []string{"eth0", "eth1"})
+	overrideVlanMTU(overrides, nics)
+
+	wantEthernet := []metadata.NetworkInterfaces{{Mac: "a", MTU: 1460}, {Mac: "b", MTU: 8896}}
+	if diff := cmp.Diff(wantEthernet, nics.EthernetInterfaces); diff != "" {
+		t.Errorf("overrideEthernetMTU(%v) returned unexpected diff (-want,+got):\n %s", overrides, diff)
+	}
+
+	if mdsNics[1].MTU != 1460 {
+		t.Errorf("overrideEthernetMTU(%v) modified the metadata descriptor, got MTU %d, want 1460", overrides, mdsNics[1].MTU)
+	}
+
+	wantVlan := map[int]VlanInterface{
+		5: {VlanInterface: metadata.VlanInterface{Vlan: 5, MTU: 1460}, ParentInterfaceID: "eth0"},
+		6: {VlanInterface: metadata.VlanInterface{Vlan: 6, MTU: 1500}, ParentInterfaceID: "eth0"},
+	}
+	if diff := cmp.Diff(wantVlan, nics.VlanInterfaces); diff != "" {
+		t.Errorf("overrideVlanMTU(%v) returned unexpected diff (-want,+got):\n %s", overrides, diff)
+	}
+}
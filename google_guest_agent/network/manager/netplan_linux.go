@@ -23,8 +23,8 @@ import (
 	"slices"
 
 	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
-	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/osinfo"
 	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/run"
+	"github.com/GoogleCloudPlatform/guest-agent/utils"
 	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
 )
 
@@ -38,12 +38,18 @@ const (
 	// netplanConfigVersion defines the version we are using for netplan's drop-in
 	// files.
 	netplanConfigVersion = 2
+
+	// netplanRendererNetworkd is netplan's systemd-networkd renderer/backend, the
+	// default if no renderer is configured.
+	netplanRendererNetworkd = "networkd"
+
+	// netplanRendererNetworkManager is netplan's NetworkManager renderer/backend.
+	netplanRendererNetworkManager = "NetworkManager"
 )
 
-// netplan is the netplan's Service interface implementation. From the guest agent's
-// network manager perspective the current form only supports the
-// systemd-networkd + netplan combination. Since netplan also supports NetworkManager
-// as a backend we'll eventually support such a combination in the future.
+// netplan is the netplan's Service interface implementation. Both the systemd-networkd
+// and NetworkManager netplan renderers are supported, systemd-networkd drop-ins for
+// configurations not supported by netplan are only written with the former.
 type netplan struct {
 	// netplanConfigDir determines where the agent writes netplan configuration files.
 	netplanConfigDir string
@@ -59,6 +65,10 @@ type netplan struct {
 	// used with netplan interface config keys in /run/netplan/20-google-guest-agent-ethernet.yaml
 	// and systemd drop-in directory name like /etc/systemd/network/10-netplan-a-ens4.network.d/
 	interfacePrefix string
+
+	// rendererConfigDirs are netplan's configuration directories, in increasing
+	// order of precedence, inspected to detect the configured renderer.
+	rendererConfigDirs []string
 }
 
 // netplanDropin maps the netplan dropin configuration yaml entries/data
@@ -77,6 +87,9 @@ type netplanNetwork struct {
 
 	// Vlans are the vlan interface's configuration entries map.
 	Vlans map[string]netplanVlan `yaml:"vlans,omitempty"`
+
+	// Renderer is the backend netplan renders the configuration to.
+	Renderer string `yaml:"renderer,omitempty"`
 }
 
 // netplanEthernet describes the actual ethernet configuration. Refer
@@ -164,12 +177,11 @@ func (n *netplan) Name() string {
 // Configure gives the opportunity for the Service implementation to adjust its configuration
 // based on the Guest Agent configuration.
 func (n *netplan) Configure(ctx context.Context, config *cfg.Sections) {
-	os := osinfo.Get()
 	// Debian 12 has a pretty generic matching netplan configuration for gce,
 	// regex in /etc/netplan/90-default.yaml matches all en* and eth* nics.
 	// Until we have that changed we are adjusting the configuration so we can
 	// override the defaults.
-	if os.OS == "debian" && os.Version.Major == 12 {
+	if osinfoGet().IsMajor("debian", 12) {
 		n.interfacePrefix = "a"
 		logger.Infof("Setting up Debian 12, overriding interface prefix with: %q", n.interfacePrefix)
 	}
@@ -177,13 +189,18 @@ func (n *netplan) Configure(ctx context.Context, config *cfg.Sections) {
 
 // IsManaging checks whether netplan is present in the system.
 func (n *netplan) IsManaging(ctx context.Context, iface string) (bool, error) {
-	if isUbuntu1804() {
+	if isUbuntu1804() && !cfg.Get().NetworkInterfaces.Ubuntu1804NetplanDropin {
 		logger.Infof("Running on Ubuntu 18.04, skipping use of netplan, falling back to dhclient")
+		notManaging(ctx, n, "Ubuntu 18.04 with ubuntu1804_netplan_dropin disabled")
 		return false, nil
 	}
 
 	// Check if the netplan CLI exists.
-	return cliExists("netplan")
+	exists, err := cliExists("netplan")
+	if !exists {
+		notManaging(ctx, n, "netplan not found")
+	}
+	return exists, err
 }
 
 // SetupEthernetInterface sets the network interfaces for netplan by writing drop-in files to the specified
@@ -205,9 +222,12 @@ func (n *netplan) SetupEthernetInterface(ctx context.Context, config *cfg.Sectio
 
 	// If we are running netplan+systemd-networkd we try to write networkd's drop-in for configs
 	// not mapped/supported by netplan.
-	reload2, err := n.writeNetworkdDropin(googleInterfaces, googleIpv6Interfaces)
-	if err != nil {
-		return fmt.Errorf("error writing systemd-networkd's drop-in: %v", err)
+	var reload2 bool
+	if n.renderer() == netplanRendererNetworkd && !legacyNetplan() {
+		reload2, err = n.writeNetworkdDropin(googleInterfaces, googleIpv6Interfaces)
+		if err != nil {
+			return fmt.Errorf("error writing systemd-networkd's drop-in: %v", err)
+		}
 	}
 
 	// Avoid unnecessary reloads, if we've really updated some config then only do a reload.
@@ -220,16 +240,40 @@ func (n *netplan) SetupEthernetInterface(ctx context.Context, config *cfg.Sectio
 	return nil
 }
 
+// legacyNetplan returns true if running on Ubuntu 18.04, whose netplan doesn't
+// support the dhcp overrides and whose networkctl can't reload configurations.
+// There the drop-ins are kept minimal, only the secondary NICs are configured
+// and the primary NIC is left to the default OS configuration.
+func legacyNetplan() bool {
+	return isUbuntu1804()
+}
+
 // reloadConfigs triggers config reload to make sure ethernet/vlan configs are written
 // on disk are applied by netplan.
 func (n *netplan) reloadConfigs(ctx context.Context) error {
 	logger.Infof("Reloading netplan configs...")
 
+	// Old networkctl has no reload support, have netplan apply the configs.
+	if legacyNetplan() {
+		if err := run.Quiet(ctx, "netplan", "apply"); err != nil {
+			return fmt.Errorf("error applying netplan config: %w", err)
+		}
+		return nil
+	}
+
 	// Avoid restarting netplan.
 	if err := run.Quiet(ctx, "netplan", "generate"); err != nil {
 		return fmt.Errorf("error generating netplan based config: %w", err)
 	}
 
+	// Avoid restarting NetworkManager, have it re-read the generated connections.
+	if n.renderer() == netplanRendererNetworkManager {
+		if err := run.Quiet(ctx, "nmcli", "connection", "reload"); err != nil {
+			return fmt.Errorf("error reloading NetworkManager connections: %v", err)
+		}
+		return nil
+	}
+
 	// Avoid restarting systemd-networkd.
 	if err := run.Quiet(ctx, "networkctl", "reload"); err != nil {
 		return fmt.Errorf("error reloading systemd-networkd network configs: %v", err)
@@ -238,6 +282,44 @@ func (n *netplan) reloadConfigs(ctx context.Context) error {
 	return nil
 }
 
+// renderer returns the renderer netplan is configured with. The renderer is a global
+// setting, the last configuration file setting it takes precedence. Files are sorted
+// by name, files in a higher precedence directory shadow the ones with the same name
+// in the lower precedence directories.
+func (n *netplan) renderer() string {
+	files := make(map[string]string)
+	for _, dir := range n.rendererConfigDirs {
+		matches, err := filepath.Glob(filepath.Join(dir, "*.yaml"))
+		if err != nil {
+			logger.Debugf("Failed to list netplan configs in %q: %v", dir, err)
+			continue
+		}
+		for _, f := range matches {
+			files[filepath.Base(f)] = f
+		}
+	}
+
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	renderer := netplanRendererNetworkd
+	for _, name := range names {
+		var config netplanDropin
+		if err := readYamlFile(files[name], &config); err != nil {
+			logger.Debugf("Failed to read netplan config %q while detecting renderer: %v", files[name], err)
+			continue
+		}
+		if config.Network.Renderer != "" {
+			renderer = config.Network.Renderer
+		}
+	}
+
+	return renderer
+}
+
 // writeNetworkdDropin writes the overloading network-manager's drop-in file for the configurations
 // not supported by netplan.
 func (n *netplan) writeNetworkdDropin(interfaces, ipv6Interfaces []string) (bool, error) {
@@ -252,8 +334,8 @@ func (n *netplan) writeNetworkdDropin(interfaces, ipv6Interfaces []string) (bool
 	}
 
 	for i, iface := range interfaces {
-		if !shouldManageInterface(i == 0) {
-			logger.Debugf("ManagePrimaryNIC is disabled, skipping writeNetworkdDropin for %s", iface)
+		if !shouldManageInterface(iface, i == 0) {
+			logger.Debugf("Interface %s is not managed by the guest agent, skipping writeNetworkdDropin", iface)
 			continue
 		}
 		logger.Debugf("writing systemd-networkd drop-in config for %s", iface)
@@ -277,10 +359,11 @@ func (n *netplan) writeNetworkdDropin(interfaces, ipv6Interfaces []string) (bool
 		// We are only interested on DHCP offered routes on the primary nic,
 		// ignore it for the secondary ones.
 		if i != 0 {
+			falseVal := false
 			data.Network.DNSDefaultRoute = false
 			data.DHCPv4 = &systemdDHCPConfig{
-				RoutesToDNS: false,
-				RoutesToNTP: false,
+				RoutesToDNS: &falseVal,
+				RoutesToNTP: &falseVal,
 			}
 		}
 
@@ -346,8 +429,13 @@ func (nd networkdNetplanDropin) write(n *netplan, iface string) (bool, error) {
 	return true, nil
 }
 
-// shouldUseDomains returns true if interface index is 0.
+// shouldUseDomains returns whether the interface at index idx uses the domains
+// provided by DHCP, see [useDHCPDomains]. Unless configured only the primary
+// interface, at index 0, does.
 func shouldUseDomains(idx int) *bool {
+	if res := useDHCPDomains(idx == 0); res != nil {
+		return res
+	}
 	res := idx == 0
 	return &res
 }
@@ -362,9 +450,15 @@ func (n *netplan) writeNetplanEthernetDropin(mtuMap map[string]int, interfaces,
 		},
 	}
 
+	legacy := legacyNetplan()
+
 	for i, iface := range interfaces {
-		if !shouldManageInterface(i == 0) {
-			logger.Debugf("ManagePrimaryNIC is disabled, skipping writeNetplanEthernetDropin for %s", iface)
+		if !shouldManageInterface(iface, i == 0) {
+			logger.Debugf("Interface %s is not managed by the guest agent, skipping writeNetplanEthernetDropin", iface)
+			continue
+		}
+		if i == 0 && legacy {
+			logger.Debugf("Running on Ubuntu 18.04, primary nic %s is managed by default OS config, skipping writeNetplanEthernetDropin", iface)
 			continue
 		}
 		logger.Debugf("Adding %s(%d) to drop-in configuration.", iface, i)
@@ -373,9 +467,11 @@ func (n *netplan) writeNetplanEthernetDropin(mtuMap map[string]int, interfaces,
 		ne := netplanEthernet{
 			Match:  netplanMatch{Name: iface},
 			DHCPv4: &trueVal,
-			DHCP4Overrides: &netplanDHCPOverrides{
+		}
+		if !legacy {
+			ne.DHCP4Overrides = &netplanDHCPOverrides{
 				UseDomains: shouldUseDomains(i),
-			},
+			}
 		}
 
 		if mtu, found := mtuMap[iface]; found {
@@ -384,8 +480,10 @@ func (n *netplan) writeNetplanEthernetDropin(mtuMap map[string]int, interfaces,
 
 		if slices.Contains(ipv6Interfaces, iface) {
 			ne.DHCPv6 = &trueVal
-			ne.DHCP6Overrides = &netplanDHCPOverrides{
-				UseDomains: shouldUseDomains(i),
+			if !legacy {
+				ne.DHCP6Overrides = &netplanDHCPOverrides{
+					UseDomains: shouldUseDomains(i),
+				}
 			}
 		}
 
@@ -472,9 +570,12 @@ func (n *netplan) SetupVlanInterface(ctx context.Context, config *cfg.Sections,
 		return fmt.Errorf("unable to write netplan VLAN dropin: %w", err)
 	}
 
-	reload2, err := n.writeNetworkdVLANDropin(nics)
-	if err != nil {
-		return fmt.Errorf("unable to write netplan networkd VLAN dropin: %w", err)
+	var reload2 bool
+	if n.renderer() == netplanRendererNetworkd && !legacyNetplan() {
+		reload2, err = n.writeNetworkdVLANDropin(nics)
+		if err != nil {
+			return fmt.Errorf("unable to write netplan networkd VLAN dropin: %w", err)
+		}
 	}
 
 	if reload1 || reload2 {
@@ -509,6 +610,10 @@ func (n *netplan) writeNetplanVLANDropin(nics *Interfaces) (bool, error) {
 			DHCP4Overrides:     &netplanDHCPOverrides{UseDomains: &falseVal},
 			DHCP6Overrides:     &netplanDHCPOverrides{UseDomains: &falseVal},
 		}
+		if legacyNetplan() {
+			nv.DHCP4Overrides = nil
+			nv.DHCP6Overrides = nil
+		}
 
 		if len(curr.IPv6) > 0 {
 			nv.DHCPv6 = &trueVal
@@ -554,6 +659,7 @@ func (n *netplan) writeNetworkdVLANDropin(nics *Interfaces) (bool, error) {
 
 		ifaceName := n.vlanInterfaceName(iface.ParentInterfaceID, iface.Vlan)
 		matchID := n.ID(ifaceName)
+		falseVal := false
 
 		// Create and setup ini file.
 		data := networkdNetplanDropin{
@@ -565,8 +671,8 @@ func (n *netplan) writeNetworkdVLANDropin(nics *Interfaces) (bool, error) {
 				DHCP:            dhcp,
 			},
 			DHCPv4: &systemdDHCPConfig{
-				RoutesToDNS: false,
-				RoutesToNTP: false,
+				RoutesToDNS: &falseVal,
+				RoutesToNTP: &falseVal,
 			},
 		}
 
@@ -587,14 +693,14 @@ func (n *netplan) writeNetworkdVLANDropin(nics *Interfaces) (bool, error) {
 // If removeVlan is true both regular nics and vlan nics are rolled back.
 func (n *netplan) rollbackConfigs(ctx context.Context, nics *Interfaces, removeVlan bool) error {
 	var reload bool
-	interfaces, err := interfaceNames(nics.EthernetInterfaces)
+	interfaces, err := nics.ethernetNames()
 	if err != nil {
 		return fmt.Errorf("failed to get list of interface names: %v", err)
 	}
 
 	netplanEthernetDropinFile := n.dropinFile(netplanEthernetSuffix)
 	existingEthernetCfgs := netplanDropin{}
-	if fileExists(netplanEthernetDropinFile) {
+	if utils.FileExists(netplanEthernetDropinFile, utils.TypeFile) {
 		if err := readYamlFile(netplanEthernetDropinFile, &existingEthernetCfgs); err != nil {
 			return fmt.Errorf("unable to read %q trying rollback configs: %w", netplanEthernetDropinFile, err)
 		}
@@ -615,7 +721,7 @@ func (n *netplan) rollbackConfigs(ctx context.Context, nics *Interfaces, removeV
 	if removeVlan {
 		existingVlanCfgs := netplanDropin{}
 		netplanVlanDropinFile := n.dropinFile(netplanVlanSuffix)
-		if fileExists(netplanVlanDropinFile) {
+		if utils.FileExists(netplanVlanDropinFile, utils.TypeFile) {
 			if err := readYamlFile(netplanVlanDropinFile, &existingVlanCfgs); err != nil {
 				return fmt.Errorf("unable to read %q trying rollback configs: %w", netplanVlanDropinFile, err)
 			}
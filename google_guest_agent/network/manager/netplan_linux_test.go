@@ -18,6 +18,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"path/filepath"
@@ -26,6 +27,8 @@ import (
 	"testing"
 	"time"
 
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/osinfo"
 	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/run"
 	"github.com/GoogleCloudPlatform/guest-agent/metadata"
 	"github.com/google/go-cmp/cmp"
@@ -45,6 +48,10 @@ func (m *mockNetplanRunner) WithCombinedOutput(ctx context.Context, name string,
 	return &run.Result{StdErr: "unimplemented"}
 }
 
+func (m *mockNetplanRunner) WithInput(ctx context.Context, stdin io.Reader, name string, args ...string) *run.Result {
+	return &run.Result{StdErr: "unimplemented"}
+}
+
 func (m *mockNetplanRunner) WithOutput(ctx context.Context, name string, args ...string) *run.Result {
 	return &run.Result{StdErr: "unimplemented"}
 }
@@ -128,8 +135,8 @@ func verifyNetworkdDropin(t *testing.T, ifaceName, networdCfg string, nics *Inte
 			DNSDefaultRoute: false,
 		},
 		DHCPv4: &systemdDHCPConfig{
-			RoutesToDNS: false,
-			RoutesToNTP: false,
+			RoutesToDNS: makebool(false),
+			RoutesToNTP: makebool(false),
 		},
 	}
 
@@ -146,8 +153,8 @@ func verifyNetworkdDropin(t *testing.T, ifaceName, networdCfg string, nics *Inte
 			DNSDefaultRoute: false,
 		},
 		DHCPv4: &systemdDHCPConfig{
-			RoutesToDNS: false,
-			RoutesToNTP: false,
+			RoutesToDNS: makebool(false),
+			RoutesToNTP: makebool(false),
 		},
 	}
 
@@ -251,8 +258,8 @@ func TestIsNetworkdNetplanConfigSame(t *testing.T) {
 			DHCP:            "yes",
 		},
 		DHCPv4: &systemdDHCPConfig{
-			RoutesToDNS: false,
-			RoutesToNTP: false,
+			RoutesToDNS: makebool(false),
+			RoutesToNTP: makebool(false),
 		},
 	}
 
@@ -361,3 +368,244 @@ func TestIsNetplanConfigSame(t *testing.T) {
 		})
 	}
 }
+
+func TestNetplanRenderer(t *testing.T) {
+	writeConfig := func(t *testing.T, path, content string) {
+		t.Helper()
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("os.MkdirAll(%s) failed unexpectedly with error: %v", filepath.Dir(path), err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("os.WriteFile(%s) failed unexpectedly with error: %v", path, err)
+		}
+	}
+
+	// Configs are written in YAML flow style.
+	nmConfig := `{"network": {"version": 2, "renderer": "NetworkManager"}}`
+	networkdConfig := `{"network": {"version": 2, "renderer": "networkd"}}`
+	noRendererConfig := `{"network": {"version": 2, "ethernets": {"eth0": {"dhcp4": true}}}}`
+
+	tests := []struct {
+		name  string
+		files map[string]string
+		want  string
+	}{
+		{
+			name: "no-configs",
+			want: netplanRendererNetworkd,
+		},
+		{
+			name:  "no-renderer",
+			files: map[string]string{"etc/50-cloud-init.yaml": noRendererConfig},
+			want:  netplanRendererNetworkd,
+		},
+		{
+			name:  "network-manager",
+			files: map[string]string{"etc/01-network-manager-all.yaml": nmConfig, "etc/50-cloud-init.yaml": noRendererConfig},
+			want:  netplanRendererNetworkManager,
+		},
+		{
+			name:  "last-file-wins",
+			files: map[string]string{"etc/01-network-manager-all.yaml": nmConfig, "lib/90-networkd.yaml": networkdConfig},
+			want:  netplanRendererNetworkd,
+		},
+		{
+			name:  "higher-precedence-dir-shadows",
+			files: map[string]string{"lib/01-renderer.yaml": nmConfig, "run/01-renderer.yaml": networkdConfig},
+			want:  netplanRendererNetworkd,
+		},
+		{
+			name:  "invalid-config-ignored",
+			files: map[string]string{"etc/01-network-manager-all.yaml": nmConfig, "etc/99-invalid.yaml": "network: ["},
+			want:  netplanRendererNetworkManager,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			root := t.TempDir()
+			for name, content := range tc.files {
+				writeConfig(t, filepath.Join(root, name), content)
+			}
+
+			n := &netplan{rendererConfigDirs: []string{filepath.Join(root, "lib"), filepath.Join(root, "etc"), filepath.Join(root, "run")}}
+			if got := n.renderer(); got != tc.want {
+				t.Errorf("renderer() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSetupVlanInterfaceNetworkManager(t *testing.T) {
+	netplanCfg := t.TempDir()
+	networkdCfg := t.TempDir()
+	rendererCfg := t.TempDir()
+	ctx := context.Background()
+
+	nmConfig := `{"network": {"version": 2, "renderer": "NetworkManager"}}`
+	if err := os.WriteFile(filepath.Join(rendererCfg, "01-network-manager-all.yaml"), []byte(nmConfig), 0644); err != nil {
+		t.Fatalf("os.WriteFile() failed unexpectedly with error: %v", err)
+	}
+
+	mgr := &netplan{netplanConfigDir: netplanCfg, networkdDropinDir: networkdCfg, priority: 20, rendererConfigDirs: []string{rendererCfg}}
+	nics := &Interfaces{
+		VlanInterfaces: map[int]VlanInterface{
+			5: {
+				VlanInterface: metadata.VlanInterface{
+					Mac:  "mac-address",
+					Vlan: 5,
+					MTU:  1460,
+				},
+				ParentInterfaceID: "eth0",
+			},
+		},
+	}
+
+	runner := setupNetplanRunner(t)
+
+	if err := mgr.SetupVlanInterface(ctx, nil, nics); err != nil {
+		t.Errorf("SetupVlanInterface(ctx, nil, %+v) failed unexpectedly with error: %v", nics, err)
+	}
+
+	wantCmds := []string{"netplan generate", "nmcli connection reload"}
+	if diff := cmp.Diff(wantCmds, runner.executedCommands); diff != "" {
+		t.Errorf("SetupVlanInterface(ctx, nil, %+v) returned diff on command executed (-want,+got)\n%s", nics, diff)
+	}
+
+	if _, err := os.Stat(filepath.Join(netplanCfg, "20-google-guest-agent-vlan.yaml")); err != nil {
+		t.Errorf("SetupVlanInterface(ctx, nil, %+v) did not write netplan vlan dropin: %v", nics, err)
+	}
+
+	entries, err := os.ReadDir(networkdCfg)
+	if err != nil {
+		t.Fatalf("os.ReadDir(%s) failed unexpectedly with error: %v", networkdCfg, err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("SetupVlanInterface(ctx, nil, %+v) wrote networkd drop-ins with NetworkManager renderer: %v", nics, entries)
+	}
+}
+
+// setupUbuntu1804 makes the tests run as in Ubuntu 18.04.
+func setupUbuntu1804(t *testing.T) {
+	t.Helper()
+
+	t.Cleanup(func() { osinfoGet = osinfo.Get })
+	osinfoGet = func() osinfo.OSInfo {
+		return osinfo.OSInfo{OS: "ubuntu", Version: osinfo.Ver{Major: 18, Minor: 4}}
+	}
+}
+
+func TestNetplanIsManagingUbuntu1804(t *testing.T) {
+	setupUbuntu1804(t)
+
+	orig := execLookPath
+	t.Cleanup(func() { execLookPath = orig })
+	execLookPath = func(name string) (string, error) { return "/usr/sbin/" + name, nil }
+
+	for _, enabled := range []bool{true, false} {
+		if err := cfg.Load([]byte(fmt.Sprintf("[NetworkInterfaces]\nubuntu1804_netplan_dropin = %t", enabled))); err != nil {
+			t.Fatalf("cfg.Load() failed unexpectedly with error: %v", err)
+		}
+
+		got, err := (&netplan{}).IsManaging(context.Background(), "eth0")
+		if err != nil {
+			t.Fatalf("netplan.IsManaging(ctx, eth0) failed unexpectedly with error: %v", err)
+		}
+		if got != enabled {
+			t.Errorf("netplan.IsManaging(ctx, eth0) = %t with ubuntu1804_netplan_dropin = %t, want %t", got, enabled, enabled)
+		}
+	}
+}
+
+func TestWriteNetplanEthernetDropinUbuntu1804(t *testing.T) {
+	setupUbuntu1804(t)
+	if err := cfg.Load([]byte("[NetworkInterfaces]\nmanage_primary_nic = true")); err != nil {
+		t.Fatalf("cfg.Load() failed unexpectedly with error: %v", err)
+	}
+
+	mgr := &netplan{netplanConfigDir: t.TempDir(), priority: 20}
+	mtu := 1460
+	if _, err := mgr.writeNetplanEthernetDropin(map[string]int{"eth0": mtu, "eth1": mtu}, []string{"eth0", "eth1"}, []string{"eth1"}); err != nil {
+		t.Fatalf("writeNetplanEthernetDropin() failed unexpectedly with error: %v", err)
+	}
+
+	want := &netplanDropin{
+		Network: netplanNetwork{
+			Version: 2,
+			Ethernets: map[string]netplanEthernet{
+				"eth1": {
+					Match:  netplanMatch{Name: "eth1"},
+					MTU:    &mtu,
+					DHCPv4: makebool(true),
+					DHCPv6: makebool(true),
+				},
+			},
+		},
+	}
+
+	got := &netplanDropin{}
+	if err := readYamlFile(mgr.dropinFile(netplanEthernetSuffix), got); err != nil {
+		t.Fatalf("readYamlFile(%q) failed unexpectedly with error: %v", mgr.dropinFile(netplanEthernetSuffix), err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("writeNetplanEthernetDropin() wrote unexpected drop-in on Ubuntu 18.04 (-want,+got)\n%s", diff)
+	}
+
+	runner := setupNetplanRunner(t)
+	if err := mgr.reloadConfigs(context.Background()); err != nil {
+		t.Fatalf("reloadConfigs(ctx) failed unexpectedly with error: %v", err)
+	}
+	if diff := cmp.Diff([]string{"netplan apply"}, runner.executedCommands); diff != "" {
+		t.Errorf("reloadConfigs(ctx) ran unexpected commands on Ubuntu 18.04 (-want,+got)\n%s", diff)
+	}
+}
+
+func TestWriteNetplanEthernetDropinUseDomains(t *testing.T) {
+	t.Cleanup(func() { osinfoGet = osinfo.Get })
+	osinfoGet = func() osinfo.OSInfo { return osinfo.OSInfo{OS: "debian", Version: osinfo.Ver{Major: 11}} }
+
+	tests := []struct {
+		name          string
+		config        string
+		wantPrimary   bool
+		wantSecondary bool
+	}{
+		{
+			name:        "default",
+			wantPrimary: true,
+		},
+		{
+			name:          "inverted",
+			config:        "primary_nic_use_domains = false\nsecondary_nic_use_domains = true",
+			wantSecondary: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := cfg.Load([]byte("[NetworkInterfaces]\nmanage_primary_nic = true\n" + tc.config)); err != nil {
+				t.Fatalf("cfg.Load() failed unexpectedly with error: %v", err)
+			}
+
+			mgr := &netplan{netplanConfigDir: t.TempDir(), priority: 20}
+			if _, err := mgr.writeNetplanEthernetDropin(nil, []string{"eth0", "eth1"}, []string{"eth0", "eth1"}); err != nil {
+				t.Fatalf("writeNetplanEthernetDropin() failed unexpectedly with error: %v", err)
+			}
+
+			got := &netplanDropin{}
+			if err := readYamlFile(mgr.dropinFile(netplanEthernetSuffix), got); err != nil {
+				t.Fatalf("readYamlFile(%q) failed unexpectedly with error: %v", mgr.dropinFile(netplanEthernetSuffix), err)
+			}
+
+			for iface, want := range map[string]bool{"eth0": tc.wantPrimary, "eth1": tc.wantSecondary} {
+				ne := got.Network.Ethernets[iface]
+				if ne.DHCP4Overrides == nil || ne.DHCP6Overrides == nil {
+					t.Fatalf("writeNetplanEthernetDropin() wrote %s without dhcp overrides: %+v", iface, ne)
+				}
+				if *ne.DHCP4Overrides.UseDomains != want || *ne.DHCP6Overrides.UseDomains != want {
+					t.Errorf("writeNetplanEthernetDropin() wrote %s with use-domains %t/%t, want %t", iface, *ne.DHCP4Overrides.UseDomains, *ne.DHCP6Overrides.UseDomains, want)
+				}
+			}
+		})
+	}
+}
@@ -138,6 +138,7 @@ func (n *networkManager) Configure(ctx context.Context, config *cfg.Sections) {
 func (n *networkManager) IsManaging(ctx context.Context, iface string) (bool, error) {
 	// Check whether NetworkManager.service is active.
 	if err := run.Quiet(ctx, "systemctl", "is-active", "NetworkManager.service"); err != nil {
+		notManaging(ctx, n, "NetworkManager.service is not active")
 		return false, nil
 	}
 
@@ -145,6 +146,7 @@ func (n *networkManager) IsManaging(ctx context.Context, iface string) (bool, er
 	// to reload the configs for its connections.
 	exists, err := cliExists("nmcli")
 	if !exists {
+		notManaging(ctx, n, "nmcli not found")
 		return false, err
 	}
 
@@ -159,15 +161,19 @@ func (n *networkManager) IsManaging(ctx context.Context, iface string) (bool, er
 	for _, line := range lines {
 		if strings.HasPrefix(line, iface) {
 			fields := strings.Split(line, ":")
+			if fields[1] != "connected" {
+				notManaging(ctx, n, "interface is %s", fields[1])
+			}
 			return fields[1] == "connected", nil
 		}
 	}
+	notManaging(ctx, n, "interface not listed by nmcli")
 	return false, nil
 }
 
 // Setup sets up the necessary configurations for NetworkManager.
 func (n *networkManager) SetupEthernetInterface(ctx context.Context, config *cfg.Sections, nics *Interfaces) error {
-	ifaces, err := interfaceNames(nics.EthernetInterfaces)
+	ifaces, err := nics.ethernetNames()
 	if err != nil {
 		return fmt.Errorf("error getting interfaces: %v", err)
 	}
@@ -285,8 +291,8 @@ func (n *networkManager) writeNetworkManagerConfigs(ifaces []string) ([]string,
 	var result []string
 
 	for i, iface := range ifaces {
-		if !shouldManageInterface(i == 0) {
-			logger.Debugf("ManagePrimaryNIC is disabled, skipping writeNetworkManagerConfigs for %s", iface)
+		if !shouldManageInterface(iface, i == 0) {
+			logger.Debugf("Interface %s is not managed by the guest agent, skipping writeNetworkManagerConfigs", iface)
 			continue
 		}
 
@@ -345,7 +351,7 @@ func (n *networkManager) writeNetworkManagerConfigs(ifaces []string) ([]string,
 }
 
 func (n *networkManager) rollbackConfigs(ctx context.Context, nics *Interfaces, removeVlan bool) error {
-	ifaces, err := interfaceNames(nics.EthernetInterfaces)
+	ifaces, err := nics.ethernetNames()
 	if err != nil {
 		return fmt.Errorf("getting interfaces: %v", err)
 	}
@@ -19,6 +19,7 @@ package manager
 import (
 	"context"
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"os/exec"
@@ -102,6 +103,10 @@ func (n nmMockRunner) WithCombinedOutput(ctx context.Context, name string, args
 	return &run.Result{}
 }
 
+func (n nmMockRunner) WithInput(ctx context.Context, stdin io.Reader, name string, args ...string) *run.Result {
+	return &run.Result{}
+}
+
 // nmTestOpts are options to set for test environment setup.
 type nmTestOpts struct {
 	// lookPathOpts contains options to set for the behavior of exec.LookPath.
@@ -105,17 +105,22 @@ type systemdNetworkConfig struct {
 
 // systemdDHCPConfig contains the dhcp specific configurations for a
 // systemd network configuration. RouteToDNS and RouteToNTP are present
-// only in context of [DHCPv4]
+// only in context of [DHCPv4], unset keys are left out of the section.
 // https://www.freedesktop.org/software/systemd/man/latest/systemd.network.html#RoutesToDNS=
 // https://www.freedesktop.org/software/systemd/man/latest/systemd.network.html#RoutesToNTP=
+// https://www.freedesktop.org/software/systemd/man/latest/systemd.network.html#UseDomains=
 type systemdDHCPConfig struct {
 	// RoutesToDNS defines if routes to the DNS servers received from the DHCP
 	// shoud be configured/installed.
-	RoutesToDNS bool
+	RoutesToDNS *bool `ini:",omitempty"`
 
 	// RoutesToNTP defines if routes to the NTP servers received from the DHCP
 	// shoud be configured/installed.
-	RoutesToNTP bool
+	RoutesToNTP *bool `ini:",omitempty"`
+
+	// UseDomains defines if the domain name received from the DHCP server is
+	// used as DNS search domain over this link.
+	UseDomains *bool `ini:",omitempty"`
 }
 
 // systemdConfig wraps the interface configuration for systemd-networkd.
@@ -188,6 +193,7 @@ func (n *systemdNetworkd) IsManaging(ctx context.Context, iface string) (bool, e
 	// Check the version.
 	exists, err := cliExists("networkctl")
 	if !exists {
+		notManaging(ctx, n, "networkctl not found")
 		return false, err
 	}
 
@@ -203,12 +209,14 @@ func (n *systemdNetworkd) IsManaging(ctx context.Context, iface string) (bool, e
 	}
 	if version < minSupportedVersion {
 		logger.Infof("systemd-networkd version %v not supported: minimum %v required", version, minSupportedVersion)
+		notManaging(ctx, n, "systemd-networkd version %d < %d", version, minSupportedVersion)
 		return false, nil
 	}
 
 	// First check if the service is running.
 	res = run.WithOutput(ctx, "systemctl", "is-active", "systemd-networkd.service")
 	if res.ExitCode != 0 {
+		notManaging(ctx, n, "systemd-networkd.service is not active")
 		return false, nil
 	}
 
@@ -230,6 +238,9 @@ func (n *systemdNetworkd) IsManaging(ctx context.Context, iface string) (bool, e
 			continue
 		}
 
+		if state != "configured" {
+			notManaging(ctx, n, "interface %s is %v", statusKey, state)
+		}
 		return state == "configured", nil
 	}
 	return false, fmt.Errorf("could not determine interface state, one of %v was not present", n.networkCtlKeys)
@@ -488,8 +499,8 @@ func (sc systemdConfig) isGuestAgentManaged() bool {
 // provided directory using the given priority.
 func (n *systemdNetworkd) writeEthernetConfig(interfaces, ipv6Interfaces []string) error {
 	for i, iface := range interfaces {
-		if !shouldManageInterface(i == 0) {
-			logger.Debugf("ManagePrimaryNIC is disabled, skipping systemdNetworkd writeEthernetConfig for %s", iface)
+		if !shouldManageInterface(iface, i == 0) {
+			logger.Debugf("Interface %s is not managed by the guest agent, skipping systemdNetworkd writeEthernetConfig", iface)
 			continue
 		}
 
@@ -517,15 +528,20 @@ func (n *systemdNetworkd) writeEthernetConfig(interfaces, ipv6Interfaces []strin
 		// We are only interested on DHCP offered routes on the primary nic,
 		// ignore it for the secondary ones.
 		if i != 0 {
+			falseVal := false
 			data.Network.DNSDefaultRoute = false
-			data.DHCPv4 = &systemdDHCPConfig{
-				RoutesToDNS: false,
-				RoutesToNTP: false,
-			}
-			data.DHCPv6 = &systemdDHCPConfig{
-				RoutesToDNS: false,
-				RoutesToNTP: false,
+			data.DHCPv4 = &systemdDHCPConfig{RoutesToDNS: &falseVal, RoutesToNTP: &falseVal}
+			data.DHCPv6 = &systemdDHCPConfig{RoutesToDNS: &falseVal, RoutesToNTP: &falseVal}
+		}
+
+		// UseDomains is left to systemd-networkd's default unless configured.
+		if useDomains := useDHCPDomains(i == 0); useDomains != nil {
+			if data.DHCPv4 == nil {
+				data.DHCPv4 = &systemdDHCPConfig{}
+				data.DHCPv6 = &systemdDHCPConfig{}
 			}
+			data.DHCPv4.UseDomains = useDomains
+			data.DHCPv6.UseDomains = useDomains
 		}
 
 		if err := data.write(n, iface); err != nil {
@@ -553,7 +569,7 @@ func (n *systemdNetworkd) RollbackNics(ctx context.Context, nics *Interfaces) er
 // otherwise only regular nics are removed.
 func (n *systemdNetworkd) rollbackConfigs(ctx context.Context, nics *Interfaces, removeVlan bool) error {
 	logger.Infof("rolling back changes for %s", n.Name())
-	interfaces, err := interfaceNames(nics.EthernetInterfaces)
+	interfaces, err := nics.ethernetNames()
 	if err != nil {
 		return fmt.Errorf("failed to get list of interface names: %v", err)
 	}
@@ -19,6 +19,7 @@ package manager
 import (
 	"context"
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"os/exec"
@@ -31,6 +32,7 @@ import (
 	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/run"
 	"github.com/GoogleCloudPlatform/guest-agent/metadata"
 	"github.com/go-ini/ini"
+	"github.com/google/go-cmp/cmp"
 )
 
 // mockSystemd is the test systemd-networkd implementation to use for testing.
@@ -178,6 +180,10 @@ func (s systemdMockRunner) WithCombinedOutput(ctx context.Context, name string,
 	return &run.Result{}
 }
 
+func (s systemdMockRunner) WithInput(ctx context.Context, stdin io.Reader, name string, args ...string) *run.Result {
+	return &run.Result{}
+}
+
 // systemdTestSetup sets up the environment before each test.
 func systemdTestSetup(t *testing.T, opts systemdTestOpts) {
 	t.Helper()
@@ -698,3 +704,64 @@ func TestSetupVlanInterfaceSuccess(t *testing.T) {
 		})
 	}
 }
+
+func TestWriteEthernetConfigUseDomains(t *testing.T) {
+	trueVal, falseVal := true, false
+	tests := []struct {
+		name          string
+		config        string
+		wantPrimary   *bool
+		wantSecondary *bool
+	}{
+		{
+			name: "default",
+		},
+		{
+			name:          "inverted",
+			config:        "primary_nic_use_domains = false\nsecondary_nic_use_domains = true",
+			wantPrimary:   &falseVal,
+			wantSecondary: &trueVal,
+		},
+		{
+			name:        "primary-only",
+			config:      "primary_nic_use_domains = true",
+			wantPrimary: &trueVal,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := cfg.Load([]byte("[NetworkInterfaces]\nmanage_primary_nic = true\n" + tc.config)); err != nil {
+				t.Fatalf("cfg.Load() failed unexpectedly with error: %v", err)
+			}
+			systemdTestSetup(t, systemdTestOpts{})
+			t.Cleanup(func() { systemdTestTearDown(t) })
+
+			if err := mockSystemd.writeEthernetConfig([]string{"iface0", "iface1"}, nil); err != nil {
+				t.Fatalf("writeEthernetConfig() failed unexpectedly with error: %v", err)
+			}
+
+			for i, want := range []*bool{tc.wantPrimary, tc.wantSecondary} {
+				iface := fmt.Sprintf("iface%d", i)
+				got := new(systemdConfig)
+				if err := readIniFile(mockSystemd.networkFile(iface), got); err != nil {
+					t.Fatalf("readIniFile(%q) failed unexpectedly with error: %v", mockSystemd.networkFile(iface), err)
+				}
+
+				for section, dhcp := range map[string]*systemdDHCPConfig{"DHCPv4": got.DHCPv4, "DHCPv6": got.DHCPv6} {
+					var useDomains *bool
+					if dhcp != nil {
+						useDomains = dhcp.UseDomains
+					}
+					if diff := cmp.Diff(want, useDomains); diff != "" {
+						t.Errorf("writeEthernetConfig() wrote %s with unexpected [%s] UseDomains (-want,+got):\n%s", iface, section, diff)
+					}
+					// Routes offered by DHCP are kept on the primary NIC only.
+					if i == 0 && dhcp != nil && (dhcp.RoutesToDNS != nil || dhcp.RoutesToNTP != nil) {
+						t.Errorf("writeEthernetConfig() wrote primary %s with [%s] routes overrides: %+v", iface, section, dhcp)
+					}
+				}
+			}
+		})
+	}
+}
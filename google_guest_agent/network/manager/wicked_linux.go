@@ -75,6 +75,7 @@ func (n *wicked) IsManaging(ctx context.Context, iface string) (bool, error) {
 	// Check if the wicked service is running.
 	res = run.WithOutput(ctx, "systemctl", "is-active", "wicked.service")
 	if res.ExitCode != 0 {
+		notManaging(ctx, n, "wicked.service is not active")
 		return false, nil
 	}
 
@@ -87,12 +88,13 @@ func (n *wicked) IsManaging(ctx context.Context, iface string) (bool, error) {
 	if fields[1] == "up" || fields[1] == "setup-in-progress" {
 		return true, nil
 	}
+	notManaging(ctx, n, "interface is %s", fields[1])
 	return false, nil
 }
 
 // SetupEthernetInterface writes the necessary configuration files for each interface and enables them.
 func (n *wicked) SetupEthernetInterface(ctx context.Context, cfg *cfg.Sections, nics *Interfaces) error {
-	ifaces, err := interfaceNames(nics.EthernetInterfaces)
+	ifaces, err := nics.ethernetNames()
 	if err != nil {
 		return fmt.Errorf("failed to get network interfaces: %v", err)
 	}
@@ -214,8 +216,8 @@ func (n *wicked) writeEthernetConfigs(ifaces []string) error {
 
 	// Write the config for all the non-primary network interfaces.
 	for i, iface := range ifaces {
-		if !shouldManageInterface(i == 0) {
-			logger.Debugf("ManagePrimaryNIC is disabled, skipping wicked writeEthernetConfig for %s", iface)
+		if !shouldManageInterface(iface, i == 0) {
+			logger.Debugf("Interface %s is not managed by the guest agent, skipping wicked writeEthernetConfig", iface)
 			continue
 		}
 
@@ -223,7 +225,7 @@ func (n *wicked) writeEthernetConfigs(ifaces []string) error {
 		ifcfg := n.ifcfgFilePath(iface)
 
 		// Avoid writing the configuration file if the configuration already exists.
-		if fileExists(ifcfg) {
+		if utils.FileExists(ifcfg, utils.TypeFile) {
 			logger.Infof("Wicked config %q already exists, will skip writing", ifcfg)
 			continue
 		}
@@ -324,7 +326,7 @@ func (n *wicked) Rollback(ctx context.Context, nics *Interfaces) error {
 // Rollback deletes all the ifcfg files written by Setup for regular nics only,
 // then reloads wicked.service.
 func (n *wicked) RollbackNics(ctx context.Context, nics *Interfaces) error {
-	ifaces, err := interfaceNames(nics.EthernetInterfaces)
+	ifaces, err := nics.ethernetNames()
 	if err != nil {
 		return fmt.Errorf("failed to get network interfaces: %v", err)
 	}
@@ -18,6 +18,7 @@ package manager
 
 import (
 	"context"
+	"io"
 	"os"
 	"path"
 	"slices"
@@ -120,6 +121,10 @@ func (w wickedMockRunner) WithCombinedOutput(ctx context.Context, name string, a
 	return &run.Result{}
 }
 
+func (w wickedMockRunner) WithInput(ctx context.Context, stdin io.Reader, name string, args ...string) *run.Result {
+	return &run.Result{}
+}
+
 // wickedTestSetup sets up the environment for each test using the provided options.
 func wickedTestSetup(t *testing.T, opts wickedTestOpts) {
 	t.Helper()
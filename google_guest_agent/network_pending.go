@@ -0,0 +1,69 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"runtime"
+	"time"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+)
+
+// networkPendingJobID is the scheduler ID of the deferred network setup check.
+const networkPendingJobID = "network-pending-work"
+
+// networkPendingJob periodically runs the address manager while the network setup
+// has deferred work left, i.e. a delayed DHCPv6 lease release. The address manager
+// otherwise only runs on metadata events, which may not happen once the delay
+// expires.
+type networkPendingJob struct {
+	// interval is how often the pending work is checked, zero disables it.
+	interval time.Duration
+}
+
+// newNetworkPendingJob returns the deferred network setup check, run at the
+// [NetworkInterfaces] dhcpv6_release_delay interval.
+func newNetworkPendingJob() *networkPendingJob {
+	return &networkPendingJob{interval: time.Duration(cfg.Get().NetworkInterfaces.DHCPv6ReleaseDelay) * time.Second}
+}
+
+// ID returns the ID for this job.
+func (j *networkPendingJob) ID() string {
+	return networkPendingJobID
+}
+
+// Interval returns the interval at which job is executed, nothing can be pending
+// before the first metadata event.
+func (j *networkPendingJob) Interval() (time.Duration, bool) {
+	return j.interval, false
+}
+
+// ShouldEnable returns true if DHCPv6 lease releases are delayed, the agent
+// doesn't set up network interfaces on Windows.
+func (j *networkPendingJob) ShouldEnable(ctx context.Context) bool {
+	return runtime.GOOS != "windows" && j.interval > 0
+}
+
+// Run runs the address manager if the network setup has deferred work left.
+func (j *networkPendingJob) Run(ctx context.Context) (bool, error) {
+	updateMu.Lock()
+	defer updateMu.Unlock()
+
+	if newMetadata == nil || !networkHasPendingWork() {
+		return true, nil
+	}
+	return true, runManager(ctx, addressManager)
+}
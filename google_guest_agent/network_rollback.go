@@ -0,0 +1,76 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/command"
+	network "github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/network/manager"
+)
+
+// networkRollbackCommand is the command monitor command used to roll back all the
+// network configuration written by the guest agent.
+const networkRollbackCommand = "network.rollback"
+
+// networkRollbackAll points to the function rolling back the network configuration,
+// overridden in tests.
+var networkRollbackAll = network.RollbackAll
+
+// networkRollbackResponse is the response of the network.rollback command.
+type networkRollbackResponse struct {
+	command.Response
+	// NetworkManager is the network manager whose configuration was rolled back,
+	// empty if no network manager was detected.
+	NetworkManager string
+}
+
+// networkRollbackHandler returns the handler of the network.rollback command.
+func networkRollbackHandler(ctx context.Context) command.Handler {
+	return func(b []byte) ([]byte, error) {
+		var resp networkRollbackResponse
+
+		mds := latestMetadata.Load()
+		if mds == nil {
+			var err error
+			mds, err = mdsClient.Get(ctx)
+			if err != nil {
+				resp.Status = 1
+				resp.StatusMessage = fmt.Sprintf("failed to get metadata: %v", err)
+				return json.Marshal(resp)
+			}
+		}
+
+		// Serialize with the metadata updates so an in-flight network setup
+		// doesn't mark the rolled back configuration as applied.
+		updateMu.Lock()
+		name, err := networkRollbackAll(ctx, mds)
+		updateMu.Unlock()
+		resp.NetworkManager = name
+		switch {
+		case err != nil:
+			resp.Status = 1
+			resp.StatusMessage = fmt.Sprintf("failed to roll back network configuration: %v", err)
+		case name == "":
+			resp.StatusMessage = "no network manager detected, nothing to roll back"
+		default:
+			resp.StatusMessage = "OK"
+		}
+
+		return json.Marshal(resp)
+	}
+}
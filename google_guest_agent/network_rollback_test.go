@@ -0,0 +1,86 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/guest-agent/metadata"
+)
+
+func TestNetworkRollbackHandler(t *testing.T) {
+	origRollback, origMetadata := networkRollbackAll, latestMetadata.Load()
+	t.Cleanup(func() {
+		networkRollbackAll = origRollback
+		latestMetadata.Store(origMetadata)
+	})
+	mds := &metadata.Descriptor{}
+	latestMetadata.Store(mds)
+
+	tests := []struct {
+		name        string
+		manager     string
+		err         error
+		wantStatus  int
+		wantManager string
+	}{
+		{
+			name:        "rolled_back",
+			manager:     "netplan",
+			wantManager: "netplan",
+		},
+		{
+			name: "no_manager",
+		},
+		{
+			name:        "failure",
+			manager:     "netplan",
+			err:         fmt.Errorf("rollback error"),
+			wantStatus:  1,
+			wantManager: "netplan",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			networkRollbackAll = func(ctx context.Context, got *metadata.Descriptor) (string, error) {
+				if got != mds {
+					t.Errorf("networkRollbackAll(ctx, %+v) called with unexpected metadata, want %+v", got, mds)
+				}
+				return tc.manager, tc.err
+			}
+
+			b, err := networkRollbackHandler(context.Background())(nil)
+			if err != nil {
+				t.Fatalf("networkRollbackHandler(ctx)(nil) failed unexpectedly with error: %v", err)
+			}
+
+			var resp networkRollbackResponse
+			if err := json.Unmarshal(b, &resp); err != nil {
+				t.Fatalf("json.Unmarshal(%s) failed unexpectedly with error: %v", b, err)
+			}
+
+			if resp.Status != tc.wantStatus {
+				t.Errorf("networkRollbackHandler(ctx)(nil) returned status %d, want %d", resp.Status, tc.wantStatus)
+			}
+			if resp.NetworkManager != tc.wantManager {
+				t.Errorf("networkRollbackHandler(ctx)(nil) returned network manager %q, want %q", resp.NetworkManager, tc.wantManager)
+			}
+		})
+	}
+}
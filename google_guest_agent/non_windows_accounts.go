@@ -27,6 +27,7 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
 	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/run"
@@ -37,7 +38,10 @@ import (
 var (
 	// sshKeys is a cache of what we have added to each managed users' authorized
 	// keys file. Avoids necessity of re-reading all files on every change.
-	sshKeys         map[string][]string
+	sshKeys map[string][]string
+	// sshKeysMu guards sshKeys, which is shared by the accounts manager and the
+	// key expiration sweep.
+	sshKeysMu       sync.Mutex
 	googleUsersFile = "/var/lib/google/google_users"
 )
 
@@ -70,7 +74,19 @@ func removeExpiredKeys(keys []string) []string {
 	return validKeys
 }
 
-type accountsMgr struct{}
+type accountsMgr struct {
+	// provisioner overrides defaultUserProvisioner if set.
+	provisioner userProvisioner
+}
+
+// backend returns the userProvisioner used to provision users, the shell
+// commands based one unless overridden.
+func (a *accountsMgr) backend() userProvisioner {
+	if a.provisioner != nil {
+		return a.provisioner
+	}
+	return defaultUserProvisioner
+}
 
 func (a *accountsMgr) Diff(ctx context.Context) (bool, error) {
 	// If any keys have changed.
@@ -85,6 +101,8 @@ func (a *accountsMgr) Diff(ctx context.Context) (bool, error) {
 	}
 
 	// If any on-disk keys have expired.
+	sshKeysMu.Lock()
+	defer sshKeysMu.Unlock()
 	for _, keys := range sshKeys {
 		if len(keys) != len(removeExpiredKeys(keys)) {
 			return true, nil
@@ -100,10 +118,21 @@ func (a *accountsMgr) Diff(ctx context.Context) (bool, error) {
 	return false, nil
 }
 
+// Name returns the manager's name, see accountsMgrName.
+func (a *accountsMgr) Name() string {
+	return accountsMgrName
+}
+
 func (a *accountsMgr) Timeout(ctx context.Context) (bool, error) {
 	return false, nil
 }
 
+// dependencies makes the accounts manager run after the OS Login manager, which
+// clears metadata SSH keys and provisions accounts itself when OS Login is enabled.
+func (a *accountsMgr) dependencies() []string {
+	return []string{osloginMgrName}
+}
+
 func (a *accountsMgr) Disabled(ctx context.Context) (bool, error) {
 	config := cfg.Get()
 	oslogin, _, _, _ := getOSLoginEnabled(newMetadata)
@@ -112,19 +141,19 @@ func (a *accountsMgr) Disabled(ctx context.Context) (bool, error) {
 
 func (a *accountsMgr) Set(ctx context.Context) error {
 	config := cfg.Get()
+	provisioner := a.backend()
+
+	sshKeysMu.Lock()
+	defer sshKeysMu.Unlock()
 
 	if sshKeys == nil {
 		logger.Debugf("initialize sshKeys map")
 		sshKeys = make(map[string][]string)
 	}
 
-	logger.Debugf("create sudoers file if needed")
-	if err := createSudoersFile(); err != nil {
-		logger.Errorf("Error creating google-sudoers file: %v.", err)
-	}
-	logger.Debugf("create sudoers group if needed")
-	if err := createSudoersGroup(ctx, config); err != nil {
-		logger.Errorf("Error creating google-sudoers group: %v.", err)
+	logger.Debugf("create sudoers file and group if needed")
+	if err := provisioner.SetupSudoers(ctx, config); err != nil {
+		logger.Errorf("Error setting up google-sudoers: %v.", err)
 	}
 
 	mdkeys := newMetadata.Instance.Attributes.SSHKeys
@@ -143,9 +172,9 @@ func (a *accountsMgr) Set(ctx context.Context) error {
 
 	// Update SSH keys, creating Google users as needed.
 	for user, userKeys := range mdKeyMap {
-		if _, err := getPasswd(user); err != nil {
+		if !provisioner.UserExists(user) {
 			logger.Infof("Creating user %s.", user)
-			if err := createGoogleUser(ctx, config, user); err != nil {
+			if err := provisioner.CreateUser(ctx, config, user); err != nil {
 				logger.Errorf("Error creating user: %s.", err)
 				continue
 			}
@@ -153,13 +182,13 @@ func (a *accountsMgr) Set(ctx context.Context) error {
 		}
 		if _, ok := gUsers[user]; !ok {
 			logger.Infof("Adding existing user %s to google-sudoers group.", user)
-			if err := addUserToGroup(ctx, user, "google-sudoers"); err != nil {
+			if err := provisioner.AddUserToGroup(ctx, user, "google-sudoers"); err != nil {
 				logger.Errorf("%v.", err)
 			}
 		}
 		if !compareStringSlice(userKeys, sshKeys[user]) {
 			logger.Infof("Updating keys for user %s.", user)
-			if err := updateAuthorizedKeysFile(ctx, user, userKeys); err != nil {
+			if err := provisioner.SetAuthorizedKeys(ctx, user, userKeys); err != nil {
 				logger.Errorf("Error updating SSH keys for %s: %v.", user, err)
 				continue
 			}
@@ -171,7 +200,7 @@ func (a *accountsMgr) Set(ctx context.Context) error {
 	for user := range gUsers {
 		if _, ok := mdKeyMap[user]; !ok && user != "" {
 			logger.Infof("Removing user %s.", user)
-			err = removeGoogleUser(ctx, config, user)
+			err = provisioner.RemoveUser(ctx, config, user)
 			if err != nil {
 				logger.Errorf("Error removing user: %v.", err)
 			}
@@ -409,10 +438,87 @@ func createSudoersGroup(ctx context.Context, config *cfg.Sections) error {
 	return nil
 }
 
+// defaultAuthorizedKeysFile is the authorized keys file used when the
+// authorized_keys_file configuration is empty, as sshd's AuthorizedKeysFile.
+const defaultAuthorizedKeysFile = "%h/.ssh/authorized_keys"
+
+// authorizedKeysPath expands the sshd AuthorizedKeysFile style pattern for
+// passwd: %h is replaced by the home directory, %u by the user name and %% by a
+// literal '%'. A relative result is taken relative to the home directory.
+func authorizedKeysPath(pattern string, passwd *passwdEntry) (string, error) {
+	if pattern == "" {
+		pattern = defaultAuthorizedKeysFile
+	}
+
+	var res strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		if pattern[i] != '%' {
+			res.WriteByte(pattern[i])
+			continue
+		}
+		if i++; i == len(pattern) {
+			return "", fmt.Errorf("authorized keys file %q ends with an incomplete token", pattern)
+		}
+		switch pattern[i] {
+		case 'h':
+			res.WriteString(passwd.HomeDir)
+		case 'u':
+			res.WriteString(passwd.Username)
+		case '%':
+			res.WriteByte('%')
+		default:
+			return "", fmt.Errorf("authorized keys file %q has unsupported token %%%c", pattern, pattern[i])
+		}
+	}
+
+	if !path.IsAbs(res.String()) {
+		return path.Join(passwd.HomeDir, res.String()), nil
+	}
+	return path.Clean(res.String()), nil
+}
+
+// authorizedKeysDir makes sure the directory of the authorized keys file akpath
+// exists, is a directory and is writable. Missing directories within the user's
+// home, i.e. ~/.ssh, are created and owned by the user, any other location is
+// expected to be provisioned along with sshd's configuration.
+func authorizedKeysDir(akpath string, passwd *passwdEntry) error {
+	dir := path.Dir(akpath)
+	info, err := os.Stat(dir)
+	if err == nil {
+		if !info.IsDir() {
+			return fmt.Errorf("authorized keys directory %s is not a directory", dir)
+		}
+		return checkWritable(dir)
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+
+	if path.Dir(dir) != path.Clean(passwd.HomeDir) {
+		return fmt.Errorf("authorized keys directory %s does not exist", dir)
+	}
+	if err = os.Mkdir(dir, 0700); err != nil {
+		return err
+	}
+	return os.Chown(dir, passwd.UID, passwd.GID)
+}
+
+// checkWritable returns an error if files can't be created in dir, e.g. because
+// it's on a read-only file system.
+func checkWritable(dir string) error {
+	f, err := os.CreateTemp(dir, ".google-write-check*")
+	if err != nil {
+		return fmt.Errorf("authorized keys directory %s is not writable: %w", dir, err)
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
 // updateAuthorizedKeysFile adds provided keys to the user's SSH
-// AuthorizedKeys file. The file and containing directory are created if it
-// does not exist. Uses a temporary file to avoid partial updates in case of
-// errors. If no keys are provided, the authorized keys file is removed.
+// AuthorizedKeys file, as configured by authorized_keys_file. The file and, if
+// within the home directory, its containing directory are created if they do
+// not exist. Uses a temporary file to avoid partial updates in case of errors.
+// If no keys are provided, the authorized keys file is removed.
 func updateAuthorizedKeysFile(ctx context.Context, user string, keys []string) error {
 	gcomment := "# Added by Google"
 
@@ -428,20 +534,13 @@ func updateAuthorizedKeysFile(ctx context.Context, user string, keys []string) e
 		return nil
 	}
 
-	sshpath := path.Join(passwd.HomeDir, ".ssh")
-	if _, err := os.Stat(sshpath); err != nil {
-		if os.IsNotExist(err) {
-			if err = os.Mkdir(sshpath, 0700); err != nil {
-				return err
-			}
-			if err = os.Chown(sshpath, passwd.UID, passwd.GID); err != nil {
-				return err
-			}
-		} else {
-			return err
-		}
+	akpath, err := authorizedKeysPath(cfg.Get().Accounts.AuthorizedKeysFile, passwd)
+	if err != nil {
+		return err
+	}
+	if err := authorizedKeysDir(akpath, passwd); err != nil {
+		return err
 	}
-	akpath := path.Join(sshpath, "authorized_keys")
 	// Remove empty file.
 	if len(keys) == 0 {
 		os.Remove(akpath)
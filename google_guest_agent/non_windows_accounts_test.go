@@ -0,0 +1,117 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAuthorizedKeysPath(t *testing.T) {
+	passwd := &passwdEntry{Username: "alice", HomeDir: "/home/alice"}
+
+	tests := []struct {
+		name    string
+		pattern string
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "default",
+			want: "/home/alice/.ssh/authorized_keys",
+		},
+		{
+			name:    "per_user_directory",
+			pattern: "/etc/ssh/authorized_keys/%u",
+			want:    "/etc/ssh/authorized_keys/alice",
+		},
+		{
+			name:    "home_token",
+			pattern: "%h/.ssh/authorized_keys2",
+			want:    "/home/alice/.ssh/authorized_keys2",
+		},
+		{
+			name:    "relative",
+			pattern: ".ssh/keys",
+			want:    "/home/alice/.ssh/keys",
+		},
+		{
+			name:    "literal_percent",
+			pattern: "/etc/ssh/%%keys/%u",
+			want:    "/etc/ssh/%keys/alice",
+		},
+		{
+			name:    "unsupported_token",
+			pattern: "/etc/ssh/keys/%i",
+			wantErr: true,
+		},
+		{
+			name:    "incomplete_token",
+			pattern: "/etc/ssh/keys/%",
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := authorizedKeysPath(tc.pattern, passwd)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("authorizedKeysPath(%q, %+v) = %v, want error: %t", tc.pattern, passwd, err, tc.wantErr)
+			}
+			if got != tc.want {
+				t.Errorf("authorizedKeysPath(%q, %+v) = %q, want %q", tc.pattern, passwd, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestAuthorizedKeysDir(t *testing.T) {
+	home := t.TempDir()
+	passwd := &passwdEntry{Username: "alice", HomeDir: home, UID: os.Getuid(), GID: os.Getgid()}
+
+	sshDir := filepath.Join(home, ".ssh")
+	if err := authorizedKeysDir(filepath.Join(sshDir, "authorized_keys"), passwd); err != nil {
+		t.Fatalf("authorizedKeysDir(%s) failed unexpectedly with error: %v", sshDir, err)
+	}
+	if info, err := os.Stat(sshDir); err != nil || !info.IsDir() || info.Mode().Perm() != 0700 {
+		t.Errorf("authorizedKeysDir(%s) did not create a 0700 directory, stat: %v, %v", sshDir, info, err)
+	}
+
+	outside := filepath.Join(t.TempDir(), "keys", "alice")
+	if err := authorizedKeysDir(outside, passwd); err == nil {
+		t.Errorf("authorizedKeysDir(%s) succeeded, want error for a missing directory out of the home directory", outside)
+	}
+
+	if os.Getuid() != 0 {
+		readOnly := filepath.Join(t.TempDir(), "keys")
+		if err := os.Mkdir(readOnly, 0500); err != nil {
+			t.Fatalf("os.Mkdir(%s) failed unexpectedly with error: %v", readOnly, err)
+		}
+		if err := authorizedKeysDir(filepath.Join(readOnly, "alice"), passwd); err == nil {
+			t.Errorf("authorizedKeysDir(%s) succeeded, want error for a read-only directory", readOnly)
+		}
+	}
+
+	notDir := filepath.Join(home, "file")
+	if err := os.WriteFile(notDir, nil, 0600); err != nil {
+		t.Fatalf("os.WriteFile(%s) failed unexpectedly with error: %v", notDir, err)
+	}
+	if err := authorizedKeysDir(filepath.Join(notDir, "authorized_keys"), passwd); err == nil {
+		t.Errorf("authorizedKeysDir(%s) succeeded, want error for a parent which is not a directory", notDir)
+	}
+}
@@ -16,6 +16,17 @@ package osinfo
 
 import (
 	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	// cacheMu protects cached.
+	cacheMu sync.Mutex
+	// cached is the OSInfo of the running system, read once and reused by
+	// subsequent Get() calls.
+	cached *OSInfo
 )
 
 // OSInfo contains OS information about the system.
@@ -30,6 +41,9 @@ type OSInfo struct {
 	KernelRelease string
 	// The kernel version.
 	KernelVersion string
+	// Kernel is the kernel release parsed as a version, i.e. 6.1.0 for a
+	// 6.1.0-18-cloud-amd64 kernel release.
+	Kernel Ver
 
 	// This is used by oslogin.go
 	Version Ver
@@ -53,3 +67,79 @@ func (v Ver) String() string {
 	}
 	return ret
 }
+
+// AtLeast returns true if v is greater than or equal to major.minor.
+func (v Ver) AtLeast(major, minor int) bool {
+	if v.Major != major {
+		return v.Major > major
+	}
+	return v.Minor >= minor
+}
+
+// Is returns true if the system is os with exactly the provided major and
+// minor versions, i.e. Is("ubuntu", 18, 4) for Ubuntu 18.04.
+func (o OSInfo) Is(os string, major, minor int) bool {
+	return o.OS == os && o.Version.Major == major && o.Version.Minor == minor
+}
+
+// IsMajor returns true if the system is os with the provided major version
+// regardless of its minor version, i.e. IsMajor("debian", 12) for Debian 12.
+func (o OSInfo) IsMajor(os string, major int) bool {
+	return o.OS == os && o.Version.Major == major
+}
+
+// AtLeast returns true if the system is os with a version greater than or equal
+// to major.minor.
+func (o OSInfo) AtLeast(os string, major, minor int) bool {
+	return o.OS == os && o.Version.AtLeast(major, minor)
+}
+
+// KernelAtLeast returns true if the running kernel release is greater than or
+// equal to major.minor.
+func (o OSInfo) KernelAtLeast(major, minor int) bool {
+	return o.Kernel.AtLeast(major, minor)
+}
+
+// parseKernelRelease parses the leading numeric part of a kernel release, i.e.
+// 6.1.0 for 6.1.0-18-cloud-amd64 or 10.0.20348 for 10.0.20348.2340. Unparsable
+// parts are left as zero.
+func parseKernelRelease(release string) Ver {
+	end := strings.IndexFunc(release, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	if end >= 0 {
+		release = release[:end]
+	}
+
+	var ret Ver
+	for i, part := range strings.SplitN(strings.Trim(release, "."), ".", 4) {
+		num, err := strconv.Atoi(part)
+		if err != nil || i > 2 {
+			break
+		}
+		switch i {
+		case 0:
+			ret.Major = num
+		case 1:
+			ret.Minor = num
+		case 2:
+			ret.Patch = num
+		}
+		ret.Length = i + 1
+	}
+	return ret
+}
+
+// Get returns OSInfo on the running system. The system is only inspected on the
+// first call, subsequent calls return the cached result.
+func Get() OSInfo {
+	cacheMu.Lock()
+	defer cacheMu.Unlock()
+
+	if cached == nil {
+		info := get()
+		info.Kernel = parseKernelRelease(info.KernelRelease)
+		cached = &info
+	}
+	return *cached
+}
@@ -0,0 +1,83 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package osinfo
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseKernelRelease(t *testing.T) {
+	tests := []struct {
+		release string
+		want    Ver
+	}{
+		{"6.1.0-18-cloud-amd64", Ver{6, 1, 0, 3}},
+		{"5.15.0-1051-gcp", Ver{5, 15, 0, 3}},
+		{"4.18.0-513.11.1.el8_9.x86_64", Ver{4, 18, 0, 3}},
+		{"10.0.20348.2340", Ver{10, 0, 20348, 3}},
+		{"6.8", Ver{6, 8, 0, 2}},
+		{"", Ver{}},
+		{"test", Ver{}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.release, func(t *testing.T) {
+			if got := parseKernelRelease(tc.release); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("parseKernelRelease(%q) = %+v, want %+v", tc.release, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestPredicates(t *testing.T) {
+	ubuntu := OSInfo{OS: "ubuntu", VersionID: "18.04", Version: Ver{18, 4, 0, 2}, Kernel: Ver{5, 4, 0, 3}}
+	debian := OSInfo{OS: "debian", VersionID: "12", Version: Ver{12, 0, 0, 1}, Kernel: Ver{6, 1, 0, 3}}
+
+	tests := []struct {
+		desc string
+		got  bool
+		want bool
+	}{
+		{"ubuntu is 18.04", ubuntu.Is("ubuntu", 18, 4), true},
+		{"ubuntu is not 18.10", ubuntu.Is("ubuntu", 18, 10), false},
+		{"debian is not 18.04", debian.Is("ubuntu", 18, 4), false},
+		{"debian is major 12", debian.IsMajor("debian", 12), true},
+		{"debian is not major 11", debian.IsMajor("debian", 11), false},
+		{"ubuntu is not major debian 18", ubuntu.IsMajor("debian", 18), false},
+		{"debian at least 11.5", debian.AtLeast("debian", 11, 5), true},
+		{"debian at least 12.0", debian.AtLeast("debian", 12, 0), true},
+		{"debian not at least 12.1", debian.AtLeast("debian", 12, 1), false},
+		{"debian not at least ubuntu 10", debian.AtLeast("ubuntu", 10, 0), false},
+		{"kernel at least 5.4", ubuntu.KernelAtLeast(5, 4), true},
+		{"kernel not at least 5.10", ubuntu.KernelAtLeast(5, 10), false},
+		{"kernel at least 5.10", debian.KernelAtLeast(5, 10), true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			if tc.got != tc.want {
+				t.Errorf("got %t, want %t", tc.got, tc.want)
+			}
+		})
+	}
+}
+
+func TestGetCached(t *testing.T) {
+	t.Cleanup(func() { cached = nil })
+	cached = &OSInfo{OS: "cached"}
+
+	if got := Get(); got.OS != "cached" {
+		t.Errorf("Get() = %+v, want cached OSInfo", got)
+	}
+}
@@ -122,8 +122,8 @@ func parseRelease() (OSInfo, error) {
 	return OSInfo{}, errors.New("no known release file found")
 }
 
-// Get returns OSInfo on the running system.
-func Get() OSInfo {
+// get reads the OSInfo of the running system.
+func get() OSInfo {
 	osInfo, err := parseRelease()
 	if err != nil {
 		// This is a non critical error, we can still return a partially populated OSInfo.
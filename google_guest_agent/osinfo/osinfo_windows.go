@@ -139,8 +139,8 @@ func getKernelInfo() (string, string, error) {
 	return getVersion(info, langCodePage)
 }
 
-// Get returns OSInfo on the running system.
-func Get() OSInfo {
+// get reads the OSInfo of the running system.
+func get() OSInfo {
 	var osInfo OSInfo
 	osInfo.OS = "windows"
 
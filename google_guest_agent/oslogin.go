@@ -16,12 +16,16 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"runtime"
 	"slices"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
@@ -30,6 +34,7 @@ import (
 	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/run"
 	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/sshca"
 	"github.com/GoogleCloudPlatform/guest-agent/metadata"
+	"github.com/GoogleCloudPlatform/guest-agent/utils"
 	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
 )
 
@@ -39,6 +44,18 @@ var (
 	googleBlockEnd   = "#### End Google OS Login control section. ####"
 	trustedCAWatcher events.Watcher
 
+	// lookPath points to the function looking up executables in PATH, replaceable
+	// by unit tests.
+	lookPath = exec.LookPath
+
+	// pamDir is the directory of the PAM configuration files, replaceable by unit tests.
+	pamDir = "/etc/pam.d"
+
+	// defaultOSLoginSudoersDir is the default directory of OS Login users' sudoers files.
+	defaultOSLoginSudoersDir = "/var/google-sudoers.d"
+	// defaultOSLoginUsersDir is the default directory of OS Login users' data.
+	defaultOSLoginUsersDir = "/var/google-users.d"
+
 	// deprecatedConfigDirectives contains a list of configuration directives (or lines)
 	// that we no longer support and should not be considered for updated versions of a
 	// given configuration file.
@@ -83,6 +100,31 @@ func getOSLoginEnabled(md *metadata.Descriptor) (bool, bool, bool, bool) {
 	return enable, twofactor, skey, reqCerts
 }
 
+// trustedCAPipePath returns the configured trusted CA pipe path, or the default one
+// if not configured.
+func trustedCAPipePath() string {
+	if path := cfg.Get().OSLogin.TrustedCAPipePath; path != "" {
+		return path
+	}
+	return sshtrustedca.DefaultPipePath
+}
+
+// trustedCAPipeMode returns the configured trusted CA pipe permissions, or the
+// default ones if not configured or invalid.
+func trustedCAPipeMode() os.FileMode {
+	modeStr := cfg.Get().OSLogin.TrustedCAPipeMode
+	if modeStr == "" {
+		return sshtrustedca.DefaultPipeMode
+	}
+
+	mode, err := strconv.ParseUint(modeStr, 8, 32)
+	if err != nil || mode > 0777 {
+		logger.Errorf("Invalid trusted_ca_pipe_mode %q, falling back to %#o", modeStr, sshtrustedca.DefaultPipeMode)
+		return sshtrustedca.DefaultPipeMode
+	}
+	return os.FileMode(mode)
+}
+
 func enableDisableOSLoginCertAuth(ctx context.Context) error {
 	if newMetadata == nil {
 		logger.Infof("Could not enable/disable OSLogin Cert Auth, metadata is not initialized.")
@@ -93,7 +135,7 @@ func enableDisableOSLoginCertAuth(ctx context.Context) error {
 	osLoginEnabled, _, _, _ := getOSLoginEnabled(newMetadata)
 	if osLoginEnabled {
 		if trustedCAWatcher == nil {
-			trustedCAWatcher = sshtrustedca.New(sshtrustedca.DefaultPipePath)
+			trustedCAWatcher = sshtrustedca.New(trustedCAPipePath(), trustedCAPipeMode())
 			if err := eventManager.AddWatcher(ctx, trustedCAWatcher); err != nil {
 				return err
 			}
@@ -115,6 +157,11 @@ func (o *osloginMgr) Diff(ctx context.Context) (bool, error) {
 		(oldReqCerts != reqCerts), nil
 }
 
+// Name returns the manager's name, see osloginMgrName.
+func (o *osloginMgr) Name() string {
+	return osloginMgrName
+}
+
 func (o *osloginMgr) Timeout(ctx context.Context) (bool, error) {
 	return false, nil
 }
@@ -142,36 +189,23 @@ func (o *osloginMgr) Set(ctx context.Context) error {
 		logger.Infof("Disabling OS Login")
 	}
 
-	if err := writeSSHConfig(enable, twofactor, skey, reqCerts); err != nil {
-		logger.Errorf("Error updating SSH config: %v.", err)
-	}
-
-	if err := writeNSSwitchConfig(enable); err != nil {
-		logger.Errorf("Error updating NSS config: %v.", err)
-	}
+	logConfigFileError("SSH config", writeSSHConfig(enable, twofactor, skey, reqCerts))
+	logConfigFileError("NSS config", writeNSSwitchConfig(enable))
+	logConfigFileError("PAM config", writePAMConfig(enable, twofactor))
+	logConfigFileError("group.conf", writeGroupConf(enable))
 
-	if err := writePAMConfig(enable, twofactor); err != nil {
-		logger.Errorf("Error updating PAM config: %v.", err)
-	}
-
-	if err := writeGroupConf(enable); err != nil {
-		logger.Errorf("Error updating group.conf: %v.", err)
-	}
-
-	for _, svc := range []string{"nscd", "unscd", "systemd-logind", "cron", "crond"} {
-		// These services should be restarted if running
-		logger.Debugf("systemctl try-restart %s, if it exists", svc)
-		if err := systemctlTryRestart(ctx, svc); err != nil {
-			logger.Errorf("Error restarting service: %v.", err)
+	if hasSystemctl() {
+		for _, svc := range []string{"nscd", "unscd", "systemd-logind", "cron", "crond"} {
+			// These services should be restarted if running
+			logger.Debugf("systemctl try-restart %s, if it exists", svc)
+			if err := systemctlTryRestart(ctx, svc); err != nil {
+				logger.Errorf("Error restarting service: %v.", err)
+			}
 		}
 	}
 
-	// SSH should be started if not running, reloaded otherwise.
-	for _, svc := range []string{"ssh", "sshd"} {
-		logger.Debugf("systemctl reload-or-restart %s, if it exists", svc)
-		if err := systemctlReloadOrRestart(ctx, svc); err != nil {
-			logger.Errorf("Error reloading service: %v.", err)
-		}
+	if err := reloadSSHD(ctx); err != nil {
+		logger.Errorf("Error reloading sshd: %v.", err)
 	}
 
 	now := fmt.Sprintf("%d", time.Now().Unix())
@@ -268,15 +302,97 @@ func filterGoogleLines(contents string) []string {
 	return filtered
 }
 
+// conflictingSSHDirectives returns the sshd configuration lines setting directives
+// the OS Login block also sets, lines are expected to be filtered with
+// filterGoogleLines(). Comments are ignored.
+func conflictingSSHDirectives(lines []string) []string {
+	conflicting := []string{"authorizedkeyscommand", "authorizedprincipalscommand"}
+
+	var res []string
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		// sshd keywords are case insensitive and may be separated from their
+		// arguments with an "=".
+		keyword, _, _ := strings.Cut(strings.ToLower(fields[0]), "=")
+		if slices.Contains(conflicting, keyword) {
+			res = append(res, strings.TrimSpace(line))
+		}
+	}
+	return res
+}
+
+// errConfigFileMissing is returned when reading a configuration file that doesn't
+// exist, e.g. sshd_config on images where sshd isn't installed yet.
+var errConfigFileMissing = errors.New("configuration file doesn't exist")
+
+// logConfigFileError logs err, the failure to update the configuration described
+// by what. Missing configuration files are expected and not logged as errors.
+func logConfigFileError(what string, err error) {
+	switch {
+	case err == nil:
+	case errors.Is(err, errConfigFileMissing):
+		logger.Infof("Skipping %s update: %v.", what, err)
+	default:
+		logger.Errorf("Error updating %s: %v.", what, err)
+	}
+}
+
+// readConfigFile returns the contents of the configuration file at path, following
+// symlinks. The returned error wraps errConfigFileMissing if the file doesn't exist.
+func readConfigFile(path string) (string, error) {
+	fi, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return "", fmt.Errorf("%s: %w", path, errConfigFileMissing)
+	}
+	if err != nil {
+		return "", err
+	}
+	if !fi.Mode().IsRegular() {
+		return "", fmt.Errorf("%s is not a regular file", path)
+	}
+
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return string(contents), nil
+}
+
+// writeConfigFile replaces the contents of the existing configuration file at path.
+// If path is a symlink its target is written, unless the target is on a read-only
+// file system: the symlink is then replaced by a regular file.
 func writeConfigFile(path, contents string) error {
 	logger.Debugf("writing %s", path)
+	target, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return err
+	}
+
+	err = overwriteFile(target, contents)
+	if err == nil || target == path || !errors.Is(err, syscall.EROFS) {
+		return err
+	}
+
+	fi, err := os.Stat(target)
+	if err != nil {
+		return err
+	}
+	logger.Infof("%s links to %s on a read-only file system, replacing the link with a regular file", path, target)
+	return utils.SaferWriteFile([]byte(contents), path, fi.Mode().Perm())
+}
+
+// overwriteFile replaces the contents of the existing file at path.
+func overwriteFile(path, contents string) error {
 	file, err := os.OpenFile(path, os.O_WRONLY|os.O_TRUNC, 0777)
 	if err != nil {
 		return err
 	}
 	defer closeFile(file)
-	file.WriteString(contents)
-	return nil
+	_, err = file.WriteString(contents)
+	return err
 }
 
 func updateSSHConfig(sshConfig string, enable, twofactor, skey, reqCerts bool) string {
@@ -297,7 +413,7 @@ func updateSSHConfig(sshConfig string, enable, twofactor, skey, reqCerts bool) s
 	// Certificate based authentication.
 	authorizedPrincipalsCommand := "AuthorizedPrincipalsCommand /usr/bin/google_authorized_principals %u %k"
 	authorizedPrincipalsUser := "AuthorizedPrincipalsCommandUser root"
-	trustedUserCAKeys := "TrustedUserCAKeys " + sshtrustedca.DefaultPipePath
+	trustedUserCAKeys := "TrustedUserCAKeys " + trustedCAPipePath()
 
 	twoFactorAuthMethods := "AuthenticationMethods publickey,keyboard-interactive"
 	if (osInfo.OS == "rhel" || osInfo.OS == "centos") && osInfo.Version.Major == 6 {
@@ -335,12 +451,19 @@ func updateSSHConfig(sshConfig string, enable, twofactor, skey, reqCerts bool) s
 }
 
 func writeSSHConfig(enable, twofactor, skey, reqCerts bool) error {
-	sshConfig, err := os.ReadFile("/etc/ssh/sshd_config")
+	sshConfig, err := readConfigFile("/etc/ssh/sshd_config")
 	if err != nil {
 		return err
 	}
-	proposed := updateSSHConfig(string(sshConfig), enable, twofactor, skey, reqCerts)
-	if proposed == string(sshConfig) {
+	if enable {
+		for _, line := range conflictingSSHDirectives(filterGoogleLines(sshConfig)) {
+			logger.Warningf("sshd_config already configures %q outside of the OS Login block, it conflicts with"+
+				" OS Login's configuration and sshd's behavior is undefined, remove it to use OS Login", line)
+		}
+	}
+
+	proposed := updateSSHConfig(sshConfig, enable, twofactor, skey, reqCerts)
+	if proposed == sshConfig {
 		return nil
 	}
 	return writeConfigFile("/etc/ssh/sshd_config", proposed)
@@ -369,21 +492,24 @@ func updateNSSwitchConfig(nsswitch string, enable bool) string {
 }
 
 func writeNSSwitchConfig(enable bool) error {
-	nsswitch, err := os.ReadFile("/etc/nsswitch.conf")
+	nsswitch, err := readConfigFile("/etc/nsswitch.conf")
 	if err != nil {
 		return err
 	}
-	proposed := updateNSSwitchConfig(string(nsswitch), enable)
-	if proposed == string(nsswitch) {
+	proposed := updateNSSwitchConfig(nsswitch, enable)
+	if proposed == nsswitch {
 		return nil
 	}
 	return writeConfigFile("/etc/nsswitch.conf", proposed)
 }
 
-func updatePAMsshdPamless(pamsshd string, enable, twofactor bool) string {
-	authOSLogin := "auth       [success=done perm_denied=die default=ignore] pam_oslogin_login.so"
-	authGroup := "auth       [default=ignore] pam_group.so"
-	sessionHomeDir := "session    [success=ok default=ignore] pam_mkhomedir.so"
+// pamLines returns the pam_oslogin_login.so, pam_group.so and pam_mkhomedir.so
+// lines added to pam.d/sshd, as configured in the OSLogin section or the OS
+// specific defaults.
+func pamLines() (authOSLogin, authGroup, sessionHomeDir string) {
+	authOSLogin = "auth       [success=done perm_denied=die default=ignore] pam_oslogin_login.so"
+	authGroup = "auth       [default=ignore] pam_group.so"
+	sessionHomeDir = "session    [success=ok default=ignore] pam_mkhomedir.so"
 
 	if runtime.GOOS == "freebsd" {
 		authOSLogin = "auth       optional pam_oslogin_login.so"
@@ -391,29 +517,128 @@ func updatePAMsshdPamless(pamsshd string, enable, twofactor bool) string {
 		sessionHomeDir = "session    optional pam_mkhomedir.so"
 	}
 
+	config := cfg.Get().OSLogin
+	if config.PAMOSLoginAuth != "" {
+		authOSLogin = config.PAMOSLoginAuth
+	}
+	if config.PAMGroupAuth != "" {
+		authGroup = config.PAMGroupAuth
+	}
+	if config.PAMMkHomeDirSession != "" {
+		sessionHomeDir = config.PAMMkHomeDirSession
+	}
+	return authOSLogin, authGroup, sessionHomeDir
+}
+
+// pamModule returns the PAM type and module of a pam.d configuration line, i.e.
+// "auth" and "pam_group.so".
+func pamModule(line string) (string, string) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 || strings.HasPrefix(fields[0], "#") {
+		return "", ""
+	}
+	for _, field := range fields[1:] {
+		if strings.HasSuffix(field, ".so") {
+			return strings.TrimPrefix(fields[0], "-"), filepath.Base(field)
+		}
+	}
+	return "", ""
+}
+
+// pamIncludes returns the pam.d files included by lines, either with Debian's
+// "@include <file>" or with "<type> include|substack <file>".
+func pamIncludes(lines []string) []string {
+	var res []string
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) == 2 && fields[0] == "@include":
+			res = append(res, fields[1])
+		case len(fields) >= 3 && (fields[1] == "include" || fields[1] == "substack"):
+			res = append(res, fields[2])
+		}
+	}
+	return res
+}
+
+// pamIncludedModules returns the "<type> <module>" entries of the files included by
+// lines, recursively. Missing or unreadable included files are ignored.
+func pamIncludedModules(lines []string) map[string]bool {
+	res := make(map[string]bool)
+	visited := make(map[string]bool)
+
+	var walk func(lines []string)
+	walk = func(lines []string) {
+		for _, include := range pamIncludes(lines) {
+			if visited[include] {
+				continue
+			}
+			visited[include] = true
+
+			contents, err := os.ReadFile(filepath.Join(pamDir, include))
+			if err != nil {
+				logger.Debugf("Failed to read included pam file %q: %v", include, err)
+				continue
+			}
+
+			included := strings.Split(string(contents), "\n")
+			for _, line := range included {
+				if pamType, module := pamModule(line); module != "" {
+					res[pamType+" "+module] = true
+				}
+			}
+			walk(included)
+		}
+	}
+
+	walk(lines)
+	return res
+}
+
+func updatePAMsshdPamless(pamsshd string, enable, twofactor bool) string {
+	authOSLogin, authGroup, sessionHomeDir := pamLines()
+
 	filtered := filterGoogleLines(string(pamsshd))
 	if enable {
-		topOfFile := []string{googleBlockStart}
-		if twofactor {
+		// Include style configurations, i.e. Debian's common-session, may already
+		// invoke the modules, adding them again would invoke them twice.
+		included := pamIncludedModules(filtered)
+		wanted := func(line string) bool {
+			pamType, module := pamModule(line)
+			if included[pamType+" "+module] {
+				logger.Infof("%s %s is already included by pam.d/sshd, not adding it", pamType, module)
+				return false
+			}
+			return true
+		}
+
+		var topOfFile []string
+		if twofactor && wanted(authOSLogin) {
 			topOfFile = append(topOfFile, authOSLogin)
 		}
-		topOfFile = append(topOfFile, authGroup, googleBlockEnd)
-		bottomOfFile := []string{googleBlockStart, sessionHomeDir, googleBlockEnd}
-		filtered = append(topOfFile, filtered...)
-		filtered = append(filtered, bottomOfFile...)
+		if wanted(authGroup) {
+			topOfFile = append(topOfFile, authGroup)
+		}
+		if len(topOfFile) > 0 {
+			topOfFile = append(append([]string{googleBlockStart}, topOfFile...), googleBlockEnd)
+			filtered = append(topOfFile, filtered...)
+		}
+		if wanted(sessionHomeDir) {
+			filtered = append(filtered, googleBlockStart, sessionHomeDir, googleBlockEnd)
+		}
 	}
 	return strings.Join(filtered, "\n")
 }
 
 func writePAMConfig(enable, twofactor bool) error {
-	pamsshd, err := os.ReadFile("/etc/pam.d/sshd")
+	pamsshd, err := readConfigFile(filepath.Join(pamDir, "sshd"))
 	if err != nil {
 		return err
 	}
 
-	proposed := updatePAMsshdPamless(string(pamsshd), enable, twofactor)
-	if proposed != string(pamsshd) {
-		if err := writeConfigFile("/etc/pam.d/sshd", proposed); err != nil {
+	proposed := updatePAMsshdPamless(pamsshd, enable, twofactor)
+	if proposed != pamsshd {
+		if err := writeConfigFile(filepath.Join(pamDir, "sshd"), proposed); err != nil {
 			return err
 		}
 	}
@@ -433,12 +658,12 @@ func updateGroupConf(groupconf string, enable bool) string {
 }
 
 func writeGroupConf(enable bool) error {
-	groupconf, err := os.ReadFile("/etc/security/group.conf")
+	groupconf, err := readConfigFile("/etc/security/group.conf")
 	if err != nil {
 		return err
 	}
-	proposed := updateGroupConf(string(groupconf), enable)
-	if proposed != string(groupconf) {
+	proposed := updateGroupConf(groupconf, enable)
+	if proposed != groupconf {
 		if err := writeConfigFile("/etc/security/group.conf", proposed); err != nil {
 			return err
 		}
@@ -446,12 +671,31 @@ func writeGroupConf(enable bool) error {
 	return nil
 }
 
-// Creates necessary OS Login directories if they don't exist.
+// osLoginSudoersDir returns the configured OS Login sudoers directory, or the
+// default one if not configured.
+func osLoginSudoersDir() string {
+	if dir := cfg.Get().OSLogin.SudoersDir; dir != "" {
+		return dir
+	}
+	return defaultOSLoginSudoersDir
+}
+
+// osLoginUsersDir returns the configured OS Login users directory, or the default
+// one if not configured.
+func osLoginUsersDir() string {
+	if dir := cfg.Get().OSLogin.UsersDir; dir != "" {
+		return dir
+	}
+	return defaultOSLoginUsersDir
+}
+
+// createOSLoginDirs creates the OS Login sudoers and users directories if they
+// don't exist.
 func createOSLoginDirs(ctx context.Context) error {
 	restorecon, restoreconerr := exec.LookPath("restorecon")
 
-	for _, dir := range []string{"/var/google-sudoers.d", "/var/google-users.d"} {
-		err := os.Mkdir(dir, 0750)
+	for _, dir := range []string{osLoginSudoersDir(), osLoginUsersDir()} {
+		err := os.MkdirAll(dir, 0750)
 		if err != nil && !os.IsExist(err) {
 			return err
 		}
@@ -467,15 +711,74 @@ func createOSLoginSudoersFile() error {
 	if runtime.GOOS == "freebsd" {
 		osloginSudoers = "/usr/local" + osloginSudoers
 	}
-	sudoFile, err := os.OpenFile(osloginSudoers, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0440)
-	if err != nil {
-		if os.IsExist(err) {
+	return writeOSLoginSudoersFile(osloginSudoers, osLoginSudoersDir())
+}
+
+// writeOSLoginSudoersFile writes the OS Login sudoers file including sudoersDir
+// if it doesn't exist. An existing file is only rewritten if it's still the
+// single include line written by the agent for a different directory, i.e. the
+// configured sudoers directory has changed, files edited by admins are kept.
+func writeOSLoginSudoersFile(path, sudoersDir string) error {
+	content := fmt.Sprintf("#includedir %s\n", sudoersDir)
+
+	existing, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		if string(existing) == content {
+			return nil
+		}
+		if !isOSLoginSudoersInclude(string(existing)) {
+			logger.Infof("%s was modified, not updating it to include %s", path, sudoersDir)
 			return nil
 		}
+	}
+
+	// Don't let SaferWriteFile create the sudoers directory with the file's mode.
+	if _, err := os.Stat(filepath.Dir(path)); err != nil {
 		return err
 	}
-	fmt.Fprintf(sudoFile, "#includedir /var/google-sudoers.d\n")
-	return sudoFile.Close()
+	// The file is replaced atomically, sudo never reads a partially written or
+	// more permissive file.
+	return utils.SaferWriteFile([]byte(content), path, 0440)
+}
+
+// isOSLoginSudoersInclude returns true if content is a single #includedir line,
+// as written by writeOSLoginSudoersFile.
+func isOSLoginSudoersInclude(content string) bool {
+	line, found := strings.CutSuffix(content, "\n")
+	return found && strings.HasPrefix(line, "#includedir ") && !strings.Contains(line, "\n")
+}
+
+// hasSystemctl returns true if systemctl is available, i.e. systemd is the init system.
+func hasSystemctl() bool {
+	_, err := lookPath("systemctl")
+	return err == nil
+}
+
+// reloadSSHD makes sshd reload its configuration. The OSLogin sshd_reload_cmd is
+// run if configured, otherwise ssh/sshd services are reloaded with systemctl.
+func reloadSSHD(ctx context.Context) error {
+	if cmd := strings.Fields(cfg.Get().OSLogin.SSHDReloadCmd); len(cmd) > 0 {
+		logger.Debugf("Reloading sshd with %q", cfg.Get().OSLogin.SSHDReloadCmd)
+		return run.Quiet(ctx, cmd[0], cmd[1:]...)
+	}
+
+	if !hasSystemctl() {
+		logger.Warningf("systemctl not found and no OSLogin sshd_reload_cmd configured, sshd won't apply" +
+			" configuration changes until it's restarted")
+		return nil
+	}
+
+	// SSH should be started if not running, reloaded otherwise.
+	for _, svc := range []string{"ssh", "sshd"} {
+		logger.Debugf("systemctl reload-or-restart %s, if it exists", svc)
+		if err := systemctlReloadOrRestart(ctx, svc); err != nil {
+			logger.Errorf("Error reloading service: %v.", err)
+		}
+	}
+	return nil
 }
 
 // systemctlTryRestart tries to restart a systemd service if it is already
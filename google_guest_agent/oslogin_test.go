@@ -15,13 +15,18 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 
 	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
 	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/events/sshtrustedca"
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/run"
 	"github.com/GoogleCloudPlatform/guest-agent/metadata"
 )
 
@@ -756,3 +761,314 @@ func TestGetOSLoginEnabled(t *testing.T) {
 		}
 	}
 }
+
+func TestWriteOSLoginSudoersFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "google-oslogin")
+
+	for _, dir := range []string{"/var/google-sudoers.d", "/var/google-sudoers.d", "/opt/google/sudoers.d"} {
+		if err := writeOSLoginSudoersFile(path, dir); err != nil {
+			t.Fatalf("writeOSLoginSudoersFile(%q, %q) failed unexpectedly with error: %v", path, dir, err)
+		}
+
+		got, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("os.ReadFile(%q) failed unexpectedly with error: %v", path, err)
+		}
+		if want := "#includedir " + dir + "\n"; string(got) != want {
+			t.Errorf("writeOSLoginSudoersFile(%q, %q) wrote %q, want %q", path, dir, got, want)
+		}
+
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatalf("os.Stat(%q) failed unexpectedly with error: %v", path, err)
+		}
+		if info.Mode().Perm() != 0440 {
+			t.Errorf("writeOSLoginSudoersFile(%q, %q) set mode %#o, want %#o", path, dir, info.Mode().Perm(), 0440)
+		}
+	}
+
+	// Files edited by admins are kept.
+	edited := "#includedir /opt/google/sudoers.d\n%admins ALL=(ALL) ALL\n"
+	if err := os.WriteFile(path, []byte(edited), 0440); err != nil {
+		t.Fatalf("os.WriteFile(%q) failed unexpectedly with error: %v", path, err)
+	}
+	if err := writeOSLoginSudoersFile(path, "/var/google-sudoers.d"); err != nil {
+		t.Fatalf("writeOSLoginSudoersFile(%q, %q) failed unexpectedly with error: %v", path, "/var/google-sudoers.d", err)
+	}
+	if got, err := os.ReadFile(path); err != nil || string(got) != edited {
+		t.Errorf("writeOSLoginSudoersFile(%q, %q) replaced an edited file with %q (%v), want %q", path, "/var/google-sudoers.d", got, err, edited)
+	}
+
+	// No temporary files are left behind.
+	files, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		t.Fatalf("os.ReadDir(%q) failed unexpectedly with error: %v", filepath.Dir(path), err)
+	}
+	if len(files) != 1 {
+		t.Errorf("found %d files in the sudoers directory, want 1", len(files))
+	}
+}
+
+func TestReadConfigFile(t *testing.T) {
+	dir := t.TempDir()
+	regular := filepath.Join(dir, "sshd_config")
+	if err := os.WriteFile(regular, []byte("Port 22\n"), 0644); err != nil {
+		t.Fatalf("os.WriteFile(%q) failed unexpectedly with error: %v", regular, err)
+	}
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink(regular, link); err != nil {
+		t.Fatalf("os.Symlink(%q, %q) failed unexpectedly with error: %v", regular, link, err)
+	}
+	dangling := filepath.Join(dir, "dangling")
+	if err := os.Symlink(filepath.Join(dir, "missing"), dangling); err != nil {
+		t.Fatalf("os.Symlink(%q) failed unexpectedly with error: %v", dangling, err)
+	}
+
+	tests := []struct {
+		name        string
+		path        string
+		want        string
+		wantErr     bool
+		wantMissing bool
+	}{
+		{
+			name: "regular",
+			path: regular,
+			want: "Port 22\n",
+		},
+		{
+			name: "symlink",
+			path: link,
+			want: "Port 22\n",
+		},
+		{
+			name:        "missing",
+			path:        filepath.Join(dir, "missing"),
+			wantErr:     true,
+			wantMissing: true,
+		},
+		{
+			name:        "dangling_symlink",
+			path:        dangling,
+			wantErr:     true,
+			wantMissing: true,
+		},
+		{
+			name:    "directory",
+			path:    dir,
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := readConfigFile(tc.path)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("readConfigFile(%q) = error %v, want error: %t", tc.path, err, tc.wantErr)
+			}
+			if errors.Is(err, errConfigFileMissing) != tc.wantMissing {
+				t.Errorf("readConfigFile(%q) = error %v, want errConfigFileMissing: %t", tc.path, err, tc.wantMissing)
+			}
+			if got != tc.want {
+				t.Errorf("readConfigFile(%q) = %q, want %q", tc.path, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestWriteConfigFileSymlink(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "sshd_config.real")
+	if err := os.WriteFile(target, []byte("old"), 0600); err != nil {
+		t.Fatalf("os.WriteFile(%q) failed unexpectedly with error: %v", target, err)
+	}
+	link := filepath.Join(dir, "sshd_config")
+	if err := os.Symlink(target, link); err != nil {
+		t.Fatalf("os.Symlink(%q, %q) failed unexpectedly with error: %v", target, link, err)
+	}
+
+	if err := writeConfigFile(link, "new"); err != nil {
+		t.Fatalf("writeConfigFile(%q, new) failed unexpectedly with error: %v", link, err)
+	}
+
+	if fi, err := os.Lstat(link); err != nil || fi.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("writeConfigFile(%q, new) replaced the symlink, want it kept", link)
+	}
+	got, err := os.ReadFile(target)
+	if err != nil {
+		t.Fatalf("os.ReadFile(%q) failed unexpectedly with error: %v", target, err)
+	}
+	if string(got) != "new" {
+		t.Errorf("writeConfigFile(%q, new) wrote %q to the link target, want %q", link, got, "new")
+	}
+
+	missing := filepath.Join(dir, "missing")
+	if err := writeConfigFile(missing, "new"); err == nil {
+		t.Errorf("writeConfigFile(%q, new) succeeded, want error as the file doesn't exist", missing)
+	}
+}
+
+func TestOSLoginDirs(t *testing.T) {
+	if err := cfg.Load([]byte("[OSLogin]\nsudoers_dir = /opt/google/sudoers.d")); err != nil {
+		t.Fatalf("cfg.Load() failed unexpectedly with error: %v", err)
+	}
+
+	if got, want := osLoginSudoersDir(), "/opt/google/sudoers.d"; got != want {
+		t.Errorf("osLoginSudoersDir() = %q, want %q", got, want)
+	}
+	if got, want := osLoginUsersDir(), defaultOSLoginUsersDir; got != want {
+		t.Errorf("osLoginUsersDir() = %q, want %q", got, want)
+	}
+}
+
+func TestConflictingSSHDirectives(t *testing.T) {
+	sshConfig := strings.Join([]string{
+		googleBlockStart,
+		"AuthorizedKeysCommand /usr/bin/google_authorized_keys",
+		"AuthorizedKeysCommandUser root",
+		googleBlockEnd,
+		"# AuthorizedKeysCommand /usr/bin/commented_out",
+		"AuthorizedKeysFile .ssh/authorized_keys",
+		"authorizedkeyscommand /usr/bin/other_keys",
+		"Match User admin",
+		"    AuthorizedPrincipalsCommand=/usr/bin/other_principals %u",
+		"AuthorizedKeysCommandUser nobody",
+	}, "\n")
+
+	want := []string{
+		"authorizedkeyscommand /usr/bin/other_keys",
+		"AuthorizedPrincipalsCommand=/usr/bin/other_principals %u",
+	}
+
+	got := conflictingSSHDirectives(filterGoogleLines(sshConfig))
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("conflictingSSHDirectives(%q) = %q, want %q", sshConfig, got, want)
+	}
+}
+
+// recordingRunner is a run.RunnerInterface recording the commands run with Quiet().
+type recordingRunner struct {
+	noopRunner
+	commands []string
+}
+
+func (r *recordingRunner) Quiet(ctx context.Context, name string, args ...string) error {
+	r.commands = append(r.commands, strings.Join(append([]string{name}, args...), " "))
+	return nil
+}
+
+func TestReloadSSHD(t *testing.T) {
+	tests := []struct {
+		name         string
+		config       string
+		hasSystemctl bool
+		want         []string
+	}{
+		{
+			name:         "custom_command",
+			config:       "[OSLogin]\nsshd_reload_cmd = rc-service sshd reload",
+			hasSystemctl: true,
+			want:         []string{"rc-service sshd reload"},
+		},
+		{
+			name:         "no_systemctl",
+			hasSystemctl: false,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := cfg.Load([]byte(tc.config)); err != nil {
+				t.Fatalf("cfg.Load() failed unexpectedly with error: %v", err)
+			}
+
+			oldLookPath := lookPath
+			lookPath = func(file string) (string, error) {
+				if tc.hasSystemctl {
+					return "/usr/bin/" + file, nil
+				}
+				return "", fmt.Errorf("%s not found", file)
+			}
+			t.Cleanup(func() { lookPath = oldLookPath })
+
+			runner := &recordingRunner{}
+			oldClient := run.Client
+			run.Client = runner
+			t.Cleanup(func() { run.Client = oldClient })
+
+			if err := reloadSSHD(context.Background()); err != nil {
+				t.Fatalf("reloadSSHD(ctx) failed unexpectedly with error: %v", err)
+			}
+
+			if strings.Join(runner.commands, "\n") != strings.Join(tc.want, "\n") {
+				t.Errorf("reloadSSHD(ctx) ran %q, want %q", runner.commands, tc.want)
+			}
+		})
+	}
+}
+
+func TestUpdatePAMsshdIncludes(t *testing.T) {
+	if err := cfg.Load(nil); err != nil {
+		t.Fatalf("cfg.Load() failed unexpectedly with error: %v", err)
+	}
+
+	oldPAMDir := pamDir
+	pamDir = t.TempDir()
+	t.Cleanup(func() { pamDir = oldPAMDir })
+
+	files := map[string]string{
+		"common-session":   "session [default=1] pam_permit.so\n@include common-mkhomedir",
+		"common-mkhomedir": "session optional pam_mkhomedir.so skel=/etc/skel",
+		"common-auth":      "auth [success=1 default=ignore] pam_unix.so",
+	}
+	for name, contents := range files {
+		if err := os.WriteFile(filepath.Join(pamDir, name), []byte(contents), 0644); err != nil {
+			t.Fatalf("os.WriteFile(%q) failed unexpectedly with error: %v", name, err)
+		}
+	}
+
+	authOSLogin, authGroup, _ := pamLines()
+	contents := strings.Join([]string{"@include common-auth", "@include common-session", "@include missing"}, "\n")
+	want := strings.Join([]string{
+		googleBlockStart,
+		authOSLogin,
+		authGroup,
+		googleBlockEnd,
+		"@include common-auth",
+		"@include common-session",
+		"@include missing",
+	}, "\n")
+
+	if got := updatePAMsshdPamless(contents, true, true); got != want {
+		t.Errorf("updatePAMsshdPamless(%q, true, true) = \n%v\nwant:\n%v", contents, got, want)
+	}
+}
+
+func TestPAMLinesOverride(t *testing.T) {
+	line := "auth       sufficient pam_group.so use_first_pass"
+	if err := cfg.Load([]byte("[OSLogin]\npam_group_auth = " + line)); err != nil {
+		t.Fatalf("cfg.Load() failed unexpectedly with error: %v", err)
+	}
+
+	if _, got, _ := pamLines(); got != line {
+		t.Errorf("pamLines() returned pam_group.so line %q, want %q", got, line)
+	}
+}
+
+func TestPAMModule(t *testing.T) {
+	tests := []struct {
+		line, wantType, wantModule string
+	}{
+		{line: "auth [default=ignore] pam_group.so", wantType: "auth", wantModule: "pam_group.so"},
+		{line: "-session optional /lib/security/pam_mkhomedir.so umask=0022", wantType: "session", wantModule: "pam_mkhomedir.so"},
+		{line: "# session optional pam_mkhomedir.so"},
+		{line: "@include common-session"},
+	}
+
+	for _, tc := range tests {
+		pamType, module := pamModule(tc.line)
+		if pamType != tc.wantType || module != tc.wantModule {
+			t.Errorf("pamModule(%q) = (%q, %q), want (%q, %q)", tc.line, pamType, module, tc.wantType, tc.wantModule)
+		}
+	}
+}
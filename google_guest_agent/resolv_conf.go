@@ -0,0 +1,201 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-agent/utils"
+	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+)
+
+const (
+	// resolvConfBlockStart and resolvConfBlockEnd delimit the resolv.conf blocks
+	// managed by the guest agent.
+	resolvConfBlockStart = "#### Google guest agent resolv.conf control. Do not edit this section. ####"
+	resolvConfBlockEnd   = "#### End Google guest agent resolv.conf control section. ####"
+)
+
+// resolvConfFile is the resolver configuration file path, replaceable by unit tests.
+var resolvConfFile = "/etc/resolv.conf"
+
+// resolvConfMgr keeps the configured name servers and search domains in resolv.conf,
+// network managers rewriting it during network setup would otherwise drop them.
+type resolvConfMgr struct{}
+
+// dependencies makes the manager run after the network setup.
+func (m *resolvConfMgr) dependencies() []string {
+	return []string{addressMgrName}
+}
+
+// resolvConfBlocks returns the managed blocks for config: the name servers block,
+// going first so its name servers take precedence, and the search block, going
+// last as resolvers only honor the last search line. Blocks with nothing to set
+// are nil, both are nil if config is not enabled.
+func resolvConfBlocks(config *cfg.ResolvConf) ([]string, []string) {
+	if config == nil || !config.Enabled {
+		return nil, nil
+	}
+
+	var head, tail []string
+	if nameservers := cfg.SplitList(config.Nameservers); len(nameservers) > 0 {
+		head = append(head, resolvConfBlockStart)
+		for _, ns := range nameservers {
+			head = append(head, "nameserver "+ns)
+		}
+		head = append(head, resolvConfBlockEnd)
+	}
+
+	if search := cfg.SplitList(config.Search); len(search) > 0 {
+		tail = []string{resolvConfBlockStart, "search " + strings.Join(search, " "), resolvConfBlockEnd}
+	}
+	return head, tail
+}
+
+// filterResolvConfBlocks returns the lines of contents outside of the blocks
+// managed by the guest agent.
+func filterResolvConfBlocks(contents string) []string {
+	var inBlock bool
+	var filtered []string
+	for _, line := range strings.Split(contents, "\n") {
+		switch {
+		case strings.Contains(line, resolvConfBlockStart):
+			inBlock = true
+		case strings.Contains(line, resolvConfBlockEnd):
+			inBlock = false
+		case !inBlock:
+			filtered = append(filtered, line)
+		}
+	}
+	return filtered
+}
+
+// updateResolvConf returns contents with the blocks previously added by the guest
+// agent replaced with the blocks wanted by config, or removed if it's disabled.
+func updateResolvConf(contents string, config *cfg.ResolvConf) string {
+	lines := filterResolvConfBlocks(contents)
+
+	// Keep the blocks before the trailing new line, if any.
+	trailing := len(lines) > 0 && lines[len(lines)-1] == ""
+	if trailing {
+		lines = lines[:len(lines)-1]
+	}
+
+	head, tail := resolvConfBlocks(config)
+	lines = append(append(head, lines...), tail...)
+	if trailing || len(head)+len(tail) > 0 {
+		lines = append(lines, "")
+	}
+	return strings.Join(lines, "\n")
+}
+
+// resolvConfSymlinkOnce logs once that a symlinked resolv.conf is not managed.
+var resolvConfSymlinkOnce sync.Once
+
+// resolvConfSymlinked reports whether resolv.conf is a symlink, i.e. to
+// systemd-resolved's stub. The target is owned by the service managing it, which
+// overwrites any edit, so it's left alone.
+func resolvConfSymlinked() bool {
+	if !utils.FileExists(resolvConfFile, utils.TypeSymlink) {
+		return false
+	}
+	resolvConfSymlinkOnce.Do(func() {
+		logger.Infof("Not managing name servers and search domains, %s is a symlink owned by another service (i.e. systemd-resolved), configure them through it instead", resolvConfFile)
+	})
+	return true
+}
+
+// readResolvConf returns the path, contents and permissions of resolv.conf, a
+// missing file is reported as empty. A symlinked resolv.conf is never followed.
+func readResolvConf() (string, string, os.FileMode, error) {
+	path := resolvConfFile
+	if utils.FileExists(path, utils.TypeSymlink) {
+		return "", "", 0, fmt.Errorf("%s is a symlink, not managing it", path)
+	}
+
+	contents, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return path, "", 0644, nil
+	}
+	if err != nil {
+		return "", "", 0, err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", "", 0, err
+	}
+	return path, string(contents), info.Mode().Perm(), nil
+}
+
+// Diff reports a diff if resolv.conf doesn't match the configured state.
+func (m *resolvConfMgr) Diff(ctx context.Context) (bool, error) {
+	_, contents, _, err := readResolvConf()
+	if err != nil {
+		return false, err
+	}
+	return updateResolvConf(contents, cfg.Get().ResolvConf) != contents, nil
+}
+
+// Name returns the manager's name, see resolvConfMgrName.
+func (m *resolvConfMgr) Name() string {
+	return resolvConfMgrName
+}
+
+func (m *resolvConfMgr) Timeout(ctx context.Context) (bool, error) {
+	return false, nil
+}
+
+// Disabled reports the manager disabled on Windows, if resolv.conf is a symlink,
+// or if the option is not enabled and resolv.conf has no managed blocks left for
+// Set to remove.
+func (m *resolvConfMgr) Disabled(ctx context.Context) (bool, error) {
+	config := cfg.Get().ResolvConf
+	if runtime.GOOS == "windows" || config == nil || resolvConfSymlinked() {
+		return true, nil
+	}
+	if config.Enabled {
+		return false, nil
+	}
+
+	_, contents, _, err := readResolvConf()
+	if err != nil {
+		return false, err
+	}
+	return !strings.Contains(contents, resolvConfBlockStart), nil
+}
+
+// Set re-applies the configured name servers and search domains to resolv.conf,
+// or rolls them back if disabled.
+func (m *resolvConfMgr) Set(ctx context.Context) error {
+	path, contents, perm, err := readResolvConf()
+	if err != nil {
+		return err
+	}
+
+	config := cfg.Get().ResolvConf
+	if config.Enabled {
+		logger.Infof("Re-applying configured name servers and search domains to %s", path)
+	} else {
+		logger.Infof("Removing guest agent managed name servers and search domains from %s", path)
+	}
+	return utils.SaferWriteFile([]byte(updateResolvConf(contents, config)), path, perm)
+}
@@ -0,0 +1,195 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+)
+
+func TestUpdateResolvConf(t *testing.T) {
+	resolvers := "nameserver 169.254.169.254\nsearch c.project.internal google.internal\n"
+	nameservers := strings.Join([]string{resolvConfBlockStart, "nameserver 10.0.0.2", "nameserver 10.0.0.3", resolvConfBlockEnd}, "\n") + "\n"
+	search := strings.Join([]string{resolvConfBlockStart, "search corp.example.com", resolvConfBlockEnd}, "\n") + "\n"
+	enabled := &cfg.ResolvConf{Enabled: true, Nameservers: "10.0.0.2, 10.0.0.3", Search: "corp.example.com"}
+
+	tests := []struct {
+		name     string
+		contents string
+		config   *cfg.ResolvConf
+		want     string
+	}{
+		{
+			name:     "add_blocks",
+			contents: resolvers,
+			config:   enabled,
+			want:     nameservers + resolvers + search,
+		},
+		{
+			name:     "add_blocks_no_trailing_newline",
+			contents: strings.TrimSuffix(resolvers, "\n"),
+			config:   enabled,
+			want:     nameservers + resolvers + search,
+		},
+		{
+			name:   "add_blocks_empty_file",
+			config: enabled,
+			want:   nameservers + search,
+		},
+		{
+			name:     "nameservers_only",
+			contents: resolvers,
+			config:   &cfg.ResolvConf{Enabled: true, Nameservers: "10.0.0.2,10.0.0.3"},
+			want:     nameservers + resolvers,
+		},
+		{
+			name:     "blocks_exist",
+			contents: nameservers + resolvers + search,
+			config:   enabled,
+			want:     nameservers + resolvers + search,
+		},
+		{
+			name:     "reapply_after_rewrite",
+			contents: resolvers + search,
+			config:   enabled,
+			want:     nameservers + resolvers + search,
+		},
+		{
+			name:     "disabled_removes_blocks",
+			contents: nameservers + resolvers + search,
+			config:   &cfg.ResolvConf{Nameservers: "10.0.0.2"},
+			want:     resolvers,
+		},
+		{
+			name:     "disabled_untouched",
+			contents: resolvers,
+			want:     resolvers,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := updateResolvConf(tc.contents, tc.config); got != tc.want {
+				t.Errorf("updateResolvConf(%q, %+v) = %q, want %q", tc.contents, tc.config, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestResolvConfMgr(t *testing.T) {
+	ctx := context.Background()
+	mgr := &resolvConfMgr{}
+
+	oldResolvConfFile := resolvConfFile
+	resolvConfFile = filepath.Join(t.TempDir(), "resolv.conf")
+	t.Cleanup(func() { resolvConfFile = oldResolvConfFile })
+
+	resolvers := "nameserver 169.254.169.254\n"
+	if err := os.WriteFile(resolvConfFile, []byte(resolvers), 0644); err != nil {
+		t.Fatalf("os.WriteFile(%q) failed unexpectedly with error: %v", resolvConfFile, err)
+	}
+
+	if err := cfg.Load([]byte("[ResolvConf]\nenabled = false")); err != nil {
+		t.Fatalf("cfg.Load() failed unexpectedly with error: %v", err)
+	}
+	if disabled, err := mgr.Disabled(ctx); err != nil || !disabled {
+		t.Errorf("resolvConfMgr.Disabled(ctx) = %t, %v with no managed blocks, want true, nil", disabled, err)
+	}
+
+	for _, enable := range []bool{true, false} {
+		config := "[ResolvConf]\nnameservers = 10.0.0.2\nenabled = false"
+		want := resolvers
+		if enable {
+			config = "[ResolvConf]\nnameservers = 10.0.0.2\nenabled = true"
+			want = strings.Join([]string{resolvConfBlockStart, "nameserver 10.0.0.2", resolvConfBlockEnd}, "\n") + "\n" + resolvers
+		}
+		if err := cfg.Load([]byte(config)); err != nil {
+			t.Fatalf("cfg.Load() failed unexpectedly with error: %v", err)
+		}
+
+		if disabled, err := mgr.Disabled(ctx); err != nil || disabled {
+			t.Errorf("resolvConfMgr.Disabled(ctx) = %t, %v with enabled = %t, want false, nil", disabled, err, enable)
+		}
+
+		diff, err := mgr.Diff(ctx)
+		if err != nil {
+			t.Fatalf("resolvConfMgr.Diff(ctx) failed unexpectedly with error: %v", err)
+		}
+		if !diff {
+			t.Errorf("resolvConfMgr.Diff(ctx) = false with enabled = %t, want true", enable)
+		}
+
+		if err := mgr.Set(ctx); err != nil {
+			t.Fatalf("resolvConfMgr.Set(ctx) failed unexpectedly with error: %v", err)
+		}
+
+		got, err := os.ReadFile(resolvConfFile)
+		if err != nil {
+			t.Fatalf("os.ReadFile(%q) failed unexpectedly with error: %v", resolvConfFile, err)
+		}
+		if string(got) != want {
+			t.Errorf("resolvConfMgr.Set(ctx) with enabled = %t wrote %q, want %q", enable, got, want)
+		}
+
+		if diff, _ := mgr.Diff(ctx); diff {
+			t.Errorf("resolvConfMgr.Diff(ctx) = true after Set() with enabled = %t, want false", enable)
+		}
+		if disabled, _ := mgr.Disabled(ctx); disabled == enable {
+			t.Errorf("resolvConfMgr.Disabled(ctx) = %t after Set() with enabled = %t, want %t", disabled, enable, !enable)
+		}
+	}
+}
+
+func TestResolvConfMgrSymlink(t *testing.T) {
+	ctx := context.Background()
+	mgr := &resolvConfMgr{}
+
+	dir := t.TempDir()
+	target := filepath.Join(dir, "stub-resolv.conf")
+	oldResolvConfFile := resolvConfFile
+	resolvConfFile = filepath.Join(dir, "resolv.conf")
+	t.Cleanup(func() { resolvConfFile = oldResolvConfFile })
+
+	// The stub is owned by systemd-resolved, it must be left alone.
+	resolvers := "nameserver 127.0.0.53\n"
+	if err := os.WriteFile(target, []byte(resolvers), 0644); err != nil {
+		t.Fatalf("os.WriteFile(%q) failed unexpectedly with error: %v", target, err)
+	}
+	if err := os.Symlink(target, resolvConfFile); err != nil {
+		t.Fatalf("os.Symlink(%q, %q) failed unexpectedly with error: %v", target, resolvConfFile, err)
+	}
+
+	if err := cfg.Load([]byte("[ResolvConf]\nnameservers = 10.0.0.2\nenabled = true")); err != nil {
+		t.Fatalf("cfg.Load() failed unexpectedly with error: %v", err)
+	}
+	if disabled, err := mgr.Disabled(ctx); err != nil || !disabled {
+		t.Errorf("resolvConfMgr.Disabled(ctx) = %t, %v with a symlinked resolv.conf, want true, nil", disabled, err)
+	}
+	if err := mgr.Set(ctx); err == nil {
+		t.Errorf("resolvConfMgr.Set(ctx) succeeded with a symlinked resolv.conf, want error")
+	}
+
+	if got, err := os.ReadFile(target); err != nil || string(got) != resolvers {
+		t.Errorf("os.ReadFile(%q) = %q, %v, want %q", target, got, err, resolvers)
+	}
+	if link, err := os.Readlink(resolvConfFile); err != nil || link != target {
+		t.Errorf("os.Readlink(%q) = %q, %v, want %q", resolvConfFile, link, err, target)
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/events"
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/events/resume"
+	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+)
+
+// resumeTriggers returns the configured resume sources, see resume.Watcher.
+func resumeTriggers() []string {
+	var triggers []string
+	for _, trigger := range strings.Split(cfg.Get().Core.ResumeTriggers, ",") {
+		if trigger = strings.TrimSpace(trigger); trigger != "" {
+			triggers = append(triggers, trigger)
+		}
+	}
+	return triggers
+}
+
+// resumeManagers returns the managers whose state is reconciled on resume.
+func resumeManagers() []manager {
+	return []manager{clockskewManager, addressManager}
+}
+
+// startResumeWatcher adds the resume watcher, if resume triggers are configured,
+// and subscribes the reconciliation of the clock and network state to it.
+func startResumeWatcher(ctx context.Context, eventManager *events.Manager) error {
+	triggers := resumeTriggers()
+	if len(triggers) == 0 {
+		return nil
+	}
+
+	if err := eventManager.AddWatcher(ctx, resume.New(triggers, currentDriftToken)); err != nil {
+		return err
+	}
+
+	eventManager.Subscribe(resume.ResumeEvent, nil, func(ctx context.Context, evType string, data interface{}, evData *events.EventData) bool {
+		if evData != nil {
+			if resumed, ok := evData.Data.(*resume.Data); ok {
+				logger.Infof("Instance resume detected (%s: %s), reconciling clock and network state.", resumed.Source, resumed.Detail)
+			}
+		}
+		reconcileOnResume(ctx, resumeManagers())
+		return true
+	})
+	return nil
+}
+
+// reconcileOnResume runs Set() of the enabled mgrs regardless of their Diff(), the
+// state they apply may be stale after a resume even if metadata didn't change.
+func reconcileOnResume(ctx context.Context, mgrs []manager) {
+	updateMu.Lock()
+	defer updateMu.Unlock()
+
+	for _, mgr := range mgrs {
+		if disabledByMetadata(mgr) {
+			continue
+		}
+		if disabled, err := mgr.Disabled(ctx); err != nil || disabled {
+			continue
+		}
+
+		if err := mgr.Set(ctx); err != nil {
+			logger.Errorf("Failed to reconcile %s manager on resume: %v", mgr.Name(), err)
+			stats.record(mgr, outcomeSetFailure)
+			continue
+		}
+		stats.record(mgr, outcomeSetSuccess)
+	}
+}
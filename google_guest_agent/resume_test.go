@@ -0,0 +1,96 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+)
+
+func TestReconcileOnResume(t *testing.T) {
+	origStats := stats
+	t.Cleanup(func() { stats = origStats })
+	stats = &managerStats{}
+
+	// Set() is called even if Diff() reports no changes.
+	enabled := &firstBootTestMgr{statsTestMgr: statsTestMgr{name: "resumeEnabledMgr"}}
+	disabled := &firstBootTestMgr{statsTestMgr: statsTestMgr{name: "resumeDisabledMgr", disabled: true}}
+	reconcileOnResume(context.Background(), []manager{enabled, disabled})
+
+	if enabled.sets != 1 {
+		t.Errorf("reconcileOnResume() called Set() of enabled manager %d times, want: 1", enabled.sets)
+	}
+	if disabled.sets != 0 {
+		t.Errorf("reconcileOnResume() called Set() of disabled manager %d times, want: 0", disabled.sets)
+	}
+}
+
+func TestResumeTriggers(t *testing.T) {
+	reloadConfig(t, []byte("[Core]\nresume_triggers = clock, drift-token,\n"))
+	if got := resumeTriggers(); len(got) != 2 || got[0] != "clock" || got[1] != "drift-token" {
+		t.Errorf("resumeTriggers() = %v, want: [clock drift-token]", got)
+	}
+
+	reloadConfig(t, []byte("[Core]\nresume_triggers =\n"))
+	if got := resumeTriggers(); len(got) != 0 {
+		t.Errorf("resumeTriggers() = %v, want none", got)
+	}
+	if err := startResumeWatcher(context.Background(), nil); err != nil {
+		t.Errorf("startResumeWatcher() without triggers failed unexpectedly with error: %v", err)
+	}
+}
+
+// TestResumeMetadataRace makes sure metadata events don't race with the resume
+// watcher and reconciliation reading the metadata, run it with -race.
+func TestResumeMetadataRace(t *testing.T) {
+	origStats, origOld, origNew, origLatest := stats, oldMetadata, newMetadata, latestMetadata.Load()
+	t.Cleanup(func() {
+		stats, oldMetadata, newMetadata = origStats, origOld, origNew
+		latestMetadata.Store(origLatest)
+	})
+	stats = &managerStats{}
+
+	ctx := context.Background()
+	var wg sync.WaitGroup
+	wg.Add(3)
+
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			applyMetadata(ctx, driftMetadata(i), []manager{&firstBootTestMgr{}})
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			currentDriftToken()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			reconcileOnResume(ctx, []manager{&firstBootTestMgr{}})
+		}
+	}()
+	wg.Wait()
+
+	if got := currentDriftToken(); got != 99 {
+		t.Errorf("currentDriftToken() = %d after the last metadata event, want: 99", got)
+	}
+	if oldMetadata != newMetadata || newMetadata != latestMetadata.Load() {
+		t.Errorf("metadata not consistent after the last metadata event: old %p, new %p, latest %p", oldMetadata, newMetadata, latestMetadata.Load())
+	}
+}
@@ -20,6 +20,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"os/exec"
 	"strings"
 	"text/template"
@@ -37,6 +38,9 @@ var (
 
 	// ErrTemplateError is the error returned when a CommandSpec's Error template is boggus.
 	ErrTemplateError = errors.New("invalid error format template")
+
+	// ErrInputTemplate is the error returned when a CommandSpec's Input template is boggus.
+	ErrInputTemplate = errors.New("invalid input format template")
 )
 
 // Result wraps a command execution result.
@@ -65,6 +69,9 @@ type RunnerInterface interface {
 	// WithCombinedOutput runs a command and returns a result with stderr and stdout
 	// combined in the Combined member of Result.
 	WithCombinedOutput(ctx context.Context, name string, args ...string) *Result
+
+	// WithInput runs a command feeding stdin to its standard input and returns the result.
+	WithInput(ctx context.Context, stdin io.Reader, name string, args ...string) *Result
 }
 
 // CommandSpec defines a Command template and an Error template. The data
@@ -76,11 +83,23 @@ type CommandSpec struct {
 	// Error is the error template, if the command fails this template is
 	// used to build the error message, i.e: "failed to parse file {{.FileName}}".
 	Error string
+
+	// Input is the optional standard input template, if set its formatted content
+	// is fed to the command's stdin, i.e: "{{.User}}:{{.Password}}".
+	Input string
 }
 
 // CommandSet is set of commands to be executed together, IOW a command batch.
 type CommandSet []CommandSpec
 
+// CommandResult wraps the result of a CommandSpec execution.
+type CommandResult struct {
+	// Result is the command execution result.
+	*Result
+	// Command is the formatted command line that was run.
+	Command string
+}
+
 // init initializes the RunClient.
 func init() {
 	Client = Runner{}
@@ -97,6 +116,23 @@ func (s CommandSet) RunQuiet(ctx context.Context, data any) error {
 	return nil
 }
 
+// RunWithOutput runs all the commands in a CommandSet as a batch and returns each
+// command's result. The batch stops on the first failing command, its result is
+// the last one returned and the error includes its stderr.
+func (s CommandSet) RunWithOutput(ctx context.Context, data any) ([]*CommandResult, error) {
+	var results []*CommandResult
+	for _, curr := range s {
+		res, err := curr.RunWithOutput(ctx, data)
+		if res != nil {
+			results = append(results, res)
+		}
+		if err != nil {
+			return results, err
+		}
+	}
+	return results, nil
+}
+
 // commandFormat formats the CommandSpec's Command field. The data is passed in
 // to the template parsing and execution.
 func (c CommandSpec) commandFormat(data any) ([]string, error) {
@@ -137,7 +173,26 @@ func (c CommandSpec) errorFormat(data any) (string, error) {
 	return buffer.String(), nil
 }
 
-// RunQuiet runs a CommandSpec command, no command output is handled.
+// inputFormat formats the CommandSpec's Input field. The data is passed in to the
+// template parsing and execution.
+func (c CommandSpec) inputFormat(data any) (string, error) {
+	tmpl, err := template.New("").Parse(c.Input)
+	if err != nil {
+		logger.Debugf("error parsing input format: %+v", err)
+		return "", ErrInputTemplate
+	}
+
+	var buffer bytes.Buffer
+	if err := tmpl.Execute(&buffer, data); err != nil {
+		logger.Debugf("error executing input format: %+v", err)
+		return "", ErrInputTemplate
+	}
+
+	return buffer.String(), nil
+}
+
+// RunQuiet runs a CommandSpec command, no command output is handled. If the
+// CommandSpec has an Input template its content is fed to the command's stdin.
 func (c CommandSpec) RunQuiet(ctx context.Context, data any) error {
 	tokens, err := c.commandFormat(data)
 	if err != nil {
@@ -149,13 +204,58 @@ func (c CommandSpec) RunQuiet(ctx context.Context, data any) error {
 		return err
 	}
 
-	if err := Client.Quiet(ctx, tokens[0], tokens[1:]...); err != nil {
-		return fmt.Errorf("%+s: %+v: %+v", errorMsg, len(tokens), err)
+	if c.Input == "" {
+		if err := Client.Quiet(ctx, tokens[0], tokens[1:]...); err != nil {
+			return fmt.Errorf("%+s: %+v: %+v", errorMsg, len(tokens), err)
+		}
+		return nil
+	}
+
+	input, err := c.inputFormat(data)
+	if err != nil {
+		return err
+	}
+
+	if res := Client.WithInput(ctx, strings.NewReader(input), tokens[0], tokens[1:]...); res.ExitCode != 0 {
+		return fmt.Errorf("%+s: %+v: %+v", errorMsg, len(tokens), res)
 	}
 
 	return nil
 }
 
+// RunWithOutput runs a CommandSpec command and returns its result. If the command
+// fails the returned error includes the formatted command line and its stderr. If
+// the CommandSpec has an Input template its content is fed to the command's stdin.
+func (c CommandSpec) RunWithOutput(ctx context.Context, data any) (*CommandResult, error) {
+	tokens, err := c.commandFormat(data)
+	if err != nil {
+		return nil, err
+	}
+
+	errorMsg, err := c.errorFormat(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var res *Result
+	if c.Input == "" {
+		res = Client.WithOutput(ctx, tokens[0], tokens[1:]...)
+	} else {
+		input, err := c.inputFormat(data)
+		if err != nil {
+			return nil, err
+		}
+		res = Client.WithInput(ctx, strings.NewReader(input), tokens[0], tokens[1:]...)
+	}
+
+	cmdRes := &CommandResult{Result: res, Command: strings.Join(tokens, " ")}
+	if res.ExitCode != 0 {
+		return cmdRes, fmt.Errorf("%s: %q exited with code %d: %s", errorMsg, cmdRes.Command, res.ExitCode, strings.TrimSpace(res.StdErr))
+	}
+
+	return cmdRes, nil
+}
+
 // Error return an error containing the stderr content.
 func (e Result) Error() string {
 	return strings.TrimSuffix(e.StdErr, "\n")
@@ -212,6 +312,13 @@ func (r Runner) WithCombinedOutput(ctx context.Context, name string, args ...str
 	}
 }
 
+// WithInput runs a command feeding stdin to its standard input and returns the result.
+func (r Runner) WithInput(ctx context.Context, stdin io.Reader, name string, args ...string) *Result {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdin = stdin
+	return execCommand(cmd)
+}
+
 // Quiet runs the current RunClient's Quiet() function.
 func Quiet(ctx context.Context, name string, args ...string) error {
 	return Client.Quiet(ctx, name, args...)
@@ -232,6 +339,11 @@ func WithCombinedOutput(ctx context.Context, name string, args ...string) *Resul
 	return Client.WithCombinedOutput(ctx, name, args...)
 }
 
+// WithInput runs the current RunClient's WithInput() function.
+func WithInput(ctx context.Context, stdin io.Reader, name string, args ...string) *Result {
+	return Client.WithInput(ctx, stdin, name, args...)
+}
+
 func execCommand(cmd *exec.Cmd) *Result {
 	var stdout, stderr bytes.Buffer
 
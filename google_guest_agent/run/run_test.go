@@ -207,6 +207,51 @@ func TestOutputTimeoutFail(t *testing.T) {
 	}
 }
 
+func TestInputSuccess(t *testing.T) {
+	tests := []struct {
+		cmd    string
+		input  string
+		output string
+	}{
+		{"cat", "foobar\n", "foobar\n"},
+		{"grep bar", "foo\nbar\n", "bar\n"},
+		{"wc -l", "", "0\n"},
+	}
+
+	for _, curr := range tests {
+		t.Run(curr.cmd, func(t *testing.T) {
+			tokens := strings.Split(curr.cmd, " ")
+			res := WithInput(context.Background(), strings.NewReader(curr.input), tokens[0], tokens[1:]...)
+			if res.ExitCode != 0 {
+				t.Errorf("run.WithInput(%s) command failed with exitcode: %d, expected 0.", curr.cmd, res.ExitCode)
+			}
+			if strings.TrimSpace(res.StdOut) != strings.TrimSpace(curr.output) {
+				t.Errorf("run.WithInput(%s) command returned stdout: %q, expected: %q.", curr.cmd, res.StdOut, curr.output)
+			}
+		})
+	}
+}
+
+func TestInputFail(t *testing.T) {
+	tests := []struct {
+		cmd   string
+		input string
+	}{
+		{"grep foobar", "foo\nbar\n"},
+		{"cat /root/foobar", "foobar"},
+	}
+
+	for _, curr := range tests {
+		t.Run(curr.cmd, func(t *testing.T) {
+			tokens := strings.Split(curr.cmd, " ")
+			res := WithInput(context.Background(), strings.NewReader(curr.input), tokens[0], tokens[1:]...)
+			if res.ExitCode == 0 {
+				t.Errorf("run.WithInput(%s) command succeeded, expected failure.", curr.cmd)
+			}
+		})
+	}
+}
+
 func TestCommandSpecSuccess(t *testing.T) {
 	type commandData struct {
 		Data string
@@ -217,17 +262,21 @@ func TestCommandSpecSuccess(t *testing.T) {
 		data commandData
 	}{
 		{
-			CommandSpec{"echo {{.Data}}", "failed to echo {{.Data}}"},
+			CommandSpec{Command: "echo {{.Data}}", Error: "failed to echo {{.Data}}"},
 			commandData{"foobar"},
 		},
 		{
-			CommandSpec{"cat {{.Data}}", "failed to cat file {{.Data}}"},
+			CommandSpec{Command: "cat {{.Data}}", Error: "failed to cat file {{.Data}}"},
 			commandData{"/proc/cpuinfo"},
 		},
 		{
-			CommandSpec{"echo 'foobar' {{.Data}}", "failed to write to file {{.Data}}"},
+			CommandSpec{Command: "echo 'foobar' {{.Data}}", Error: "failed to write to file {{.Data}}"},
 			commandData{path.Join(t.TempDir(), "file.data")},
 		},
+		{
+			CommandSpec{Command: "grep -q {{.Data}}", Error: "failed to grep {{.Data}}", Input: "some {{.Data}} input"},
+			commandData{"foobar"},
+		},
 	}
 
 	for i, curr := range tests {
@@ -250,22 +299,31 @@ func TestCommandSpecFailure(t *testing.T) {
 		internalError error
 	}{
 		{
-			spec:          CommandSpec{"", "failed to echo {{.Data}}"},
+			spec:          CommandSpec{Command: "", Error: "failed to echo {{.Data}}"},
 			data:          commandData{"foobar"},
 			internalError: ErrCommandTemplate,
 		},
 		{
-			spec:          CommandSpec{"invalid field {{.UnknownField}}", "failed to echo {{.Data}}"},
+			spec:          CommandSpec{Command: "invalid field {{.UnknownField}}", Error: "failed to echo {{.Data}}"},
 			data:          commandData{"foobar"},
 			internalError: ErrCommandTemplate,
 		},
 		{
-			spec:          CommandSpec{"echo {{.Data}}", "invalid data {{.UnknownField}}"},
+			spec:          CommandSpec{Command: "echo {{.Data}}", Error: "invalid data {{.UnknownField}}"},
 			data:          commandData{"foobar"},
 			internalError: ErrTemplateError,
 		},
 		{
-			spec: CommandSpec{"echoxx {{.Data}}", "invalid data {{.Data}}"},
+			spec: CommandSpec{Command: "echoxx {{.Data}}", Error: "invalid data {{.Data}}"},
+			data: commandData{"foobar"},
+		},
+		{
+			spec:          CommandSpec{Command: "cat", Error: "failed to cat {{.Data}}", Input: "{{.UnknownField}}"},
+			data:          commandData{"foobar"},
+			internalError: ErrInputTemplate,
+		},
+		{
+			spec: CommandSpec{Command: "grep -q {{.Data}}", Error: "failed to grep {{.Data}}", Input: "other input"},
 			data: commandData{"foobar"},
 		},
 	}
@@ -281,3 +339,82 @@ func TestCommandSpecFailure(t *testing.T) {
 		})
 	}
 }
+
+func TestCommandSetRunWithOutput(t *testing.T) {
+	type commandData struct {
+		Data string
+	}
+
+	tests := []struct {
+		name         string
+		set          CommandSet
+		wantCommands []string
+		wantStdOut   []string
+		wantErr      bool
+	}{
+		{
+			name: "success",
+			set: CommandSet{
+				{Command: "echo {{.Data}}", Error: "failed to echo {{.Data}}"},
+				{Command: "cat", Error: "failed to cat {{.Data}}", Input: "input {{.Data}}"},
+			},
+			wantCommands: []string{"echo foobar", "cat"},
+			wantStdOut:   []string{"foobar\n", "input foobar"},
+		},
+		{
+			name: "stops_on_failure",
+			set: CommandSet{
+				{Command: "echo {{.Data}}", Error: "failed to echo {{.Data}}"},
+				{Command: "cat /root/{{.Data}}", Error: "failed to cat {{.Data}}"},
+				{Command: "echo never", Error: "failed to echo"},
+			},
+			wantCommands: []string{"echo foobar", "cat /root/foobar"},
+			wantStdOut:   []string{"foobar\n", ""},
+			wantErr:      true,
+		},
+		{
+			name: "invalid_template",
+			set: CommandSet{
+				{Command: "echo {{.Data}}", Error: "failed to echo {{.Data}}"},
+				{Command: "echo {{.UnknownField}}", Error: "failed to echo {{.Data}}"},
+			},
+			wantCommands: []string{"echo foobar"},
+			wantStdOut:   []string{"foobar\n"},
+			wantErr:      true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			results, err := tc.set.RunWithOutput(context.Background(), commandData{"foobar"})
+			if (err != nil) != tc.wantErr {
+				t.Errorf("RunWithOutput() = %v, want error: %t", err, tc.wantErr)
+			}
+
+			if len(results) != len(tc.wantCommands) {
+				t.Fatalf("RunWithOutput() returned %d results, want %d", len(results), len(tc.wantCommands))
+			}
+
+			for i, res := range results {
+				if res.Command != tc.wantCommands[i] {
+					t.Errorf("RunWithOutput() result %d command = %q, want %q", i, res.Command, tc.wantCommands[i])
+				}
+				if res.StdOut != tc.wantStdOut[i] {
+					t.Errorf("RunWithOutput() result %d stdout = %q, want %q", i, res.StdOut, tc.wantStdOut[i])
+				}
+			}
+		})
+	}
+}
+
+func TestCommandSpecRunWithOutputError(t *testing.T) {
+	spec := CommandSpec{Command: "ls {{.}}", Error: "failed to list {{.}}"}
+	res, err := spec.RunWithOutput(context.Background(), "/root/foobar")
+	if err == nil {
+		t.Fatalf("RunWithOutput() succeeded, want error")
+	}
+
+	if !strings.Contains(err.Error(), "failed to list /root/foobar") || !strings.Contains(err.Error(), strings.TrimSpace(res.StdErr)) {
+		t.Errorf("RunWithOutput() = %v, want error including the error message and stderr %q", err, res.StdErr)
+	}
+}
@@ -18,13 +18,25 @@ package scheduler
 import (
 	"context"
 	"fmt"
+	"math/rand"
 	"sync"
 	"time"
 
+	"github.com/GoogleCloudPlatform/guest-agent/utils"
 	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
 	"github.com/robfig/cron/v3"
 )
 
+// errorLimiter rate limits the errors of jobs failing repeatedly, e.g. during a
+// metadata server outage.
+var errorLimiter = utils.NewLogLimiter(0)
+
+// SetLogRateLimit sets the interval at which identical job errors are logged, a
+// zero interval logs every error.
+func SetLogRateLimit(interval time.Duration) {
+	errorLimiter.SetInterval(interval)
+}
+
 // Job defines the interface between the schedule manager and the actual job.
 type Job interface {
 	// ID returns the job id.
@@ -40,6 +52,60 @@ type Job interface {
 	Run(context.Context) (bool, error)
 }
 
+// OneShotJob is an optional interface a Job can implement to run only once.
+// A one-shot job fires once, either immediately or after Interval() as
+// requested by the job, and is removed from the schedule when it fires.
+type OneShotJob interface {
+	Job
+	// OneShot returns true if the job must be unscheduled after its first run.
+	OneShot() bool
+}
+
+// JitterJob is an optional interface a Job can implement to spread its runs.
+// Every scheduled run is delayed by a random duration of up to Jitter() times
+// the job's interval.
+type JitterJob interface {
+	Job
+	// Jitter returns the jitter fraction, values are clamped to [0, 1].
+	Jitter() float64
+}
+
+// isOneShot returns true if job implements OneShotJob and requests a single run.
+func isOneShot(job Job) bool {
+	j, ok := job.(OneShotJob)
+	return ok && j.OneShot()
+}
+
+// jitterOf returns the job's jitter fraction clamped to [0, 1], jobs not
+// implementing JitterJob have no jitter.
+func jitterOf(job Job) float64 {
+	j, ok := job.(JitterJob)
+	if !ok {
+		return 0
+	}
+	jitter := j.Jitter()
+	if jitter < 0 {
+		return 0
+	}
+	if jitter > 1 {
+		return 1
+	}
+	return jitter
+}
+
+// jitterSchedule implements cron.Schedule, it activates once every interval
+// plus a random delay of up to jitter*interval.
+type jitterSchedule struct {
+	interval time.Duration
+	jitter   float64
+}
+
+// Next returns the next activation time later than t.
+func (s jitterSchedule) Next(t time.Time) time.Time {
+	delay := s.interval + time.Duration(rand.Float64()*s.jitter*float64(s.interval))
+	return t.Add(delay)
+}
+
 // Scheduler implements job schedule manager and offers a way to schedule/unschedule new jobs.
 type Scheduler struct {
 	cron *cron.Cron
@@ -68,14 +134,20 @@ func Get() *Scheduler {
 
 // getFunc generates a wrapper function for cron scheduler.
 func (s *Scheduler) getFunc(ctx context.Context, job Job) func() {
+	oneShot := isOneShot(job)
 	f := func() {
+		// Unschedule one-shot jobs before running them, a long running job must
+		// not be fired again by the next activation.
+		if oneShot {
+			s.UnscheduleJob(job.ID())
+		}
 		logger.Infof("Invoking job %q", job.ID())
 		schedule, err := job.Run(ctx)
-		if !schedule {
+		if !schedule && !oneShot {
 			s.UnscheduleJob(job.ID())
 		}
 		if err != nil {
-			logger.Errorf("Failed to execute job %s: %v", job.ID(), err)
+			errorLimiter.Logf(logger.Errorf, "Failed to execute job %s: %v", job.ID(), err)
 		}
 	}
 	return f
@@ -90,7 +162,7 @@ func (s *Scheduler) ScheduleJob(ctx context.Context, job Job, synchronous bool)
 	logger.Infof("Scheduling job: %s", job.ID())
 
 	interval, startNow := job.Interval()
-	if err := s.jobInit(job.ID(), interval, s.getFunc(ctx, job), startNow, synchronous); err != nil {
+	if err := s.jobInit(job.ID(), interval, jitterOf(job), s.getFunc(ctx, job), startNow, synchronous); err != nil {
 		return err
 	}
 
@@ -103,13 +175,14 @@ func (s *Scheduler) setEntryID(jobID string, entryID cron.EntryID) {
 	s.jobs[jobID] = entryID
 }
 
-// jobInit adds job to the schedule to run at specified interval.
+// jobInit adds job to the schedule to run at specified interval, each run is
+// delayed by a random duration of up to jitter*interval.
 // Setting startImmediately to true executes first run immediately, otherwise
 // first run will be after interval (at now+interval).
 // If startImmediately and synchronous both are true, init method will block
 // until job is completed.
-func (s *Scheduler) jobInit(jobID string, interval time.Duration, job func(), startImmediately, synchronous bool) error {
-	logger.Infof("Scheduling job %q to run at %f hr interval", jobID, interval.Hours())
+func (s *Scheduler) jobInit(jobID string, interval time.Duration, jitter float64, job func(), startImmediately, synchronous bool) error {
+	logger.Infof("Scheduling job %q to run at %f hr interval with %.2f jitter", jobID, interval.Hours(), jitter)
 
 	_, found := s.jobs[jobID]
 	// If found, job is already running, return.
@@ -118,9 +191,20 @@ func (s *Scheduler) jobInit(jobID string, interval time.Duration, job func(), st
 		return nil
 	}
 
-	entry, err := s.cron.AddFunc(fmt.Sprintf("@every %ds", int(interval.Seconds())), job)
-	if err != nil {
-		return fmt.Errorf("unable to schedule %q: %w", jobID, err)
+	var entry cron.EntryID
+	if jitter > 0 {
+		// Keep the same second granularity as the @every descriptor.
+		interval = interval.Round(time.Second)
+		if interval < time.Second {
+			interval = time.Second
+		}
+		entry = s.cron.Schedule(jitterSchedule{interval: interval, jitter: jitter}, cron.FuncJob(job))
+	} else {
+		var err error
+		entry, err = s.cron.AddFunc(fmt.Sprintf("@every %ds", int(interval.Seconds())), job)
+		if err != nil {
+			return fmt.Errorf("unable to schedule %q: %w", jobID, err)
+		}
 	}
 	s.setEntryID(jobID, entry)
 
@@ -138,8 +222,8 @@ func (s *Scheduler) jobInit(jobID string, interval time.Duration, job func(), st
 
 // UnscheduleJob removes the job from schedule.
 func (s *Scheduler) UnscheduleJob(jobID string) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
 	logger.Infof("Unscheduling job %q", jobID)
 
@@ -16,6 +16,7 @@ package scheduler
 
 import (
 	"context"
+	"sync"
 	"testing"
 	"time"
 )
@@ -27,10 +28,22 @@ type testJob struct {
 	id           string
 	ctr          int
 	stopAfter    int
+	// runs, if set, receives the counter value after every run.
+	runs chan int
+	// mu protects ctr from overlapping runs.
+	mu sync.Mutex
 }
 
 func (j *testJob) Run(_ context.Context) (bool, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
 	j.ctr++
+	if j.runs != nil {
+		select {
+		case j.runs <- j.ctr:
+		default:
+		}
+	}
 	if j.ctr == j.stopAfter {
 		return false, nil
 	}
@@ -209,3 +222,134 @@ func TestScheduleJobsNoWait(t *testing.T) {
 		t.Errorf("ScheduleJobs(ctx, job1, true) returned after %f seconds, expected no wait", got.Seconds())
 	}
 }
+
+type testOneShotJob struct {
+	testJob
+}
+
+func (j *testOneShotJob) OneShot() bool {
+	return true
+}
+
+// waitRuns waits for the job reporting on runs to have run n times.
+func waitRuns(t *testing.T, runs <-chan int, n int) {
+	t.Helper()
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case ctr := <-runs:
+			if ctr >= n {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("job did not run %d times before timeout", n)
+		}
+	}
+}
+
+func TestOneShotSchedule(t *testing.T) {
+	tests := []struct {
+		name        string
+		startingNow bool
+	}{
+		{"start_now", true},
+		{"start_after_interval", false},
+	}
+
+	s := Get()
+	defer s.Stop()
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			job := &testOneShotJob{
+				testJob: testJob{
+					interval:     time.Second,
+					id:           "test_one_shot_job_" + tc.name,
+					shouldEnable: true,
+					startingNow:  tc.startingNow,
+					runs:         make(chan int, 10),
+				},
+			}
+
+			if err := s.ScheduleJob(context.Background(), job, false); err != nil {
+				t.Fatalf("ScheduleJob(ctx, %s) failed unexpectedly with error: %v", job.ID(), err)
+			}
+
+			waitRuns(t, job.runs, 1)
+
+			// One-shot jobs are unscheduled before running, no other run can follow.
+			if s.IsScheduled(job.ID()) {
+				t.Errorf("IsScheduled(%s) = true, want false", job.ID())
+			}
+			if job.ctr != 1 {
+				t.Errorf("One-shot job %s ran %d times, want 1", job.ID(), job.ctr)
+			}
+		})
+	}
+}
+
+type testJitterJob struct {
+	testJob
+	jitter float64
+}
+
+func (j *testJitterJob) Jitter() float64 {
+	return j.jitter
+}
+
+func TestJitterOf(t *testing.T) {
+	tests := []struct {
+		name string
+		job  Job
+		want float64
+	}{
+		{"no_jitter_job", &testJob{}, 0},
+		{"negative", &testJitterJob{jitter: -1}, 0},
+		{"fraction", &testJitterJob{jitter: 0.25}, 0.25},
+		{"too_large", &testJitterJob{jitter: 2}, 1},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := jitterOf(tc.job); got != tc.want {
+				t.Errorf("jitterOf(%+v) = %f, want: %f", tc.job, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestJitterScheduleNext(t *testing.T) {
+	sched := jitterSchedule{interval: time.Minute, jitter: 0.5}
+	now := time.Now()
+
+	for i := 0; i < 100; i++ {
+		next := sched.Next(now)
+		if next.Before(now.Add(time.Minute)) || next.After(now.Add(90*time.Second)) {
+			t.Fatalf("jitterSchedule.Next(%v) = %v, want between %v and %v", now, next, now.Add(time.Minute), now.Add(90*time.Second))
+		}
+	}
+}
+
+func TestJitterSchedule(t *testing.T) {
+	job := &testJitterJob{
+		testJob: testJob{
+			interval:     time.Second,
+			id:           "test_jitter_job",
+			shouldEnable: true,
+			startingNow:  true,
+			runs:         make(chan int, 10),
+		},
+		jitter: 0.5,
+	}
+
+	s := Get()
+	defer s.Stop()
+
+	if err := s.ScheduleJob(context.Background(), job, false); err != nil {
+		t.Fatalf("ScheduleJob(ctx, %s) failed unexpectedly with error: %v", job.ID(), err)
+	}
+	defer s.UnscheduleJob(job.ID())
+
+	// Runs happen every 1 to 1.5 seconds after the immediate one.
+	waitRuns(t, job.runs, 3)
+}
@@ -0,0 +1,209 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/command"
+	network "github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/network/manager"
+	"github.com/GoogleCloudPlatform/guest-agent/metadata"
+)
+
+// selfTestTimeout is the time a single self-test check is allowed to take.
+const selfTestTimeout = 10 * time.Second
+
+// errSkipCheck is returned by self-test checks not applicable to the current
+// environment or configuration.
+var errSkipCheck = errors.New("not applicable")
+
+// selfTestCheck is a single check run by the selftest action.
+type selfTestCheck struct {
+	// name describes what is being checked.
+	name string
+	// critical makes the self-test fail if the check fails.
+	critical bool
+	// hint is the remediation hint printed if the check fails.
+	hint string
+	// run runs the check, returning a short detail message on success.
+	run func(ctx context.Context) (string, error)
+}
+
+// selfTestChecks returns the checks run by the selftest action.
+func selfTestChecks() []selfTestCheck {
+	mdsClient := metadata.New()
+
+	return []selfTestCheck{
+		{
+			name:     "Metadata server reachable",
+			critical: true,
+			hint:     "check the instance's network configuration, routes to 169.254.169.254 and any firewall or proxy in the way",
+			run: func(ctx context.Context) (string, error) {
+				id, err := mdsClient.GetKey(ctx, "instance/id", nil)
+				if err != nil {
+					return "", err
+				}
+				return "instance id " + id, nil
+			},
+		},
+		{
+			name: "Command monitor socket up",
+			hint: "check the guest agent service is running and Unstable command_pipe_path matches its configuration",
+			run:  checkCommandMonitor,
+		},
+		{
+			name: "Network manager detected",
+			hint: "secondary network interfaces are not configured without a supported network manager, see the NetworkInterfaces configuration",
+			run: func(ctx context.Context) (string, error) {
+				if runtime.GOOS == "windows" {
+					return "", errSkipCheck
+				}
+				mds, err := mdsClient.Get(ctx)
+				if err != nil {
+					return "", fmt.Errorf("failed to get metadata: %w", err)
+				}
+				return network.DetectNetworkManager(ctx, mds)
+			},
+		},
+		{
+			name:     "OS Login configuration well-formed",
+			critical: true,
+			hint:     "remove the damaged Google OS Login control sections and restart the guest agent to rewrite them",
+			run: func(ctx context.Context) (string, error) {
+				if runtime.GOOS == "windows" {
+					return "", errSkipCheck
+				}
+				return checkOSLoginFiles(osLoginConfigFiles())
+			},
+		},
+	}
+}
+
+// checkCommandMonitor checks the command monitor answers the agent.version command.
+func checkCommandMonitor(ctx context.Context) (string, error) {
+	if !cfg.Get().Unstable.CommandMonitorEnabled {
+		return "", errSkipCheck
+	}
+
+	req, err := json.Marshal(command.Request{Command: versionCommand})
+	if err != nil {
+		return "", err
+	}
+
+	var resp versionResponse
+	if err := json.Unmarshal(command.SendCommand(ctx, req), &resp); err != nil {
+		return "", fmt.Errorf("invalid response: %w", err)
+	}
+	if resp.Status != 0 {
+		return "", fmt.Errorf("status %d: %s", resp.Status, resp.StatusMessage)
+	}
+	return "agent version " + resp.Version, nil
+}
+
+// osLoginConfigFiles returns the files the OS Login control sections are written to.
+func osLoginConfigFiles() []string {
+	return []string{"/etc/ssh/sshd_config", filepath.Join(pamDir, "sshd")}
+}
+
+// checkOSLoginFiles checks the Google OS Login control sections of files, missing
+// files are ignored.
+func checkOSLoginFiles(files []string) (string, error) {
+	var sections int
+	for _, file := range files {
+		contents, err := os.ReadFile(file)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+
+		n, err := checkGoogleBlocks(string(contents))
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", file, err)
+		}
+		sections += n
+	}
+	return fmt.Sprintf("%d control section(s) found", sections), nil
+}
+
+// checkGoogleBlocks returns the number of Google OS Login control sections in
+// contents, or an error if a section is not properly opened or closed. Unbalanced
+// sections make the agent drop the user's configuration following them.
+func checkGoogleBlocks(contents string) (int, error) {
+	var sections int
+	var inBlock bool
+	for i, line := range strings.Split(contents, "\n") {
+		switch {
+		case strings.Contains(line, googleBlockStart):
+			if inBlock {
+				return 0, fmt.Errorf("line %d: section started twice", i+1)
+			}
+			inBlock = true
+		case strings.Contains(line, googleBlockEnd):
+			if !inBlock {
+				return 0, fmt.Errorf("line %d: section end without start", i+1)
+			}
+			inBlock = false
+			sections++
+		}
+	}
+	if inBlock {
+		return 0, fmt.Errorf("section is never closed")
+	}
+	return sections, nil
+}
+
+// runSelfTest runs checks, writing a pass/fail report to w. It returns the
+// process exit code, non zero if any critical check failed.
+func runSelfTest(ctx context.Context, w io.Writer, checks []selfTestCheck) int {
+	var failed bool
+	for _, check := range checks {
+		checkCtx, cancel := context.WithTimeout(ctx, selfTestTimeout)
+		detail, err := check.run(checkCtx)
+		cancel()
+
+		switch {
+		case errors.Is(err, errSkipCheck):
+			fmt.Fprintf(w, "[SKIP] %s\n", check.name)
+		case err != nil:
+			level := "WARN"
+			if check.critical {
+				level = "FAIL"
+				failed = true
+			}
+			fmt.Fprintf(w, "[%s] %s: %v\n       hint: %s\n", level, check.name, err, check.hint)
+		default:
+			fmt.Fprintf(w, "[PASS] %s: %s\n", check.name, detail)
+		}
+	}
+
+	if failed {
+		fmt.Fprintln(w, "Self-test failed.")
+		return 1
+	}
+	fmt.Fprintln(w, "Self-test passed.")
+	return 0
+}
@@ -0,0 +1,143 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckGoogleBlocks(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents string
+		want     int
+		wantErr  bool
+	}{
+		{
+			name:     "no_sections",
+			contents: "PermitRootLogin no\n",
+		},
+		{
+			name:     "one_section",
+			contents: strings.Join([]string{googleBlockStart, "AuthorizedKeysCommandUser root", googleBlockEnd, "PermitRootLogin no"}, "\n"),
+			want:     1,
+		},
+		{
+			name:     "two_sections",
+			contents: strings.Join([]string{googleBlockStart, googleBlockEnd, "Match User x", googleBlockStart, googleBlockEnd}, "\n"),
+			want:     2,
+		},
+		{
+			name:     "never_closed",
+			contents: strings.Join([]string{googleBlockStart, "PermitRootLogin no"}, "\n"),
+			wantErr:  true,
+		},
+		{
+			name:     "started_twice",
+			contents: strings.Join([]string{googleBlockStart, googleBlockStart, googleBlockEnd}, "\n"),
+			wantErr:  true,
+		},
+		{
+			name:     "end_without_start",
+			contents: strings.Join([]string{"PermitRootLogin no", googleBlockEnd}, "\n"),
+			wantErr:  true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := checkGoogleBlocks(tc.contents)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("checkGoogleBlocks() error = %v, want error: %t", err, tc.wantErr)
+			}
+			if got != tc.want {
+				t.Errorf("checkGoogleBlocks() = %d, want %d", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestCheckOSLoginFiles(t *testing.T) {
+	dir := t.TempDir()
+	valid := filepath.Join(dir, "valid")
+	broken := filepath.Join(dir, "broken")
+	missing := filepath.Join(dir, "missing")
+
+	if err := os.WriteFile(valid, []byte(googleBlockStart+"\n"+googleBlockEnd+"\n"), 0644); err != nil {
+		t.Fatalf("os.WriteFile(%s) failed unexpectedly with error: %v", valid, err)
+	}
+	if err := os.WriteFile(broken, []byte(googleBlockStart+"\n"), 0644); err != nil {
+		t.Fatalf("os.WriteFile(%s) failed unexpectedly with error: %v", broken, err)
+	}
+
+	if _, err := checkOSLoginFiles([]string{valid, missing}); err != nil {
+		t.Errorf("checkOSLoginFiles(%s, %s) failed unexpectedly with error: %v", valid, missing, err)
+	}
+	if _, err := checkOSLoginFiles([]string{valid, broken}); err == nil || !strings.Contains(err.Error(), broken) {
+		t.Errorf("checkOSLoginFiles(%s, %s) = %v, want error naming %s", valid, broken, err, broken)
+	}
+}
+
+func TestRunSelfTest(t *testing.T) {
+	pass := func(context.Context) (string, error) { return "ok", nil }
+	fail := func(context.Context) (string, error) { return "", fmt.Errorf("broken") }
+	skip := func(context.Context) (string, error) { return "", errSkipCheck }
+
+	tests := []struct {
+		name   string
+		checks []selfTestCheck
+		want   int
+		output []string
+	}{
+		{
+			name:   "all_pass",
+			checks: []selfTestCheck{{name: "a", critical: true, run: pass}, {name: "b", run: skip}},
+			want:   0,
+			output: []string{"[PASS] a: ok", "[SKIP] b"},
+		},
+		{
+			name:   "non_critical_failure",
+			checks: []selfTestCheck{{name: "a", critical: true, run: pass}, {name: "b", hint: "fix b", run: fail}},
+			want:   0,
+			output: []string{"[WARN] b: broken", "hint: fix b"},
+		},
+		{
+			name:   "critical_failure",
+			checks: []selfTestCheck{{name: "a", critical: true, hint: "fix a", run: fail}, {name: "b", run: pass}},
+			want:   1,
+			output: []string{"[FAIL] a: broken", "hint: fix a", "[PASS] b: ok", "Self-test failed."},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if got := runSelfTest(context.Background(), &buf, tc.checks); got != tc.want {
+				t.Errorf("runSelfTest() = %d, want %d", got, tc.want)
+			}
+			for _, line := range tc.output {
+				if !strings.Contains(buf.String(), line) {
+					t.Errorf("runSelfTest() output = %q, want it to contain %q", buf.String(), line)
+				}
+			}
+		})
+	}
+}
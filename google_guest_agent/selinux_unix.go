@@ -0,0 +1,202 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/run"
+	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+)
+
+const (
+	// defaultHomeBase is the base directory SELinux policies label as user homes.
+	defaultHomeBase = "/home"
+	// useraddCantCreateHome is the useradd exit code for "can't create home directory".
+	useraddCantCreateHome = 12
+)
+
+var (
+	// selinuxEnforceFile reports whether SELinux is enforcing, overridden in tests.
+	selinuxEnforceFile = "/sys/fs/selinux/enforce"
+	// useraddDefaultsFile holds useradd defaults, overridden in tests.
+	useraddDefaultsFile = "/etc/default/useradd"
+
+	// selinuxHomeBasesMu protects selinuxHomeBases.
+	selinuxHomeBasesMu sync.Mutex
+	// selinuxHomeBases are the non default home base directories already labeled as
+	// equivalent to /home, avoids running semanage for every new user.
+	selinuxHomeBases = make(map[string]bool)
+)
+
+// selinuxEnforcing returns true if SELinux is enabled and in enforcing mode.
+func selinuxEnforcing() bool {
+	data, err := os.ReadFile(selinuxEnforceFile)
+	if err != nil {
+		return false
+	}
+	return strings.TrimSpace(string(data)) == "1"
+}
+
+// useraddHomeBase returns the base directory useradd creates homes in when no
+// base directory is given in its command line.
+func useraddHomeBase() string {
+	f, err := os.Open(useraddDefaultsFile)
+	if err != nil {
+		return defaultHomeBase
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		key, value, found := strings.Cut(strings.TrimSpace(scanner.Text()), "=")
+		if found && strings.TrimSpace(key) == "HOME" && strings.TrimSpace(value) != "" {
+			return strings.TrimSpace(value)
+		}
+	}
+	return defaultHomeBase
+}
+
+// useraddHomeDir returns the home directory useradd is going to use for username
+// given its command line arguments.
+func useraddHomeDir(args []string, username string) string {
+	var home, base string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case (arg == "-d" || arg == "--home-dir") && i+1 < len(args):
+			i++
+			home = args[i]
+		case strings.HasPrefix(arg, "--home-dir="):
+			home = strings.TrimPrefix(arg, "--home-dir=")
+		case (arg == "-b" || arg == "--base-dir") && i+1 < len(args):
+			i++
+			base = args[i]
+		case strings.HasPrefix(arg, "--base-dir="):
+			base = strings.TrimPrefix(arg, "--base-dir=")
+		}
+	}
+
+	if home != "" {
+		return filepath.Clean(home)
+	}
+	if base == "" {
+		base = useraddHomeBase()
+	}
+	return filepath.Join(base, username)
+}
+
+// selinuxHomeDir returns the home directory of username if SELinux is enforcing and
+// the home directory is out of the default home base, meaning it requires special
+// handling to get the right SELinux context. Otherwise it returns an empty string.
+func selinuxHomeDir(args []string, username string) string {
+	if !selinuxEnforcing() {
+		return ""
+	}
+	home := useraddHomeDir(args, username)
+	if filepath.Dir(home) == defaultHomeBase {
+		return ""
+	}
+	return home
+}
+
+// labelHomeBase makes SELinux label the base directory of home as it labels /home,
+// so useradd is allowed to create the home directory in it.
+func labelHomeBase(ctx context.Context, home string) {
+	base := filepath.Dir(home)
+
+	selinuxHomeBasesMu.Lock()
+	defer selinuxHomeBasesMu.Unlock()
+	if selinuxHomeBases[base] {
+		return
+	}
+
+	semanage, err := exec.LookPath("semanage")
+	if err != nil {
+		logger.Infof("No semanage available, not labeling %s as a home base directory", base)
+		return
+	}
+
+	// An already existing equivalence rule makes semanage fail, which is fine.
+	if err := run.Quiet(ctx, semanage, "fcontext", "-a", "-e", defaultHomeBase, base); err != nil {
+		logger.Debugf("semanage failed to add %s equivalence to %s: %v", base, defaultHomeBase, err)
+	}
+	restoreSELinuxContext(ctx, base, false)
+	selinuxHomeBases[base] = true
+}
+
+// restoreSELinuxContext restores the SELinux context of path, recursively if requested.
+func restoreSELinuxContext(ctx context.Context, path string, recursive bool) {
+	restorecon, err := exec.LookPath("restorecon")
+	if err != nil {
+		logger.Infof("No restorecon available, not restoring SELinux context of: %s", path)
+		return
+	}
+
+	args := []string{path}
+	if recursive {
+		args = []string{"-R", path}
+	}
+	if err := run.Quiet(ctx, restorecon, args...); err != nil {
+		logger.Warningf("Failed to restore SELinux context of %s: %v", path, err)
+	}
+}
+
+// createHomeDir creates the home directory of an already existing user, used when
+// useradd created the user but failed creating its home directory.
+func createHomeDir(username, home string) error {
+	u, err := user.Lookup(username)
+	if err != nil {
+		return fmt.Errorf("failed to lookup user %s: %+v", username, err)
+	}
+
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return fmt.Errorf("invalid uid %q for user %s: %+v", u.Uid, username, err)
+	}
+
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return fmt.Errorf("invalid gid %q for user %s: %+v", u.Gid, username, err)
+	}
+
+	if err := os.MkdirAll(home, 0700); err != nil {
+		return fmt.Errorf("failed to create home directory %s: %+v", home, err)
+	}
+
+	if err := os.Chown(home, uid, gid); err != nil {
+		return fmt.Errorf("failed to change ownership of home directory %s: %+v", home, err)
+	}
+
+	return nil
+}
+
+// isExitCode returns true if err is a command result with the provided exit code.
+func isExitCode(err error, code int) bool {
+	var res *run.Result
+	return errors.As(err, &res) && res.ExitCode == code
+}
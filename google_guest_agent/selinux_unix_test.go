@@ -0,0 +1,132 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/run"
+)
+
+func TestSELinuxHomeDir(t *testing.T) {
+	oldEnforce, oldDefaults := selinuxEnforceFile, useraddDefaultsFile
+	t.Cleanup(func() {
+		selinuxEnforceFile = oldEnforce
+		useraddDefaultsFile = oldDefaults
+	})
+
+	dir := t.TempDir()
+	useraddDefaultsFile = filepath.Join(dir, "useradd")
+	if err := os.WriteFile(useraddDefaultsFile, []byte("GROUP=100\nHOME=/mnt/homes\n"), 0644); err != nil {
+		t.Fatalf("os.WriteFile(%s) failed unexpectedly with error: %v", useraddDefaultsFile, err)
+	}
+
+	tests := []struct {
+		name      string
+		enforce   string
+		args      []string
+		wantHome  string
+		wantSEDir string
+	}{
+		{
+			name:      "defaults_file_base",
+			enforce:   "1",
+			args:      []string{"-m", "-s", "/bin/bash", "user"},
+			wantHome:  "/mnt/homes/user",
+			wantSEDir: "/mnt/homes/user",
+		},
+		{
+			name:      "default_home",
+			enforce:   "1",
+			args:      []string{"-m", "-b", "/home", "user"},
+			wantHome:  "/home/user",
+			wantSEDir: "",
+		},
+		{
+			name:      "home_dir_flag",
+			enforce:   "1",
+			args:      []string{"-m", "-d", "/data/user/", "user"},
+			wantHome:  "/data/user",
+			wantSEDir: "/data/user",
+		},
+		{
+			name:      "long_flags",
+			enforce:   "1",
+			args:      []string{"--create-home", "--base-dir=/srv", "user"},
+			wantHome:  "/srv/user",
+			wantSEDir: "/srv/user",
+		},
+		{
+			name:      "permissive",
+			enforce:   "0",
+			args:      []string{"-m", "-d", "/data/user", "user"},
+			wantHome:  "/data/user",
+			wantSEDir: "",
+		},
+		{
+			name:      "selinux_disabled",
+			args:      []string{"-m", "-d", "/data/user", "user"},
+			wantHome:  "/data/user",
+			wantSEDir: "",
+		},
+	}
+
+	for i, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			selinuxEnforceFile = filepath.Join(dir, fmt.Sprintf("enforce-%d", i))
+			if tc.enforce != "" {
+				if err := os.WriteFile(selinuxEnforceFile, []byte(tc.enforce), 0644); err != nil {
+					t.Fatalf("os.WriteFile(%s) failed unexpectedly with error: %v", selinuxEnforceFile, err)
+				}
+			}
+
+			if got := useraddHomeDir(tc.args, "user"); got != tc.wantHome {
+				t.Errorf("useraddHomeDir(%v, user) = %q, want %q", tc.args, got, tc.wantHome)
+			}
+
+			if got := selinuxHomeDir(tc.args, "user"); got != tc.wantSEDir {
+				t.Errorf("selinuxHomeDir(%v, user) = %q, want %q", tc.args, got, tc.wantSEDir)
+			}
+		})
+	}
+}
+
+func TestIsExitCode(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		code int
+		want bool
+	}{
+		{name: "nil", err: nil, code: useraddCantCreateHome, want: false},
+		{name: "matching", err: &run.Result{ExitCode: useraddCantCreateHome}, code: useraddCantCreateHome, want: true},
+		{name: "other_code", err: &run.Result{ExitCode: 1}, code: useraddCantCreateHome, want: false},
+		{name: "wrapped", err: fmt.Errorf("useradd: %w", &run.Result{ExitCode: 12}), code: 12, want: true},
+		{name: "other_error", err: fmt.Errorf("error"), code: 12, want: false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := isExitCode(tc.err, tc.code); got != tc.want {
+				t.Errorf("isExitCode(%v, %d) = %t, want %t", tc.err, tc.code, got, tc.want)
+			}
+		})
+	}
+}
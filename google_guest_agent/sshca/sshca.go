@@ -18,7 +18,9 @@ package sshca
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"strings"
+	"sync"
 
 	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/events"
 	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/events/sshtrustedca"
@@ -38,7 +40,14 @@ type TrustedCert struct {
 
 var (
 	// mdsClient is the metadata's client, used to query oslogin certificates.
-	mdsClient *metadata.Client
+	mdsClient metadata.MDSClientInterface
+
+	// servedKeysMu protects servedKeys.
+	servedKeysMu sync.Mutex
+	// servedKeys are the CA public keys last written to the pipe, they are served
+	// again if the metadata server can't be queried so sshd never ends up with no
+	// trusted CA, i.e. in the middle of a rotation.
+	servedKeys []string
 )
 
 // Init initializes the sshca's event handler callback.
@@ -53,6 +62,68 @@ func Close() {
 	mdsClient = nil
 }
 
+// caKeys returns the unique, non empty, public keys of certs in their original
+// order. During a rotation metadata lists both the new and the old CA keys.
+func caKeys(certs Certificates) []string {
+	var res []string
+	seen := make(map[string]bool)
+	for _, curr := range certs.Certs {
+		key := strings.TrimSpace(curr.PublicKey)
+		if key == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+		res = append(res, key)
+	}
+	return res
+}
+
+// updateServedKeys records keys as the served CA keys, logging the keys introduced
+// and retired since the previous set.
+func updateServedKeys(keys []string) {
+	servedKeysMu.Lock()
+	defer servedKeysMu.Unlock()
+
+	previous := make(map[string]bool)
+	for _, key := range servedKeys {
+		previous[key] = true
+	}
+
+	var added int
+	for _, key := range keys {
+		if !previous[key] {
+			added++
+		}
+		delete(previous, key)
+	}
+
+	if added > 0 || len(previous) > 0 {
+		logger.Infof("Trusted CA keys changed: %d introduced, %d retired, serving %d keys", added, len(previous), len(keys))
+	}
+	servedKeys = keys
+}
+
+// lastServedKeys returns the CA keys last written to the pipe.
+func lastServedKeys() []string {
+	servedKeysMu.Lock()
+	defer servedKeysMu.Unlock()
+	return servedKeys
+}
+
+// currentKeys returns the CA keys currently defined in metadata.
+func currentKeys(ctx context.Context) ([]string, error) {
+	certificate, err := mdsClient.GetKey(ctx, "oslogin/certificates", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get certificate from metadata server: %w", err)
+	}
+
+	var certs Certificates
+	if err := json.Unmarshal([]byte(certificate), &certs); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal certificate json: %w", err)
+	}
+	return caKeys(certs), nil
+}
+
 // writeFile is an event handler callback and writes the actual sshca content to the pipe
 // used by openssh to grant access based on ssh ca.
 func writeFile(ctx context.Context, evType string, data interface{}, evData *events.EventData) bool {
@@ -76,26 +147,20 @@ func writeFile(ctx context.Context, evType string, data interface{}, evData *eve
 		pipeData.Finished()
 	}()
 
-	certificate, err := mdsClient.GetKey(ctx, "oslogin/certificates", nil)
+	keys, err := currentKeys(ctx)
 	if err != nil {
-		logger.Errorf("Failed to get certificate from metadata server: %+v", err)
-		return true
+		keys = lastServedKeys()
+		logger.Errorf("%v, serving the %d previously known CA keys", err, len(keys))
+	} else {
+		updateServedKeys(keys)
 	}
 
-	// Keep a copy of the returned certificate for error fallback caching.
-	var certs Certificates
-	var outData []string
-
-	if err := json.Unmarshal([]byte(certificate), &certs); err != nil {
-		logger.Errorf("Failed to unmarshal certificate json: %+v", err)
+	if len(keys) == 0 {
 		return true
 	}
 
-	for _, curr := range certs.Certs {
-		outData = append(outData, curr.PublicKey)
-	}
-
-	outStr := strings.Join(outData, "\n")
+	// One key per line, as expected by sshd's TrustedUserCAKeys.
+	outStr := strings.Join(keys, "\n") + "\n"
 	n, err := pipeData.File.WriteString(outStr)
 	if err != nil {
 		logger.Errorf("Failed to write certificate to the write end of the pipe: %+v", err)
@@ -103,7 +168,7 @@ func writeFile(ctx context.Context, evType string, data interface{}, evData *eve
 	}
 
 	if n != len(outStr) {
-		logger.Errorf("Wrote the wrong ammout of data, wrote %d bytes instead of %d bytes", n, len(certificate))
+		logger.Errorf("Wrote the wrong ammout of data, wrote %d bytes instead of %d bytes", n, len(outStr))
 	}
 
 	return true
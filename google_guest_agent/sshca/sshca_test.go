@@ -0,0 +1,152 @@
+// Copyright 2023 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sshca
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/events"
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/events/sshtrustedca"
+	"github.com/GoogleCloudPlatform/guest-agent/metadata"
+)
+
+// mdsTestClient is a fake metadata client serving the oslogin/certificates key.
+type mdsTestClient struct {
+	// keys are the CA public keys returned in the certificates response.
+	keys []string
+	// err makes GetKey fail if set.
+	err error
+}
+
+func (mds *mdsTestClient) Get(ctx context.Context) (*metadata.Descriptor, error) {
+	return nil, fmt.Errorf("Get() not yet implemented")
+}
+
+func (mds *mdsTestClient) GetKey(ctx context.Context, key string, headers map[string]string) (string, error) {
+	if mds.err != nil {
+		return "", mds.err
+	}
+	if key != "oslogin/certificates" {
+		return "", fmt.Errorf("unknown key %q", key)
+	}
+
+	var certs Certificates
+	for _, key := range mds.keys {
+		certs.Certs = append(certs.Certs, TrustedCert{PublicKey: key})
+	}
+	res, err := json.Marshal(certs)
+	return string(res), err
+}
+
+func (mds *mdsTestClient) GetKeyRecursive(ctx context.Context, key string) (string, error) {
+	return "", fmt.Errorf("GetKeyRecursive() not yet implemented")
+}
+
+func (mds *mdsTestClient) GetKeyRecursiveWithEtag(ctx context.Context, key string) (string, string, error) {
+	return "", "", fmt.Errorf("GetKeyRecursiveWithEtag() not yet implemented")
+}
+
+func (mds *mdsTestClient) Watch(ctx context.Context) (*metadata.Descriptor, error) {
+	return nil, fmt.Errorf("Watch() not yet implemented")
+}
+
+func (mds *mdsTestClient) WriteGuestAttributes(ctx context.Context, key string, value string) error {
+	return fmt.Errorf("WriteGuestAttributes() not yet implemented")
+}
+
+func (mds *mdsTestClient) WriteGuestAttributesBatch(ctx context.Context, attrs map[string]string) error {
+	return fmt.Errorf("WriteGuestAttributesBatch() not yet implemented")
+}
+
+func (mds *mdsTestClient) DeleteGuestAttribute(ctx context.Context, key string) error {
+	return fmt.Errorf("DeleteGuestAttribute() not yet implemented")
+}
+
+// readPipe runs writeFile against a regular file standing in for the pipe and
+// returns what was written.
+func readPipe(t *testing.T) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "pipe")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("os.Create(%s) failed unexpectedly with error: %v", path, err)
+	}
+
+	evData := &events.EventData{Data: &sshtrustedca.PipeData{File: f, Finished: func() {}}}
+	if !writeFile(context.Background(), sshtrustedca.ReadEvent, nil, evData) {
+		t.Fatalf("writeFile() = false, want true")
+	}
+
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("os.ReadFile(%s) failed unexpectedly with error: %v", path, err)
+	}
+	return string(got)
+}
+
+func TestWriteFileRotation(t *testing.T) {
+	mds := &mdsTestClient{}
+	mdsClient = mds
+	t.Cleanup(func() {
+		mdsClient = nil
+		servedKeys = nil
+	})
+
+	tests := []struct {
+		name string
+		keys []string
+		err  error
+		want string
+	}{
+		{
+			name: "single_ca",
+			keys: []string{"ssh-ed25519 AAAAold"},
+			want: "ssh-ed25519 AAAAold\n",
+		},
+		{
+			name: "new_ca_introduced",
+			keys: []string{"ssh-ed25519 AAAAold", "ssh-ed25519 AAAAnew", "ssh-ed25519 AAAAold", " "},
+			want: "ssh-ed25519 AAAAold\nssh-ed25519 AAAAnew\n",
+		},
+		{
+			name: "metadata_unavailable",
+			err:  fmt.Errorf("metadata server unavailable"),
+			want: "ssh-ed25519 AAAAold\nssh-ed25519 AAAAnew\n",
+		},
+		{
+			name: "old_ca_retired",
+			keys: []string{"ssh-ed25519 AAAAnew"},
+			want: "ssh-ed25519 AAAAnew\n",
+		},
+		{
+			name: "all_retired",
+			want: "",
+		},
+	}
+
+	// The cases run in order, each one updating the set defined in metadata.
+	for _, tc := range tests {
+		mds.keys, mds.err = tc.keys, tc.err
+		if got := readPipe(t); got != tc.want {
+			t.Errorf("%s: writeFile() wrote %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
@@ -28,6 +28,10 @@ func resetPwd(username, pwd string) error {
 	return nil
 }
 
+func osMinPasswordLength() (int, error) {
+	return 0, nil
+}
+
 func readRegMultiString(key, name string) ([]string, error) {
 	return nil, nil
 }
@@ -0,0 +1,143 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+)
+
+const (
+	// sdNotifyReady is the sd_notify message reporting service readiness.
+	sdNotifyReady = "READY=1"
+	// sdNotifyWatchdog is the sd_notify message keeping the watchdog alive.
+	sdNotifyWatchdog = "WATCHDOG=1"
+)
+
+var (
+	// getenv points to the function reading environment variables.
+	getenv = os.Getenv
+
+	// sdNotify points to the function sending notification messages to systemd.
+	sdNotify = sdNotifySocket
+)
+
+// sdNotifySocket sends state to systemd's notification socket defined by the
+// NOTIFY_SOCKET environment variable. It's a no-op if NOTIFY_SOCKET is not set,
+// i.e. we are not running as a systemd service of Type=notify.
+func sdNotifySocket(state string) error {
+	socket := getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+
+	// Abstract namespace sockets are referred with a leading "@".
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("failed to connect to notify socket %q: %w", socket, err)
+	}
+	defer closer(conn)
+
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return fmt.Errorf("failed to write %q to notify socket %q: %w", state, socket, err)
+	}
+	return nil
+}
+
+// watchdogInterval returns the watchdog ping interval, half of the timeout set
+// by systemd in WATCHDOG_USEC. If WATCHDOG_PID is set it must match our pid. A
+// zero interval is returned if the watchdog is not enabled for us.
+func watchdogInterval() (time.Duration, error) {
+	usecStr := getenv("WATCHDOG_USEC")
+	if usecStr == "" {
+		return 0, nil
+	}
+
+	if pidStr := getenv("WATCHDOG_PID"); pidStr != "" {
+		pid, err := strconv.Atoi(pidStr)
+		if err != nil {
+			return 0, fmt.Errorf("invalid WATCHDOG_PID %q: %w", pidStr, err)
+		}
+		if pid != os.Getpid() {
+			return 0, nil
+		}
+	}
+
+	usec, err := strconv.ParseInt(usecStr, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid WATCHDOG_USEC %q: %w", usecStr, err)
+	}
+	if usec <= 0 {
+		return 0, fmt.Errorf("invalid WATCHDOG_USEC %q, must be positive", usecStr)
+	}
+
+	return time.Duration(usec) * time.Microsecond / 2, nil
+}
+
+// notifySystemdReady notifies systemd the agent is ready and starts the watchdog
+// pings if the watchdog is enabled. Pings are only sent while healthy() returns
+// true so a wedged agent gets restarted, and stop when ctx is done.
+func notifySystemdReady(ctx context.Context, healthy func() bool) {
+	if err := sdNotify(sdNotifyReady); err != nil {
+		logger.Warningf("Failed to notify systemd readiness: %v", err)
+	}
+
+	interval, err := watchdogInterval()
+	if err != nil {
+		logger.Errorf("Failed to determine systemd watchdog interval: %v", err)
+		return
+	}
+
+	if interval == 0 {
+		logger.Debugf("Systemd watchdog not enabled, skipping watchdog pings")
+		return
+	}
+
+	logger.Infof("Systemd watchdog enabled, pinging every %s", interval)
+	go runWatchdog(ctx, interval, healthy)
+}
+
+// runWatchdog sends a watchdog ping every interval while healthy() returns true,
+// until ctx is done.
+func runWatchdog(ctx context.Context, interval time.Duration, healthy func() bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			logger.Debugf("Context done, stopping systemd watchdog pings")
+			return
+		case <-ticker.C:
+			if !healthy() {
+				logger.Warningf("Agent is not healthy, skipping systemd watchdog ping")
+				continue
+			}
+			if err := sdNotify(sdNotifyWatchdog); err != nil {
+				logger.Warningf("Failed to ping systemd watchdog: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,191 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockGetenv overrides getenv with env for the duration of the test.
+func mockGetenv(t *testing.T, env map[string]string) {
+	t.Helper()
+	orig := getenv
+	t.Cleanup(func() { getenv = orig })
+	getenv = func(key string) string { return env[key] }
+}
+
+func TestSdNotifySocket(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("unix datagram sockets are not supported on windows")
+	}
+
+	socket := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("net.ListenUnixgram(%q) failed unexpectedly with error: %v", socket, err)
+	}
+	defer conn.Close()
+
+	mockGetenv(t, map[string]string{"NOTIFY_SOCKET": socket})
+
+	if err := sdNotifySocket(sdNotifyReady); err != nil {
+		t.Fatalf("sdNotifySocket(%q) failed unexpectedly with error: %v", sdNotifyReady, err)
+	}
+
+	buf := make([]byte, 64)
+	if err := conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatalf("SetReadDeadline() failed unexpectedly with error: %v", err)
+	}
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("conn.Read() failed unexpectedly with error: %v", err)
+	}
+	if got := string(buf[:n]); got != sdNotifyReady {
+		t.Errorf("sdNotifySocket(%q) sent %q, want %q", sdNotifyReady, got, sdNotifyReady)
+	}
+}
+
+func TestSdNotifySocketNoSocket(t *testing.T) {
+	mockGetenv(t, nil)
+
+	if err := sdNotifySocket(sdNotifyReady); err != nil {
+		t.Errorf("sdNotifySocket(%q) with no NOTIFY_SOCKET = %v, want nil", sdNotifyReady, err)
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	pid := fmt.Sprintf("%d", os.Getpid())
+
+	tests := []struct {
+		name    string
+		env     map[string]string
+		want    time.Duration
+		wantErr bool
+	}{
+		{
+			name: "disabled",
+			env:  map[string]string{},
+		},
+		{
+			name: "enabled",
+			env:  map[string]string{"WATCHDOG_USEC": "30000000"},
+			want: 15 * time.Second,
+		},
+		{
+			name: "matching_pid",
+			env:  map[string]string{"WATCHDOG_USEC": "2000000", "WATCHDOG_PID": pid},
+			want: time.Second,
+		},
+		{
+			name: "other_pid",
+			env:  map[string]string{"WATCHDOG_USEC": "2000000", "WATCHDOG_PID": "1"},
+		},
+		{
+			name:    "invalid_usec",
+			env:     map[string]string{"WATCHDOG_USEC": "abc"},
+			wantErr: true,
+		},
+		{
+			name:    "negative_usec",
+			env:     map[string]string{"WATCHDOG_USEC": "-1"},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			mockGetenv(t, tc.env)
+
+			got, err := watchdogInterval()
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("watchdogInterval() = %v, want error: %t", err, tc.wantErr)
+			}
+			if got != tc.want {
+				t.Errorf("watchdogInterval() = %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRunWatchdog(t *testing.T) {
+	var mu sync.Mutex
+	var sent []string
+
+	orig := sdNotify
+	t.Cleanup(func() { sdNotify = orig })
+	sdNotify = func(state string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		sent = append(sent, state)
+		return nil
+	}
+
+	healthy := true
+	var healthyMu sync.Mutex
+	isHealthy := func() bool {
+		healthyMu.Lock()
+		defer healthyMu.Unlock()
+		return healthy
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		runWatchdog(ctx, 10*time.Millisecond, isHealthy)
+		close(done)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	healthyMu.Lock()
+	healthy = false
+	healthyMu.Unlock()
+
+	mu.Lock()
+	pings := len(sent)
+	mu.Unlock()
+
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("runWatchdog() didn't return after context cancellation")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if pings == 0 {
+		t.Errorf("runWatchdog() sent no pings while healthy, want at least one")
+	}
+	// Allow for a tick racing with the health flip.
+	if len(sent) > pings+1 {
+		t.Errorf("runWatchdog() sent %d pings after becoming unhealthy, want at most 1", len(sent)-pings)
+	}
+	for _, s := range sent {
+		if s != sdNotifyWatchdog {
+			t.Errorf("runWatchdog() sent %q, want %q", s, sdNotifyWatchdog)
+		}
+	}
+}
@@ -18,12 +18,14 @@ import (
 	"context"
 	"encoding/base64"
 	"runtime"
+	"strings"
 	"time"
 
 	"github.com/GoogleCloudPlatform/guest-agent/metadata"
 	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
 	"google.golang.org/protobuf/proto"
 
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
 	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/osinfo"
 	tpb "github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/telemetry/proto"
 )
@@ -33,6 +35,33 @@ var (
 	telemetryInterval = 24 * time.Hour
 )
 
+// Names of the telemetry fields as referred by the Telemetry's omit_fields
+// configuration key.
+const (
+	fieldAgentName     = "agent_name"
+	fieldAgentVersion  = "agent_version"
+	fieldAgentArch     = "agent_arch"
+	fieldOS            = "os"
+	fieldLongName      = "os_long_name"
+	fieldShortName     = "os_short_name"
+	fieldVersion       = "os_version"
+	fieldKernelRelease = "kernel_release"
+	fieldKernelVersion = "kernel_version"
+)
+
+// knownFields is the set of all the telemetry fields.
+var knownFields = map[string]bool{
+	fieldAgentName:     true,
+	fieldAgentVersion:  true,
+	fieldAgentArch:     true,
+	fieldOS:            true,
+	fieldLongName:      true,
+	fieldShortName:     true,
+	fieldVersion:       true,
+	fieldKernelRelease: true,
+	fieldKernelVersion: true,
+}
+
 // Data is telemetry data on the current agent and OS.
 type Data struct {
 	// Name of the agent.
@@ -54,13 +83,25 @@ type Data struct {
 	KernelRelease string
 	// Kernel Version.
 	KernelVersion string
+
+	// Omit is the set of fields, by their configuration name, left out of
+	// the reported telemetry.
+	Omit map[string]bool
+}
+
+// field returns value or nil if the field name is omitted.
+func (d Data) field(name string, value *string) *string {
+	if d.Omit[name] {
+		return nil
+	}
+	return value
 }
 
 func formatGuestAgent(d Data) string {
 	data, err := proto.Marshal(&tpb.AgentInfo{
-		Name:         &d.AgentName,
-		Version:      &d.AgentVersion,
-		Architecture: &d.AgentArch,
+		Name:         d.field(fieldAgentName, &d.AgentName),
+		Version:      d.field(fieldAgentVersion, &d.AgentVersion),
+		Architecture: d.field(fieldAgentArch, &d.AgentArch),
 	})
 	if err != nil {
 		logger.Warningf("Error marshalling AgentInfo: %v", err)
@@ -70,12 +111,12 @@ func formatGuestAgent(d Data) string {
 
 func formatGuestOS(d Data) string {
 	data, err := proto.Marshal(&tpb.OSInfo{
-		OsType:        &d.OS,
-		LongName:      &d.LongName,
-		ShortName:     &d.ShortName,
-		Version:       &d.Version,
-		KernelVersion: &d.KernelVersion,
-		KernelRelease: &d.KernelRelease,
+		OsType:        d.field(fieldOS, &d.OS),
+		LongName:      d.field(fieldLongName, &d.LongName),
+		ShortName:     d.field(fieldShortName, &d.ShortName),
+		Version:       d.field(fieldVersion, &d.Version),
+		KernelVersion: d.field(fieldKernelVersion, &d.KernelVersion),
+		KernelRelease: d.field(fieldKernelRelease, &d.KernelRelease),
 	})
 	if err != nil {
 		logger.Warningf("Error marshalling AgentInfo: %v", err)
@@ -100,17 +141,45 @@ type Job struct {
 	client       metadata.MDSClientInterface
 	programName  string
 	agentVersion string
+	omit         map[string]bool
 }
 
-// New initializes a new TelemetryJob.
+// New initializes a new TelemetryJob. Fields to be omitted from the reported
+// telemetry are read from the Telemetry configuration section.
 func New(client metadata.MDSClientInterface, programName, agentVersion string) *Job {
+	var omitFields string
+	if config := cfg.Get().Telemetry; config != nil {
+		omitFields = config.OmitFields
+	}
+
 	return &Job{
 		client:       client,
 		programName:  programName,
 		agentVersion: agentVersion,
+		omit:         parseOmitFields(omitFields),
 	}
 }
 
+// parseOmitFields parses the comma separated list of fields to omit, unknown
+// fields are logged and ignored.
+func parseOmitFields(fields string) map[string]bool {
+	res := make(map[string]bool)
+
+	for _, field := range strings.Split(fields, ",") {
+		field = strings.ToLower(strings.TrimSpace(field))
+		if field == "" {
+			continue
+		}
+		if !knownFields[field] {
+			logger.Warningf("Ignoring unknown telemetry field %q", field)
+			continue
+		}
+		res[field] = true
+	}
+
+	return res
+}
+
 // ID returns the ID for this job.
 func (j *Job) ID() string {
 	return telemetryJobID
@@ -129,6 +198,7 @@ func (j *Job) Run(ctx context.Context) (bool, error) {
 		Version:       osInfo.VersionID,
 		KernelRelease: osInfo.KernelRelease,
 		KernelVersion: osInfo.KernelVersion,
+		Omit:          j.omit,
 	}
 	if err := Record(ctx, j.client, d); err != nil {
 		// Log this here in Debug mode as telemetry is best effort.
@@ -16,9 +16,14 @@ package telemetry
 
 import (
 	"context"
+	"encoding/base64"
+	"reflect"
 	"testing"
 
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
 	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/fakes"
+	tpb "github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/telemetry/proto"
+	"google.golang.org/protobuf/proto"
 )
 
 type mdsClient struct {
@@ -61,5 +66,88 @@ func TestRecord(t *testing.T) {
 			t.Errorf("received headers does not contain all expected headers, want: %q, got: %q", want, got)
 		}
 	}
+}
+
+func TestParseOmitFields(t *testing.T) {
+	tests := []struct {
+		name   string
+		fields string
+		want   map[string]bool
+	}{
+		{"empty", "", map[string]bool{}},
+		{"single", "agent_version", map[string]bool{"agent_version": true}},
+		{"multiple", " agent_version, OS_Version ,,kernel_release", map[string]bool{"agent_version": true, "os_version": true, "kernel_release": true}},
+		{"unknown", "agent_version,unknown", map[string]bool{"agent_version": true}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := parseOmitFields(tc.fields); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("parseOmitFields(%q) = %v, want: %v", tc.fields, got, tc.want)
+			}
+		})
+	}
+}
+
+func unmarshalHeader(t *testing.T, header string, m proto.Message) {
+	t.Helper()
+
+	data, err := base64.StdEncoding.DecodeString(header)
+	if err != nil {
+		t.Fatalf("base64.StdEncoding.DecodeString(%q) failed unexpectedly with error: %v", header, err)
+	}
+	if err := proto.Unmarshal(data, m); err != nil {
+		t.Fatalf("proto.Unmarshal(%q) failed unexpectedly with error: %v", header, err)
+	}
+}
+
+func TestFormatOmitFields(t *testing.T) {
+	d := Data{
+		AgentName:     "AgentName",
+		AgentVersion:  "AgentVersion",
+		AgentArch:     "AgentArch",
+		OS:            "OS",
+		LongName:      "LongName",
+		ShortName:     "ShortName",
+		Version:       "Version",
+		KernelRelease: "KernelRelease",
+		KernelVersion: "KernelVersion",
+		Omit:          map[string]bool{fieldAgentVersion: true, fieldVersion: true, fieldKernelVersion: true},
+	}
 
+	agent := &tpb.AgentInfo{}
+	unmarshalHeader(t, formatGuestAgent(d), agent)
+	if agent.Version != nil {
+		t.Errorf("formatGuestAgent(%+v) reported agent version %q, want omitted", d, *agent.Version)
+	}
+	if agent.Name == nil || *agent.Name != d.AgentName {
+		t.Errorf("formatGuestAgent(%+v) reported agent name %v, want: %q", d, agent.Name, d.AgentName)
+	}
+
+	os := &tpb.OSInfo{}
+	unmarshalHeader(t, formatGuestOS(d), os)
+	if os.Version != nil || os.KernelVersion != nil {
+		t.Errorf("formatGuestOS(%+v) reported versions (%v, %v), want omitted", d, os.Version, os.KernelVersion)
+	}
+	if os.KernelRelease == nil || *os.KernelRelease != d.KernelRelease {
+		t.Errorf("formatGuestOS(%+v) reported kernel release %v, want: %q", d, os.KernelRelease, d.KernelRelease)
+	}
+}
+
+func TestNewOmitFields(t *testing.T) {
+	if err := cfg.Load(nil); err != nil {
+		t.Fatalf("cfg.Load(nil) failed unexpectedly with error: %v", err)
+	}
+	if job := New(&mdsClient{}, "program", "version"); len(job.omit) != 0 {
+		t.Errorf("New() with default config omits fields %v, want none", job.omit)
+	}
+
+	config := []byte("[Telemetry]\nomit_fields = agent_version,os_version")
+	if err := cfg.Load(config); err != nil {
+		t.Fatalf("cfg.Load(%s) failed unexpectedly with error: %v", config, err)
+	}
+	want := map[string]bool{fieldAgentVersion: true, fieldVersion: true}
+	if job := New(&mdsClient{}, "program", "version"); !reflect.DeepEqual(job.omit, want) {
+		t.Errorf("New() omits fields %v, want: %v", job.omit, want)
+	}
 }
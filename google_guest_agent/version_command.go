@@ -0,0 +1,55 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"runtime"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/command"
+	network "github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/network/manager"
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/osinfo"
+)
+
+// versionCommand is the command monitor command reporting the agent version and
+// the details of the environment it's running on.
+const versionCommand = "agent.version"
+
+// versionResponse is the response of the agent.version command.
+type versionResponse struct {
+	command.Response
+	// Version is the guest agent version.
+	Version string
+	// GoVersion is the Go runtime version the guest agent was built with.
+	GoVersion string
+	// Arch is the architecture the guest agent was built for.
+	Arch string
+	// OS is the detected operating system information.
+	OS osinfo.OSInfo
+	// NetworkManager is the network manager detected as managing the primary
+	// network interface, empty if not detected (yet).
+	NetworkManager string
+}
+
+// versionHandler handles the agent.version command.
+func versionHandler(_ []byte) ([]byte, error) {
+	return json.Marshal(versionResponse{
+		Version:        version,
+		GoVersion:      runtime.Version(),
+		Arch:           runtime.GOARCH,
+		OS:             osinfo.Get(),
+		NetworkManager: network.ActiveManager(),
+	})
+}
@@ -0,0 +1,50 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"runtime"
+	"testing"
+)
+
+func TestVersionHandler(t *testing.T) {
+	oldVersion := version
+	t.Cleanup(func() { version = oldVersion })
+	version = "20240101.00"
+
+	b, err := versionHandler(nil)
+	if err != nil {
+		t.Fatalf("versionHandler(nil) failed unexpectedly with error: %v", err)
+	}
+
+	var resp versionResponse
+	if err := json.Unmarshal(b, &resp); err != nil {
+		t.Fatalf("json.Unmarshal(%s) failed unexpectedly with error: %v", b, err)
+	}
+
+	if resp.Status != 0 {
+		t.Errorf("versionHandler(nil) returned status %d, want 0", resp.Status)
+	}
+	if resp.Version != version {
+		t.Errorf("versionHandler(nil) returned version %q, want %q", resp.Version, version)
+	}
+	if resp.GoVersion != runtime.Version() {
+		t.Errorf("versionHandler(nil) returned go version %q, want %q", resp.GoVersion, runtime.Version())
+	}
+	if resp.Arch != runtime.GOARCH {
+		t.Errorf("versionHandler(nil) returned arch %q, want %q", resp.Arch, runtime.GOARCH)
+	}
+}
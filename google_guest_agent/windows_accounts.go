@@ -46,24 +46,92 @@ var (
 	sshdRegKey    = `SYSTEM\CurrentControlSet\Services\sshd`
 )
 
+const (
+	// maxPwLgth is the maximum length of generated passwords.
+	maxPwLgth = 255
+)
+
+// pwdPolicy defines the generated passwords' minimum length and the number of
+// character classes they must contain.
+type pwdPolicy struct {
+	minLength int
+	classes   int
+}
+
+// defaultPwdPolicy meets Windows complexity requirements, passwords contain
+// characters from at least 3 of the 4 character classes.
+var defaultPwdPolicy = pwdPolicy{minLength: 15, classes: 3}
+
+// validate checks policy is achievable and meets the OS minimum password length.
+func (p pwdPolicy) validate(osMinLength int) error {
+	if p.classes < 1 || p.classes > 4 {
+		return fmt.Errorf("invalid number of character classes %d, must be between 1 and 4", p.classes)
+	}
+	if p.minLength < p.classes || p.minLength > maxPwLgth {
+		return fmt.Errorf("invalid password length %d, must be between %d and %d", p.minLength, p.classes, maxPwLgth)
+	}
+	if p.minLength < osMinLength {
+		return fmt.Errorf("password length %d is lower than the OS minimum %d", p.minLength, osMinLength)
+	}
+	return nil
+}
+
+// atLeast returns p with its minimum length raised to minLength if it's lower.
+func (p pwdPolicy) atLeast(minLength int) pwdPolicy {
+	if p.minLength < minLength {
+		p.minLength = minLength
+	}
+	return p
+}
+
+// getOSMinPasswordLength returns the OS minimum password length, replaceable by
+// unit tests.
+var getOSMinPasswordLength = osMinPasswordLength
+
+// configPwdPolicy returns the password policy defined in the Accounts configuration
+// section. Its minimum length is raised to the OS minimum password length if it's
+// lower. Invalid policies are logged and the default policy, raised likewise, is
+// returned.
+func configPwdPolicy() pwdPolicy {
+	config := cfg.Get().Accounts
+	policy := pwdPolicy{
+		minLength: config.WindowsPasswordLength,
+		classes:   config.WindowsPasswordCharacterClasses,
+	}
+
+	osMinLength, err := getOSMinPasswordLength()
+	if err != nil {
+		logger.Warningf("Failed to get OS minimum password length: %v", err)
+	}
+	if policy.minLength < osMinLength {
+		logger.Infof("Raising Windows password length %d to the OS minimum %d", policy.minLength, osMinLength)
+		policy = policy.atLeast(osMinLength)
+	}
+
+	if err := policy.validate(osMinLength); err != nil {
+		logger.Errorf("Invalid Windows password policy, using default: %v", err)
+		return defaultPwdPolicy.atLeast(osMinLength)
+	}
+	return policy
+}
+
 // newPwd will generate a random password that meets Windows complexity
-// requirements: https://technet.microsoft.com/en-us/library/cc786468.
+// requirements: https://technet.microsoft.com/en-us/library/cc786468,
+// or the stricter/looser number of character classes defined by policy.
 // Characters that are difficult for users to type on a command line (quotes,
 // non english characters) are not used.
-func newPwd(userPwLgth int) (string, error) {
+func newPwd(userPwLgth int, policy pwdPolicy) (string, error) {
 	var pwLgth int
-	minPwLgth := 15
-	maxPwLgth := 255
 	lower := []byte("abcdefghijklmnopqrstuvwxyz")
 	upper := []byte("ABCDEFGHIJKLMNOPQRSTUVWXYZ")
 	numbers := []byte("0123456789")
 	special := []byte(`~!@#$%^&*_-+=|\(){}[]:;<>,.?/`)
 	chars := bytes.Join([][]byte{lower, upper, numbers, special}, nil)
-	pwLgth = minPwLgth
-	if userPwLgth > minPwLgth {
+	pwLgth = policy.minLength
+	if userPwLgth > policy.minLength {
 		pwLgth = userPwLgth
 	}
-	if userPwLgth > maxPwLgth {
+	if pwLgth > maxPwLgth {
 		pwLgth = maxPwLgth
 	}
 
@@ -90,9 +158,9 @@ func newPwd(userPwLgth int) (string, error) {
 		if bytes.ContainsAny(special, string(b)) {
 			s = 1
 		}
-		// If the password does not meet Windows complexity requirements, try again.
+		// If the password does not meet the complexity requirements, try again.
 		// https://technet.microsoft.com/en-us/library/cc786468
-		if l+u+n+s >= 3 {
+		if l+u+n+s >= policy.classes {
 			return string(b), nil
 		}
 	}
@@ -118,7 +186,7 @@ func printCreds(creds *credsJSON) error {
 }
 
 func createOrResetPwd(ctx context.Context, k metadata.WindowsKey) (*credsJSON, error) {
-	pwd, err := newPwd(k.PasswordLength)
+	pwd, err := newPwd(k.PasswordLength, configPwdPolicy())
 	if err != nil {
 		return nil, fmt.Errorf("error creating password: %v", err)
 	}
@@ -148,7 +216,7 @@ func createOrResetPwd(ctx context.Context, k metadata.WindowsKey) (*credsJSON, e
 }
 
 func createSSHUser(ctx context.Context, user string) error {
-	pwd, err := newPwd(20)
+	pwd, err := newPwd(20, configPwdPolicy())
 	if err != nil {
 		return fmt.Errorf("error creating password: %v", err)
 	}
@@ -252,6 +320,11 @@ func (a *winAccountsMgr) Diff(ctx context.Context) (bool, error) {
 	return false, nil
 }
 
+// Name returns the manager's name, see winAccountsMgrName.
+func (a *winAccountsMgr) Name() string {
+	return winAccountsMgrName
+}
+
 func (a *winAccountsMgr) Timeout(ctx context.Context) (bool, error) {
 	return false, nil
 }
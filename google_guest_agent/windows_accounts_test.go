@@ -112,6 +112,91 @@ func TestAccountsDisabled(t *testing.T) {
 	}
 }
 
+func TestPwdPolicyValidate(t *testing.T) {
+	tests := []struct {
+		name        string
+		policy      pwdPolicy
+		osMinLength int
+		wantErr     bool
+	}{
+		{"default", defaultPwdPolicy, 0, false},
+		{"all_classes", pwdPolicy{minLength: 20, classes: 4}, 14, false},
+		{"no_classes", pwdPolicy{minLength: 20, classes: 0}, 0, true},
+		{"too_many_classes", pwdPolicy{minLength: 20, classes: 5}, 0, true},
+		{"shorter_than_classes", pwdPolicy{minLength: 2, classes: 3}, 0, true},
+		{"too_long", pwdPolicy{minLength: 256, classes: 3}, 0, true},
+		{"below_os_minimum", pwdPolicy{minLength: 12, classes: 3}, 14, true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.policy.validate(tc.osMinLength)
+			if (err != nil) != tc.wantErr {
+				t.Errorf("pwdPolicy(%+v).validate(%d) = %v, want error: %t", tc.policy, tc.osMinLength, err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestConfigPwdPolicy(t *testing.T) {
+	origOSMin := getOSMinPasswordLength
+	t.Cleanup(func() { getOSMinPasswordLength = origOSMin })
+
+	tests := []struct {
+		name        string
+		config      string
+		osMinLength int
+		want        pwdPolicy
+	}{
+		{"default", "", 0, defaultPwdPolicy},
+		{"custom", "[Accounts]\nwindows_password_length = 30\nwindows_password_character_classes = 4", 14, pwdPolicy{minLength: 30, classes: 4}},
+		{"invalid", "[Accounts]\nwindows_password_length = 30\nwindows_password_character_classes = 5", 0, defaultPwdPolicy},
+		{"below_os_minimum", "[Accounts]\nwindows_password_length = 12\nwindows_password_character_classes = 4", 14, pwdPolicy{minLength: 14, classes: 4}},
+		{"default_below_os_minimum", "", 20, pwdPolicy{minLength: 20, classes: defaultPwdPolicy.classes}},
+		{"invalid_below_os_minimum", "[Accounts]\nwindows_password_length = 30\nwindows_password_character_classes = 5", 20, pwdPolicy{minLength: 20, classes: defaultPwdPolicy.classes}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			getOSMinPasswordLength = func() (int, error) { return tc.osMinLength, nil }
+			reloadConfig(t, []byte(tc.config))
+			if got := configPwdPolicy(); got != tc.want {
+				t.Errorf("configPwdPolicy() = %+v, want: %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestNewPwdPolicy(t *testing.T) {
+	policy := pwdPolicy{minLength: 4, classes: 4}
+	for i := 0; i < 1000; i++ {
+		pwd, err := newPwd(0, policy)
+		if err != nil {
+			t.Fatalf("newPwd(0, %+v) failed unexpectedly with error: %v", policy, err)
+		}
+		if len(pwd) != policy.minLength {
+			t.Fatalf("newPwd(0, %+v) = %q, want %d characters", policy, pwd, policy.minLength)
+		}
+
+		var l, u, n, s int
+		for _, r := range pwd {
+			switch {
+			case unicode.IsLower(r):
+				l = 1
+			case unicode.IsUpper(r):
+				u = 1
+			case unicode.IsDigit(r):
+				n = 1
+			case unicode.IsPunct(r) || unicode.IsSymbol(r):
+				s = 1
+			}
+		}
+		if l+u+n+s != 4 {
+			t.Fatalf("newPwd(0, %+v) = %q, want characters from all 4 classes", policy, pwd)
+		}
+	}
+}
+
 // Test takes ~43 sec to complete and is resource intensive.
 func TestNewPwd(t *testing.T) {
 	minPasswordLength := 15
@@ -133,7 +218,7 @@ func TestNewPwd(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			for i := 0; i < 100000; i++ {
-				pwd, err := newPwd(tt.passwordLength)
+				pwd, err := newPwd(tt.passwordLength, defaultPwdPolicy)
 				if err != nil {
 					t.Fatal(err)
 				}
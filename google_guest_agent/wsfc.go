@@ -17,6 +17,7 @@ package main
 import (
 	"context"
 	"net"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -25,7 +26,11 @@ import (
 	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
 )
 
-const wsfcDefaultAgentPort = "59998"
+const (
+	wsfcDefaultAgentPort = "59998"
+	// wsfcMaxAgentPort is the highest valid wsfc agent port.
+	wsfcMaxAgentPort = 65535
+)
 
 type agentState int
 
@@ -81,10 +86,22 @@ func newWsfcManager() *wsfcManager {
 	} else if newMetadata.Instance.Attributes.WSFCAgentPort != "" {
 		newPort = newMetadata.Instance.Attributes.WSFCAgentPort
 	} else if newMetadata.Project.Attributes.WSFCAgentPort != "" {
-		newPort = newMetadata.Instance.Attributes.WSFCAgentPort
+		newPort = newMetadata.Project.Attributes.WSFCAgentPort
+	}
+
+	agent := getWsfcAgentInstance()
+	if !validWsfcPort(newPort) {
+		logger.Errorf("Invalid wsfc agent port %q, keeping port %s", newPort, agent.getPort())
+		newPort = agent.getPort()
 	}
 
-	return &wsfcManager{agentNewState: newState, agentNewPort: newPort, agent: getWsfcAgentInstance()}
+	return &wsfcManager{agentNewState: newState, agentNewPort: newPort, agent: agent}
+}
+
+// validWsfcPort returns true if port is a valid TCP port number.
+func validWsfcPort(port string) bool {
+	p, err := strconv.Atoi(port)
+	return err == nil && p > 0 && p <= wsfcMaxAgentPort
 }
 
 // Implement manager.diff()
@@ -99,13 +116,18 @@ func (m *wsfcManager) Disabled(ctx context.Context) (bool, error) {
 	return false, nil
 }
 
+// Name returns the manager's name, see wsfcManagerName.
+func (m *wsfcManager) Name() string {
+	return wsfcManagerName
+}
+
 func (m *wsfcManager) Timeout(ctx context.Context) (bool, error) {
 	return false, nil
 }
 
 // Diff will always be called before set. So in set, only two cases are possible:
 // - state changed: start or stop the wsfc agent accordingly
-// - port changed: restart the agent if it is running
+// - port changed: rebind the agent to the new port if it is running
 func (m *wsfcManager) Set(ctx context.Context) error {
 	m.agent.setPort(m.agentNewPort)
 
@@ -120,11 +142,7 @@ func (m *wsfcManager) Set(ctx context.Context) error {
 
 	// If port changed
 	if m.agent.getState() == running {
-		if err := m.agent.stop(); err != nil {
-			return err
-		}
-
-		return m.agent.run()
+		return m.agent.rebind()
 	}
 
 	return nil
@@ -136,6 +154,7 @@ type healthAgent interface {
 	getPort() string
 	setPort(string)
 	run() error
+	rebind() error
 	stop() error
 }
 
@@ -189,6 +208,25 @@ func (a *wsfcAgent) run() error {
 	return nil
 }
 
+// Rebind a running agent to its current port. The new listener is started before
+// closing the previous one, and health check requests being handled are not
+// interrupted.
+func (a *wsfcAgent) rebind() error {
+	if a.getState() == stopped {
+		return a.run()
+	}
+
+	oldListener := a.listener
+	a.listener = nil
+	if err := a.run(); err != nil {
+		a.listener = oldListener
+		return err
+	}
+
+	logger.Infof("wsfc agent - closing listener of previous port.")
+	return oldListener.Close()
+}
+
 // Handle health check request.
 // The request payload is WSFC ip address.
 // Sendback 1 if ipaddress is found locally and 0 otherwise.
@@ -21,6 +21,7 @@ import (
 	"fmt"
 	"net"
 	"reflect"
+	"sync"
 	"testing"
 
 	"github.com/GoogleCloudPlatform/guest-agent/metadata"
@@ -60,6 +61,9 @@ func TestNewWsfcManager(t *testing.T) {
 		{"wsfc enabled", args{setEnableWSFC(testMetadata, mkptr(true))}, &wsfcManager{agentNewState: running, agentNewPort: wsfcDefaultAgentPort, agent: testAgent}},
 		{"wsfc addrs is set", args{setWSFCAddresses(testMetadata, "0.0.0.0")}, &wsfcManager{agentNewState: running, agentNewPort: wsfcDefaultAgentPort, agent: testAgent}},
 		{"wsfc port is set", args{setWSFCAgentPort(testMetadata, "1818")}, &wsfcManager{agentNewState: stopped, agentNewPort: "1818", agent: testAgent}},
+		{"wsfc project port is set", args{&metadata.Descriptor{Project: metadata.Project{Attributes: metadata.Attributes{WSFCAgentPort: "1819"}}}}, &wsfcManager{agentNewState: stopped, agentNewPort: "1819", agent: testAgent}},
+		{"wsfc port is not a number", args{setWSFCAgentPort(testMetadata, "port")}, &wsfcManager{agentNewState: stopped, agentNewPort: testAgent.getPort(), agent: testAgent}},
+		{"wsfc port out of range", args{setWSFCAgentPort(testMetadata, "65536")}, &wsfcManager{agentNewState: stopped, agentNewPort: testAgent.getPort(), agent: testAgent}},
 	}
 
 	for _, tt := range tests {
@@ -102,12 +106,13 @@ func TestWsfcManagerDiff(t *testing.T) {
 
 // Mock health agent for unit testing
 type mockAgent struct {
-	state       agentState
-	port        string
-	runError    bool
-	stopError   bool
-	runInvoked  bool
-	stopInvoked bool
+	state         agentState
+	port          string
+	runError      bool
+	stopError     bool
+	runInvoked    bool
+	stopInvoked   bool
+	rebindInvoked bool
 }
 
 func (a *mockAgent) getState() agentState {
@@ -132,6 +137,15 @@ func (a *mockAgent) run() error {
 	return nil
 }
 
+func (a *mockAgent) rebind() error {
+	a.rebindInvoked = true
+	if a.runError {
+		return errors.New("Rebind error")
+	}
+
+	return nil
+}
+
 func (a *mockAgent) stop() error {
 	a.stopInvoked = true
 	if a.stopError {
@@ -144,20 +158,20 @@ func (a *mockAgent) stop() error {
 
 func TestWsfcManagerSet(t *testing.T) {
 	tests := []struct {
-		name        string
-		m           *wsfcManager
-		wantErr     bool
-		runInvoked  bool
-		stopInvoked bool
+		name          string
+		m             *wsfcManager
+		wantErr       bool
+		runInvoked    bool
+		stopInvoked   bool
+		rebindInvoked bool
 	}{
-		{"set start agent", &wsfcManager{agentNewState: running, agent: &mockAgent{state: stopped}}, false, true, false},
-		{"set start agent error", &wsfcManager{agentNewState: running, agent: &mockAgent{state: stopped, runError: true}}, true, true, false},
-		{"set stop agent", &wsfcManager{agentNewState: stopped, agent: &mockAgent{state: running}}, false, false, true},
-		{"set stop agent error", &wsfcManager{agentNewState: stopped, agent: &mockAgent{state: running, stopError: true}}, true, false, true},
-		{"set restart agent", &wsfcManager{agentNewState: running, agentNewPort: "1", agent: &mockAgent{state: running, port: "0"}}, false, true, true},
-		{"set restart agent stop error", &wsfcManager{agentNewState: running, agentNewPort: "1", agent: &mockAgent{state: running, port: "0", stopError: true}}, true, false, true},
-		{"set restart agent start error", &wsfcManager{agentNewState: running, agentNewPort: "1", agent: &mockAgent{state: running, port: "0", runError: true}}, true, true, true},
-		{"set do nothing", &wsfcManager{agentNewState: stopped, agentNewPort: "1", agent: &mockAgent{state: stopped, port: "0"}}, false, false, false},
+		{"set start agent", &wsfcManager{agentNewState: running, agent: &mockAgent{state: stopped}}, false, true, false, false},
+		{"set start agent error", &wsfcManager{agentNewState: running, agent: &mockAgent{state: stopped, runError: true}}, true, true, false, false},
+		{"set stop agent", &wsfcManager{agentNewState: stopped, agent: &mockAgent{state: running}}, false, false, true, false},
+		{"set stop agent error", &wsfcManager{agentNewState: stopped, agent: &mockAgent{state: running, stopError: true}}, true, false, true, false},
+		{"set rebind agent", &wsfcManager{agentNewState: running, agentNewPort: "1", agent: &mockAgent{state: running, port: "0"}}, false, false, false, true},
+		{"set rebind agent error", &wsfcManager{agentNewState: running, agentNewPort: "1", agent: &mockAgent{state: running, port: "0", runError: true}}, true, false, false, true},
+		{"set do nothing", &wsfcManager{agentNewState: stopped, agentNewPort: "1", agent: &mockAgent{state: stopped, port: "0"}}, false, false, false, false},
 	}
 
 	ctx := context.Background()
@@ -177,6 +191,10 @@ func TestWsfcManagerSet(t *testing.T) {
 				t.Errorf("wsfcManager.set() stopInvoked = %v, want %v", gotStopInvoked, tt.stopInvoked)
 			}
 
+			if gotRebindInvoked := mAgent.rebindInvoked; gotRebindInvoked != tt.rebindInvoked {
+				t.Errorf("wsfcManager.set() rebindInvoked = %v, want %v", gotRebindInvoked, tt.rebindInvoked)
+			}
+
 			if tt.m.agentNewPort != mAgent.port {
 				t.Errorf("wsfcManager.set() does not set prot, agent port = %v, want %v", mAgent.port, tt.m.agentNewPort)
 			}
@@ -258,6 +276,66 @@ func TestWsfcRunAgentE2E(t *testing.T) {
 	}
 }
 
+func TestWsfcAgentRebindE2E(t *testing.T) {
+	agent := &wsfcAgent{port: "59996", waitGroup: &sync.WaitGroup{}}
+	if err := agent.run(); err != nil {
+		t.Fatalf("wsfcAgent.run() failed unexpectedly with error: %v", err)
+	}
+	defer agent.stop()
+
+	// Open a health check connection before rebinding, its request is only sent
+	// after the agent moved to the new port.
+	conn, err := net.Dial("tcp", "localhost:59996")
+	if err != nil {
+		t.Fatalf("net.Dial() failed unexpectedly with error: %v", err)
+	}
+	defer closer(conn)
+
+	// Connections are accepted in order, a round trip on a connection opened
+	// after conn guarantees conn was accepted before the old listener is closed.
+	invalidIP := "255.255.255.256"
+	if got, err := getHealthCheckResponce(invalidIP, agent); got != "0" {
+		t.Fatalf("health check on previous port = %q (%v), want %q", got, err, "0")
+	}
+
+	agent.setPort("59995")
+	if err := agent.rebind(); err != nil {
+		t.Fatalf("wsfcAgent.rebind() failed unexpectedly with error: %v", err)
+	}
+
+	fmt.Fprint(conn, invalidIP)
+	if got, err := bufio.NewReader(conn).ReadString('\n'); got != "0" {
+		t.Errorf("health check on connection opened before rebind = %q (%v), want %q", got, err, "0")
+	}
+
+	if got, err := getHealthCheckResponce(invalidIP, agent); got != "0" {
+		t.Errorf("health check on new port = %q (%v), want %q", got, err, "0")
+	}
+
+	if _, err := net.Dial("tcp", "localhost:59996"); err == nil {
+		t.Errorf("previous port still accepting connections after rebind")
+	}
+}
+
+func TestValidWsfcPort(t *testing.T) {
+	tests := map[string]bool{
+		"59998": true,
+		"1":     true,
+		"65535": true,
+		"0":     false,
+		"65536": false,
+		"-1":    false,
+		"port":  false,
+		"":      false,
+	}
+
+	for port, want := range tests {
+		if got := validWsfcPort(port); got != want {
+			t.Errorf("validWsfcPort(%q) = %t, want %t", port, got, want)
+		}
+	}
+}
+
 func TestInvokeRunOnRunningWsfcAgent(t *testing.T) {
 	agent := &wsfcAgent{listener: testListener}
 
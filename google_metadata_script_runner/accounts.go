@@ -0,0 +1,108 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/command"
+	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+)
+
+const (
+	// accountsReadyCommand is the guest agent command reporting whether users are provisioned.
+	accountsReadyCommand = "accounts.ready"
+	// defaultWaitForAccountsTimeout is used if the configured timeout is invalid.
+	defaultWaitForAccountsTimeout = 2 * time.Minute
+)
+
+var (
+	// sendCommand sends a request to the guest agent command monitor, overridden in tests.
+	sendCommand = command.SendCommand
+	// accountsPollInterval is the interval between accounts.ready requests.
+	accountsPollInterval = 2 * time.Second
+)
+
+// accountsReadyResponse is the guest agent response to the accounts.ready command.
+type accountsReadyResponse struct {
+	command.Response
+	Ready bool
+}
+
+// accountsReady asks the guest agent whether users have been provisioned.
+func accountsReady(ctx context.Context) (bool, error) {
+	req, err := json.Marshal(command.Request{Command: accountsReadyCommand})
+	if err != nil {
+		return false, fmt.Errorf("failed to marshal %s request: %+v", accountsReadyCommand, err)
+	}
+
+	var resp accountsReadyResponse
+	if err := json.Unmarshal(sendCommand(ctx, req), &resp); err != nil {
+		return false, fmt.Errorf("failed to unmarshal %s response: %+v", accountsReadyCommand, err)
+	}
+
+	if resp.Ready {
+		return true, nil
+	}
+
+	if resp.Status != 0 && resp.Status != 1 {
+		return false, fmt.Errorf("%s request failed with status %d: %s", accountsReadyCommand, resp.Status, resp.StatusMessage)
+	}
+
+	return false, nil
+}
+
+// waitForAccountsTimeout returns the configured wait for accounts timeout.
+func waitForAccountsTimeout() time.Duration {
+	timeout, err := time.ParseDuration(cfg.Get().MetadataScripts.WaitForAccountsTimeout)
+	if err != nil || timeout <= 0 {
+		logger.Warningf("Invalid wait_for_accounts_timeout %q, using default of %s",
+			cfg.Get().MetadataScripts.WaitForAccountsTimeout, defaultWaitForAccountsTimeout)
+		return defaultWaitForAccountsTimeout
+	}
+	return timeout
+}
+
+// waitForAccounts polls the guest agent until it reports users are provisioned or
+// timeout expires. It returns false if users could not be confirmed as provisioned,
+// callers are expected to proceed anyway.
+func waitForAccounts(ctx context.Context, timeout time.Duration) bool {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	ticker := time.NewTicker(accountsPollInterval)
+	defer ticker.Stop()
+
+	for {
+		ready, err := accountsReady(ctx)
+		if err != nil {
+			logger.Debugf("Users not confirmed as provisioned: %v", err)
+		}
+		if ready {
+			return true
+		}
+
+		select {
+		case <-ctx.Done():
+			logger.Warningf("Timed out after %s waiting for the guest agent to provision users, running scripts anyway", timeout)
+			return false
+		case <-ticker.C:
+		}
+	}
+}
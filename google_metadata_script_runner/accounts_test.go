@@ -0,0 +1,81 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/command"
+)
+
+func TestWaitForAccounts(t *testing.T) {
+	oldSend, oldInterval := sendCommand, accountsPollInterval
+	t.Cleanup(func() {
+		sendCommand = oldSend
+		accountsPollInterval = oldInterval
+	})
+	accountsPollInterval = time.Millisecond
+
+	notReady, _ := json.Marshal(accountsReadyResponse{Response: command.Response{Status: 1}})
+	ready, _ := json.Marshal(accountsReadyResponse{Ready: true})
+	connErr, _ := json.Marshal(command.ConnError)
+
+	tests := []struct {
+		name      string
+		responses [][]byte
+		want      bool
+	}{
+		{
+			name:      "ready",
+			responses: [][]byte{ready},
+			want:      true,
+		},
+		{
+			name:      "ready_after_polling",
+			responses: [][]byte{connErr, notReady, []byte("invalid"), ready},
+			want:      true,
+		},
+		{
+			name:      "never_ready",
+			responses: [][]byte{notReady},
+			want:      false,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			calls := 0
+			sendCommand = func(ctx context.Context, req []byte) []byte {
+				var r command.Request
+				if err := json.Unmarshal(req, &r); err != nil || r.Command != accountsReadyCommand {
+					t.Errorf("sendCommand(%s) got unexpected request, want command %q", req, accountsReadyCommand)
+				}
+				resp := tc.responses[len(tc.responses)-1]
+				if calls < len(tc.responses) {
+					resp = tc.responses[calls]
+				}
+				calls++
+				return resp
+			}
+
+			if got := waitForAccounts(context.Background(), 100*time.Millisecond); got != tc.want {
+				t.Errorf("waitForAccounts() = %t, want %t", got, tc.want)
+			}
+		})
+	}
+}
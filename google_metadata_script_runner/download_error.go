@@ -0,0 +1,61 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// downloadAttempt is a failed attempt to download a script from a source.
+type downloadAttempt struct {
+	// source describes where the download was attempted from and how, i.e.
+	// "authenticated GCS gs://bucket/object".
+	source string
+	// err is the error the attempt failed with.
+	err error
+}
+
+// downloadError is returned when a script could not be downloaded from any of
+// the sources tried, it reports every source with its individual failure.
+type downloadError struct {
+	// url is the script URL as defined in metadata.
+	url string
+	// attempts are the failed attempts, in the order they were made.
+	attempts []downloadAttempt
+}
+
+// add records a failed attempt.
+func (e *downloadError) add(source string, err error) {
+	e.attempts = append(e.attempts, downloadAttempt{source: source, err: err})
+}
+
+// Error implements the error interface.
+func (e *downloadError) Error() string {
+	var sources []string
+	for i, attempt := range e.attempts {
+		sources = append(sources, fmt.Sprintf("(%d) %s: %v", i+1, attempt.source, attempt.err))
+	}
+	return fmt.Sprintf("failed to download script %q from all %d sources: %s", e.url, len(e.attempts), strings.Join(sources, "; "))
+}
+
+// Unwrap returns the errors of all attempts.
+func (e *downloadError) Unwrap() []error {
+	var errs []error
+	for _, attempt := range e.attempts {
+		errs = append(errs, attempt.err)
+	}
+	return errs
+}
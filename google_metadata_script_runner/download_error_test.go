@@ -0,0 +1,48 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestDownloadError(t *testing.T) {
+	gcsErr := errors.New("storage: object doesn't exist")
+	httpErr := fmt.Errorf("GET %q, bad status: 404 Not Found", "https://storage.googleapis.com/bucket/object")
+
+	dlErr := &downloadError{url: "gs://bucket/object"}
+	dlErr.add("authenticated GCS gs://bucket/object", gcsErr)
+	dlErr.add("HTTP GET https://storage.googleapis.com/bucket/object", httpErr)
+
+	want := `failed to download script "gs://bucket/object" from all 2 sources: ` +
+		`(1) authenticated GCS gs://bucket/object: storage: object doesn't exist; ` +
+		`(2) HTTP GET https://storage.googleapis.com/bucket/object: GET "https://storage.googleapis.com/bucket/object", bad status: 404 Not Found`
+	if got := dlErr.Error(); got != want {
+		t.Errorf("downloadError.Error() = %q, want %q", got, want)
+	}
+
+	for _, err := range []error{gcsErr, httpErr} {
+		if !errors.Is(dlErr, err) {
+			t.Errorf("errors.Is(%v, %v) = false, want true", dlErr, err)
+		}
+	}
+
+	var target *downloadError
+	if !errors.As(fmt.Errorf("wrapped: %w", dlErr), &target) || len(target.attempts) != 2 {
+		t.Errorf("errors.As(wrapped error, *downloadError) did not return the download error with 2 attempts")
+	}
+}
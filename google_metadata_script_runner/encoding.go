@@ -0,0 +1,80 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const (
+	// encodingSuffix is appended to a script's metadata key to form the key of
+	// the attribute defining how the inline script is encoded, e.g.
+	// startup-script-encoding.
+	encodingSuffix = "-encoding"
+
+	// encodingBase64 is the encoding of base64 encoded inline scripts.
+	encodingBase64 = "base64"
+	// encodingGzipBase64 is the encoding of gzip compressed, then base64 encoded
+	// inline scripts.
+	encodingGzipBase64 = "gzip+base64"
+
+	// maxDecodedScriptSize is the maximum size of a decompressed inline script.
+	maxDecodedScriptSize = 32 << 20
+)
+
+// decodeScript decodes the inline script value according to encoding. An empty
+// encoding means the script is plain text and is returned as is.
+func decodeScript(value, encoding string) (string, error) {
+	encoding = strings.ToLower(strings.TrimSpace(encoding))
+	if encoding == "" {
+		return value, nil
+	}
+
+	if encoding != encodingBase64 && encoding != encodingGzipBase64 {
+		return "", fmt.Errorf("unsupported script encoding %q, supported encodings: %s, %s", encoding, encodingBase64, encodingGzipBase64)
+	}
+
+	data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+	if err != nil {
+		return "", fmt.Errorf("failed to base64 decode script: %v", err)
+	}
+
+	if encoding == encodingGzipBase64 {
+		reader, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return "", fmt.Errorf("failed to read gzip script: %v", err)
+		}
+		defer reader.Close()
+
+		data, err = io.ReadAll(io.LimitReader(reader, maxDecodedScriptSize+1))
+		if err != nil {
+			return "", fmt.Errorf("failed to decompress gzip script: %v", err)
+		}
+		if len(data) > maxDecodedScriptSize {
+			return "", fmt.Errorf("decompressed script exceeds the maximum size of %d bytes", maxDecodedScriptSize)
+		}
+	}
+
+	if len(bytes.TrimSpace(data)) == 0 {
+		return "", fmt.Errorf("decoded script is empty")
+	}
+
+	return string(data), nil
+}
@@ -0,0 +1,102 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"testing"
+)
+
+func gzipBase64(t *testing.T, data string) string {
+	t.Helper()
+
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write([]byte(data)); err != nil {
+		t.Fatalf("gzip Write() failed unexpectedly with error: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("gzip Close() failed unexpectedly with error: %v", err)
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes())
+}
+
+func TestDecodeScript(t *testing.T) {
+	script := "#!/bin/bash\necho hello\n"
+
+	tests := []struct {
+		name     string
+		value    string
+		encoding string
+		want     string
+		wantErr  bool
+	}{
+		{
+			name:  "plain",
+			value: script,
+			want:  script,
+		},
+		{
+			name:     "base64",
+			value:    base64.StdEncoding.EncodeToString([]byte(script)) + "\n",
+			encoding: "base64",
+			want:     script,
+		},
+		{
+			name:     "gzip_base64",
+			value:    gzipBase64(t, script),
+			encoding: " GZIP+BASE64 ",
+			want:     script,
+		},
+		{
+			name:     "invalid_base64",
+			value:    "not base64!",
+			encoding: "base64",
+			wantErr:  true,
+		},
+		{
+			name:     "not_gzip",
+			value:    base64.StdEncoding.EncodeToString([]byte(script)),
+			encoding: "gzip+base64",
+			wantErr:  true,
+		},
+		{
+			name:     "empty_decoded",
+			value:    gzipBase64(t, " \n"),
+			encoding: "gzip+base64",
+			wantErr:  true,
+		},
+		{
+			name:     "unsupported_encoding",
+			value:    script,
+			encoding: "zstd",
+			wantErr:  true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := decodeScript(tc.value, tc.encoding)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("decodeScript(%q, %q) = %v, want error: %t", tc.value, tc.encoding, err, tc.wantErr)
+			}
+			if got != tc.want {
+				t.Errorf("decodeScript(%q, %q) = %q, want %q", tc.value, tc.encoding, got, tc.want)
+			}
+		})
+	}
+}
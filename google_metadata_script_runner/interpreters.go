@@ -0,0 +1,136 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+)
+
+var (
+	// windowsScriptExtensions are the extensions Windows knows how to execute
+	// natively, or through powershell in the case of ps1.
+	windowsScriptExtensions = []string{"bat", "cmd", "ps1", "exe"}
+
+	// shebangExtensions maps the interpreters referred by a script's shebang line
+	// to the extension the script is given, if it can be run, see shebangExtension.
+	shebangExtensions = map[string]string{
+		"bash":       "sh",
+		"sh":         "sh",
+		"python":     "py",
+		"python3":    "py",
+		"pwsh":       "ps1",
+		"powershell": "ps1",
+	}
+)
+
+// scriptInterpreters parses the script_interpreters configuration, a comma
+// separated list of extension=command entries, into a map indexed by extension.
+func scriptInterpreters() map[string][]string {
+	res := make(map[string][]string)
+
+	for _, entry := range strings.Split(cfg.Get().MetadataScripts.ScriptInterpreters, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+
+		ext, command, found := strings.Cut(entry, "=")
+		ext = strings.TrimPrefix(strings.TrimSpace(ext), ".")
+		args := strings.Fields(command)
+		if !found || ext == "" || len(args) == 0 {
+			logger.Warningf("Ignoring invalid script_interpreters entry %q, expected format is extension=command", entry)
+			continue
+		}
+
+		res[ext] = args
+	}
+
+	return res
+}
+
+// scriptExtensions returns the extensions metadata scripts are recognized by on
+// Windows, the natively supported ones followed by the configured interpreters'.
+func scriptExtensions() []string {
+	var configured []string
+	for ext := range scriptInterpreters() {
+		configured = append(configured, ext)
+	}
+	sort.Strings(configured)
+
+	return append(append([]string{}, windowsScriptExtensions...), configured...)
+}
+
+// shebangExtension returns the extension mapped to the interpreter referred by
+// the shebang line of filePath, or an empty string if there's no known shebang.
+// Only ps1, run through powershell, and the extensions with a configured
+// interpreter are returned, i.e. "sh" requires a script_interpreters entry.
+func shebangExtension(filePath string) string {
+	f, err := os.Open(filePath)
+	if err != nil {
+		logger.Debugf("Failed to open %s for shebang detection: %v", filePath, err)
+		return ""
+	}
+	defer f.Close()
+
+	line, err := bufio.NewReader(f).ReadString('\n')
+	if err != nil && line == "" {
+		return ""
+	}
+
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, "#!") {
+		return ""
+	}
+
+	fields := strings.Fields(strings.TrimPrefix(line, "#!"))
+	if len(fields) == 0 {
+		return ""
+	}
+
+	// Handle "#!/usr/bin/env <interpreter>" shebangs.
+	interpreter := path.Base(strings.ReplaceAll(fields[0], "\\", "/"))
+	if interpreter == "env" && len(fields) > 1 {
+		interpreter = path.Base(fields[1])
+	}
+
+	ext := shebangExtensions[strings.TrimSuffix(strings.ToLower(interpreter), ".exe")]
+	if _, configured := scriptInterpreters()[ext]; ext != "ps1" && !configured {
+		if ext != "" {
+			logger.Debugf("No interpreter configured for %s scripts, ignoring %s shebang line", ext, filePath)
+		}
+		return ""
+	}
+	return ext
+}
+
+// windowsScriptSuffixes returns the metadata key suffixes of the inline scripts
+// run on Windows, the natively supported ones followed by the configured
+// interpreters' extensions.
+func windowsScriptSuffixes() []string {
+	suffixes := []string{"ps1", "cmd", "bat"}
+	for _, ext := range scriptExtensions() {
+		if !slices.Contains(windowsScriptExtensions, ext) {
+			suffixes = append(suffixes, ext)
+		}
+	}
+	return suffixes
+}
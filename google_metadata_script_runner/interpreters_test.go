@@ -0,0 +1,148 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestScriptInterpreters(t *testing.T) {
+	defer cfg.Load(nil)
+
+	config := "[MetadataScripts]\nscript_interpreters = py=python.exe -u, .sh = bash.exe,invalid,rb="
+	if err := cfg.Load([]byte(config)); err != nil {
+		t.Fatalf("cfg.Load(%s) failed unexpectedly with error: %v", config, err)
+	}
+
+	want := map[string][]string{
+		"py": {"python.exe", "-u"},
+		"sh": {"bash.exe"},
+	}
+	if diff := cmp.Diff(want, scriptInterpreters()); diff != "" {
+		t.Errorf("scriptInterpreters() returned unexpected diff (-want,+got):\n%s", diff)
+	}
+
+	wantExts := []string{"bat", "cmd", "ps1", "exe", "py", "sh"}
+	if diff := cmp.Diff(wantExts, scriptExtensions()); diff != "" {
+		t.Errorf("scriptExtensions() returned unexpected diff (-want,+got):\n%s", diff)
+	}
+
+	scriptURL := &url.URL{Path: "gs://gcs-bucket/script.py"}
+	if got := normalizeFilePathForWindows("C:/Temp/file", "windows-startup-script-url", scriptURL); got != "C:/Temp/file.py" {
+		t.Errorf("normalizeFilePathForWindows(%q, %q, %q) = %q, want %q", "C:/Temp/file", "windows-startup-script-url", scriptURL.Path, got, "C:/Temp/file.py")
+	}
+}
+
+func TestShebangExtension(t *testing.T) {
+	defer cfg.Load(nil)
+
+	config := "[MetadataScripts]\nscript_interpreters = py=python.exe, sh=bash.exe"
+	if err := cfg.Load([]byte(config)); err != nil {
+		t.Fatalf("cfg.Load(%s) failed unexpectedly with error: %v", config, err)
+	}
+
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{
+			name:    "python_env",
+			content: "#!/usr/bin/env python3\nprint('hello')\n",
+			want:    "py",
+		},
+		{
+			name:    "bash",
+			content: "#!/bin/bash -e\necho hello\n",
+			want:    "sh",
+		},
+		{
+			name:    "windows_path",
+			content: "#!C:\\PowerShell\\7\\pwsh.exe\r\nWrite-Host hello\r\n",
+			want:    "ps1",
+		},
+		{
+			name:    "unknown_interpreter",
+			content: "#!/usr/bin/perl\nprint 'hello';\n",
+		},
+		{
+			name:    "no_shebang",
+			content: "echo hello\n",
+		},
+		{
+			name: "empty",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			filePath := filepath.Join(t.TempDir(), "script")
+			if err := os.WriteFile(filePath, []byte(tc.content), 0644); err != nil {
+				t.Fatalf("os.WriteFile(%q) failed unexpectedly with error: %v", filePath, err)
+			}
+
+			if got := shebangExtension(filePath); got != tc.want {
+				t.Errorf("shebangExtension(%q) = %q, want %q", tc.content, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestShebangExtensionNoInterpreter(t *testing.T) {
+	if err := cfg.Load(nil); err != nil {
+		t.Fatalf("cfg.Load(nil) failed unexpectedly with error: %v", err)
+	}
+
+	filePath := filepath.Join(t.TempDir(), "script")
+	if err := os.WriteFile(filePath, []byte("#!/bin/bash\necho hello\n"), 0644); err != nil {
+		t.Fatalf("os.WriteFile(%q) failed unexpectedly with error: %v", filePath, err)
+	}
+
+	// Without a configured sh interpreter the script can't be run on Windows.
+	if got := shebangExtension(filePath); got != "" {
+		t.Errorf("shebangExtension(%q) = %q, want \"\"", filePath, got)
+	}
+}
+
+func TestGetWantedKeysInterpreters(t *testing.T) {
+	defer cfg.Load(nil)
+
+	config := "[MetadataScripts]\nscript_interpreters = py=python.exe, ps1=pwsh.exe"
+	if err := cfg.Load([]byte(config)); err != nil {
+		t.Fatalf("cfg.Load(%s) failed unexpectedly with error: %v", config, err)
+	}
+
+	want := []string{
+		"windows-startup-script-ps1",
+		"windows-startup-script-cmd",
+		"windows-startup-script-bat",
+		"windows-startup-script-py",
+		"windows-startup-script",
+		"windows-startup-script-url",
+	}
+	got, err := getWantedKeys([]string{"", "startup"}, "windows")
+	if err != nil {
+		t.Fatalf("getWantedKeys(startup, windows) failed unexpectedly with error: %v", err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("getWantedKeys(startup, windows) returned unexpected diff (-want,+got):\n%s", diff)
+	}
+}
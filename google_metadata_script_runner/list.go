@@ -0,0 +1,96 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+)
+
+// listFlag makes the script runner print the scripts it would run, and where
+// they would be fetched from, without running them.
+const listFlag = "--list"
+
+// parseListFlag returns args without a trailing listFlag and whether it was set.
+func parseListFlag(args []string) ([]string, bool) {
+	if len(args) == 3 && args[2] == listFlag {
+		return args[:2], true
+	}
+	return args, false
+}
+
+// hasServiceAccount returns true if the instance has a default service account
+// with a storage scope, i.e. GCS downloads can be authenticated.
+func hasServiceAccount(ctx context.Context) bool {
+	return checkStorageCredentials(ctx) == nil
+}
+
+// scriptSource describes where the script of metadataKey would be fetched from.
+func scriptSource(metadataKey, value string, authenticated bool) string {
+	if !strings.HasSuffix(metadataKey, "-url") {
+		return fmt.Sprintf("inline, %d bytes", len(value))
+	}
+
+	path := strings.TrimSpace(value)
+	if u, err := url.Parse(path); err == nil && u.Scheme == "file" {
+		local, err := localScriptPath(u)
+		if err != nil {
+			return fmt.Sprintf("invalid local file, %v", err)
+		}
+		return fmt.Sprintf("local file %s", local)
+	}
+	bucket, object := parseGCS(path)
+	if bucket == "" || object == "" {
+		return fmt.Sprintf("plain HTTP GET %s", path)
+	}
+	if authenticated {
+		return fmt.Sprintf("GCS authenticated, bucket %q object %q, falling back to GCS anonymous", bucket, object)
+	}
+	return fmt.Sprintf("GCS anonymous, https://%s/%s/%s", storageURL, bucket, object)
+}
+
+// printScripts writes to w the scripts found for action, in the order they
+// would run, without running them.
+func printScripts(w io.Writer, action string, wantedKeys []string, scripts map[string]string, authenticated bool) {
+	var found int
+	for _, key := range wantedKeys {
+		value, ok := scripts[key]
+		if !ok {
+			continue
+		}
+		if found == 0 {
+			fmt.Fprintf(w, "%s scripts that would run:\n", action)
+		}
+		found++
+		fmt.Fprintf(w, "  %s: %s\n", key, scriptSource(key, value, authenticated))
+	}
+
+	if found == 0 {
+		fmt.Fprintf(w, "No %s scripts to run.\n", action)
+	}
+}
+
+// listScripts prints the scripts found in metadata for action without running them.
+func listScripts(ctx context.Context, w io.Writer, action string, wantedKeys []string) error {
+	scripts, err := getExistingKeys(ctx, wantedKeys)
+	if err != nil {
+		return err
+	}
+	printScripts(w, action, wantedKeys, scripts, hasServiceAccount(ctx))
+	return nil
+}
@@ -0,0 +1,109 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseListFlag(t *testing.T) {
+	tests := []struct {
+		args     []string
+		wantArgs []string
+		wantList bool
+	}{
+		{args: []string{"runner", "startup"}, wantArgs: []string{"runner", "startup"}},
+		{args: []string{"runner", "startup", "--list"}, wantArgs: []string{"runner", "startup"}, wantList: true},
+		{args: []string{"runner", "startup", "--other"}, wantArgs: []string{"runner", "startup", "--other"}},
+	}
+
+	for _, tc := range tests {
+		args, list := parseListFlag(tc.args)
+		if diff := cmp.Diff(tc.wantArgs, args); diff != "" || list != tc.wantList {
+			t.Errorf("parseListFlag(%v) = (%v, %t), want (%v, %t)", tc.args, args, list, tc.wantArgs, tc.wantList)
+		}
+	}
+}
+
+func TestScriptSource(t *testing.T) {
+	tests := []struct {
+		name          string
+		key           string
+		value         string
+		authenticated bool
+		want          string
+	}{
+		{
+			name:  "inline",
+			key:   "startup-script",
+			value: "echo hi",
+			want:  "inline, 7 bytes",
+		},
+		{
+			name:          "gcs_authenticated",
+			key:           "startup-script-url",
+			value:         "gs://bucket/dir/script.sh",
+			authenticated: true,
+			want:          `GCS authenticated, bucket "bucket" object "dir/script.sh", falling back to GCS anonymous`,
+		},
+		{
+			name:  "gcs_anonymous",
+			key:   "startup-script-url",
+			value: " https://storage.googleapis.com/bucket/script.sh\n",
+			want:  "GCS anonymous, https://storage.googleapis.com/bucket/script.sh",
+		},
+		{
+			name:          "http",
+			key:           "startup-script-url",
+			value:         "https://example.com/script.sh",
+			authenticated: true,
+			want:          "plain HTTP GET https://example.com/script.sh",
+		},
+		{
+			name:  "local_file",
+			key:   "startup-script-url",
+			value: "file:///opt/scripts/startup.sh",
+			want:  "local file /opt/scripts/startup.sh",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := scriptSource(tc.key, tc.value, tc.authenticated); got != tc.want {
+				t.Errorf("scriptSource(%q, %q, %t) = %q, want %q", tc.key, tc.value, tc.authenticated, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestPrintScripts(t *testing.T) {
+	wantedKeys := []string{"startup-script", "startup-script-url"}
+
+	var buf bytes.Buffer
+	printScripts(&buf, "startup", wantedKeys, map[string]string{"startup-script-url": "https://example.com/s.sh", "startup-script": "ls"}, false)
+	want := "startup scripts that would run:\n  startup-script: inline, 2 bytes\n  startup-script-url: plain HTTP GET https://example.com/s.sh\n"
+	if got := buf.String(); got != want {
+		t.Errorf("printScripts() wrote %q, want %q", got, want)
+	}
+
+	buf.Reset()
+	printScripts(&buf, "startup", wantedKeys, nil, false)
+	if got, want := buf.String(), "No startup scripts to run.\n"; got != want {
+		t.Errorf("printScripts() wrote %q, want %q", got, want)
+	}
+}
@@ -21,7 +21,7 @@ package main
 import (
 	"bufio"
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -33,7 +33,10 @@ import (
 	"path/filepath"
 	"regexp"
 	"runtime"
+	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"cloud.google.com/go/storage"
@@ -42,6 +45,7 @@ import (
 	"github.com/GoogleCloudPlatform/guest-agent/retry"
 	"github.com/GoogleCloudPlatform/guest-agent/utils"
 	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+	"golang.org/x/oauth2/google"
 )
 
 const (
@@ -49,12 +53,17 @@ const (
 	bucket         = "([a-z0-9][-_.a-z0-9]*)"
 	object         = "(.+)"
 	defaultTimeout = 20 * time.Second
+	// maxRedirects is the maximum number of redirects followed downloading a script.
+	maxRedirects = 5
+	// truncatedMarker is appended to the script output lines cut to
+	// max_log_line_length.
+	truncatedMarker = "[truncated]"
 )
 
 var (
 	programName    = path.Base(os.Args[0])
 	powerShellArgs = []string{"-NoProfile", "-NoLogo", "-ExecutionPolicy", "Unrestricted", "-File"}
-	errUsage       = fmt.Errorf("no valid arguments specified. Specify one of \"startup\", \"shutdown\" or \"specialize\"")
+	errUsage       = fmt.Errorf("no valid arguments specified. Specify one of \"startup\", \"shutdown\" or \"specialize\", optionally followed by %q", listFlag)
 
 	// Many of the Google Storage URLs are supported below.
 	// It is preferred that customers specify their object using
@@ -89,7 +98,7 @@ var (
 )
 
 func init() {
-	client = metadata.New()
+	client = metadata.New(metadata.WithUserAgent(fmt.Sprintf("%s/%s", programName, version)))
 }
 
 func newStorageClient(ctx context.Context) (*storage.Client, error) {
@@ -99,6 +108,59 @@ func newStorageClient(ctx context.Context) (*storage.Client, error) {
 	return storage.NewClient(ctx)
 }
 
+// errNoStorageCredentials is wrapped by the errors of checkStorageCredentials when
+// the instance can't authenticate GCS downloads.
+var errNoStorageCredentials = errors.New("only public objects downloadable")
+
+// storageScopes are the service account scopes allowing to read GCS objects.
+var storageScopes = []string{
+	"https://www.googleapis.com/auth/cloud-platform",
+	"https://www.googleapis.com/auth/devstorage.full_control",
+	"https://www.googleapis.com/auth/devstorage.read_only",
+	"https://www.googleapis.com/auth/devstorage.read_write",
+}
+
+// findDefaultCredentials points to the function looking up the Application Default
+// Credentials, overridden in tests.
+var findDefaultCredentials = google.FindDefaultCredentials
+
+// checkStorageCredentials returns an error wrapping errNoStorageCredentials if no
+// Application Default Credentials are found, or if they are the instance's service
+// account and it has no storage scope. Credentials from a key file, i.e. set with
+// GOOGLE_APPLICATION_CREDENTIALS, are used as is. Other errors mean the credentials
+// couldn't be checked.
+func checkStorageCredentials(ctx context.Context) error {
+	creds, err := findDefaultCredentials(ctx, storageScopes...)
+	if err != nil {
+		return fmt.Errorf("no default credentials found: %v; %w", err, errNoStorageCredentials)
+	}
+	// Credentials read from a file carry their JSON, only the ones provided by
+	// the metadata server depend on the instance's scopes.
+	if len(creds.JSON) != 0 {
+		return nil
+	}
+
+	scopes, err := getMetadataKey(ctx, "/instance/service-accounts/default/scopes")
+	if metadata.IsNotFound(err) {
+		return fmt.Errorf("instance has no service account; %w", errNoStorageCredentials)
+	}
+	if err != nil {
+		return err
+	}
+	return checkStorageScopes(scopes)
+}
+
+// checkStorageScopes returns an error wrapping errNoStorageCredentials if none of
+// the newline separated scopes allows reading GCS objects.
+func checkStorageScopes(scopes string) error {
+	for _, scope := range strings.Fields(scopes) {
+		if slices.Contains(storageScopes, scope) {
+			return nil
+		}
+	}
+	return fmt.Errorf("instance service account lacks storage scope; %w", errNoStorageCredentials)
+}
+
 func downloadGSURL(ctx context.Context, bucket, object string, file *os.File) error {
 	client, err := newStorageClient(ctx)
 	if err != nil {
@@ -115,13 +177,72 @@ func downloadGSURL(ctx context.Context, bucket, object string, file *os.File) er
 	}
 	defer r.Close()
 
-	_, err = io.Copy(file, r)
-	return err
+	return copyScript(file, r)
+}
+
+// checkRedirect limits the redirects followed downloading a script: their number,
+// downgrades from https to http and, unless allowed by the configuration, redirects
+// to other hosts.
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= maxRedirects {
+		return fmt.Errorf("stopped after %d redirects", maxRedirects)
+	}
+	origin := via[0].URL
+	if origin.Scheme == "https" && req.URL.Scheme != "https" {
+		return fmt.Errorf("redirect from https to %s not allowed", req.URL.Scheme)
+	}
+	if !cfg.Get().MetadataScripts.CrossHostRedirects && req.URL.Host != origin.Host {
+		return fmt.Errorf("redirect from host %q to %q not allowed", origin.Host, req.URL.Host)
+	}
+	return nil
+}
+
+// copyScript copies the script read from src to dst, failing if it's larger than
+// the configured maximum script size.
+func copyScript(dst io.Writer, src io.Reader) error {
+	limit := cfg.Get().MetadataScripts.MaxScriptSize
+	if limit <= 0 {
+		_, err := io.Copy(dst, src)
+		return err
+	}
+
+	n, err := io.Copy(dst, io.LimitReader(src, limit+1))
+	if err != nil {
+		return err
+	}
+	if n > limit {
+		return fmt.Errorf("script is larger than max_script_size of %d bytes", limit)
+	}
+	return nil
+}
+
+// downloadTransport returns the transport scripts are downloaded with, going
+// through the configured download_proxy if set, the proxy from the environment
+// otherwise.
+func downloadTransport() http.RoundTripper {
+	proxy := cfg.Get().MetadataScripts.DownloadProxy
+	if proxy == "" {
+		return http.DefaultTransport
+	}
+
+	proxyURL, err := url.Parse(proxy)
+	if err != nil {
+		logger.Warningf("Invalid download_proxy %q, using the proxy from the environment: %v", proxy, err)
+		return http.DefaultTransport
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyURL(proxyURL)
+	return transport
 }
 
 func downloadURL(ctx context.Context, url string, file *os.File) error {
+	client := &http.Client{Transport: downloadTransport(), CheckRedirect: checkRedirect}
 	res, err := retry.RunWithResponse(ctx, defaultRetryPolicy, func() (*http.Response, error) {
-		res, err := http.Get(url)
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return nil, err
+		}
+		res, err := client.Do(req)
 		if err != nil {
 			return res, err
 		}
@@ -135,7 +256,24 @@ func downloadURL(ctx context.Context, url string, file *os.File) error {
 	}
 	defer res.Body.Close()
 
-	_, err = io.Copy(file, res.Body)
+	if limit := cfg.Get().MetadataScripts.MaxScriptSize; limit > 0 && res.ContentLength > limit {
+		return fmt.Errorf("script of %d bytes is larger than max_script_size of %d bytes", res.ContentLength, limit)
+	}
+	return copyScript(file, res.Body)
+}
+
+// lookupStorageHost resolves the storage host, only looking up IPv6 addresses if
+// the instance is configured to prefer IPv6. Each attempt is bounded so an
+// unreachable resolver doesn't block the download.
+func lookupStorageHost(ctx context.Context) error {
+	network := "ip"
+	if cfg.Get().MDS.PreferIPv6 {
+		network = "ip6"
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+	_, err := net.DefaultResolver.LookupIP(ctx, network, storageURL)
 	return err
 }
 
@@ -146,30 +284,42 @@ func downloadScript(ctx context.Context, path string, file *os.File) error {
 	// we get an error.
 	policy := retry.Policy{MaxAttempts: 20, BackoffFactor: 1, Jitter: time.Second * 5}
 	err := retry.Run(ctx, policy, func() error {
-		_, err := net.LookupHost(storageURL)
-		return err
+		return lookupStorageHost(ctx)
 	})
 	if err != nil {
 		return fmt.Errorf("%q lookup failed, err: %+v", storageURL, err)
 	}
 
+	dlErr := &downloadError{url: path}
+
 	bucket, object := parseGCS(path)
 	if bucket != "" && object != "" {
-		err = downloadGSURL(ctx, bucket, object, file)
+		// Only skip the authenticated download if the instance can't authenticate
+		// for sure, it's still attempted if the credentials couldn't be checked.
+		if err = checkStorageCredentials(ctx); !errors.Is(err, errNoStorageCredentials) {
+			err = downloadGSURL(ctx, bucket, object, file)
+		}
 		if err == nil {
 			logger.Debugf("Succesfull download using GSURL, bucket: %s, object: %s, file: %+v",
 				bucket, object, file)
 			return nil
 		}
 
-		logger.Infof("Failed to download object [%s] from GCS bucket [%s], err: %+v", object, bucket, err)
-
-		logger.Infof("Trying unauthenticated download")
+		dlErr.add(fmt.Sprintf("authenticated GCS gs://%s/%s", bucket, object), err)
+		if errors.Is(err, errNoStorageCredentials) {
+			logger.Warningf("Cannot download gs://%s/%s authenticated, trying unauthenticated download: %v", bucket, object, err)
+		} else {
+			logger.Debugf("Failed to download object [%s] from GCS bucket [%s], trying unauthenticated download, err: %+v", object, bucket, err)
+		}
 		path = fmt.Sprintf("https://%s/%s/%s", storageURL, bucket, object)
 	}
 
 	// Fall back to an HTTP GET of the URL.
-	return downloadURL(ctx, path, file)
+	if err := downloadURL(ctx, path, file); err != nil {
+		dlErr.add(fmt.Sprintf("HTTP GET %s", path), err)
+		return dlErr
+	}
+	return nil
 }
 
 func parseGCS(path string) (string, string) {
@@ -183,43 +333,24 @@ func parseGCS(path string) (string, string) {
 }
 
 func getMetadataKey(ctx context.Context, key string) (string, error) {
-	md, err := getMetadata(ctx, key, false)
+	md, err := client.GetKey(ctx, key, nil)
 	if err != nil {
-		return "", err
+		return "", fmt.Errorf("unable to get %q from MDS: %w", key, err)
 	}
-	return string(md), nil
+	return md, nil
 }
 
+// getMetadataAttributes returns the attributes map of key. If key doesn't exist
+// the returned error satisfies metadata.IsNotFound.
 func getMetadataAttributes(ctx context.Context, key string) (map[string]string, error) {
-	md, err := getMetadata(ctx, key, true)
-	if err != nil {
-		return nil, err
-	}
 	var att map[string]string
-	return att, json.Unmarshal(md, &att)
-}
-
-func getMetadata(ctx context.Context, key string, recurse bool) ([]byte, error) {
-	var resp string
-	var err error
-
-	if recurse {
-		resp, err = client.GetKeyRecursive(ctx, key)
-	} else {
-		resp, err = client.GetKey(ctx, key, nil)
-	}
-
-	if err != nil {
-		return nil, fmt.Errorf("unable to get %q from MDS, with recursive flag set to %t: %w", key, recurse, err)
-	}
-
-	return []byte(resp), nil
+	return att, metadata.GetKeyRecursiveInto(ctx, client, key, &att)
 }
 
 func normalizeFilePathForWindows(filePath string, metadataKey string, gcsScriptURL *url.URL) string {
 	// If either the metadataKey ends in one of these extensions OR if this is a url startup script and if the
 	// url path ends in one of these extensions, append the extension to the filePath name so that Windows can recognize it.
-	for _, ext := range []string{"bat", "cmd", "ps1", "exe"} {
+	for _, ext := range scriptExtensions() {
 		if strings.HasSuffix(metadataKey, "-"+ext) || (gcsScriptURL != nil && strings.HasSuffix(gcsScriptURL.Path, "."+ext)) {
 			filePath = fmt.Sprintf("%s.%s", filePath, ext)
 			break
@@ -228,14 +359,57 @@ func normalizeFilePathForWindows(filePath string, metadataKey string, gcsScriptU
 	return filePath
 }
 
+// localScriptPath returns the path of the local file referenced by the file://
+// URL scriptURL, used as is by the script runner, e.g. for air-gapped instances.
+func localScriptPath(scriptURL *url.URL) (string, error) {
+	if scriptURL.Host != "" && scriptURL.Host != "localhost" {
+		return "", fmt.Errorf("file URL %q must not have a remote host", scriptURL)
+	}
+
+	p := scriptURL.Path
+	// file:///C:/scripts/startup.ps1 has the /C:/scripts/startup.ps1 path.
+	if runtime.GOOS == "windows" && len(p) > 2 && p[0] == '/' && p[2] == ':' {
+		p = p[1:]
+	}
+	p = filepath.FromSlash(p)
+	if !filepath.IsAbs(p) {
+		return "", fmt.Errorf("file URL %q must have an absolute path", scriptURL)
+	}
+	return p, nil
+}
+
+// copyLocalScript copies the script referenced by the file:// URL scriptURL to file.
+func copyLocalScript(scriptURL *url.URL, file *os.File) error {
+	p, err := localScriptPath(scriptURL)
+	if err != nil {
+		return err
+	}
+
+	src, err := os.Open(p)
+	if err != nil {
+		return fmt.Errorf("error opening local script: %v", err)
+	}
+	defer src.Close()
+
+	if _, err := io.Copy(file, src); err != nil {
+		return fmt.Errorf("error copying local script %s: %v", p, err)
+	}
+	return nil
+}
+
 func writeScriptToFile(ctx context.Context, value string, filePath string, gcsScriptURL *url.URL) error {
-	// Create or download files.
+	// Create, copy or download files.
 	if gcsScriptURL != nil {
 		file, err := os.OpenFile(filePath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0755)
 		if err != nil {
 			return fmt.Errorf("error opening temp file: %v", err)
 		}
-		if err := downloadScript(ctx, value, file); err != nil {
+		if gcsScriptURL.Scheme == "file" {
+			err = copyLocalScript(gcsScriptURL, file)
+		} else {
+			err = downloadScript(ctx, value, file)
+		}
+		if err != nil {
 			file.Close()
 			return err
 		}
@@ -253,7 +427,7 @@ func writeScriptToFile(ctx context.Context, value string, filePath string, gcsSc
 	return nil
 }
 
-func setupAndRunScript(ctx context.Context, metadataKey string, value string) error {
+func setupAndRunScript(ctx context.Context, metadataKey string, value string, encoding string, runOnce bool) error {
 	// Make sure that the URL is valid for URL startup scripts
 	var gcsScriptURL *url.URL
 	if strings.HasSuffix(metadataKey, "-url") {
@@ -262,6 +436,12 @@ func setupAndRunScript(ctx context.Context, metadataKey string, value string) er
 		if err != nil {
 			return err
 		}
+	} else {
+		var err error
+		value, err = decodeScript(value, encoding)
+		if err != nil {
+			return fmt.Errorf("unable to decode %s: %v", metadataKey, err)
+		}
 	}
 
 	// Make temp directory.
@@ -280,25 +460,97 @@ func setupAndRunScript(ctx context.Context, metadataKey string, value string) er
 		return fmt.Errorf("unable to write script to file: %v", err)
 	}
 
-	return runScript(tmpFile, metadataKey)
+	// Windows can't execute a script without a known extension, try detecting it
+	// from the script's shebang line, for -url and bare inline scripts.
+	if runtime.GOOS == "windows" && filepath.Ext(tmpFile) == "" {
+		if ext := shebangExtension(tmpFile); ext != "" {
+			logger.Debugf("Detected %s script from %s shebang line", ext, metadataKey)
+			if err := os.Rename(tmpFile, tmpFile+"."+ext); err != nil {
+				return fmt.Errorf("unable to rename script file: %v", err)
+			}
+			tmpFile += "." + ext
+		} else if gcsScriptURL == nil {
+			return fmt.Errorf("unable to run %s, it has no extension nor a shebang line referring to a known interpreter", metadataKey)
+		}
+	}
+
+	// Run-once scripts are skipped if they already ran with the same content,
+	// changing the script runs it again.
+	var hash string
+	if runOnce {
+		if hash, err = scriptHash(tmpFile); err != nil {
+			return fmt.Errorf("unable to hash script: %v", err)
+		}
+		ran, err := alreadyRun(metadataKey, hash)
+		if err != nil {
+			logger.Warningf("Failed to read %s run-once record, running it: %v", metadataKey, err)
+		}
+		if ran {
+			return errAlreadyRun
+		}
+		if err := recordRun(metadataKey, hash); err != nil {
+			logger.Warningf("Failed to record %s ran, it will run again: %v", metadataKey, err)
+		}
+	}
+
+	return runScript(tmpFile, metadataKey, scriptTimeout(os.Args[1]))
+}
+
+// scriptTimeout returns the configured timeout of the scripts run by action,
+// zero if they're not limited.
+func scriptTimeout(action string) time.Duration {
+	var timeout string
+	switch action {
+	case "startup":
+		timeout = cfg.Get().MetadataScripts.StartupTimeout
+	case "shutdown":
+		timeout = cfg.Get().MetadataScripts.ShutdownTimeout
+	default:
+		return 0
+	}
+
+	if timeout == "" {
+		return 0
+	}
+	d, err := time.ParseDuration(timeout)
+	if err != nil || d < 0 {
+		logger.Warningf("Invalid %s_timeout %q, not limiting %s scripts", action, timeout, action)
+		return 0
+	}
+	return d
 }
 
-// Craft the command to run.
-func runScript(filePath string, metadataKey string) error {
+// Craft the command to run, killing it if it's still running after timeout,
+// unless it's zero.
+func runScript(filePath string, metadataKey string, timeout time.Duration) error {
 	var cmd *exec.Cmd
+	interpreter, hasInterpreter := scriptInterpreters()[strings.TrimPrefix(filepath.Ext(filePath), ".")]
 	if strings.HasSuffix(filePath, ".ps1") {
 		cmd = exec.Command("powershell.exe", append(powerShellArgs, filePath)...)
+	} else if hasInterpreter {
+		cmd = exec.Command(interpreter[0], append(interpreter[1:], filePath)...)
 	} else {
 		if runtime.GOOS == "windows" {
 			cmd = exec.Command(filePath)
 		} else {
-			cmd = exec.Command(cfg.Get().MetadataScripts.DefaultShell, "-c", filePath)
+			cmd = exec.Command(defaultShell, "-c", filePath)
 		}
 	}
-	return runCmd(cmd, metadataKey)
+
+	config := cfg.Get().MetadataScripts
+	if err := setScriptUser(cmd, filepath.Dir(filePath), config.RunAsUser, config.RunAsGroup); err != nil {
+		return err
+	}
+	return runCmdWithTimeout(cmd, metadataKey, timeout)
 }
 
 func runCmd(c *exec.Cmd, name string) error {
+	return runCmdWithTimeout(c, name, 0)
+}
+
+// runCmdWithTimeout runs c, logging its output as name's. If timeout is not zero
+// c and the processes it started are killed once it expires.
+func runCmdWithTimeout(c *exec.Cmd, name string, timeout time.Duration) error {
 	pr, pw, err := os.Pipe()
 	if err != nil {
 		return err
@@ -308,28 +560,80 @@ func runCmd(c *exec.Cmd, name string) error {
 	c.Stdout = pw
 	c.Stderr = pw
 
+	if timeout > 0 {
+		setProcessGroup(c)
+	}
+
 	if err := c.Start(); err != nil {
 		return err
 	}
 	pw.Close()
 
-	in := bufio.NewScanner(pr)
+	var killed atomic.Bool
+	if timeout > 0 {
+		timer := time.AfterFunc(timeout, func() {
+			killed.Store(true)
+			logger.Errorf("%s script still running after %s, killing it", name, timeout)
+			if err := killProcessGroup(c); err != nil {
+				logger.Errorf("Failed to kill %s script: %v", name, err)
+			}
+		})
+		defer timer.Stop()
+	}
+
+	in := bufio.NewReaderSize(pr, maxLogLineLength())
 	for {
-		if !in.Scan() {
-			if err := in.Err(); err != nil {
+		line, truncated, err := readLogLine(in)
+		if err != nil {
+			if err != io.EOF {
 				logger.Errorf("error while communicating with %q script: %v", name, err)
 			}
 			break
 		}
+		if truncated {
+			line += " " + truncatedMarker
+		}
 		logger.Log(logger.LogEntry{
-			Message:   fmt.Sprintf("%s: %s", name, in.Text()),
+			Message:   fmt.Sprintf("%s: %s", name, line),
 			CallDepth: 3,
 			Severity:  logger.Info,
 		})
 	}
 	pr.Close()
 
-	return c.Wait()
+	err = c.Wait()
+	if killed.Load() {
+		return fmt.Errorf("%s script killed after exceeding its %s timeout", name, timeout)
+	}
+	return err
+}
+
+// maxLogLineLength returns the configured maximum length of the script output
+// lines logged.
+func maxLogLineLength() int {
+	if n := cfg.Get().MetadataScripts.MaxLogLineLength; n > 0 {
+		return n
+	}
+	return bufio.MaxScanTokenSize
+}
+
+// readLogLine reads the next line of script output from r, without its line
+// ending. Lines longer than r's buffer are cut to its size, the rest of the line
+// is discarded and truncated is true.
+func readLogLine(r *bufio.Reader) (line string, truncated bool, err error) {
+	data, isPrefix, err := r.ReadLine()
+	if err != nil {
+		return "", false, err
+	}
+	line, truncated = string(data), isPrefix
+
+	for isPrefix {
+		if _, isPrefix, err = r.ReadLine(); err != nil {
+			// The output ended mid-line, the next read reports it.
+			break
+		}
+	}
+	return line, truncated, nil
 }
 
 // getWantedKeys returns the list of keys to check for a given type of script and OS.
@@ -368,20 +672,16 @@ func getWantedKeys(args []string, os string) ([]string, error) {
 	}
 
 	var mdkeys []string
-	var suffixes []string
 	if os == "windows" {
-		suffixes = []string{"ps1", "cmd", "bat", "url"}
-	} else {
-		suffixes = []string{"url"}
-		// The 'bare' startup-script or shutdown-script key, not supported on Windows.
-		mdkeys = append(mdkeys, fmt.Sprintf("%s-script", prefix))
-	}
-
-	for _, suffix := range suffixes {
-		mdkeys = append(mdkeys, fmt.Sprintf("%s-script-%s", prefix, suffix))
+		for _, suffix := range windowsScriptSuffixes() {
+			mdkeys = append(mdkeys, fmt.Sprintf("%s-script-%s", prefix, suffix))
+		}
 	}
+	// The 'bare' startup-script or shutdown-script key, on Windows it's only run
+	// if its shebang line refers to a known interpreter, see shebangExtension.
+	mdkeys = append(mdkeys, fmt.Sprintf("%s-script", prefix))
 
-	return mdkeys, nil
+	return append(mdkeys, fmt.Sprintf("%s-script-url", prefix)), nil
 }
 
 func parseMetadata(md map[string]string, wanted []string) map[string]string {
@@ -396,14 +696,29 @@ func parseMetadata(md map[string]string, wanted []string) map[string]string {
 	return found
 }
 
-// getExistingKeys returns the wanted keys that are set in metadata.
+// getExistingKeys returns the wanted keys that are set in metadata, along with
+// the <key>-encoding attribute of the found keys if set. An attributes source
+// missing in metadata is skipped.
 func getExistingKeys(ctx context.Context, wanted []string) (map[string]string, error) {
 	for _, attrs := range []string{"/instance/attributes", "/project/attributes"} {
 		md, err := getMetadataAttributes(ctx, attrs)
+		if metadata.IsNotFound(err) {
+			logger.Infof("No %s found in metadata, skipping.", attrs)
+			continue
+		}
 		if err != nil {
 			return nil, err
 		}
 		if found := parseMetadata(md, wanted); len(found) != 0 {
+			// Carry the encoding and run-once attributes of the scripts found in
+			// the same attributes.
+			for key := range found {
+				for _, suffix := range []string{encodingSuffix, runOnceSuffix} {
+					if value, ok := md[key+suffix]; ok && value != "" {
+						found[key+suffix] = value
+					}
+				}
+			}
 			return found, nil
 		}
 	}
@@ -437,17 +752,33 @@ func main() {
 		os.Exit(1)
 	}
 
+	if err := cfg.Get().ValidateSections("metadatascripts", "mds"); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid instance configuration: %+v", err)
+		os.Exit(1)
+	}
+	metadata.PreferIPv6(cfg.Get().MDS.PreferIPv6)
+
 	if !cfg.Get().Core.CloudLoggingEnabled {
 		opts.DisableCloudLogging = true
 	}
 
+	args, list := parseListFlag(os.Args)
+
 	// The keys to check vary based on the argument and the OS. Also functions to validate arguments.
-	wantedKeys, err := getWantedKeys(os.Args, runtime.GOOS)
+	wantedKeys, err := getWantedKeys(args, runtime.GOOS)
 	if err != nil {
 		fmt.Printf("%s\n", err.Error())
 		os.Exit(2)
 	}
 
+	if list {
+		if err := listScripts(ctx, os.Stdout, args[1], wantedKeys); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to list %s scripts: %v\n", args[1], err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	projectID, err := getMetadataKey(ctx, "/project/project-id")
 	if err == nil {
 		opts.ProjectName = projectID
@@ -461,30 +792,126 @@ func main() {
 	// Try flushing logs before exiting, if not flushed logs could go missing.
 	defer logger.Close()
 
+	if err := cfg.Get().Validate(); err != nil {
+		logger.Warningf("Ignoring invalid instance configuration unused by %s: %v", programName, err)
+	}
+
 	logger.Infof("Starting %s scripts (version %s).", os.Args[1], version)
 
-	scripts, err := getExistingKeys(ctx, wantedKeys)
+	if runtime.GOOS != "windows" {
+		if defaultShell, err = resolveDefaultShell(cfg.Get().MetadataScripts.DefaultShell, runtime.GOOS); err != nil {
+			logger.Errorf("Invalid MetadataScripts configuration, not running %s scripts: %v", os.Args[1], err)
+			os.Exit(1)
+		}
+	}
+
+	if os.Args[1] == "startup" && cfg.Get().MetadataScripts.WaitForAccounts {
+		logger.Infof("Waiting for the guest agent to provision users.")
+		if waitForAccounts(ctx, waitForAccountsTimeout()) {
+			logger.Infof("Users provisioned, proceeding with startup scripts.")
+		}
+	}
+
+	if os.Args[1] == "specialize" {
+		err = runSpecialize(ctx, specializeSteps(), func(ctx context.Context) error {
+			return runScripts(ctx, os.Args[1], wantedKeys)
+		})
+	} else {
+		err = runScripts(ctx, os.Args[1], wantedKeys)
+	}
 	if err != nil {
 		logger.Fatalf(err.Error())
 	}
 
+	logger.Infof("Finished running %s scripts.", os.Args[1])
+}
+
+// runScripts runs the wantedKeys scripts found in metadata, in order unless
+// script_concurrency allows running them concurrently. Individual script failures
+// are logged and don't prevent running the remaining scripts. A summary of the
+// run is written if configured.
+func runScripts(ctx context.Context, action string, wantedKeys []string) error {
+	summary := newRunSummary(action, wantedKeys)
+	defer writeRunSummary(ctx, summary)
+
+	scripts, err := getExistingKeys(ctx, wantedKeys)
+	if err != nil {
+		summary.Error = truncateError(err)
+		return err
+	}
+
 	if len(scripts) == 0 {
-		logger.Infof("No %s scripts to run.", os.Args[1])
-		return
+		logger.Infof("No %s scripts to run.", action)
+		return nil
 	}
 
+	var keys []string
 	for _, wantedKey := range wantedKeys {
-		value, ok := scripts[wantedKey]
-		if !ok {
-			continue
+		if _, ok := scripts[wantedKey]; ok {
+			keys = append(keys, wantedKey)
+			summary.result(wantedKey).Found = true
 		}
-		logger.Infof("Found %s in metadata.", wantedKey)
-		if err := setupAndRunScript(ctx, wantedKey, value); err != nil {
-			logger.Warningf("Script %q failed with error: %v", wantedKey, err)
-			continue
+	}
+
+	failed := runScriptKeys(keys, cfg.Get().MetadataScripts.ScriptConcurrency, func(key string) error {
+		logger.Infof("Found %s in metadata.", key)
+		start := time.Now()
+		runOnce := runOnceEnabled(action, scripts[key+runOnceSuffix])
+		err := setupAndRunScript(ctx, key, scripts[key], scripts[key+encodingSuffix], runOnce)
+		if errors.Is(err, errAlreadyRun) {
+			logger.Infof("Skipping %s, it already ran with the same content.", key)
+			summary.result(key).Skipped = true
+			return nil
 		}
-		logger.Infof("%s exit status 0", wantedKey)
+		summary.result(key).record(start, err)
+		if err != nil {
+			logger.Warningf("Script %q failed with error: %v", key, err)
+			return err
+		}
+		logger.Infof("%s exit status 0", key)
+		return nil
+	})
+
+	if len(failed) > 0 {
+		logger.Warningf("%d of %d %s scripts failed: %v", len(failed), len(keys), action, failed)
 	}
 
-	logger.Infof("Finished running %s scripts.", os.Args[1])
+	return nil
+}
+
+// runScriptKeys calls run for each of keys, running up to concurrency of them at
+// the same time. With a concurrency of 1 or less keys are run sequentially, in
+// order. The keys for which run failed are returned, in keys order.
+func runScriptKeys(keys []string, concurrency int, run func(key string) error) []string {
+	errs := make([]error, len(keys))
+
+	if concurrency <= 1 {
+		for i, key := range keys {
+			errs[i] = run(key)
+		}
+	} else {
+		var wg sync.WaitGroup
+		sem := make(chan struct{}, concurrency)
+
+		for i, key := range keys {
+			wg.Add(1)
+			sem <- struct{}{}
+			go func(i int, key string) {
+				defer func() {
+					<-sem
+					wg.Done()
+				}()
+				errs[i] = run(key)
+			}(i, key)
+		}
+		wg.Wait()
+	}
+
+	var failed []string
+	for i, err := range errs {
+		if err != nil {
+			failed = append(failed, keys[i])
+		}
+	}
+	return failed
 }
@@ -15,8 +15,11 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -24,12 +27,14 @@ import (
 	"path/filepath"
 	"reflect"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"cloud.google.com/go/storage"
 	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
 	"github.com/GoogleCloudPlatform/guest-agent/metadata"
+	"golang.org/x/oauth2/google"
 	"google.golang.org/api/option"
 )
 
@@ -53,6 +58,7 @@ func TestGetWantedArgs(t *testing.T) {
 				"sysprep-specialize-script-ps1",
 				"sysprep-specialize-script-cmd",
 				"sysprep-specialize-script-bat",
+				"sysprep-specialize-script",
 				"sysprep-specialize-script-url",
 			},
 		},
@@ -63,6 +69,7 @@ func TestGetWantedArgs(t *testing.T) {
 				"windows-startup-script-ps1",
 				"windows-startup-script-cmd",
 				"windows-startup-script-bat",
+				"windows-startup-script",
 				"windows-startup-script-url",
 			},
 		},
@@ -73,6 +80,7 @@ func TestGetWantedArgs(t *testing.T) {
 				"windows-shutdown-script-ps1",
 				"windows-shutdown-script-cmd",
 				"windows-shutdown-script-bat",
+				"windows-shutdown-script",
 				"windows-shutdown-script-url",
 			},
 		},
@@ -183,6 +191,10 @@ func (mds *mdsClient) GetKeyRecursive(ctx context.Context, key string) (string,
 	return `{"key1":"value1","key2":"value2"}`, nil
 }
 
+func (mds *mdsClient) GetKeyRecursiveWithEtag(ctx context.Context, key string) (string, string, error) {
+	return "", "", fmt.Errorf("GetKeyRecursiveWithEtag() not yet implemented")
+}
+
 func (mds *mdsClient) Watch(ctx context.Context) (*metadata.Descriptor, error) {
 	return nil, fmt.Errorf("Watch() not yet implemented")
 }
@@ -191,6 +203,14 @@ func (mds *mdsClient) WriteGuestAttributes(ctx context.Context, key string, valu
 	return fmt.Errorf("WriteGuestattributes() not yet implemented")
 }
 
+func (mds *mdsClient) WriteGuestAttributesBatch(ctx context.Context, attrs map[string]string) error {
+	return fmt.Errorf("WriteGuestAttributesBatch() not yet implemented")
+}
+
+func (mds *mdsClient) DeleteGuestAttribute(ctx context.Context, key string) error {
+	return fmt.Errorf("DeleteGuestAttribute() not yet implemented")
+}
+
 func TestGetMetadata(t *testing.T) {
 	ctx := context.Background()
 	client = &mdsClient{}
@@ -376,6 +396,288 @@ func TestDownloadURL(t *testing.T) {
 	}
 }
 
+func TestDownloadURLLimits(t *testing.T) {
+	ctx := context.Background()
+	defaultRetryPolicy.Jitter = time.Millisecond
+
+	config := cfg.Get().MetadataScripts
+	maxSize, crossHost := config.MaxScriptSize, config.CrossHostRedirects
+	t.Cleanup(func() {
+		config.MaxScriptSize, config.CrossHostRedirects = maxSize, crossHost
+	})
+	config.MaxScriptSize = 8
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/small":
+			fmt.Fprint(w, "small")
+		case "/large":
+			fmt.Fprint(w, "larger than 8 bytes")
+		case "/redirect":
+			http.Redirect(w, r, "/small", http.StatusFound)
+		case "/loop":
+			http.Redirect(w, r, "/loop", http.StatusFound)
+		case "/cross_host":
+			// The test server listens on 127.0.0.1, localhost is another host.
+			http.Redirect(w, r, strings.Replace("http://"+r.Host+"/small", "127.0.0.1", "localhost", 1), http.StatusFound)
+		}
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name      string
+		key       string
+		crossHost bool
+		want      string
+		wantErr   bool
+	}{
+		{
+			name: "within_size",
+			key:  "/small",
+			want: "small",
+		},
+		{
+			name:    "exceeds_size",
+			key:     "/large",
+			wantErr: true,
+		},
+		{
+			name: "same_host_redirect",
+			key:  "/redirect",
+			want: "small",
+		},
+		{
+			name:    "redirect_loop",
+			key:     "/loop",
+			wantErr: true,
+		},
+		{
+			name:    "cross_host_redirect_denied",
+			key:     "/cross_host",
+			wantErr: true,
+		},
+		{
+			name:      "cross_host_redirect_allowed",
+			key:       "/cross_host",
+			crossHost: true,
+			want:      "small",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.CrossHostRedirects = tt.crossHost
+			f, err := os.Create(filepath.Join(t.TempDir(), tt.name))
+			if err != nil {
+				t.Fatalf("Failed to setup test file: %v", err)
+			}
+			defer f.Close()
+
+			url := server.URL + tt.key
+			if err := downloadURL(ctx, url, f); (err != nil) != tt.wantErr {
+				t.Fatalf("downloadURL(ctx, %s, %s) error = [%v], wantErr %t", url, f.Name(), err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			got, err := os.ReadFile(f.Name())
+			if err != nil {
+				t.Fatalf("failed to read output file %q, with error: %v", f.Name(), err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("downloadURL(ctx, %s, %s) wrote = [%s], want [%s]", url, f.Name(), string(got), tt.want)
+			}
+		})
+	}
+}
+
+func TestDownloadURLProxy(t *testing.T) {
+	ctx := context.Background()
+	defaultRetryPolicy.Jitter = time.Millisecond
+
+	var proxied []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = append(proxied, r.URL.String())
+		fmt.Fprint(w, "proxied")
+	}))
+	defer proxy.Close()
+
+	config := cfg.Get().MetadataScripts
+	downloadProxy := config.DownloadProxy
+	t.Cleanup(func() {
+		config.DownloadProxy = downloadProxy
+	})
+	config.DownloadProxy = proxy.URL
+
+	file, err := os.Create(filepath.Join(t.TempDir(), "script"))
+	if err != nil {
+		t.Fatalf("os.Create() failed unexpectedly with error: %v", err)
+	}
+	defer file.Close()
+
+	scriptURL := "http://scripts.example.com/startup.sh"
+	if err := downloadURL(ctx, scriptURL, file); err != nil {
+		t.Fatalf("downloadURL(ctx, %s) failed unexpectedly with error: %v", scriptURL, err)
+	}
+	if want := []string{scriptURL}; !reflect.DeepEqual(proxied, want) {
+		t.Errorf("downloadURL(ctx, %s) proxied %v, want: %v", scriptURL, proxied, want)
+	}
+	got, err := os.ReadFile(file.Name())
+	if err != nil {
+		t.Fatalf("os.ReadFile(%s) failed unexpectedly with error: %v", file.Name(), err)
+	}
+	if string(got) != "proxied" {
+		t.Errorf("downloadURL(ctx, %s) wrote %q, want: %q", scriptURL, got, "proxied")
+	}
+}
+
+func TestWriteScriptToFileLocal(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "startup.sh")
+	if err := os.WriteFile(src, []byte("echo local"), 0644); err != nil {
+		t.Fatalf("os.WriteFile(%s) failed unexpectedly with error: %v", src, err)
+	}
+
+	tests := []struct {
+		name    string
+		url     string
+		wantErr bool
+	}{
+		{
+			name: "local_file",
+			url:  "file://" + filepath.ToSlash(src),
+		},
+		{
+			name: "localhost",
+			url:  "file://localhost" + filepath.ToSlash(src),
+		},
+		{
+			name:    "remote_host",
+			url:     "file://example.com" + filepath.ToSlash(src),
+			wantErr: true,
+		},
+		{
+			name:    "missing_file",
+			url:     "file://" + filepath.ToSlash(filepath.Join(dir, "missing.sh")),
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			u, err := url.Parse(tc.url)
+			if err != nil {
+				t.Fatalf("url.Parse(%q) failed unexpectedly with error: %v", tc.url, err)
+			}
+			dest := filepath.Join(t.TempDir(), "startup-script-url")
+
+			err = writeScriptToFile(context.Background(), tc.url, dest, u)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("writeScriptToFile(ctx, %q, %s) = %v, want error: %t", tc.url, dest, err, tc.wantErr)
+			}
+			if tc.wantErr {
+				return
+			}
+			got, err := os.ReadFile(dest)
+			if err != nil {
+				t.Fatalf("os.ReadFile(%s) failed unexpectedly with error: %v", dest, err)
+			}
+			if string(got) != "echo local" {
+				t.Errorf("writeScriptToFile(ctx, %q, %s) wrote %q, want %q", tc.url, dest, got, "echo local")
+			}
+		})
+	}
+}
+
+func TestCheckStorageScopes(t *testing.T) {
+	tests := []struct {
+		name    string
+		scopes  string
+		wantErr bool
+	}{
+		{
+			name:   "read_only",
+			scopes: "https://www.googleapis.com/auth/devstorage.read_only\nhttps://www.googleapis.com/auth/logging.write\n",
+		},
+		{
+			name:   "cloud_platform",
+			scopes: "https://www.googleapis.com/auth/cloud-platform\n",
+		},
+		{
+			name:    "no_storage_scope",
+			scopes:  "https://www.googleapis.com/auth/logging.write\nhttps://www.googleapis.com/auth/monitoring.write\n",
+			wantErr: true,
+		},
+		{
+			name:    "no_scopes",
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := checkStorageScopes(tc.scopes)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("checkStorageScopes(%q) = %v, want error: %t", tc.scopes, err, tc.wantErr)
+			}
+			if tc.wantErr && !errors.Is(err, errNoStorageCredentials) {
+				t.Errorf("checkStorageScopes(%q) = %v, want error wrapping %v", tc.scopes, err, errNoStorageCredentials)
+			}
+		})
+	}
+}
+
+func TestCheckStorageCredentials(t *testing.T) {
+	tests := []struct {
+		name       string
+		creds      *google.Credentials
+		credsErr   error
+		wantErr    bool
+		wantNoCred bool
+	}{
+		{
+			name:       "no_default_credentials",
+			credsErr:   fmt.Errorf("could not find default credentials"),
+			wantErr:    true,
+			wantNoCred: true,
+		},
+		{
+			name:  "key_file_credentials",
+			creds: &google.Credentials{JSON: []byte(`{"type":"service_account"}`)},
+		},
+		{
+			// The fake MDS client fails to return the scopes, they can't be checked.
+			name:    "metadata_server_credentials",
+			creds:   &google.Credentials{},
+			wantErr: true,
+		},
+	}
+
+	prevClient, prevFind := client, findDefaultCredentials
+	t.Cleanup(func() {
+		client = prevClient
+		findDefaultCredentials = prevFind
+	})
+	client = &mdsClient{}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			findDefaultCredentials = func(context.Context, ...string) (*google.Credentials, error) {
+				return tc.creds, tc.credsErr
+			}
+
+			err := checkStorageCredentials(context.Background())
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("checkStorageCredentials(ctx) = %v, want error: %t", err, tc.wantErr)
+			}
+			if got := errors.Is(err, errNoStorageCredentials); got != tc.wantNoCred {
+				t.Errorf("checkStorageCredentials(ctx) = %v, wraps %v: %t, want: %t", err, errNoStorageCredentials, got, tc.wantNoCred)
+			}
+		})
+	}
+}
+
 func TestDownloadGSURL(t *testing.T) {
 	ctx := context.Background()
 	ctr := make(map[string]int)
@@ -452,3 +754,91 @@ func TestDownloadGSURL(t *testing.T) {
 		})
 	}
 }
+
+func TestRunScriptKeys(t *testing.T) {
+	keys := []string{"startup-script", "startup-script-url", "other-script"}
+
+	for _, concurrency := range []int{0, 1, 2, 5} {
+		t.Run(fmt.Sprintf("concurrency_%d", concurrency), func(t *testing.T) {
+			var mu sync.Mutex
+			var ran []string
+			var running, maxRunning int
+
+			failed := runScriptKeys(keys, concurrency, func(key string) error {
+				mu.Lock()
+				ran = append(ran, key)
+				running++
+				if running > maxRunning {
+					maxRunning = running
+				}
+				mu.Unlock()
+
+				time.Sleep(10 * time.Millisecond)
+
+				mu.Lock()
+				running--
+				mu.Unlock()
+
+				if key == "startup-script-url" {
+					return fmt.Errorf("script failed")
+				}
+				return nil
+			})
+
+			if want := []string{"startup-script-url"}; !reflect.DeepEqual(failed, want) {
+				t.Errorf("runScriptKeys(%v, %d) = %v, want %v", keys, concurrency, failed, want)
+			}
+
+			if len(ran) != len(keys) {
+				t.Errorf("runScriptKeys(%v, %d) ran %v, want all keys run", keys, concurrency, ran)
+			}
+
+			wantMax := concurrency
+			if wantMax < 1 {
+				wantMax = 1
+			}
+			if maxRunning > wantMax {
+				t.Errorf("runScriptKeys(%v, %d) ran %d scripts concurrently, want at most %d", keys, concurrency, maxRunning, wantMax)
+			}
+
+			if concurrency <= 1 {
+				if !reflect.DeepEqual(ran, keys) {
+					t.Errorf("runScriptKeys(%v, %d) ran keys in order %v, want %v", keys, concurrency, ran, keys)
+				}
+			}
+		})
+	}
+}
+
+func TestReadLogLine(t *testing.T) {
+	long := strings.Repeat("a", 40)
+	input := "short\n" + long + "\r\n" + "after\n" + long
+
+	type line struct {
+		text      string
+		truncated bool
+	}
+	want := []line{
+		{text: "short"},
+		{text: long[:16], truncated: true},
+		{text: "after"},
+		{text: long[:16], truncated: true},
+	}
+
+	in := bufio.NewReaderSize(strings.NewReader(input), 16)
+	var got []line
+	for {
+		text, truncated, err := readLogLine(in)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("readLogLine() failed unexpectedly with error: %v", err)
+		}
+		got = append(got, line{text: text, truncated: truncated})
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("readLogLine() read %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+// setProcessGroup makes c run in its own process group, so killProcessGroup
+// also kills the processes started by it.
+func setProcessGroup(c *exec.Cmd) {
+	if c.SysProcAttr == nil {
+		c.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	c.SysProcAttr.Setpgid = true
+}
+
+// setScriptUser makes c run as userName and groupName, the user's primary group
+// if empty, and gives them ownership of the script's dir and its content so
+// they can run it. c keeps running as the agent's user if userName is empty.
+func setScriptUser(c *exec.Cmd, dir, userName, groupName string) error {
+	if userName == "" {
+		return nil
+	}
+
+	u, err := user.Lookup(userName)
+	if err != nil {
+		return fmt.Errorf("cannot run script as user %q: %v", userName, err)
+	}
+	gid := u.Gid
+	if groupName != "" {
+		g, err := user.LookupGroup(groupName)
+		if err != nil {
+			return fmt.Errorf("cannot run script as group %q: %v", groupName, err)
+		}
+		gid = g.Gid
+	}
+
+	uidNum, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return fmt.Errorf("invalid uid %q of user %q: %v", u.Uid, userName, err)
+	}
+	gidNum, err := strconv.ParseUint(gid, 10, 32)
+	if err != nil {
+		return fmt.Errorf("invalid gid %q: %v", gid, err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("cannot read script dir: %v", err)
+	}
+	paths := []string{dir}
+	for _, e := range entries {
+		paths = append(paths, filepath.Join(dir, e.Name()))
+	}
+	for _, p := range paths {
+		if err := os.Lchown(p, int(uidNum), int(gidNum)); err != nil {
+			return fmt.Errorf("cannot give user %q ownership of %s: %v", userName, p, err)
+		}
+	}
+
+	if c.SysProcAttr == nil {
+		c.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	// Supplementary groups are dropped, the script only gets the privileges of
+	// the configured user and group.
+	c.SysProcAttr.Credential = &syscall.Credential{Uid: uint32(uidNum), Gid: uint32(gidNum)}
+	return nil
+}
+
+// killProcessGroup kills the started command c and its process group.
+func killProcessGroup(c *exec.Cmd) error {
+	return syscall.Kill(-c.Process.Pid, syscall.SIGKILL)
+}
@@ -0,0 +1,117 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunCmdWithTimeout(t *testing.T) {
+	tests := []struct {
+		name    string
+		script  string
+		timeout time.Duration
+		wantErr string
+	}{
+		{
+			name:   "no_timeout",
+			script: "echo done",
+		},
+		{
+			name:    "within_timeout",
+			script:  "echo done",
+			timeout: time.Minute,
+		},
+		{
+			name:    "killed",
+			script:  "sleep 30 & sleep 30",
+			timeout: 100 * time.Millisecond,
+			wantErr: "killed after exceeding its 100ms timeout",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			start := time.Now()
+			err := runCmdWithTimeout(exec.Command("/bin/sh", "-c", tc.script), tc.name, tc.timeout)
+			if tc.wantErr == "" && err != nil {
+				t.Fatalf("runCmdWithTimeout(%q, %s) failed unexpectedly with error: %v", tc.script, tc.timeout, err)
+			}
+			if tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)) {
+				t.Fatalf("runCmdWithTimeout(%q, %s) = %v, want error containing %q", tc.script, tc.timeout, err, tc.wantErr)
+			}
+			// The background sleep keeps the output pipe open unless the whole
+			// process group is killed.
+			if elapsed := time.Since(start); elapsed > 10*time.Second {
+				t.Errorf("runCmdWithTimeout(%q, %s) returned after %s, want the process group killed", tc.script, tc.timeout, elapsed)
+			}
+		})
+	}
+}
+
+func TestSetScriptUser(t *testing.T) {
+	dir := t.TempDir()
+	script := filepath.Join(dir, "startup-script")
+	if err := os.WriteFile(script, []byte("exit 0"), 0755); err != nil {
+		t.Fatalf("os.WriteFile(%s) failed unexpectedly with error: %v", script, err)
+	}
+
+	c := exec.Command("/bin/sh", script)
+	if err := setScriptUser(c, dir, "", ""); err != nil {
+		t.Fatalf("setScriptUser(%s, \"\", \"\") failed unexpectedly with error: %v", dir, err)
+	}
+	if c.SysProcAttr != nil {
+		t.Errorf("setScriptUser(%s, \"\", \"\") set SysProcAttr %+v, want nil", dir, c.SysProcAttr)
+	}
+
+	if err := setScriptUser(c, dir, "no-such-user-for-scripts", ""); err == nil || !strings.Contains(err.Error(), "no-such-user-for-scripts") {
+		t.Errorf("setScriptUser(%s, no-such-user-for-scripts, \"\") = %v, want error naming the user", dir, err)
+	}
+
+	current, err := user.Current()
+	if err != nil {
+		t.Fatalf("user.Current() failed unexpectedly with error: %v", err)
+	}
+	if err := setScriptUser(c, dir, current.Username, "no-such-group-for-scripts"); err == nil || !strings.Contains(err.Error(), "no-such-group-for-scripts") {
+		t.Errorf("setScriptUser(%s, %s, no-such-group-for-scripts) = %v, want error naming the group", dir, current.Username, err)
+	}
+
+	if err := setScriptUser(c, dir, current.Username, ""); err != nil {
+		t.Fatalf("setScriptUser(%s, %s, \"\") failed unexpectedly with error: %v", dir, current.Username, err)
+	}
+	if got := strconv.FormatUint(uint64(c.SysProcAttr.Credential.Uid), 10); got != current.Uid {
+		t.Errorf("setScriptUser(%s, %s, \"\") set uid %s, want: %s", dir, current.Username, got, current.Uid)
+	}
+	if got := strconv.FormatUint(uint64(c.SysProcAttr.Credential.Gid), 10); got != current.Gid {
+		t.Errorf("setScriptUser(%s, %s, \"\") set gid %s, want: %s", dir, current.Username, got, current.Gid)
+	}
+
+	// Dropping supplementary groups requires root.
+	if os.Geteuid() != 0 {
+		return
+	}
+	if err := runCmdWithTimeout(c, "startup-script", time.Minute); err != nil {
+		t.Errorf("runCmdWithTimeout(%s) as user %s failed unexpectedly with error: %v", script, current.Username, err)
+	}
+}
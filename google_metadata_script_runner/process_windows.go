@@ -0,0 +1,41 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+)
+
+// setProcessGroup is a no-op on Windows, killProcessGroup relies on the process
+// tree instead.
+func setProcessGroup(c *exec.Cmd) {}
+
+// setScriptUser fails if userName is set, running scripts as another user is
+// not supported on Windows.
+func setScriptUser(c *exec.Cmd, dir, userName, groupName string) error {
+	if userName == "" {
+		return nil
+	}
+	return fmt.Errorf("cannot run script as user %q: run_as_user is not supported on Windows", userName)
+}
+
+// killProcessGroup kills the started command c and the processes started by it.
+func killProcessGroup(c *exec.Cmd) error {
+	return exec.Command("taskkill", "/T", "/F", "/PID", strconv.Itoa(c.Process.Pid)).Run()
+}
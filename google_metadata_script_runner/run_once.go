@@ -0,0 +1,105 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-agent/utils"
+)
+
+// runOnceSuffix is appended to a startup script's metadata key to form the key
+// of the attribute making it run only once per script content, e.g.
+// startup-script-run-once.
+const runOnceSuffix = "-run-once"
+
+// runOnceDir is where the hashes of the run-once scripts that were started are
+// recorded, one file per metadata key.
+var runOnceDir = defaultRunOnceDir()
+
+// errAlreadyRun is returned for run-once scripts that already ran with the same
+// content.
+var errAlreadyRun = errors.New("script already ran with the same content")
+
+func defaultRunOnceDir() string {
+	if runtime.GOOS == "windows" {
+		return filepath.Join(os.Getenv("ProgramData"), "Google", "Compute Engine", "metadata-scripts-run-once")
+	}
+	return "/var/lib/google/metadata-scripts-run-once"
+}
+
+// runOnceEnabled returns true if the scripts of action with the given
+// <key>-run-once attribute value must only run once per script content. Only
+// startup scripts support it, either all of them with the run_once config or
+// individually with the attribute set to true.
+func runOnceEnabled(action, attribute string) bool {
+	if action != "startup" {
+		return false
+	}
+	if cfg.Get().MetadataScripts.RunOnce {
+		return true
+	}
+	enabled, err := strconv.ParseBool(strings.TrimSpace(attribute))
+	return err == nil && enabled
+}
+
+// scriptHash returns the hex encoded SHA-256 of the script file at path.
+func scriptHash(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// alreadyRun returns true if the script of metadataKey was already started with
+// the content hashed to hash.
+func alreadyRun(metadataKey, hash string) (bool, error) {
+	data, err := os.ReadFile(filepath.Join(runOnceDir, metadataKey))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return strings.TrimSpace(string(data)) == hash, nil
+}
+
+// recordRun records the script of metadataKey is started with the content hashed
+// to hash, it won't run again until its content changes. It's recorded before
+// the script runs so a script rebooting the instance, which never returns, only
+// runs once, failed scripts aren't run again either.
+func recordRun(metadataKey, hash string) error {
+	if err := os.MkdirAll(runOnceDir, 0755); err != nil {
+		return fmt.Errorf("failed to create run-once directory: %w", err)
+	}
+	return utils.SaferWriteFile([]byte(hash), filepath.Join(runOnceDir, metadataKey), 0644)
+}
@@ -0,0 +1,153 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+)
+
+func TestRunOnceEnabled(t *testing.T) {
+	config := cfg.Get().MetadataScripts
+	runOnce := config.RunOnce
+	t.Cleanup(func() { config.RunOnce = runOnce })
+
+	tests := []struct {
+		name      string
+		action    string
+		attribute string
+		config    bool
+		want      bool
+	}{
+		{name: "startup_attribute", action: "startup", attribute: "true", want: true},
+		{name: "startup_attribute_false", action: "startup", attribute: "false"},
+		{name: "startup_attribute_invalid", action: "startup", attribute: "yes please"},
+		{name: "startup_no_attribute", action: "startup"},
+		{name: "startup_config", action: "startup", config: true, want: true},
+		{name: "shutdown_attribute", action: "shutdown", attribute: "true"},
+		{name: "specialize_config", action: "specialize", config: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			config.RunOnce = tc.config
+			if got := runOnceEnabled(tc.action, tc.attribute); got != tc.want {
+				t.Errorf("runOnceEnabled(%q, %q) = %t, want %t", tc.action, tc.attribute, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRecordRun(t *testing.T) {
+	oldDir := runOnceDir
+	t.Cleanup(func() { runOnceDir = oldDir })
+	runOnceDir = filepath.Join(t.TempDir(), "run-once")
+
+	ran, err := alreadyRun("startup-script", "hash1")
+	if err != nil || ran {
+		t.Fatalf("alreadyRun(startup-script, hash1) = %t, %v before recording, want false, nil", ran, err)
+	}
+
+	if err := recordRun("startup-script", "hash1"); err != nil {
+		t.Fatalf("recordRun(startup-script, hash1) failed unexpectedly with error: %v", err)
+	}
+
+	tests := []struct {
+		key  string
+		hash string
+		want bool
+	}{
+		{key: "startup-script", hash: "hash1", want: true},
+		{key: "startup-script", hash: "hash2", want: false},
+		{key: "startup-script-url", hash: "hash1", want: false},
+	}
+
+	for _, tc := range tests {
+		ran, err := alreadyRun(tc.key, tc.hash)
+		if err != nil {
+			t.Errorf("alreadyRun(%s, %s) failed unexpectedly with error: %v", tc.key, tc.hash, err)
+		}
+		if ran != tc.want {
+			t.Errorf("alreadyRun(%s, %s) = %t, want %t", tc.key, tc.hash, ran, tc.want)
+		}
+	}
+}
+
+func TestSetupAndRunScriptRunOnce(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("shell scripts are not supported on windows")
+	}
+	if _, err := os.Stat(defaultShell); err != nil {
+		t.Skipf("default shell %s not available: %v", defaultShell, err)
+	}
+
+	ctx := context.Background()
+	oldDir := runOnceDir
+	t.Cleanup(func() { runOnceDir = oldDir })
+	runOnceDir = filepath.Join(t.TempDir(), "run-once")
+
+	out := filepath.Join(t.TempDir(), "out")
+	script := "echo ran >> " + out
+
+	run := func(script string, runOnce bool) error {
+		return setupAndRunScript(ctx, "startup-script", script, "", runOnce)
+	}
+	runs := func() int {
+		data, err := os.ReadFile(out)
+		if err != nil {
+			return 0
+		}
+		return strings.Count(string(data), "ran")
+	}
+
+	if err := run(script, true); err != nil {
+		t.Fatalf("first run failed unexpectedly with error: %v", err)
+	}
+	if err := run(script, true); !errors.Is(err, errAlreadyRun) {
+		t.Errorf("second run returned error %v, want %v", err, errAlreadyRun)
+	}
+	if got := runs(); got != 1 {
+		t.Errorf("script ran %d times after running the same content twice, want 1", got)
+	}
+
+	if err := run(script, false); err != nil {
+		t.Fatalf("run without run-once failed unexpectedly with error: %v", err)
+	}
+	if err := run(script+" # changed", true); err != nil {
+		t.Fatalf("run with changed content failed unexpectedly with error: %v", err)
+	}
+	if got := runs(); got != 3 {
+		t.Errorf("script ran %d times, want 3", got)
+	}
+
+	// Scripts are recorded when they start, a failed one doesn't run again.
+	failing := script + "; exit 1"
+	if err := run(failing, true); err == nil {
+		t.Fatalf("failing run succeeded, want error")
+	}
+	if err := run(failing, true); !errors.Is(err, errAlreadyRun) {
+		t.Errorf("failing script second run returned error %v, want %v", err, errAlreadyRun)
+	}
+	if got := runs(); got != 4 {
+		t.Errorf("script ran %d times, want 4", got)
+	}
+}
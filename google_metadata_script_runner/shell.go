@@ -0,0 +1,67 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+var (
+	// osDefaultShells are the shells scripts are run with, keyed by GOOS, when
+	// default_shell is not configured.
+	osDefaultShells = map[string]string{
+		"freebsd": "/usr/local/bin/bash",
+	}
+
+	// execLookPath points to the function looking up executables in PATH,
+	// replaceable by unit tests.
+	execLookPath = exec.LookPath
+
+	// defaultShell is the resolved shell scripts without a known interpreter are
+	// run with, set by resolveDefaultShell at startup.
+	defaultShell = "/bin/bash"
+)
+
+// resolveDefaultShell returns the path of the shell scripts are run with on goos.
+// An empty shell falls back to the OS default, a bare name is looked up in PATH
+// and a path must point to an executable file.
+func resolveDefaultShell(shell, goos string) (string, error) {
+	if shell == "" {
+		shell = "/bin/bash"
+		if osShell, found := osDefaultShells[goos]; found {
+			shell = osShell
+		}
+	}
+
+	if !strings.ContainsRune(shell, os.PathSeparator) {
+		path, err := execLookPath(shell)
+		if err != nil {
+			return "", fmt.Errorf("default_shell %q not found in PATH: %w", shell, err)
+		}
+		return path, nil
+	}
+
+	info, err := os.Stat(shell)
+	if err != nil {
+		return "", fmt.Errorf("default_shell %q is not available: %w", shell, err)
+	}
+	if info.IsDir() || info.Mode().Perm()&0111 == 0 {
+		return "", fmt.Errorf("default_shell %q is not an executable file", shell)
+	}
+	return shell, nil
+}
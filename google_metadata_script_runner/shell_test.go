@@ -0,0 +1,106 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolveDefaultShell(t *testing.T) {
+	dir := t.TempDir()
+	executable := filepath.Join(dir, "shell")
+	notExecutable := filepath.Join(dir, "not-executable")
+	if err := os.WriteFile(executable, nil, 0755); err != nil {
+		t.Fatalf("os.WriteFile(%s) failed unexpectedly with error: %v", executable, err)
+	}
+	if err := os.WriteFile(notExecutable, nil, 0644); err != nil {
+		t.Fatalf("os.WriteFile(%s) failed unexpectedly with error: %v", notExecutable, err)
+	}
+
+	oldShells, oldLookPath := osDefaultShells, execLookPath
+	t.Cleanup(func() { osDefaultShells, execLookPath = oldShells, oldLookPath })
+	osDefaultShells = map[string]string{"freebsd": executable}
+	execLookPath = func(name string) (string, error) {
+		if name == "sh" {
+			return "/usr/bin/sh", nil
+		}
+		return "", fmt.Errorf("%s not found", name)
+	}
+
+	tests := []struct {
+		name    string
+		shell   string
+		goos    string
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "os_default",
+			goos: "freebsd",
+			want: executable,
+		},
+		{
+			name:  "path",
+			shell: executable,
+			goos:  "linux",
+			want:  executable,
+		},
+		{
+			name:  "bare_name",
+			shell: "sh",
+			goos:  "linux",
+			want:  "/usr/bin/sh",
+		},
+		{
+			name:    "bare_name_not_found",
+			shell:   "zsh",
+			goos:    "linux",
+			wantErr: true,
+		},
+		{
+			name:    "missing",
+			shell:   filepath.Join(dir, "missing"),
+			goos:    "linux",
+			wantErr: true,
+		},
+		{
+			name:    "not_executable",
+			shell:   notExecutable,
+			goos:    "linux",
+			wantErr: true,
+		},
+		{
+			name:    "directory",
+			shell:   dir,
+			goos:    "linux",
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := resolveDefaultShell(tc.shell, tc.goos)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("resolveDefaultShell(%q, %q) error = %v, want error: %t", tc.shell, tc.goos, err, tc.wantErr)
+			}
+			if got != tc.want {
+				t.Errorf("resolveDefaultShell(%q, %q) = %q, want %q", tc.shell, tc.goos, got, tc.want)
+			}
+		})
+	}
+}
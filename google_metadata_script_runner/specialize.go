@@ -0,0 +1,99 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"os/exec"
+	"slices"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+)
+
+// userScriptsStep is the specialize step running the user's sysprep-specialize
+// scripts.
+const userScriptsStep = "user-scripts"
+
+// specializeStep is a built-in step of the specialize action.
+type specializeStep func(ctx context.Context) error
+
+var (
+	// builtinSpecializeSteps maps the names of the built-in specialize steps that
+	// can be listed in the specialize_steps configuration to their implementation.
+	builtinSpecializeSteps = map[string]specializeStep{
+		// flush-dns drops any DNS resolution cached while the image was prepared.
+		"flush-dns": func(ctx context.Context) error {
+			return runCmd(exec.CommandContext(ctx, "ipconfig", "/flushdns"), "flush-dns")
+		},
+		// renew-dhcp renews the DHCP leases of all the network adapters.
+		"renew-dhcp": func(ctx context.Context) error {
+			return runCmd(exec.CommandContext(ctx, "ipconfig", "/renew"), "renew-dhcp")
+		},
+	}
+)
+
+// specializeSteps returns the ordered list of specialize steps configured with
+// the specialize_steps key, defaulting to only running the user scripts.
+func specializeSteps() []string {
+	var steps []string
+	for _, step := range strings.Split(cfg.Get().MetadataScripts.SpecializeSteps, ",") {
+		if step = strings.TrimSpace(step); step != "" {
+			steps = append(steps, step)
+		}
+	}
+
+	if len(steps) == 0 {
+		return []string{userScriptsStep}
+	}
+	return steps
+}
+
+// runSpecialize runs the specialize steps in the given order, userScripts runs
+// the user's sysprep-specialize scripts when the user-scripts step is reached.
+// Built-in steps are independent, a failing or unknown step is logged and the
+// following steps are still run. The user scripts failing to run is an error
+// returned right away, as when they are the only step.
+func runSpecialize(ctx context.Context, steps []string, userScripts specializeStep) error {
+	if !slices.Contains(steps, userScriptsStep) {
+		logger.Warningf("Specialize steps %q don't include %q, sysprep-specialize scripts won't run.", steps, userScriptsStep)
+	}
+
+	for _, name := range steps {
+		if name == userScriptsStep {
+			logger.Infof("Running specialize step %q.", name)
+			if err := userScripts(ctx); err != nil {
+				return err
+			}
+			logger.Infof("Specialize step %q finished.", name)
+			continue
+		}
+
+		step, found := builtinSpecializeSteps[name]
+		if !found {
+			logger.Warningf("Unknown specialize step %q, skipping.", name)
+			continue
+		}
+
+		logger.Infof("Running specialize step %q.", name)
+		if err := step(ctx); err != nil {
+			logger.Warningf("Specialize step %q failed with error: %v", name, err)
+			continue
+		}
+		logger.Infof("Specialize step %q finished.", name)
+	}
+	return nil
+}
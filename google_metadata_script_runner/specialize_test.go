@@ -0,0 +1,99 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestSpecializeSteps(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  string
+		want []string
+	}{
+		{
+			name: "default",
+			want: []string{userScriptsStep},
+		},
+		{
+			name: "empty",
+			cfg:  "[MetadataScripts]\nspecialize_steps = ",
+			want: []string{userScriptsStep},
+		},
+		{
+			name: "ordered",
+			cfg:  "[MetadataScripts]\nspecialize_steps = renew-dhcp, user-scripts,flush-dns",
+			want: []string{"renew-dhcp", userScriptsStep, "flush-dns"},
+		},
+	}
+
+	defer cfg.Load(nil)
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := cfg.Load([]byte(tc.cfg)); err != nil {
+				t.Fatalf("cfg.Load(%s) failed unexpectedly with error: %v", tc.cfg, err)
+			}
+			if diff := cmp.Diff(tc.want, specializeSteps()); diff != "" {
+				t.Errorf("specializeSteps() returned unexpected diff (-want,+got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestRunSpecialize(t *testing.T) {
+	var got []string
+	step := func(name string, err error) specializeStep {
+		return func(context.Context) error {
+			got = append(got, name)
+			return err
+		}
+	}
+
+	orig := builtinSpecializeSteps
+	t.Cleanup(func() { builtinSpecializeSteps = orig })
+	builtinSpecializeSteps = map[string]specializeStep{
+		"first":  step("first", nil),
+		"failed": step("failed", fmt.Errorf("step error")),
+		"last":   step("last", nil),
+	}
+
+	steps := []string{"first", "failed", "unknown", userScriptsStep, "last"}
+	if err := runSpecialize(context.Background(), steps, step(userScriptsStep, nil)); err != nil {
+		t.Errorf("runSpecialize(%v) failed unexpectedly with error: %v", steps, err)
+	}
+
+	want := []string{"first", "failed", userScriptsStep, "last"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("runSpecialize(%v) ran unexpected steps (-want,+got):\n%s", steps, diff)
+	}
+
+	// Failing to run the user scripts is returned and stops the remaining steps.
+	got = nil
+	if err := runSpecialize(context.Background(), steps, step(userScriptsStep, fmt.Errorf("metadata error"))); err == nil {
+		t.Errorf("runSpecialize(%v) succeeded with failing user scripts, want error", steps)
+	}
+
+	want = []string{"first", "failed", userScriptsStep}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("runSpecialize(%v) with failing user scripts ran unexpected steps (-want,+got):\n%s", steps, diff)
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"time"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+	"github.com/GoogleCloudPlatform/guest-agent/utils"
+	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
+)
+
+// maxSummaryError is the maximum length of the errors recorded in the summary.
+const maxSummaryError = 1024
+
+// runSummary is the machine-readable record of the scripts run for an action,
+// written if summary_path or summary_guest_attribute are set.
+type runSummary struct {
+	Action string `json:"action"`
+	// Error is set if the scripts couldn't be looked up in metadata.
+	Error   string          `json:"error,omitempty"`
+	Scripts []*scriptResult `json:"scripts"`
+}
+
+// scriptResult is the outcome of a single wanted key.
+type scriptResult struct {
+	Key   string `json:"key"`
+	Found bool   `json:"found"`
+	// Skipped is set for run-once scripts that already ran with the same content.
+	Skipped bool `json:"skipped,omitempty"`
+	// ExitCode is not set if the script didn't run or was killed.
+	ExitCode *int    `json:"exit_code,omitempty"`
+	Duration float64 `json:"duration_seconds"`
+	Error    string  `json:"error,omitempty"`
+}
+
+// newRunSummary returns the summary of action with all wantedKeys not found.
+func newRunSummary(action string, wantedKeys []string) *runSummary {
+	s := &runSummary{Action: action}
+	for _, key := range wantedKeys {
+		s.Scripts = append(s.Scripts, &scriptResult{Key: key})
+	}
+	return s
+}
+
+// result returns the result of key, nil if it's not a wanted key.
+func (s *runSummary) result(key string) *scriptResult {
+	for _, r := range s.Scripts {
+		if r.Key == key {
+			return r
+		}
+	}
+	return nil
+}
+
+// record sets the duration and outcome of a script started at start and
+// returning err.
+func (r *scriptResult) record(start time.Time, err error) {
+	r.Duration = time.Since(start).Seconds()
+
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		code := 0
+		r.ExitCode = &code
+	case errors.As(err, &exitErr) && exitErr.ExitCode() >= 0:
+		code := exitErr.ExitCode()
+		r.ExitCode = &code
+	}
+	if err != nil {
+		r.Error = truncateError(err)
+	}
+}
+
+// truncateError returns err's message, cut to maxSummaryError bytes.
+func truncateError(err error) string {
+	msg := err.Error()
+	if len(msg) > maxSummaryError {
+		msg = msg[:maxSummaryError] + "..."
+	}
+	return msg
+}
+
+// writeRunSummary writes s to the configured summary file and guest attribute,
+// failures are logged and don't affect the scripts outcome.
+func writeRunSummary(ctx context.Context, s *runSummary) {
+	config := cfg.Get().MetadataScripts
+	if config.SummaryPath == "" && !config.SummaryGuestAttribute {
+		return
+	}
+
+	data, err := json.Marshal(s)
+	if err != nil {
+		logger.Errorf("Failed to encode %s scripts summary: %v", s.Action, err)
+		return
+	}
+
+	if config.SummaryPath != "" {
+		if err := utils.SaferWriteFile(data, config.SummaryPath, 0644); err != nil {
+			logger.Errorf("Failed to write %s scripts summary to %s: %v", s.Action, config.SummaryPath, err)
+		}
+	}
+	if config.SummaryGuestAttribute {
+		key := summaryGuestAttribute(s.Action)
+		if err := client.WriteGuestAttributes(ctx, key, string(data)); err != nil {
+			logger.Errorf("Failed to write %s scripts summary to guest attribute %s: %v", s.Action, key, err)
+		}
+	}
+}
+
+// summaryGuestAttribute returns the guest attribute the summary of action is
+// written to.
+func summaryGuestAttribute(action string) string {
+	return fmt.Sprintf("metadata-scripts/%s-summary", action)
+}
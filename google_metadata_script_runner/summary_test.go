@@ -0,0 +1,117 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/guest-agent/google_guest_agent/cfg"
+)
+
+func TestScriptResultRecord(t *testing.T) {
+	exitErr := exec.Command("/bin/sh", "-c", "exit 3").Run()
+
+	tests := []struct {
+		name         string
+		err          error
+		wantExitCode *int
+		wantError    string
+	}{
+		{
+			name:         "success",
+			wantExitCode: intPtr(0),
+		},
+		{
+			name:         "exit_code",
+			err:          exitErr,
+			wantExitCode: intPtr(3),
+			wantError:    "exit status 3",
+		},
+		{
+			name:      "not_run",
+			err:       errors.New("unable to write script to file"),
+			wantError: "unable to write script to file",
+		},
+		{
+			name:      "truncated",
+			err:       errors.New(strings.Repeat("e", maxSummaryError+10)),
+			wantError: strings.Repeat("e", maxSummaryError) + "...",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r := &scriptResult{Key: "startup-script"}
+			r.record(time.Now(), tc.err)
+
+			if (r.ExitCode == nil) != (tc.wantExitCode == nil) || (r.ExitCode != nil && *r.ExitCode != *tc.wantExitCode) {
+				t.Errorf("record(%v) set exit code %v, want: %v", tc.err, r.ExitCode, tc.wantExitCode)
+			}
+			if r.Error != tc.wantError {
+				t.Errorf("record(%v) set error %q, want: %q", tc.err, r.Error, tc.wantError)
+			}
+		})
+	}
+}
+
+func TestWriteRunSummary(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "summary.json")
+	config := fmt.Sprintf("[MetadataScripts]\nsummary_path = %s\n", path)
+	if err := cfg.Load([]byte(config)); err != nil {
+		t.Fatalf("cfg.Load(%q) failed unexpectedly with error: %v", config, err)
+	}
+	t.Cleanup(func() {
+		if err := cfg.Load(nil); err != nil {
+			t.Fatalf("cfg.Load(nil) failed unexpectedly with error: %v", err)
+		}
+	})
+
+	summary := newRunSummary("startup", []string{"startup-script-url", "startup-script"})
+	summary.result("startup-script").Found = true
+	summary.result("startup-script").record(time.Now(), nil)
+	writeRunSummary(context.Background(), summary)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("os.ReadFile(%s) failed unexpectedly with error: %v", path, err)
+	}
+	var got runSummary
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("json.Unmarshal(%s) failed unexpectedly with error: %v", data, err)
+	}
+
+	if got.Action != "startup" || len(got.Scripts) != 2 {
+		t.Fatalf("writeRunSummary() wrote %s, want startup summary of 2 scripts", data)
+	}
+	if s := got.Scripts[0]; s.Key != "startup-script-url" || s.Found || s.ExitCode != nil {
+		t.Errorf("writeRunSummary() wrote %+v for startup-script-url, want not found", s)
+	}
+	if s := got.Scripts[1]; s.Key != "startup-script" || !s.Found || s.ExitCode == nil || *s.ExitCode != 0 {
+		t.Errorf("writeRunSummary() wrote %+v for startup-script, want found with exit code 0", s)
+	}
+}
+
+func intPtr(i int) *int {
+	return &i
+}
@@ -18,13 +18,20 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"os"
+	"path/filepath"
+	"runtime/debug"
 	"slices"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/GoogleCloudPlatform/guest-agent/retry"
@@ -35,6 +42,9 @@ const (
 	defaultMetadataURL = "http://169.254.169.254/computeMetadata/v1/"
 	defaultEtag        = "NONE"
 
+	// ipv6MetadataURL is the metadata server's URL on IPv6-only instances.
+	ipv6MetadataURL = "http://[fd20:ce::254]/computeMetadata/v1/"
+
 	// defaultHangtimeout is the timeout parameter passed to metadata as the hang timeout.
 	defaultHangTimeout = 60
 
@@ -42,21 +52,68 @@ const (
 	// defaultHangTimeout and client timeout should be enough to avoid canceling the context
 	// before headers and body are read.
 	defaultClientTimeout = 70
+
+	// defaultMaxIdleConns is the number of idle connections to the metadata server
+	// kept for reuse. A few requests, e.g. guest attribute writes, run concurrently
+	// with the long poll.
+	defaultMaxIdleConns = 4
+
+	// defaultIdleConnTimeout is how long idle connections are kept, it must be longer
+	// than the gap between two long polls so the watcher reuses its connection.
+	defaultIdleConnTimeout = 2 * defaultClientTimeout * time.Second
+
+	// maxConcurrentGuestAttributeWrites is the maximum number of guest attributes
+	// WriteGuestAttributesBatch writes concurrently.
+	maxConcurrentGuestAttributeWrites = 4
 )
 
 var (
 	// we backoff until 10s
 	backoffDuration = 100 * time.Millisecond
 	backoffAttempts = 100
+
+	// preferIPv6 makes clients use the metadata server's IPv6 address, see PreferIPv6.
+	preferIPv6 atomic.Bool
+
+	// defaultUserAgent identifies the program issuing metadata server requests,
+	// binaries knowing their release version override it with WithUserAgent.
+	defaultUserAgent = fmt.Sprintf("%s/%s", filepath.Base(os.Args[0]), buildVersion())
 )
 
+// metadataHosts are the metadata server hosts, they're link-local so requests
+// to them never go through a proxy.
+var metadataHosts = []string{"169.254.169.254", "fd20:ce::254", "metadata.google.internal", "metadata"}
+
+// proxy is the proxy function of the metadata client transport, it honors the
+// HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables except for the
+// metadata server hosts, which are always reached directly.
+func proxy(req *http.Request) (*url.URL, error) {
+	if slices.Contains(metadataHosts, req.URL.Hostname()) {
+		return nil, nil
+	}
+	return http.ProxyFromEnvironment(req)
+}
+
+// buildVersion returns the version of the main module the program was built
+// from, "unknown" if it's not available.
+func buildVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok || info.Main.Version == "" {
+		return "unknown"
+	}
+	return info.Main.Version
+}
+
 // MDSClientInterface is the minimum required Metadata Server interface for Guest Agent.
 type MDSClientInterface interface {
 	Get(context.Context) (*Descriptor, error)
 	GetKey(context.Context, string, map[string]string) (string, error)
 	GetKeyRecursive(context.Context, string) (string, error)
+	GetKeyRecursiveWithEtag(context.Context, string) (string, string, error)
 	Watch(context.Context) (*Descriptor, error)
 	WriteGuestAttributes(context.Context, string, string) error
+	WriteGuestAttributesBatch(context.Context, map[string]string) error
+	DeleteGuestAttribute(context.Context, string) error
 }
 
 // requestConfig is used internally to configure an http request given its context.
@@ -69,23 +126,141 @@ type requestConfig struct {
 	headers    map[string]string
 }
 
+// TokenProvider provides a short-lived token injected as a header on every
+// request made to the metadata server.
+type TokenProvider interface {
+	// Token returns the header name and value of a valid token, fetching or
+	// refreshing it as needed. An empty header name means no header is added.
+	Token(context.Context) (string, string, error)
+}
+
+// noopTokenProvider is the default TokenProvider, it never adds a token header.
+type noopTokenProvider struct{}
+
+// Token implements TokenProvider, it returns no token.
+func (noopTokenProvider) Token(context.Context) (string, string, error) {
+	return "", "", nil
+}
+
 // Client defines the public interface between the core guest agent and
 // the metadata layer.
 type Client struct {
-	metadataURL string
-	etag        string
-	httpClient  *http.Client
+	metadataURL   string
+	etag          string
+	httpClient    *http.Client
+	tokenProvider TokenProvider
+	userAgent     string
+}
+
+// Option configures a Client allocated by New.
+type Option func(*Client)
+
+// WithMaxIdleConns sets the number of idle connections to the metadata server kept
+// for reuse.
+func WithMaxIdleConns(n int) Option {
+	return func(c *Client) {
+		c.transport().MaxIdleConns = n
+		c.transport().MaxIdleConnsPerHost = n
+	}
+}
+
+// WithIdleConnTimeout sets how long idle connections to the metadata server are
+// kept for reuse, zero means no limit.
+func WithIdleConnTimeout(timeout time.Duration) Option {
+	return func(c *Client) {
+		c.transport().IdleConnTimeout = timeout
+	}
+}
+
+// WithDisableKeepAlives makes the client use a new connection for each request if
+// disable is true.
+func WithDisableKeepAlives(disable bool) Option {
+	return func(c *Client) {
+		c.transport().DisableKeepAlives = disable
+	}
 }
 
-// New allocates and configures a new Client instance.
-func New() *Client {
-	return &Client{
-		metadataURL: defaultMetadataURL,
-		etag:        defaultEtag,
+// WithUserAgent sets the User-Agent header of the requests to the metadata server,
+// e.g. program/version, used to attribute them in the metadata server logs.
+func WithUserAgent(userAgent string) Option {
+	return func(c *Client) {
+		c.userAgent = userAgent
+	}
+}
+
+// New allocates and configures a new Client instance. By default connections are
+// kept alive and reused and requests identify the program with its binary name
+// and build version, opts tune the connection reuse and the User-Agent.
+func New(opts ...Option) *Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConns = defaultMaxIdleConns
+	transport.MaxIdleConnsPerHost = defaultMaxIdleConns
+	transport.IdleConnTimeout = defaultIdleConnTimeout
+	transport.Proxy = proxy
+
+	c := &Client{
+		etag: defaultEtag,
 		httpClient: &http.Client{
-			Timeout: defaultClientTimeout * time.Second,
+			Timeout:   defaultClientTimeout * time.Second,
+			Transport: transport,
 		},
+		tokenProvider: noopTokenProvider{},
+		userAgent:     defaultUserAgent,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// transport returns the http.Transport configured by New.
+func (c *Client) transport() *http.Transport {
+	return c.httpClient.Transport.(*http.Transport)
+}
+
+// PreferIPv6 makes all clients reach the metadata server on its IPv6 address
+// instead of its IPv4 link-local address, as required on IPv6-only instances.
+// It applies to clients already allocated too, so it can be called once the
+// configuration is loaded.
+func PreferIPv6(prefer bool) {
+	preferIPv6.Store(prefer)
+}
+
+// baseURL returns the metadata server URL requests are sent to.
+func (c *Client) baseURL() string {
+	if c.metadataURL != "" {
+		return c.metadataURL
+	}
+	if preferIPv6.Load() {
+		return ipv6MetadataURL
+	}
+	return defaultMetadataURL
+}
+
+// SetTokenProvider sets the TokenProvider used to inject a token header on every
+// metadata server request. Setting nil restores the default no-op provider.
+func (c *Client) SetTokenProvider(provider TokenProvider) {
+	if provider == nil {
+		provider = noopTokenProvider{}
+	}
+	c.tokenProvider = provider
+}
+
+// addToken adds the token header provided by the client's TokenProvider to req.
+func (c *Client) addToken(ctx context.Context, req *http.Request) error {
+	if c.tokenProvider == nil {
+		return nil
+	}
+
+	header, token, err := c.tokenProvider.Token(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get metadata server token: %+v", err)
+	}
+
+	if header != "" {
+		req.Header.Set(header, token)
 	}
+	return nil
 }
 
 // Descriptor wraps/holds all the metadata keys, the structure reflects the json
@@ -107,13 +282,36 @@ func (m *Descriptor) UnmarshalJSON(b []byte) error {
 	}
 
 	// If this is a syntax error return a useful error.
-	sErr, ok := err.(*json.SyntaxError)
-	if !ok {
-		return err
+	if sErr, ok := err.(*json.SyntaxError); ok {
+		_, line, pos := jsonErrorContext(b, sErr.Offset)
+		return fmt.Errorf("JSON syntax error: %s \n%s\n%s^", err, line, strings.Repeat(" ", pos))
+	}
+
+	// Type errors happen when a field changes its shape, point to the offending
+	// value and name the field.
+	if tErr, ok := err.(*json.UnmarshalTypeError); ok {
+		lineNumber, line, pos := jsonErrorContext(b, tErr.Offset)
+		field := tErr.Field
+		if field == "" {
+			field = "<root>"
+		}
+		return fmt.Errorf("JSON type error: field %q: cannot unmarshal %s into %s, line %d: %w \n%s\n%s^",
+			field, tErr.Value, tErr.Type, lineNumber, err, line, strings.Repeat(" ", pos))
+	}
+
+	return err
+}
+
+// jsonErrorContext returns the line number, starting at 1, and the contents of
+// the line of b containing the byte at offset, as well as the position of that
+// byte in the line, i.e. where to place a '^'.
+func jsonErrorContext(b []byte, offset int64) (int, []byte, int) {
+	if offset > int64(len(b)) {
+		offset = int64(len(b))
 	}
 
 	// Byte number where the error line starts.
-	start := bytes.LastIndex(b[:sErr.Offset], []byte("\n")) + 1
+	start := bytes.LastIndex(b[:offset], []byte("\n")) + 1
 	// Assume end byte of error line is EOF unless this isn't the last line.
 	end := len(b)
 	if i := bytes.Index(b[start:], []byte("\n")); i >= 0 {
@@ -121,12 +319,12 @@ func (m *Descriptor) UnmarshalJSON(b []byte) error {
 	}
 
 	// Position of error in line (where to place the '^').
-	pos := int(sErr.Offset) - start
+	pos := int(offset) - start
 	if pos != 0 {
 		pos = pos - 1
 	}
 
-	return fmt.Errorf("JSON syntax error: %s \n%s\n%s^", err, b[start:end], strings.Repeat(" ", pos))
+	return bytes.Count(b[:start], []byte("\n")) + 1, b[start:end], pos
 }
 
 type virtualClock struct {
@@ -141,6 +339,9 @@ type Instance struct {
 	// MachineType represents the instance's machine type.
 	MachineType string
 
+	// Hostname is the instance's fully qualified host name.
+	Hostname string
+
 	// Attributes are the instance's attributes.
 	Attributes Attributes
 
@@ -223,6 +424,9 @@ type Attributes struct {
 	WSFCAddresses             string
 	WSFCAgentPort             string
 	DisableTelemetry          bool
+	// DisabledManagers is the comma separated list of the names of the guest agent
+	// managers to disable, nil if the attribute is not set.
+	DisabledManagers *string
 }
 
 // UnmarshalJSON unmarshals b into Attribute.
@@ -253,6 +457,7 @@ func (a *Attributes) UnmarshalJSON(b []byte) error {
 		DisableTelemetry          string      `json:"disable-guest-telemetry"`
 		DisableHTTPSMdsSetup      string      `json:"disable-https-mds-setup"`
 		HTTPSMDSEnableNativeStore string      `json:"enable-https-mds-native-cert-store"`
+		DisabledManagers          *string     `json:"disabled-managers"`
 	}
 	var temp inner
 	if err := json.Unmarshal(b, &temp); err != nil {
@@ -262,6 +467,7 @@ func (a *Attributes) UnmarshalJSON(b []byte) error {
 	a.WSFCAddresses = temp.WSFCAddresses
 	a.WSFCAgentPort = temp.WSFCAgentPort
 	a.WindowsKeys = temp.WindowsKeys
+	a.DisabledManagers = temp.DisabledManagers
 
 	value, err := strconv.ParseBool(temp.DisableHTTPSMdsSetup)
 	if err == nil {
@@ -336,17 +542,35 @@ func (c *Client) updateEtag(resp *http.Response) bool {
 }
 
 // MDSReqError represents custom error produced by HTTP requests made on MDS. It captures
-// error and HTTP response for inspecting status code.
+// error and HTTP response for inspecting status code, and the request's context error
+// if the request failed because its context was canceled or its deadline exceeded.
 type MDSReqError struct {
 	status int
 	err    error
+	ctxErr error
 }
 
 // Error implements method defined on error interface to transform custom type into error.
 func (m *MDSReqError) Error() string {
+	if m.ctxErr != nil {
+		return fmt.Sprintf("request aborted: [%v], error: [%v]", m.ctxErr, m.err)
+	}
 	return fmt.Sprintf("request failed with status code: [%d], error: [%v]", m.status, m.err)
 }
 
+// StatusCode returns the HTTP status code of the failed request, -1 if the request
+// failed before getting a response.
+func (m *MDSReqError) StatusCode() int {
+	return m.status
+}
+
+// IsNotFound returns true if err is, or wraps, an MDSReqError for a request the
+// metadata server responded with 404 Not Found, i.e. the requested key doesn't exist.
+func IsNotFound(err error) bool {
+	var mdsErr *MDSReqError
+	return errors.As(err, &mdsErr) && mdsErr.status == http.StatusNotFound
+}
+
 // shouldRetry method checks if MDSReqError is temporary and retriable or not.
 func shouldRetry(err error) bool {
 	e, ok := err.(*MDSReqError)
@@ -355,32 +579,51 @@ func shouldRetry(err error) bool {
 		return true
 	}
 
+	// The request's context is done, further attempts would fail the same way.
+	if e.ctxErr != nil {
+		return false
+	}
+
 	// Known non-retriable status codes.
 	codes := []int{404}
 
 	return !slices.Contains(codes, e.status)
 }
 
+// mdsResponse holds the body of a successful MDS response and the etag it was
+// served with.
+type mdsResponse struct {
+	body string
+	etag string
+}
+
 func (c *Client) retry(ctx context.Context, cfg requestConfig) (string, error) {
+	resp, err := c.retryWithEtag(ctx, cfg)
+	return resp.body, err
+}
+
+func (c *Client) retryWithEtag(ctx context.Context, cfg requestConfig) (mdsResponse, error) {
+	// The backoff is constant, randomizing it would shorten the total time spent
+	// retrying, callers rely on it to ride out short MDS outages, i.e. at startup.
 	policy := retry.Policy{MaxAttempts: backoffAttempts, Jitter: backoffDuration, BackoffFactor: 1, ShouldRetry: shouldRetry}
 
-	fn := func() (string, error) {
+	fn := func() (mdsResponse, error) {
 		resp, err := c.do(ctx, cfg)
 		if err != nil {
 			statusCode := -1
 			if resp != nil {
 				statusCode = resp.StatusCode
 			}
-			return "", &MDSReqError{statusCode, err}
+			return mdsResponse{}, &MDSReqError{status: statusCode, err: err, ctxErr: ctx.Err()}
 		}
 		defer resp.Body.Close()
 
 		md, err := io.ReadAll(resp.Body)
 		if err != nil {
-			return "", fmt.Errorf("failed to read metadata server response bytes: %+v", err)
+			return mdsResponse{}, fmt.Errorf("failed to read metadata server response bytes: %+v", err)
 		}
 
-		return string(md), nil
+		return mdsResponse{body: string(md), etag: resp.Header.Get("etag")}, nil
 	}
 
 	return retry.RunWithResponse(ctx, policy, fn)
@@ -388,7 +631,7 @@ func (c *Client) retry(ctx context.Context, cfg requestConfig) (string, error) {
 
 // GetKey gets a specific metadata key.
 func (c *Client) GetKey(ctx context.Context, key string, headers map[string]string) (string, error) {
-	reqURL, err := url.JoinPath(c.metadataURL, key)
+	reqURL, err := url.JoinPath(c.baseURL(), key)
 	if err != nil {
 		return "", fmt.Errorf("failed to form metadata url: %+v", err)
 	}
@@ -402,7 +645,7 @@ func (c *Client) GetKey(ctx context.Context, key string, headers map[string]stri
 
 // GetKeyRecursive gets a specific metadata key recursively and returns JSON output.
 func (c *Client) GetKeyRecursive(ctx context.Context, key string) (string, error) {
-	reqURL, err := url.JoinPath(c.metadataURL, key)
+	reqURL, err := url.JoinPath(c.baseURL(), key)
 	if err != nil {
 		return "", fmt.Errorf("failed to form metadata url: %+v", err)
 	}
@@ -415,6 +658,40 @@ func (c *Client) GetKeyRecursive(ctx context.Context, key string) (string, error
 	return c.retry(ctx, cfg)
 }
 
+// GetKeyRecursiveInto gets a specific metadata key recursively using client and
+// unmarshals the JSON output into out. Use GetKeyRecursive to get the raw output.
+func GetKeyRecursiveInto(ctx context.Context, client MDSClientInterface, key string, out any) error {
+	resp, err := client.GetKeyRecursive(ctx, key)
+	if err != nil {
+		return fmt.Errorf("failed to get %q from MDS: %w", key, err)
+	}
+	if err := json.Unmarshal([]byte(resp), out); err != nil {
+		return fmt.Errorf("failed to unmarshal %q: %w", key, err)
+	}
+	return nil
+}
+
+// GetKeyRecursiveWithEtag gets a specific metadata key recursively and returns JSON
+// output along with the etag reported by the metadata server.
+func (c *Client) GetKeyRecursiveWithEtag(ctx context.Context, key string) (string, string, error) {
+	reqURL, err := url.JoinPath(c.baseURL(), key)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to form metadata url: %+v", err)
+	}
+
+	cfg := requestConfig{
+		baseURL:    reqURL,
+		jsonOutput: true,
+		recursive:  true,
+	}
+
+	resp, err := c.retryWithEtag(ctx, cfg)
+	if err != nil {
+		return "", "", err
+	}
+	return resp.body, resp.etag, nil
+}
+
 // Watch runs a longpoll on metadata server.
 func (c *Client) Watch(ctx context.Context) (*Descriptor, error) {
 	return c.get(ctx, true)
@@ -427,7 +704,7 @@ func (c *Client) Get(ctx context.Context) (*Descriptor, error) {
 
 func (c *Client) get(ctx context.Context, hang bool) (*Descriptor, error) {
 	cfg := requestConfig{
-		baseURL:    c.metadataURL,
+		baseURL:    c.baseURL(),
 		timeout:    defaultHangTimeout,
 		recursive:  true,
 		jsonOutput: true,
@@ -453,30 +730,89 @@ func (c *Client) get(ctx context.Context, hang bool) (*Descriptor, error) {
 // WriteGuestAttributes does a put call to mds changing a guest attribute value.
 func (c *Client) WriteGuestAttributes(ctx context.Context, key, value string) error {
 	logger.Debugf("write guest attribute %q", key)
+	return c.guestAttributeRequest(ctx, http.MethodPut, key, value)
+}
+
+// WriteGuestAttributesBatch writes all the guest attributes in attrs, the PUT calls are
+// issued concurrently with at most maxConcurrentGuestAttributeWrites in flight. It returns
+// an error listing all the attributes that failed to be written.
+func (c *Client) WriteGuestAttributesBatch(ctx context.Context, attrs map[string]string) error {
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		failed []string
+	)
+
+	sem := make(chan struct{}, maxConcurrentGuestAttributeWrites)
+	for key, value := range attrs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(key, value string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			if err := c.WriteGuestAttributes(ctx, key, value); err != nil {
+				mu.Lock()
+				failed = append(failed, fmt.Sprintf("%s: %v", key, err))
+				mu.Unlock()
+			}
+		}(key, value)
+	}
+	wg.Wait()
 
-	finalURL, err := url.JoinPath(c.metadataURL, "instance/guest-attributes/", key)
+	if len(failed) > 0 {
+		sort.Strings(failed)
+		return fmt.Errorf("failed to write guest attributes: [%s]", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// DeleteGuestAttribute does a delete call to mds removing a guest attribute.
+func (c *Client) DeleteGuestAttribute(ctx context.Context, key string) error {
+	logger.Debugf("delete guest attribute %q", key)
+	return c.guestAttributeRequest(ctx, http.MethodDelete, key, "")
+}
+
+// addHeaders adds to req the headers set on all the metadata server requests.
+func (c *Client) addHeaders(req *http.Request) {
+	req.Header.Add("Metadata-Flavor", "Google")
+	if c.userAgent != "" {
+		req.Header.Set("User-Agent", c.userAgent)
+	}
+}
+
+// guestAttributeRequest issues a method call for the guest attribute key with value as the
+// request's body.
+func (c *Client) guestAttributeRequest(ctx context.Context, method, key, value string) error {
+	finalURL, err := url.JoinPath(c.baseURL(), "instance/guest-attributes/", key)
 	if err != nil {
 		return fmt.Errorf("failed to form metadata url: %+v", err)
 	}
 
-	logger.Debugf("Requesting(PUT) MDS URL: %s", finalURL)
+	logger.Debugf("Requesting(%s) MDS URL: %s", method, finalURL)
 
 	// This is a arbitrary retry number.
 	policy := retry.Policy{MaxAttempts: 10, Jitter: backoffDuration, BackoffFactor: 1}
 
-	putCall := func() error {
-		req, err := http.NewRequest("PUT", finalURL, strings.NewReader(value))
+	call := func() error {
+		req, err := http.NewRequest(method, finalURL, strings.NewReader(value))
 		if err != nil {
 			return err
 		}
-		req.Header.Add("Metadata-Flavor", "Google")
+		c.addHeaders(req)
+		// Token failures are temporary, surface them as a retriable MDSReqError.
+		if err := c.addToken(ctx, req); err != nil {
+			return &MDSReqError{status: -1, err: err}
+		}
 		req = req.WithContext(ctx)
 		_, err = c.httpClient.Do(req)
 
 		return err
 	}
 
-	return retry.Run(ctx, policy, putCall)
+	return retry.Run(ctx, policy, call)
 }
 
 func (c *Client) do(ctx context.Context, cfg requestConfig) (*http.Response, error) {
@@ -512,10 +848,16 @@ func (c *Client) do(ctx context.Context, cfg requestConfig) (*http.Response, err
 		return nil, err
 	}
 
-	req.Header.Add("Metadata-Flavor", "Google")
+	c.addHeaders(req)
 	for k, v := range cfg.headers {
 		req.Header.Add(k, v)
 	}
+
+	// A token error is wrapped by the caller in a retriable MDSReqError.
+	if err := c.addToken(ctx, req); err != nil {
+		return nil, err
+	}
+
 	resp, err := c.httpClient.Do(req)
 
 	// If we are canceling httpClient will also wrap the context's error so
@@ -17,12 +17,16 @@ package metadata
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"reflect"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -176,11 +180,178 @@ func TestGetKeyRecursive(t *testing.T) {
 	}
 }
 
+func TestGetKeyRecursiveInto(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/valid":
+			fmt.Fprint(w, `{"ssh-keys":"name:ssh-rsa [KEY] instance1","other-metadata":"foo"}`)
+		case "/invalid":
+			fmt.Fprint(w, "BADJSON")
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+
+	testsrv := httptest.NewServer(handler)
+	defer testsrv.Close()
+
+	client := New()
+	client.metadataURL = testsrv.URL
+
+	var got map[string]string
+	if err := GetKeyRecursiveInto(context.Background(), client, "valid", &got); err != nil {
+		t.Fatalf("GetKeyRecursiveInto(ctx, client, valid, &got) failed unexpectedly with error: %v", err)
+	}
+	want := map[string]string{"ssh-keys": "name:ssh-rsa [KEY] instance1", "other-metadata": "foo"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("GetKeyRecursiveInto(ctx, client, valid, &got) returned unexpected diff (-want +got):\n%s", diff)
+	}
+
+	var syntaxErr *json.SyntaxError
+	if err := GetKeyRecursiveInto(context.Background(), client, "invalid", &got); !errors.As(err, &syntaxErr) {
+		t.Errorf("GetKeyRecursiveInto(ctx, client, invalid, &got) = %v, want json.SyntaxError", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := GetKeyRecursiveInto(ctx, client, "missing", &got); err == nil || !strings.Contains(err.Error(), `"missing"`) {
+		t.Errorf("GetKeyRecursiveInto(ctx, client, missing, &got) = %v, want error naming the key", err)
+	}
+}
+
+func TestNewOptions(t *testing.T) {
+	tests := []struct {
+		name                  string
+		opts                  []Option
+		wantMaxIdleConns      int
+		wantIdleConnTimeout   time.Duration
+		wantDisableKeepAlives bool
+	}{
+		{
+			name:                "defaults",
+			wantMaxIdleConns:    defaultMaxIdleConns,
+			wantIdleConnTimeout: defaultIdleConnTimeout,
+		},
+		{
+			name:                  "options",
+			opts:                  []Option{WithMaxIdleConns(1), WithIdleConnTimeout(time.Minute), WithDisableKeepAlives(true)},
+			wantMaxIdleConns:      1,
+			wantIdleConnTimeout:   time.Minute,
+			wantDisableKeepAlives: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			transport := New(tc.opts...).transport()
+			if transport.MaxIdleConns != tc.wantMaxIdleConns || transport.MaxIdleConnsPerHost != tc.wantMaxIdleConns {
+				t.Errorf("New(%v) max idle connections = %d (per host %d), want %d", tc.opts, transport.MaxIdleConns, transport.MaxIdleConnsPerHost, tc.wantMaxIdleConns)
+			}
+			if transport.IdleConnTimeout != tc.wantIdleConnTimeout {
+				t.Errorf("New(%v) idle connection timeout = %v, want %v", tc.opts, transport.IdleConnTimeout, tc.wantIdleConnTimeout)
+			}
+			if transport.DisableKeepAlives != tc.wantDisableKeepAlives {
+				t.Errorf("New(%v) disable keep-alives = %t, want %t", tc.opts, transport.DisableKeepAlives, tc.wantDisableKeepAlives)
+			}
+		})
+	}
+
+	if defaultIdleConnTimeout <= defaultHangTimeout*time.Second {
+		t.Errorf("defaultIdleConnTimeout = %v, must be longer than the hang timeout %ds", defaultIdleConnTimeout, defaultHangTimeout)
+	}
+}
+
+func TestConnectionReuse(t *testing.T) {
+	tests := []struct {
+		name      string
+		opts      []Option
+		wantConns int
+	}{
+		{
+			name:      "keep_alive",
+			wantConns: 1,
+		},
+		{
+			name:      "disable_keep_alives",
+			opts:      []Option{WithDisableKeepAlives(true)},
+			wantConns: 3,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var conns int
+			testsrv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, "value")
+			}))
+			testsrv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+				if state == http.StateNew {
+					mu.Lock()
+					conns++
+					mu.Unlock()
+				}
+			}
+			testsrv.Start()
+			defer testsrv.Close()
+
+			client := New(tc.opts...)
+			client.metadataURL = testsrv.URL
+			for i := 0; i < 3; i++ {
+				if _, err := client.GetKey(context.Background(), "key", nil); err != nil {
+					t.Fatalf("client.GetKey(ctx, key, nil) failed unexpectedly with error: %v", err)
+				}
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if conns != tc.wantConns {
+				t.Errorf("client opened %d connections for 3 requests, want %d", conns, tc.wantConns)
+			}
+		})
+	}
+}
+
+func TestGetKeyRecursiveWithEtag(t *testing.T) {
+	wantValue := `{"ssh-keys":"name:ssh-rsa [KEY] instance1","block-project-ssh-keys":"false"}`
+	wantEtag := "etag1"
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("etag", wantEtag)
+		fmt.Fprint(w, wantValue)
+	})
+
+	testsrv := httptest.NewServer(handler)
+	defer testsrv.Close()
+
+	client := New()
+	client.metadataURL = testsrv.URL
+
+	key := "key"
+	gotValue, gotEtag, err := client.GetKeyRecursiveWithEtag(context.Background(), key)
+	if err != nil {
+		t.Errorf("client.GetKeyRecursiveWithEtag(ctx, %s) failed unexpectedly with error: %v", key, err)
+	}
+
+	if wantValue != gotValue {
+		t.Errorf("client.GetKeyRecursiveWithEtag(ctx, %s) = %q, want: %q", key, gotValue, wantValue)
+	}
+	if wantEtag != gotEtag {
+		t.Errorf("client.GetKeyRecursiveWithEtag(ctx, %s) returned etag %q, want: %q", key, gotEtag, wantEtag)
+	}
+
+	// The client's own longpoll etag must not be affected by key requests.
+	if client.etag != defaultEtag {
+		t.Errorf("client.GetKeyRecursiveWithEtag(ctx, %s) changed client etag to %q, want: %q", key, client.etag, defaultEtag)
+	}
+}
+
 func TestShouldRetry(t *testing.T) {
 	tests := []struct {
 		desc   string
 		status int
 		err    error
+		ctxErr error
 		want   bool
 	}{
 		{
@@ -201,11 +372,31 @@ func TestShouldRetry(t *testing.T) {
 			want:   true,
 			err:    fmt.Errorf("fake retriable error"),
 		},
+		{
+			desc:   "503_should_retry",
+			status: 503,
+			want:   true,
+			err:    fmt.Errorf("fake server error"),
+		},
+		{
+			desc:   "context_canceled_should_not_retry",
+			status: -1,
+			want:   false,
+			err:    context.Canceled,
+			ctxErr: context.Canceled,
+		},
+		{
+			desc:   "context_deadline_should_not_retry",
+			status: -1,
+			want:   false,
+			err:    context.DeadlineExceeded,
+			ctxErr: context.DeadlineExceeded,
+		},
 	}
 
 	for _, test := range tests {
 		t.Run(test.desc, func(t *testing.T) {
-			err := &MDSReqError{test.status, test.err}
+			err := &MDSReqError{status: test.status, err: test.err, ctxErr: test.ctxErr}
 			if got := shouldRetry(err); got != test.want {
 				t.Errorf("shouldRetry(%+v) = %t, want %t", err, got, test.want)
 			}
@@ -254,6 +445,39 @@ func TestRetry(t *testing.T) {
 	}
 }
 
+func TestRetryContextCanceled(t *testing.T) {
+	var reqs int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqs++
+		// Hold the request until the client gives up.
+		<-r.Context().Done()
+	}))
+	defer ts.Close()
+
+	client := &Client{
+		metadataURL: ts.URL,
+		httpClient: &http.Client{
+			Timeout: 10 * time.Second,
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	req := requestConfig{baseURL: ts.URL}
+	start := time.Now()
+	if _, err := client.retry(ctx, req); err == nil {
+		t.Errorf("retry(ctx, %+v) succeeded with canceled context, want error", req)
+	}
+
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("retry(ctx, %+v) returned after %v, want prompt return on canceled context", req, elapsed)
+	}
+	if reqs != 1 {
+		t.Errorf("retry(ctx, %+v) made %d requests, want: 1", req, reqs)
+	}
+}
+
 func TestRetryError(t *testing.T) {
 	ctx := context.Background()
 	ctr := make(map[string]int)
@@ -279,9 +503,10 @@ func TestRetryError(t *testing.T) {
 	}
 
 	tests := []struct {
-		desc    string
-		mdsKey  string
-		wantCtr int
+		desc         string
+		mdsKey       string
+		wantCtr      int
+		wantNotFound bool
 	}{
 		{
 			desc:    "retries_exhausted",
@@ -289,9 +514,10 @@ func TestRetryError(t *testing.T) {
 			mdsKey:  "/retry",
 		},
 		{
-			desc:    "non_retriable_failure",
-			wantCtr: 1,
-			mdsKey:  "/fail_fast",
+			desc:         "non_retriable_failure",
+			wantCtr:      1,
+			mdsKey:       "/fail_fast",
+			wantNotFound: true,
 		},
 	}
 
@@ -310,6 +536,9 @@ func TestRetryError(t *testing.T) {
 			if ctr[test.mdsKey] != test.wantCtr {
 				t.Errorf("retry(ctx, %+v) retried %d times, should have returned after %d retries", req, ctr[test.mdsKey], test.wantCtr)
 			}
+			if got := IsNotFound(err); got != test.wantNotFound {
+				t.Errorf("IsNotFound(%v) = %t, want %t", err, got, test.wantNotFound)
+			}
 		})
 	}
 }
@@ -353,3 +582,279 @@ func TestVlanInterfaces(t *testing.T) {
 		t.Errorf("json.Unmarshal(%s, &md) returned unexpected diff (-want,+got):\n %s", cfg, diff)
 	}
 }
+
+type testTokenProvider struct {
+	calls    int
+	failures int
+}
+
+func (p *testTokenProvider) Token(context.Context) (string, string, error) {
+	p.calls++
+	if p.calls <= p.failures {
+		return "", "", fmt.Errorf("fake token error")
+	}
+	return "X-Test-Token", fmt.Sprintf("token-%d", p.calls), nil
+}
+
+func TestTokenProvider(t *testing.T) {
+	var gotTokens []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotTokens = append(gotTokens, r.Header.Get("X-Test-Token"))
+		w.Header().Set("etag", "foo")
+		fmt.Fprint(w, "{}")
+	}))
+	defer ts.Close()
+
+	ctx := context.Background()
+	client := New()
+	client.metadataURL = ts.URL
+	client.SetTokenProvider(&testTokenProvider{})
+
+	if _, err := client.GetKey(ctx, "key", nil); err != nil {
+		t.Fatalf("GetKey(ctx, key, nil) failed unexpectedly with error: %v", err)
+	}
+	if _, err := client.Watch(ctx); err != nil {
+		t.Fatalf("Watch(ctx) failed unexpectedly with error: %v", err)
+	}
+	if err := client.WriteGuestAttributes(ctx, "key", "value"); err != nil {
+		t.Fatalf("WriteGuestAttributes(ctx, key, value) failed unexpectedly with error: %v", err)
+	}
+
+	want := []string{"token-1", "token-2", "token-3"}
+	if !reflect.DeepEqual(gotTokens, want) {
+		t.Errorf("metadata server received tokens %v, want: %v", gotTokens, want)
+	}
+
+	// Restoring the default provider must stop adding the token header.
+	client.SetTokenProvider(nil)
+	if _, err := client.GetKey(ctx, "key", nil); err != nil {
+		t.Fatalf("GetKey(ctx, key, nil) failed unexpectedly with error: %v", err)
+	}
+	if got := gotTokens[len(gotTokens)-1]; got != "" {
+		t.Errorf("metadata server received token %q with default provider, want none", got)
+	}
+}
+
+func TestTokenProviderError(t *testing.T) {
+	var reqs int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqs++
+		fmt.Fprint(w, "some-metadata")
+	}))
+	defer ts.Close()
+
+	ctx := context.Background()
+	provider := &testTokenProvider{failures: 2}
+	client := New()
+	client.metadataURL = ts.URL
+	client.SetTokenProvider(provider)
+
+	// Token failures must be retried until a token is available.
+	if _, err := client.GetKey(ctx, "key", nil); err != nil {
+		t.Fatalf("GetKey(ctx, key, nil) failed unexpectedly with error: %v", err)
+	}
+	if provider.calls != 3 || reqs != 1 {
+		t.Errorf("GetKey(ctx, key, nil) fetched token %d times and made %d requests, want: 3 and 1", provider.calls, reqs)
+	}
+}
+
+func TestGuestAttributesBatchAndDelete(t *testing.T) {
+	var mu sync.Mutex
+	attrs := make(map[string]string)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := strings.TrimPrefix(r.URL.Path, "/instance/guest-attributes/")
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("io.ReadAll(%s) failed unexpectedly with error: %v", r.URL.Path, err)
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.Method {
+		case http.MethodPut:
+			attrs[key] = string(body)
+		case http.MethodDelete:
+			delete(attrs, key)
+		default:
+			t.Errorf("unexpected %s request for %s", r.Method, r.URL.Path)
+		}
+	}))
+	defer ts.Close()
+
+	ctx := context.Background()
+	client := New()
+	client.metadataURL = ts.URL
+
+	want := map[string]string{
+		"guest-agent/key1": "value1",
+		"guest-agent/key2": "value2",
+		"guest-agent/key3": "value3",
+		"guest-agent/key4": "value4",
+		"guest-agent/key5": "value5",
+		"guest-agent/key6": "value6",
+	}
+	if err := client.WriteGuestAttributesBatch(ctx, want); err != nil {
+		t.Fatalf("WriteGuestAttributesBatch(ctx, %v) failed unexpectedly with error: %v", want, err)
+	}
+	if !reflect.DeepEqual(attrs, want) {
+		t.Errorf("WriteGuestAttributesBatch(ctx, %v) wrote %v, want: %v", want, attrs, want)
+	}
+
+	if err := client.DeleteGuestAttribute(ctx, "guest-agent/key1"); err != nil {
+		t.Fatalf("DeleteGuestAttribute(ctx, guest-agent/key1) failed unexpectedly with error: %v", err)
+	}
+	if _, found := attrs["guest-agent/key1"]; found || len(attrs) != len(want)-1 {
+		t.Errorf("DeleteGuestAttribute(ctx, guest-agent/key1) left attributes %v, want only guest-agent/key1 removed", attrs)
+	}
+}
+
+func TestUserAgent(t *testing.T) {
+	var mu sync.Mutex
+	var got []string
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		got = append(got, r.Header.Get("User-Agent"))
+		fmt.Fprint(w, "value")
+	}))
+	defer ts.Close()
+
+	ctx := context.Background()
+	for _, tc := range []struct {
+		name string
+		opts []Option
+		want string
+	}{
+		{
+			name: "default",
+			want: defaultUserAgent,
+		},
+		{
+			name: "override",
+			opts: []Option{WithUserAgent("GCEGuestAgent/20240101.00")},
+			want: "GCEGuestAgent/20240101.00",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got = nil
+			client := New(tc.opts...)
+			client.metadataURL = ts.URL
+
+			if _, err := client.GetKey(ctx, "key", nil); err != nil {
+				t.Fatalf("GetKey(ctx, key) failed unexpectedly with error: %v", err)
+			}
+			if err := client.WriteGuestAttributes(ctx, "guest-agent/key", "value"); err != nil {
+				t.Fatalf("WriteGuestAttributes(ctx, guest-agent/key) failed unexpectedly with error: %v", err)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if len(got) != 2 {
+				t.Fatalf("client made %d requests, want: 2", len(got))
+			}
+			for _, ua := range got {
+				if ua != tc.want {
+					t.Errorf("request User-Agent = %q, want: %q", ua, tc.want)
+				}
+			}
+		})
+	}
+
+	if !strings.Contains(defaultUserAgent, "/") {
+		t.Errorf("defaultUserAgent = %q, want program/version", defaultUserAgent)
+	}
+}
+
+func TestProxy(t *testing.T) {
+	for _, u := range []string{defaultMetadataURL, ipv6MetadataURL, "http://metadata.google.internal/computeMetadata/v1/"} {
+		req, err := http.NewRequest(http.MethodGet, u, nil)
+		if err != nil {
+			t.Fatalf("http.NewRequest(GET, %s) failed unexpectedly with error: %v", u, err)
+		}
+		got, err := proxy(req)
+		if err != nil || got != nil {
+			t.Errorf("proxy(%s) = %v, %v, want no proxy", u, got, err)
+		}
+	}
+}
+
+func TestBaseURL(t *testing.T) {
+	t.Cleanup(func() { PreferIPv6(false) })
+
+	tests := []struct {
+		name        string
+		metadataURL string
+		preferIPv6  bool
+		want        string
+	}{
+		{
+			name: "default",
+			want: defaultMetadataURL,
+		},
+		{
+			name:       "prefer_ipv6",
+			preferIPv6: true,
+			want:       ipv6MetadataURL,
+		},
+		{
+			name:        "overridden",
+			metadataURL: "http://localhost/",
+			preferIPv6:  true,
+			want:        "http://localhost/",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			client := New()
+			client.metadataURL = tc.metadataURL
+			PreferIPv6(tc.preferIPv6)
+
+			if got := client.baseURL(); got != tc.want {
+				t.Errorf("baseURL() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestDescriptorUnmarshalJSONErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     string
+		wantType bool
+		want     []string
+	}{
+		{
+			name: "syntax_error",
+			data: "{\n  \"instance\": {\n    \"hostname\": \"vm\",,\n  }\n}",
+			want: []string{"JSON syntax error", `    "hostname": "vm",,` + "\n" + strings.Repeat(" ", 21) + "^"},
+		},
+		{
+			name:     "type_error",
+			data:     "{\n  \"instance\": {\n    \"hostname\": 5\n  }\n}",
+			wantType: true,
+			want:     []string{"JSON type error", `field "instance.hostname"`, "cannot unmarshal number into string", "line 3", `    "hostname": 5` + "\n" + strings.Repeat(" ", 16) + "^"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var got Descriptor
+			err := got.UnmarshalJSON([]byte(tc.data))
+			if err == nil {
+				t.Fatalf("Descriptor.UnmarshalJSON(%q) succeeded, want error", tc.data)
+			}
+			for _, want := range tc.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("Descriptor.UnmarshalJSON(%q) = %q, want it to contain %q", tc.data, err, want)
+				}
+			}
+			var tErr *json.UnmarshalTypeError
+			if got := errors.As(err, &tErr); got != tc.wantType {
+				t.Errorf("errors.As(%v, *json.UnmarshalTypeError) = %t, want %t", err, got, tc.wantType)
+			}
+		})
+	}
+}
@@ -19,11 +19,28 @@ import (
 	"context"
 	"fmt"
 	"math"
+	"math/rand"
 	"time"
 
 	"github.com/GoogleCloudPlatform/guest-logging-go/logger"
 )
 
+// JitterMode defines how the computed backoff is randomized between attempts.
+type JitterMode int
+
+const (
+	// JitterNone waits exactly the computed backoff, it's the default.
+	JitterNone JitterMode = iota
+	// JitterFull waits a random duration between zero and the computed backoff.
+	JitterFull
+	// JitterEqual waits half the computed backoff plus a random duration up to the
+	// other half.
+	JitterEqual
+)
+
+// randInt63n returns a random number in [0, n), replaceable by unit tests.
+var randInt63n = rand.Int63n
+
 // IsRetriable is method signature for implementing to override default logic of retrying each error.
 type IsRetriable func(error) bool
 
@@ -39,13 +56,33 @@ type Policy struct {
 	// ShouldRetry is optional and the way to override default retry logic of retry every error.
 	// If ShouldRetry is not provided/implemented every error will be retried until all attempts are exhausted.
 	ShouldRetry IsRetriable
+	// MaxElapsed is optional and caps the total time spent retrying. No further attempt is made
+	// once it has elapsed or if the next attempt would start after it, regardless of the
+	// attempts left. Zero means no cap, only MaxAttempts applies.
+	MaxElapsed time.Duration
+	// JitterMode defines how the backoff between attempts is randomized, randomizing it
+	// decorrelates the retries of many clients failing at the same time.
+	JitterMode JitterMode
 }
 
 // backoff computes interval between retries. Interval is jitter*(backoffFactor^attempt).
 // For e.g. if jitter was set to 10 and factor was 3, backoff between attempts would be [10, 30, 90, 270...].
+// The result is then randomized according to the policy's JitterMode.
 func backoff(attempt int, policy Policy) time.Duration {
-	b := float64(policy.Jitter) * math.Pow(policy.BackoffFactor, float64(attempt))
-	return time.Duration(b)
+	b := time.Duration(float64(policy.Jitter) * math.Pow(policy.BackoffFactor, float64(attempt)))
+	if b <= 0 {
+		return b
+	}
+
+	switch policy.JitterMode {
+	case JitterFull:
+		return time.Duration(randInt63n(int64(b)))
+	case JitterEqual:
+		half := b / 2
+		return half + time.Duration(randInt63n(int64(b-half)))
+	default:
+		return b
+	}
 }
 
 // isRetriable checks if error is retriable. If ShouldRetry is unimplemented it always returns
@@ -68,26 +105,32 @@ func RunWithResponse[T any](ctx context.Context, policy Policy, f func() (T, err
 		return res, fmt.Errorf("retry function cannot be nil")
 	}
 
+	start := time.Now()
 	for attempt := 0; attempt < policy.MaxAttempts; attempt++ {
 		if res, err = f(); err == nil {
 			return res, nil
 		}
 
 		if err != nil && !isRetriable(policy, err) {
-			return res, fmt.Errorf("giving up, retry policy returned false on error: %+v", err)
+			return res, fmt.Errorf("giving up, retry policy returned false on error: %w", err)
 		}
 
 		logger.Debugf("Attempt %d failed with error %+v", attempt, err)
 
 		// Return early, no need to wait if all retries have exhausted.
 		if attempt+1 >= policy.MaxAttempts {
-			return res, fmt.Errorf("exhausted all (%d) retries, last error: %+v", policy.MaxAttempts, err)
+			return res, fmt.Errorf("exhausted all (%d) retries, last error: %w", policy.MaxAttempts, err)
+		}
+
+		wait := backoff(attempt, policy)
+		if policy.MaxElapsed > 0 && time.Since(start)+wait > policy.MaxElapsed {
+			return res, fmt.Errorf("exceeded maximum retry duration (%s) after %d attempts, last error: %w", policy.MaxElapsed, attempt+1, err)
 		}
 
 		select {
 		case <-ctx.Done():
 			return res, ctx.Err()
-		case <-time.After(backoff(attempt, policy)):
+		case <-time.After(wait):
 		}
 	}
 	return res, fmt.Errorf("num of retries set to 0, made no attempts to run")
@@ -18,6 +18,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"strings"
 	"testing"
 	"time"
 )
@@ -191,3 +192,145 @@ func TestIsRetriable(t *testing.T) {
 		})
 	}
 }
+
+func TestRetryMaxElapsed(t *testing.T) {
+	tests := []struct {
+		name         string
+		policy       Policy
+		ctxTimeout   time.Duration
+		wantErr      string
+		wantCtxErr   bool
+		wantAttempts int
+	}{
+		{
+			name:    "max_elapsed_first",
+			policy:  Policy{MaxAttempts: 100, BackoffFactor: 1, Jitter: 10 * time.Millisecond, MaxElapsed: 35 * time.Millisecond},
+			wantErr: "exceeded maximum retry duration",
+		},
+		{
+			name:         "max_attempts_first",
+			policy:       Policy{MaxAttempts: 3, BackoffFactor: 1, Jitter: time.Millisecond, MaxElapsed: time.Hour},
+			wantErr:      "exhausted all (3) retries",
+			wantAttempts: 3,
+		},
+		{
+			name:       "context_first",
+			policy:     Policy{MaxAttempts: 100, BackoffFactor: 1, Jitter: 10 * time.Millisecond, MaxElapsed: time.Hour},
+			ctxTimeout: 25 * time.Millisecond,
+			wantCtxErr: true,
+		},
+		{
+			name:    "next_attempt_past_max_elapsed",
+			policy:  Policy{MaxAttempts: 100, BackoffFactor: 1, Jitter: time.Hour, MaxElapsed: time.Minute},
+			wantErr: "exceeded maximum retry duration (1m0s) after 1 attempts",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tc.ctxTimeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tc.ctxTimeout)
+				defer cancel()
+			}
+
+			ctr := 0
+			fn := func() error {
+				ctr++
+				return fmt.Errorf("fake error")
+			}
+
+			start := time.Now()
+			err := Run(ctx, tc.policy, fn)
+			if err == nil {
+				t.Fatalf("Run(ctx, %+v, fn) succeeded, want error", tc.policy)
+			}
+
+			if tc.wantCtxErr && !errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("Run(ctx, %+v, fn) = %v, want context deadline exceeded", tc.policy, err)
+			}
+			if tc.wantErr != "" && !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("Run(ctx, %+v, fn) = %v, want error containing %q", tc.policy, err, tc.wantErr)
+			}
+			if tc.wantAttempts > 0 && ctr != tc.wantAttempts {
+				t.Errorf("Run(ctx, %+v, fn) made %d attempts, want %d", tc.policy, ctr, tc.wantAttempts)
+			}
+			if tc.policy.MaxElapsed < time.Minute && time.Since(start) > tc.policy.MaxElapsed+50*time.Millisecond {
+				t.Errorf("Run(ctx, %+v, fn) took %s, want at most about %s", tc.policy, time.Since(start), tc.policy.MaxElapsed)
+			}
+		})
+	}
+}
+
+func TestBackoffJitterMode(t *testing.T) {
+	tests := []struct {
+		name string
+		mode JitterMode
+		rand func(n int64) int64
+		want []time.Duration
+	}{
+		{
+			name: "none",
+			mode: JitterNone,
+			want: []time.Duration{10, 20, 40},
+		},
+		{
+			name: "full_min",
+			mode: JitterFull,
+			rand: func(int64) int64 { return 0 },
+			want: []time.Duration{0, 0, 0},
+		},
+		{
+			name: "full_max",
+			mode: JitterFull,
+			rand: func(n int64) int64 { return n - 1 },
+			want: []time.Duration{9, 19, 39},
+		},
+		{
+			name: "equal_min",
+			mode: JitterEqual,
+			rand: func(int64) int64 { return 0 },
+			want: []time.Duration{5, 10, 20},
+		},
+		{
+			name: "equal_max",
+			mode: JitterEqual,
+			rand: func(n int64) int64 { return n - 1 },
+			want: []time.Duration{9, 19, 39},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.rand != nil {
+				oldRand := randInt63n
+				randInt63n = tc.rand
+				t.Cleanup(func() { randInt63n = oldRand })
+			}
+
+			policy := Policy{MaxAttempts: len(tc.want), BackoffFactor: 2, Jitter: time.Duration(10), JitterMode: tc.mode}
+			for i, want := range tc.want {
+				if got := backoff(i, policy); got != want {
+					t.Errorf("backoff(%d, %+v) = %d, want %d", i, policy, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestBackoffJitterModeRange(t *testing.T) {
+	for _, mode := range []JitterMode{JitterFull, JitterEqual} {
+		policy := Policy{BackoffFactor: 1, Jitter: time.Second, JitterMode: mode}
+		lower := time.Duration(0)
+		if mode == JitterEqual {
+			lower = time.Second / 2
+		}
+
+		for i := 0; i < 100; i++ {
+			if got := backoff(0, policy); got < lower || got >= time.Second {
+				t.Fatalf("backoff(0, %+v) = %s, want in [%s, %s)", policy, got, lower, time.Second)
+			}
+		}
+	}
+}
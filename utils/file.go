@@ -17,12 +17,41 @@
 package utils
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"io/fs"
 	"os"
 	"path/filepath"
+	"time"
+
+	"github.com/GoogleCloudPlatform/guest-agent/retry"
 )
 
+// ErrFileTooLarge is returned by CopyFileStream when the source file exceeds the
+// maximum allowed size.
+var ErrFileTooLarge = errors.New("file exceeds the maximum allowed size")
+
+// ErrNotSymlink is returned by ReadSymlinkTarget when the path exists but is not
+// a symbolic link.
+var ErrNotSymlink = errors.New("not a symbolic link")
+
+// Type is the type of file FileExists checks for.
+type Type int
+
+const (
+	// TypeFile is a regular file, or a symbolic link to one.
+	TypeFile Type = iota
+	// TypeDir is a directory, or a symbolic link to one.
+	TypeDir
+	// TypeSymlink is a symbolic link itself, whether its target exists or not.
+	TypeSymlink
+)
+
+// copyFilePolicy is the retry policy used by CopyFileStream on transient errors.
+var copyFilePolicy = retry.Policy{MaxAttempts: 3, BackoffFactor: 2, Jitter: 100 * time.Millisecond}
+
 // SaferWriteFile writes to a temporary file and then replaces the expected output file.
 // This prevents other processes from reading partial content while the writer is still writing.
 func SaferWriteFile(content []byte, outputFile string, perm fs.FileMode) error {
@@ -71,6 +100,115 @@ func CopyFile(src, dst string, perm fs.FileMode) error {
 	return nil
 }
 
+// CopyFileStream copies content from src to dst streaming it rather than reading
+// it all in memory, and sets permissions. Copying fails with ErrFileTooLarge if src
+// is larger than maxSize bytes. The content is written to a temporary file renamed
+// over dst, a failed copy never leaves a partial dst behind. Transient failures are
+// retried, a missing src or a too large file are not.
+func CopyFileStream(ctx context.Context, src, dst string, perm fs.FileMode, maxSize int64) error {
+	policy := copyFilePolicy
+	policy.ShouldRetry = func(err error) bool {
+		return !errors.Is(err, ErrFileTooLarge) && !errors.Is(err, fs.ErrNotExist)
+	}
+
+	var copyErr error
+	err := retry.Run(ctx, policy, func() error {
+		copyErr = copyFileStream(src, dst, perm, maxSize)
+		return copyErr
+	})
+
+	// Return non-retriable errors as is so callers can inspect them.
+	if err != nil && copyErr != nil && !policy.ShouldRetry(copyErr) {
+		return copyErr
+	}
+	return err
+}
+
+// copyFileStream does a single CopyFileStream attempt.
+func copyFileStream(src, dst string, perm fs.FileMode, maxSize int64) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("failed to open %q: %w", src, err)
+	}
+	defer in.Close()
+
+	dir := filepath.Dir(dst)
+	if err := os.MkdirAll(dir, perm); err != nil {
+		return fmt.Errorf("unable to create required directories for %q: %w", dst, err)
+	}
+
+	tmp, err := os.CreateTemp(dir, filepath.Base(dst)+"*")
+	if err != nil {
+		return fmt.Errorf("unable to create temporary file under %q: %w", dir, err)
+	}
+	// Only relevant if we fail before renaming it.
+	defer os.Remove(tmp.Name())
+
+	// Read at most one byte past the limit to detect larger files.
+	n, err := io.Copy(tmp, io.LimitReader(in, maxSize+1))
+	if err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to copy %q to %q: %w", src, dst, err)
+	}
+
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close temporary file: %w", err)
+	}
+
+	if n > maxSize {
+		return fmt.Errorf("unable to copy %q, limit is %d bytes: %w", src, maxSize, ErrFileTooLarge)
+	}
+
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return fmt.Errorf("unable to set permissions on temporary file %q: %w", tmp.Name(), err)
+	}
+
+	if err := os.Rename(tmp.Name(), dst); err != nil {
+		return fmt.Errorf("failed to write %q: %w", dst, err)
+	}
+
+	return nil
+}
+
+// FileExists returns true if path exists and is of type t. Symbolic links are
+// followed unless checking for TypeSymlink.
+func FileExists(path string, t Type) bool {
+	stat := os.Stat
+	if t == TypeSymlink {
+		stat = os.Lstat
+	}
+
+	info, err := stat(path)
+	if err != nil {
+		return false
+	}
+
+	switch t {
+	case TypeFile:
+		return info.Mode().IsRegular()
+	case TypeDir:
+		return info.IsDir()
+	case TypeSymlink:
+		return info.Mode()&fs.ModeSymlink != 0
+	default:
+		return false
+	}
+}
+
+// ReadSymlinkTarget returns the target of the symbolic link path. If path doesn't
+// exist the returned error satisfies errors.Is(err, fs.ErrNotExist), if it's not
+// a symbolic link errors.Is(err, ErrNotSymlink).
+func ReadSymlinkTarget(path string) (string, error) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return "", err
+	}
+	if info.Mode()&fs.ModeSymlink == 0 {
+		return "", fmt.Errorf("%q: %w", path, ErrNotSymlink)
+	}
+	return os.Readlink(path)
+}
+
 // WriteFile creates parent directories if required and writes content to the output file.
 func WriteFile(content []byte, outputFile string, perm fs.FileMode) error {
 	if err := os.MkdirAll(filepath.Dir(outputFile), perm); err != nil {
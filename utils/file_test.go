@@ -15,6 +15,9 @@
 package utils
 
 import (
+	"context"
+	"errors"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"testing"
@@ -85,3 +88,146 @@ func TestCopyFileError(t *testing.T) {
 		t.Errorf("CopyFile(%s, %s) succeeded for non-existent file, want error", src, dst)
 	}
 }
+
+func TestCopyFileStream(t *testing.T) {
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "src")
+	want := "testdata"
+	if err := os.WriteFile(src, []byte(want), 0777); err != nil {
+		t.Fatalf("failed to write test source file: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		maxSize int64
+		wantErr bool
+	}{
+		{"below_limit", 100, false},
+		{"at_limit", int64(len(want)), false},
+		{"above_limit", int64(len(want)) - 1, true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			dst := filepath.Join(tmp, tc.name, "dst")
+			err := CopyFileStream(context.Background(), src, dst, 0644, tc.maxSize)
+
+			if tc.wantErr {
+				if !errors.Is(err, ErrFileTooLarge) {
+					t.Errorf("CopyFileStream(ctx, %s, %s, 0644, %d) = %v, want: %v", src, dst, tc.maxSize, err, ErrFileTooLarge)
+				}
+				if _, err := os.Stat(dst); !os.IsNotExist(err) {
+					t.Errorf("CopyFileStream(ctx, %s, %s, 0644, %d) left destination file behind, os.Stat() = %v", src, dst, tc.maxSize, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("CopyFileStream(ctx, %s, %s, 0644, %d) failed unexpectedly with error: %v", src, dst, tc.maxSize, err)
+			}
+
+			got, err := os.ReadFile(dst)
+			if err != nil {
+				t.Fatalf("unable to read %q: %v", dst, err)
+			}
+			if string(got) != want {
+				t.Errorf("CopyFileStream(ctx, %s, %s, 0644, %d) copied %q, expected %q", src, dst, tc.maxSize, string(got), want)
+			}
+
+			i, err := os.Stat(dst)
+			if err != nil {
+				t.Fatalf("os.Stat(%s) failed unexpectedly with err: %+v", dst, err)
+			}
+			if i.Mode().Perm() != 0o644 {
+				t.Errorf("CopyFileStream(ctx, %s, %s) set incorrect permissions, os.Stat(%s) = %o, want %o", src, dst, dst, i.Mode().Perm(), 0o644)
+			}
+		})
+	}
+}
+
+func TestCopyFileStreamError(t *testing.T) {
+	tmp := t.TempDir()
+	dst := filepath.Join(tmp, "dst")
+	src := filepath.Join(tmp, "src")
+
+	if err := CopyFileStream(context.Background(), src, dst, 0644, 100); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("CopyFileStream(ctx, %s, %s, 0644, 100) = %v, want: %v", src, dst, err, fs.ErrNotExist)
+	}
+}
+
+func TestFileExists(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, nil, 0644); err != nil {
+		t.Fatalf("os.WriteFile(%s) failed unexpectedly with error: %v", file, err)
+	}
+	fileLink := filepath.Join(dir, "file-link")
+	if err := os.Symlink(file, fileLink); err != nil {
+		t.Fatalf("os.Symlink(%s, %s) failed unexpectedly with error: %v", file, fileLink, err)
+	}
+	dirLink := filepath.Join(dir, "dir-link")
+	if err := os.Symlink(dir, dirLink); err != nil {
+		t.Fatalf("os.Symlink(%s, %s) failed unexpectedly with error: %v", dir, dirLink, err)
+	}
+	danglingLink := filepath.Join(dir, "dangling-link")
+	if err := os.Symlink(filepath.Join(dir, "missing"), danglingLink); err != nil {
+		t.Fatalf("os.Symlink(%s) failed unexpectedly with error: %v", danglingLink, err)
+	}
+
+	tests := []struct {
+		name string
+		path string
+		typ  Type
+		want bool
+	}{
+		{name: "file_as_file", path: file, typ: TypeFile, want: true},
+		{name: "file_as_dir", path: file, typ: TypeDir, want: false},
+		{name: "file_as_symlink", path: file, typ: TypeSymlink, want: false},
+		{name: "dir_as_dir", path: dir, typ: TypeDir, want: true},
+		{name: "dir_as_file", path: dir, typ: TypeFile, want: false},
+		{name: "dir_as_symlink", path: dir, typ: TypeSymlink, want: false},
+		{name: "file_link_as_file", path: fileLink, typ: TypeFile, want: true},
+		{name: "file_link_as_symlink", path: fileLink, typ: TypeSymlink, want: true},
+		{name: "dir_link_as_dir", path: dirLink, typ: TypeDir, want: true},
+		{name: "dangling_link_as_symlink", path: danglingLink, typ: TypeSymlink, want: true},
+		{name: "dangling_link_as_file", path: danglingLink, typ: TypeFile, want: false},
+		{name: "missing", path: filepath.Join(dir, "missing"), typ: TypeFile, want: false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := FileExists(tc.path, tc.typ); got != tc.want {
+				t.Errorf("FileExists(%s, %d) = %t, want %t", tc.path, tc.typ, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestReadSymlinkTarget(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, nil, 0644); err != nil {
+		t.Fatalf("os.WriteFile(%s) failed unexpectedly with error: %v", file, err)
+	}
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink(file, link); err != nil {
+		t.Fatalf("os.Symlink(%s, %s) failed unexpectedly with error: %v", file, link, err)
+	}
+
+	got, err := ReadSymlinkTarget(link)
+	if err != nil {
+		t.Fatalf("ReadSymlinkTarget(%s) failed unexpectedly with error: %v", link, err)
+	}
+	if got != file {
+		t.Errorf("ReadSymlinkTarget(%s) = %s, want %s", link, got, file)
+	}
+
+	if _, err := ReadSymlinkTarget(file); !errors.Is(err, ErrNotSymlink) {
+		t.Errorf("ReadSymlinkTarget(%s) = %v, want error %v", file, err, ErrNotSymlink)
+	}
+
+	missing := filepath.Join(dir, "missing")
+	if _, err := ReadSymlinkTarget(missing); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("ReadSymlinkTarget(%s) = %v, want error %v", missing, err, fs.ErrNotExist)
+	}
+}
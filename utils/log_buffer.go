@@ -0,0 +1,118 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogBufferEntry is a log line captured by a LogBuffer.
+type LogBufferEntry struct {
+	// Time is when the line was written.
+	Time time.Time
+	// Message is the formatted log line.
+	Message string
+}
+
+// LogBuffer is an io.Writer keeping the last lines written to it in memory, it's
+// meant to be added to the logger's writers so recent entries can be retrieved
+// from a running process without waiting for log export.
+type LogBuffer struct {
+	mu sync.Mutex
+	// entries is the ring of captured lines, next is the slot the next line is
+	// written to and full reports whether the ring wrapped around already.
+	entries []LogBufferEntry
+	next    int
+	full    bool
+	// now returns the current time, replaceable by unit tests.
+	now func() time.Time
+}
+
+// NewLogBuffer returns a LogBuffer keeping the last size lines, a zero size
+// disables capturing.
+func NewLogBuffer(size int) *LogBuffer {
+	if size < 0 {
+		size = 0
+	}
+	return &LogBuffer{
+		entries: make([]LogBufferEntry, size),
+		now:     time.Now,
+	}
+}
+
+// Write captures b as a single line, a trailing newline is dropped.
+func (l *LogBuffer) Write(b []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.entries) == 0 {
+		return len(b), nil
+	}
+
+	l.entries[l.next] = LogBufferEntry{Time: l.now(), Message: strings.TrimRight(string(b), "\n")}
+	l.next = (l.next + 1) % len(l.entries)
+	if l.next == 0 {
+		l.full = true
+	}
+	return len(b), nil
+}
+
+// SetSize changes the number of lines kept, the most recent lines fitting the
+// new size are preserved. A zero size disables capturing.
+func (l *LogBuffer) SetSize(size int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if size < 0 {
+		size = 0
+	}
+	if size == len(l.entries) {
+		return
+	}
+
+	if size == 0 {
+		l.entries, l.next, l.full = nil, 0, false
+		return
+	}
+
+	entries := make([]LogBufferEntry, size)
+	kept := copy(entries, l.tail(size))
+	l.entries, l.next, l.full = entries, kept%size, kept == size
+}
+
+// Tail returns the last n captured lines, oldest first. A non positive n returns
+// all of them.
+func (l *LogBuffer) Tail(n int) []LogBufferEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.tail(n)
+}
+
+// tail returns a copy of the last n captured lines, oldest first, l.mu must be
+// held.
+func (l *LogBuffer) tail(n int) []LogBufferEntry {
+	var ordered []LogBufferEntry
+	if l.full {
+		ordered = append(ordered, l.entries[l.next:]...)
+	}
+	ordered = append(ordered, l.entries[:l.next]...)
+
+	if n > 0 && n < len(ordered) {
+		ordered = ordered[len(ordered)-n:]
+	}
+	return ordered
+}
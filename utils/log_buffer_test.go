@@ -0,0 +1,80 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func logBufferMessages(entries []LogBufferEntry) []string {
+	var msgs []string
+	for _, e := range entries {
+		msgs = append(msgs, e.Message)
+	}
+	return msgs
+}
+
+func TestLogBuffer(t *testing.T) {
+	l := NewLogBuffer(3)
+	for i := 1; i <= 5; i++ {
+		fmt.Fprintf(l, "line %d\n", i)
+	}
+
+	tests := []struct {
+		name string
+		n    int
+		want []string
+	}{
+		{name: "all", n: 0, want: []string{"line 3", "line 4", "line 5"}},
+		{name: "last_two", n: 2, want: []string{"line 4", "line 5"}},
+		{name: "more_than_kept", n: 10, want: []string{"line 3", "line 4", "line 5"}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if diff := cmp.Diff(tc.want, logBufferMessages(l.Tail(tc.n))); diff != "" {
+				t.Errorf("Tail(%d) returned diff (-want +got):\n%s", tc.n, diff)
+			}
+		})
+	}
+}
+
+func TestLogBufferSetSize(t *testing.T) {
+	l := NewLogBuffer(4)
+	for i := 1; i <= 3; i++ {
+		fmt.Fprintf(l, "line %d\n", i)
+	}
+
+	l.SetSize(2)
+	if diff := cmp.Diff([]string{"line 2", "line 3"}, logBufferMessages(l.Tail(0))); diff != "" {
+		t.Errorf("Tail(0) after shrinking returned diff (-want +got):\n%s", diff)
+	}
+
+	l.SetSize(3)
+	fmt.Fprintf(l, "line 4\n")
+	fmt.Fprintf(l, "line 5\n")
+	if diff := cmp.Diff([]string{"line 3", "line 4", "line 5"}, logBufferMessages(l.Tail(0))); diff != "" {
+		t.Errorf("Tail(0) after growing returned diff (-want +got):\n%s", diff)
+	}
+
+	l.SetSize(0)
+	fmt.Fprintf(l, "line 6\n")
+	if got := l.Tail(0); len(got) != 0 {
+		t.Errorf("Tail(0) with capturing disabled returned %v, want none", got)
+	}
+}
@@ -0,0 +1,174 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// LogFunc is a logging function, e.g. logger.Errorf.
+type LogFunc func(format string, args ...any)
+
+// LogLimiter collapses repeated identical log messages. The first occurrence of a
+// message is logged, further occurrences within the interval are only counted and
+// summarized by the first occurrence logged after the interval elapsed.
+type LogLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	// entries tracks the messages logged in the current interval.
+	entries map[string]*limitedMessage
+	// now returns the current time, replaceable by unit tests.
+	now func() time.Time
+}
+
+// limitedMessage is a message logged by a LogLimiter.
+type limitedMessage struct {
+	// logged is when the message was last logged.
+	logged time.Time
+	// suppressed is the number of occurrences not logged since.
+	suppressed int
+}
+
+// NewLogLimiter returns a LogLimiter logging identical messages at most once per
+// interval, a zero interval disables rate limiting.
+func NewLogLimiter(interval time.Duration) *LogLimiter {
+	return &LogLimiter{
+		interval: interval,
+		entries:  make(map[string]*limitedMessage),
+		now:      time.Now,
+	}
+}
+
+// SetInterval changes the rate limiting interval, a zero interval disables it.
+func (l *LogLimiter) SetInterval(interval time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.interval = interval
+}
+
+// Logf formats the message and logs it with log unless it was already logged in
+// the current interval.
+func (l *LogLimiter) Logf(log LogFunc, format string, args ...any) {
+	msg := fmt.Sprintf(format, args...)
+
+	l.mu.Lock()
+	now := l.now()
+	if l.interval <= 0 {
+		l.mu.Unlock()
+		log("%s", msg)
+		return
+	}
+
+	// Forget messages not seen for a whole interval, their summary is only due
+	// when they occur again.
+	for key, entry := range l.entries {
+		if entry.suppressed == 0 && now.Sub(entry.logged) >= l.interval {
+			delete(l.entries, key)
+		}
+	}
+
+	entry, found := l.entries[msg]
+	if found && now.Sub(entry.logged) < l.interval {
+		entry.suppressed++
+		l.mu.Unlock()
+		return
+	}
+
+	var suppressed int
+	var since time.Duration
+	if found {
+		suppressed, since = entry.suppressed, now.Sub(entry.logged)
+	}
+	l.entries[msg] = &limitedMessage{logged: now}
+	l.mu.Unlock()
+
+	if suppressed > 0 {
+		log("%s (%d occurrences in the last %s)", msg, suppressed+1, since.Round(time.Second))
+		return
+	}
+	log("%s", msg)
+}
+
+// Reset forgets the logged messages, the next occurrence of any message is logged
+// again. Use it once the condition causing the messages is resolved, the
+// occurrences suppressed since a message was last logged are summarized with log.
+func (l *LogLimiter) Reset(log LogFunc) {
+	l.mu.Lock()
+	now := l.now()
+	entries := l.entries
+	l.entries = make(map[string]*limitedMessage)
+	l.mu.Unlock()
+
+	msgs := make([]string, 0, len(entries))
+	for msg := range entries {
+		msgs = append(msgs, msg)
+	}
+	sort.Strings(msgs)
+
+	for _, msg := range msgs {
+		entry := entries[msg]
+		if entry.suppressed > 0 {
+			log("%s (%d more occurrences in the last %s, resolved)", msg, entry.suppressed, now.Sub(entry.logged).Round(time.Second))
+		}
+	}
+}
+
+// limiterState is the persisted form of a limitedMessage.
+type limiterState struct {
+	Logged     time.Time `json:"logged"`
+	Suppressed int       `json:"suppressed"`
+}
+
+// Load restores the messages saved by Save, so processes running periodically,
+// i.e. from a timer, rate limit the messages they repeat across runs. A missing
+// or invalid file is ignored.
+func (l *LogLimiter) Load(path string) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+
+	var state map[string]limiterState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for msg, entry := range state {
+		l.entries[msg] = &limitedMessage{logged: entry.Logged, suppressed: entry.Suppressed}
+	}
+}
+
+// Save persists the logged messages to path for Load.
+func (l *LogLimiter) Save(path string) error {
+	l.mu.Lock()
+	state := make(map[string]limiterState, len(l.entries))
+	for msg, entry := range l.entries {
+		state[msg] = limiterState{Logged: entry.logged, Suppressed: entry.suppressed}
+	}
+	l.mu.Unlock()
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("failed to marshal log limiter state: %w", err)
+	}
+	return SaferWriteFile(data, path, 0644)
+}
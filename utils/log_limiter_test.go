@@ -0,0 +1,112 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestLogLimiter(t *testing.T) {
+	var logged []string
+	log := func(format string, args ...any) { logged = append(logged, fmt.Sprintf(format, args...)) }
+
+	start := time.Now()
+	now := start
+	l := NewLogLimiter(time.Minute)
+	l.now = func() time.Time { return now }
+
+	l.Logf(log, "network error: %s", "unreachable")
+	l.Logf(log, "network error: %s", "unreachable")
+	l.Logf(log, "other error")
+	now = start.Add(30 * time.Second)
+	l.Logf(log, "network error: %s", "unreachable")
+	now = start.Add(time.Minute)
+	l.Logf(log, "network error: %s", "unreachable")
+	l.Logf(log, "network error: %s", "unreachable")
+	now = start.Add(3 * time.Minute)
+	l.Logf(log, "network error: %s", "unreachable")
+	l.Logf(log, "other error")
+	l.Logf(log, "other error")
+	now = start.Add(3*time.Minute + 10*time.Second)
+	l.Reset(log)
+	l.Logf(log, "other error")
+
+	want := []string{
+		"network error: unreachable",
+		"other error",
+		"network error: unreachable (3 occurrences in the last 1m0s)",
+		"network error: unreachable (2 occurrences in the last 2m0s)",
+		"other error",
+		"other error (1 more occurrences in the last 10s, resolved)",
+		"other error",
+	}
+	if diff := cmp.Diff(want, logged); diff != "" {
+		t.Errorf("LogLimiter.Logf() logged unexpected messages (-want +got):\n%s", diff)
+	}
+}
+
+func TestLogLimiterDisabled(t *testing.T) {
+	var logged int
+	log := func(format string, args ...any) { logged++ }
+
+	l := NewLogLimiter(time.Minute)
+	l.SetInterval(0)
+	for i := 0; i < 3; i++ {
+		l.Logf(log, "network error")
+	}
+
+	if logged != 3 {
+		t.Errorf("LogLimiter.Logf() with a zero interval logged %d messages, want 3", logged)
+	}
+}
+
+func TestLogLimiterSaveLoad(t *testing.T) {
+	var logged []string
+	log := func(format string, args ...any) { logged = append(logged, fmt.Sprintf(format, args...)) }
+
+	start := time.Now()
+	now := start
+	path := filepath.Join(t.TempDir(), "limiter.json")
+
+	// Each run uses a new LogLimiter, as a process started by a timer would.
+	for i := 0; i < 3; i++ {
+		l := NewLogLimiter(time.Hour)
+		l.now = func() time.Time { return now }
+		l.Load(path)
+		l.Logf(log, "refresh failed")
+		if err := l.Save(path); err != nil {
+			t.Fatalf("LogLimiter.Save(%q) failed unexpectedly with error: %v", path, err)
+		}
+		now = now.Add(10 * time.Minute)
+	}
+
+	l := NewLogLimiter(time.Hour)
+	l.now = func() time.Time { return now }
+	l.Load(path)
+	l.Reset(log)
+
+	want := []string{
+		"refresh failed",
+		"refresh failed (2 more occurrences in the last 30m0s, resolved)",
+	}
+	if diff := cmp.Diff(want, logged); diff != "" {
+		t.Errorf("LogLimiter.Logf() across Save() and Load() logged unexpected messages (-want +got):\n%s", diff)
+	}
+}
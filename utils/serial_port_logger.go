@@ -16,20 +16,64 @@
 
 package utils
 
-import "github.com/tarm/serial"
+import (
+	"io"
+	"sync"
 
-// SerialPort is a type for writing to a named serial port.
+	"github.com/tarm/serial"
+)
+
+// openSerialPort opens the named serial port, it's a variable so tests can
+// replace the actual device.
+var openSerialPort = func(name string) (io.WriteCloser, error) {
+	p, err := serial.OpenPort(&serial.Config{Name: name, Baud: 115200})
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// SerialPort is a type for writing to a named serial port. The port is opened
+// on the first Write and kept open for subsequent writes, it's only reopened
+// after a failed write. The zero value (with Port set) is ready to use.
 type SerialPort struct {
 	Port string
+
+	mu   sync.Mutex
+	port io.WriteCloser
 }
 
 func (s *SerialPort) Write(b []byte) (int, error) {
-	c := &serial.Config{Name: s.Port, Baud: 115200}
-	p, err := serial.OpenPort(c)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.port == nil {
+		p, err := openSerialPort(s.Port)
+		if err != nil {
+			return 0, err
+		}
+		s.port = p
+	}
+
+	n, err := s.port.Write(b)
 	if err != nil {
-		return 0, err
+		// Drop the port so the next write reopens it.
+		s.port.Close()
+		s.port = nil
+	}
+	return n, err
+}
+
+// Close releases the serial port if it's open. A later Write reopens it.
+func (s *SerialPort) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.port == nil {
+		return nil
 	}
-	defer p.Close()
 
-	return p.Write(b)
+	err := s.port.Close()
+	s.port = nil
+	return err
 }
@@ -0,0 +1,103 @@
+// Copyright 2024 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"fmt"
+	"io"
+	"testing"
+)
+
+type testSerialPort struct {
+	written string
+	closed  bool
+	failing bool
+}
+
+func (p *testSerialPort) Write(b []byte) (int, error) {
+	if p.failing {
+		return 0, fmt.Errorf("fake write error")
+	}
+	p.written += string(b)
+	return len(b), nil
+}
+
+func (p *testSerialPort) Close() error {
+	p.closed = true
+	return nil
+}
+
+func TestSerialPortReuse(t *testing.T) {
+	var opened []*testSerialPort
+	orig := openSerialPort
+	openSerialPort = func(name string) (io.WriteCloser, error) {
+		p := &testSerialPort{}
+		opened = append(opened, p)
+		return p, nil
+	}
+	t.Cleanup(func() { openSerialPort = orig })
+
+	s := &SerialPort{Port: "COM1"}
+	for _, line := range []string{"line1\n", "line2\n"} {
+		if _, err := s.Write([]byte(line)); err != nil {
+			t.Fatalf("SerialPort.Write(%q) failed unexpectedly with error: %v", line, err)
+		}
+	}
+
+	if len(opened) != 1 {
+		t.Fatalf("SerialPort.Write() opened the port %d times, want: 1", len(opened))
+	}
+	if opened[0].written != "line1\nline2\n" {
+		t.Errorf("SerialPort.Write() wrote %q, want: %q", opened[0].written, "line1\nline2\n")
+	}
+
+	// A failed write drops the port, the next write must reopen it.
+	opened[0].failing = true
+	if _, err := s.Write([]byte("line3\n")); err == nil {
+		t.Errorf("SerialPort.Write(%q) succeeded on failing port, want error", "line3\n")
+	}
+	if !opened[0].closed {
+		t.Errorf("SerialPort.Write() didn't close the port after a write error")
+	}
+	if _, err := s.Write([]byte("line4\n")); err != nil {
+		t.Fatalf("SerialPort.Write(%q) failed unexpectedly with error: %v", "line4\n", err)
+	}
+	if len(opened) != 2 || opened[1].written != "line4\n" {
+		t.Errorf("SerialPort.Write() didn't reopen the port after a write error, opened %d ports", len(opened))
+	}
+
+	if err := s.Close(); err != nil {
+		t.Errorf("SerialPort.Close() failed unexpectedly with error: %v", err)
+	}
+	if !opened[1].closed {
+		t.Errorf("SerialPort.Close() didn't close the open port")
+	}
+}
+
+func TestSerialPortOpenError(t *testing.T) {
+	orig := openSerialPort
+	openSerialPort = func(name string) (io.WriteCloser, error) {
+		return nil, fmt.Errorf("fake open error")
+	}
+	t.Cleanup(func() { openSerialPort = orig })
+
+	s := &SerialPort{Port: "COM1"}
+	if _, err := s.Write([]byte("line\n")); err == nil {
+		t.Errorf("SerialPort.Write() succeeded with failing open, want error")
+	}
+	if err := s.Close(); err != nil {
+		t.Errorf("SerialPort.Close() failed unexpectedly with error on never opened port: %v", err)
+	}
+}
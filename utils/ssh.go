@@ -21,11 +21,15 @@ import (
 	"errors"
 	"regexp"
 	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/crypto/ssh"
 )
 
+// ErrExpiredKey is returned for google-ssh keys past their expiration time.
+var ErrExpiredKey = errors.New("invalid ssh key entry - expired key")
+
 type sshExpiration struct {
 	ExpireOn string
 	UserName string
@@ -61,23 +65,65 @@ func CheckExpiredKey(key string) error {
 		return err
 	}
 	if expired {
-		return errors.New("invalid ssh key entry - expired key")
+		return ErrExpiredKey
 	}
 	return nil
 }
 
+// defaultExpirationLayouts are the layouts, besides RFC3339, expiration times
+// are always parsed with, before the ones added by SetExpirationLayouts.
+var defaultExpirationLayouts = []string{"2006-01-02T15:04:05-0700"}
+
+var (
+	// expirationLayoutsMu protects expirationLayouts.
+	expirationLayoutsMu sync.RWMutex
+	// expirationLayouts are the layouts CheckExpired tries, in order.
+	expirationLayouts = append([]string{time.RFC3339}, defaultExpirationLayouts...)
+)
+
+// SetExpirationLayouts sets the layouts CheckExpired tries, in order, after
+// RFC3339 and the default ones, i.e. for keys stamped by older tooling. The
+// defaults are kept so setting layouts never makes existing keys unparseable,
+// and thus expired. nil restores the defaults only.
+func SetExpirationLayouts(layouts []string) {
+	res := append([]string{time.RFC3339}, defaultExpirationLayouts...)
+
+	expirationLayoutsMu.Lock()
+	defer expirationLayoutsMu.Unlock()
+	expirationLayouts = append(res, layouts...)
+}
+
+// SplitExpirationLayouts splits the "|" separated layouts of the Accounts
+// key_expiration_layouts configuration for SetExpirationLayouts, commas being
+// valid layout characters. It returns nil, i.e. only the defaults, if s is empty.
+func SplitExpirationLayouts(s string) []string {
+	var layouts []string
+	for _, layout := range strings.Split(s, "|") {
+		if layout = strings.TrimSpace(layout); layout != "" {
+			layouts = append(layouts, layout)
+		}
+	}
+	return layouts
+}
+
 // CheckExpired takes a time string and determines if it represents a time in the past.
+// The time is parsed with the first matching layout, see SetExpirationLayouts.
 func CheckExpired(expireOn string) (bool, error) {
-	t, err := time.Parse(time.RFC3339, expireOn)
-	if err != nil {
-		t2, err2 := time.Parse("2006-01-02T15:04:05-0700", expireOn)
-		if err2 != nil {
-			return true, err //Return RFC3339 error
+	expirationLayoutsMu.RLock()
+	layouts := expirationLayouts
+	expirationLayoutsMu.RUnlock()
+
+	var rfc3339Err error
+	for _, layout := range layouts {
+		t, err := time.Parse(layout, expireOn)
+		if err == nil {
+			return t.Before(time.Now()), nil
+		}
+		if rfc3339Err == nil {
+			rfc3339Err = err
 		}
-		t = t2
 	}
-	return t.Before(time.Now()), nil
-
+	return true, rfc3339Err //Return RFC3339 error
 }
 
 // ValidateUser checks for the presence of a characters which should not be
@@ -16,7 +16,9 @@ package utils
 
 import (
 	"fmt"
+	"reflect"
 	"testing"
+	"time"
 )
 
 func TestGetUserKey(t *testing.T) {
@@ -105,6 +107,79 @@ func TestCheckExpiredKey(t *testing.T) {
 	}
 }
 
+func TestCheckExpired(t *testing.T) {
+	t.Cleanup(func() { SetExpirationLayouts(nil) })
+
+	spaced := "2006-01-02 15:04:05 -0700"
+	tests := []struct {
+		name        string
+		layouts     []string
+		expireOn    string
+		wantExpired bool
+		wantErr     bool
+	}{
+		{
+			name:     "rfc3339",
+			expireOn: "2095-04-23T12:34:56+00:00",
+		},
+		{
+			name:     "legacy_offset",
+			expireOn: "2095-04-23T12:34:56+0000",
+		},
+		{
+			name:        "legacy_offset_expired",
+			expireOn:    "2021-04-23T12:34:56+0000",
+			wantExpired: true,
+		},
+		{
+			name:        "space_separated_not_configured",
+			expireOn:    "2095-04-23 12:34:56 +0000",
+			wantExpired: true,
+			wantErr:     true,
+		},
+		{
+			name:     "space_separated",
+			layouts:  []string{spaced},
+			expireOn: "2095-04-23 12:34:56 +0000",
+		},
+		{
+			name:     "rfc1123z",
+			layouts:  []string{spaced, time.RFC1123Z},
+			expireOn: "Mon, 23 Apr 2095 12:34:56 +0000",
+		},
+		{
+			name:        "rfc1123z_expired",
+			layouts:     []string{spaced, time.RFC1123Z},
+			expireOn:    "Fri, 23 Apr 2021 12:34:56 +0000",
+			wantExpired: true,
+		},
+		{
+			name:     "defaults_kept",
+			layouts:  []string{spaced},
+			expireOn: "2095-04-23T12:34:56+0000",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			SetExpirationLayouts(tc.layouts)
+
+			expired, err := CheckExpired(tc.expireOn)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("CheckExpired(%q) = %v, want error: %t", tc.expireOn, err, tc.wantErr)
+			}
+			if expired != tc.wantExpired {
+				t.Errorf("CheckExpired(%q) = %t, want %t", tc.expireOn, expired, tc.wantExpired)
+			}
+
+			// The RFC3339 error is reported when no layout matches.
+			if _, wantErr := time.Parse(time.RFC3339, tc.expireOn); tc.wantErr && err.Error() != wantErr.Error() {
+				t.Errorf("CheckExpired(%q) = %v, want RFC3339 error %v", tc.expireOn, err, wantErr)
+			}
+		})
+	}
+}
+
 func TestValidateUser(t *testing.T) {
 	table := []struct {
 		user  string
@@ -126,3 +201,21 @@ func TestValidateUser(t *testing.T) {
 		}
 	}
 }
+
+func TestSplitExpirationLayouts(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{in: "", want: nil},
+		{in: " | ", want: nil},
+		{in: "2006-01-02 15:04:05 -0700", want: []string{"2006-01-02 15:04:05 -0700"}},
+		{in: "2006-01-02 15:04:05 -0700 | Mon, 02 Jan 2006 15:04:05 -0700", want: []string{"2006-01-02 15:04:05 -0700", time.RFC1123Z}},
+	}
+
+	for _, tc := range tests {
+		if got := SplitExpirationLayouts(tc.in); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("SplitExpirationLayouts(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}